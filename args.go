@@ -0,0 +1,127 @@
+package scpi
+
+// Arg is a parameter read and converted according to its ParamSpec before
+// the callback runs
+type Arg struct {
+	Present bool      // False for an omitted optional parameter
+	Kind    ParamKind // Kind of the parameter as received
+	Number  Number    // Numeric value, converted to the spec's Units
+	Text    string    // String contents or mnemonic as received
+	Choice  int32     // Tag of the matched ParamSpec.Choices entry
+	Block   []byte    // Arbitrary block contents
+}
+
+// Arg returns the i-th parameter of the running command as converted from
+// its Command.Params, or an absent Arg for an omitted optional parameter
+// or an index beyond the schema
+func (c *Context) Arg(i int) Arg {
+	if i < 0 || i >= len(c.args) {
+		return Arg{}
+	}
+	return c.args[i]
+}
+
+// readArgs reads the parameters of cmd according to cmd.Params into c.args.
+// Errors are queued with the codes Validate reports, plus -224 for an
+// unknown choice and -222 for a value out of range, and false is returned
+// so the callback is not run. The parameters are left unread, so the
+// callback may still read them with the Param functions.
+func (c *Context) readArgs(cmd *Command) bool {
+	pos, count := c.paramsPos, c.inputCount
+	c.args = c.args[:0]
+	for _, spec := range cmd.Params {
+		arg, err := c.readArg(spec)
+		if err != nil {
+			return false
+		}
+		if !arg.Present {
+			break
+		}
+		c.args = append(c.args, arg)
+	}
+	if c.hasUnreadParams() {
+		c.ErrorPush(NewError(CodeParameterNotAllowed))
+		return false
+	}
+	c.paramsPos, c.inputCount = pos, count
+	return true
+}
+
+// readArg reads and converts one parameter. The parameter is peeked first
+// and then read again with the Param* function for its kind.
+func (c *Context) readArg(spec ParamSpec) (Arg, error) {
+	pos, count := c.paramsPos, c.inputCount
+	param, err := c.Parameter(!spec.Optional)
+	if err != nil || param.Type == TokenUnknown {
+		return Arg{}, err
+	}
+	arg := Arg{Present: true, Kind: param.Kind()}
+	if len(spec.Kinds) > 0 && !containsKind(spec.Kinds, arg.Kind) {
+		return Arg{}, c.fail(detailError(CodeDataTypeError, "%s", spec.Name), "%s: unexpected data type", spec.Name)
+	}
+
+	numeric := len(spec.Kinds) == 0 || containsKind(spec.Kinds, KindNumeric)
+	switch arg.Kind {
+	case KindMnemonic:
+		arg.Text = string(param.Data)
+		if spec.Choices != nil {
+			for _, choice := range spec.Choices {
+				if matchPattern(choice.Name, arg.Text) {
+					arg.Choice = choice.Tag
+					return arg, nil
+				}
+			}
+			return Arg{}, c.fail(detailError(CodeIllegalParameterValue, "%s", spec.Name), "%s: invalid choice %s", spec.Name, arg.Text)
+		}
+		if !numeric || !isSpecialNumber(arg.Text) {
+			return arg, nil
+		}
+		fallthrough
+	case KindNumeric, KindNondecimalNumeric:
+		c.paramsPos, c.inputCount = pos, count
+		if arg.Number, err = c.ParamNumberWithUnits(spec.Units, true); err != nil {
+			return Arg{}, err
+		}
+		return arg, c.checkRange(spec, &arg.Number)
+	case KindString:
+		c.paramsPos, c.inputCount = pos, count
+		arg.Text, err = c.ParamString(true)
+	case KindBlock:
+		c.paramsPos, c.inputCount = pos, count
+		arg.Block, err = c.ParamArbitraryBlock(true)
+	default:
+		arg.Text = string(param.Data)
+	}
+	return arg, err
+}
+
+// checkRange resolves MINimum and MAXimum to the bounds of spec and queues
+// -222 for a value outside them. Specs without bounds accept any value.
+func (c *Context) checkRange(spec ParamSpec, num *Number) error {
+	if spec.Min == 0 && spec.Max == 0 {
+		return nil
+	}
+	if num.Special {
+		switch SpecialNumber(num.Tag) {
+		case NumMin:
+			num.Value, num.Special = spec.Min, false
+		case NumMax:
+			num.Value, num.Special = spec.Max, false
+		}
+		return nil
+	}
+	if num.Value < spec.Min || num.Value > spec.Max {
+		return c.fail(detailError(CodeDataOutOfRange, "%s", spec.Name), "%s: %g out of range", spec.Name, num.Value)
+	}
+	return nil
+}
+
+// isSpecialNumber reports whether mnemonic is one ParamNumber accepts
+func isSpecialNumber(mnemonic string) bool {
+	for _, special := range specialNumbers {
+		if matchPattern(special.Name, mnemonic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package scpi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// ChecksumAlgorithm selects how block payloads are checked
+type ChecksumAlgorithm int
+
+const (
+	ChecksumCRC32  ChecksumAlgorithm = iota // IEEE CRC-32, 4 bytes big-endian
+	ChecksumSHA256                          // SHA-256, 32 bytes
+)
+
+// Size returns the length in bytes of a checksum
+func (a ChecksumAlgorithm) Size() int {
+	if a == ChecksumSHA256 {
+		return sha256.Size
+	}
+	return crc32.Size
+}
+
+// Sum returns the checksum of data
+func (a ChecksumAlgorithm) Sum(data []byte) []byte {
+	if a == ChecksumSHA256 {
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+	return binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(data))
+}
+
+// VerifyChecksum checks data against a checksum given as hex digits, as
+// hosts usually send it in a string parameter. Case is ignored.
+func VerifyChecksum(data []byte, alg ChecksumAlgorithm, checksum string) error {
+	want, err := hex.DecodeString(strings.TrimSpace(checksum))
+	if err != nil || len(want) != alg.Size() {
+		return fmt.Errorf("malformed checksum %q", checksum)
+	}
+	if got := alg.Sum(data); !bytes.Equal(got, want) {
+		return fmt.Errorf("checksum mismatch: got %X, want %X", got, want)
+	}
+	return nil
+}
+
+// FirmwareChecksum returns a SystemHooks.ValidateFirmware hook that requires
+// the image to come with a matching hex checksum
+func FirmwareChecksum(alg ChecksumAlgorithm) func(image []byte, checksum string) error {
+	return func(image []byte, checksum string) error {
+		return VerifyChecksum(image, alg, checksum)
+	}
+}
+
+// ParamArbitraryBlockChecked reads an arbitrary block whose payload ends with
+// its own checksum: the data followed by alg.Sum(data). It returns the data
+// without the checksum, or pushes -230 if the checksum is missing or does
+// not match.
+func (c *Context) ParamArbitraryBlockChecked(alg ChecksumAlgorithm, mandatory bool) ([]byte, error) {
+	payload, err := c.ParamArbitraryBlock(mandatory)
+	if err != nil || payload == nil {
+		return nil, err
+	}
+
+	n := len(payload) - alg.Size()
+	if n < 0 {
+		return nil, c.fail(NewError(CodeDataCorruptOrStale), "block of %d bytes is too short for its checksum", len(payload))
+	}
+	data, sum := payload[:n], payload[n:]
+	if !bytes.Equal(alg.Sum(data), sum) {
+		return nil, c.fail(NewError(CodeDataCorruptOrStale), "block checksum mismatch")
+	}
+	return data, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// definition describes a mock instrument
+type definition struct {
+	IDN      [4]string    `json:"idn"`
+	Commands []commandDef `json:"commands"`
+}
+
+// commandDef describes one mock command. A query answers the value of Expr,
+// or the entries of Responses in turn, or the value of State, or Response.
+// A command stores its parameters in State, then assigns the values of the
+// Set expressions to their state variables, which start out as 0 unless a
+// State of the same name has a Default. Expressions see the state variables
+// and the parameters as "param". Error, if set, is queued instead.
+type commandDef struct {
+	Pattern   string            `json:"pattern"`
+	Response  string            `json:"response,omitempty"`
+	Responses []string          `json:"responses,omitempty"`
+	State     string            `json:"state,omitempty"`
+	Default   string            `json:"default,omitempty"` // Initial and *RST value of State
+	Expr      string            `json:"expr,omitempty"`
+	Set       map[string]string `json:"set,omitempty"`
+	Error     int16             `json:"error,omitempty"`
+
+	expr *expression
+	set  map[string]*expression
+}
+
+// loadDefinition decodes a JSON definition
+func loadDefinition(r io.Reader) (*definition, error) {
+	var def definition
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&def); err != nil {
+		return nil, err
+	}
+	for i := range def.Commands {
+		cmd := &def.Commands[i]
+		if cmd.Pattern == "" {
+			return nil, fmt.Errorf("command %d: missing pattern", i)
+		}
+		if cmd.Expr != "" {
+			e, err := parseExpression(cmd.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: expr: %w", cmd.Pattern, err)
+			}
+			cmd.expr = e
+		}
+		cmd.set = make(map[string]*expression, len(cmd.Set))
+		for name, src := range cmd.Set {
+			e, err := parseExpression(src)
+			if err != nil {
+				return nil, fmt.Errorf("%s: set %s: %w", cmd.Pattern, name, err)
+			}
+			cmd.set[name] = e
+		}
+	}
+	return &def, nil
+}
+
+// mock holds the state of a running mock instrument
+type mock struct {
+	def   *definition
+	mu    sync.Mutex
+	state map[string]string
+	turn  map[*commandDef]int
+}
+
+// newMock creates a mock instrument in its reset state
+func newMock(def *definition) *mock {
+	m := &mock{def: def}
+	m.reset()
+	return m
+}
+
+// reset restores every state variable to its default
+func (m *mock) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = make(map[string]string)
+	m.turn = make(map[*commandDef]int)
+	for _, cmd := range m.def.Commands {
+		if _, ok := m.state[cmd.State]; cmd.State != "" && (!ok || cmd.Default != "") {
+			m.state[cmd.State] = cmd.Default
+		}
+	}
+	for _, cmd := range m.def.Commands {
+		for name := range cmd.Set {
+			if _, ok := m.state[name]; !ok {
+				m.state[name] = "0"
+			}
+		}
+	}
+}
+
+// commands returns the command table of the mock: the defined commands
+// followed by *IDN?, *RST, *CLS and SYSTem:ERRor? unless defined
+func (m *mock) commands() []*scpi.Command {
+	var commands []*scpi.Command
+	for i := range m.def.Commands {
+		cmd := &m.def.Commands[i]
+		commands = append(commands, &scpi.Command{
+			Pattern:  cmd.Pattern,
+			Callback: func(ctx *scpi.Context) scpi.Result { return m.run(ctx, cmd) },
+		})
+	}
+
+	builtins := []*scpi.Command{
+		{Pattern: "*IDN?", Callback: scpi.CoreIdnQ},
+		{Pattern: "*RST", Callback: func(ctx *scpi.Context) scpi.Result {
+			m.reset()
+			return scpi.ResOK
+		}},
+		{Pattern: "*CLS", Callback: scpi.CoreCls},
+		{Pattern: "SYSTem:ERRor[:NEXT]?", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.ResultError(ctx.ErrorPop())
+			return scpi.ResOK
+		}},
+	}
+	for _, b := range builtins {
+		if !m.defines(b.Pattern) {
+			commands = append(commands, b)
+		}
+	}
+	return commands
+}
+
+// defines reports whether the definition has a command with pattern
+func (m *mock) defines(pattern string) bool {
+	for _, cmd := range m.def.Commands {
+		if strings.EqualFold(cmd.Pattern, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// run executes a defined command
+func (m *mock) run(ctx *scpi.Context, cmd *commandDef) scpi.Result {
+	if cmd.Error != 0 {
+		ctx.ErrorPush(scpi.NewError(cmd.Error))
+		return scpi.ResErr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	param, err := rawParams(ctx)
+	if err != nil {
+		return scpi.ResErr
+	}
+	vars := make(map[string]string, len(m.state)+1)
+	for name, v := range m.state {
+		vars[name] = v
+	}
+	vars["param"] = param
+
+	if !strings.HasSuffix(cmd.Pattern, "?") {
+		if cmd.State != "" {
+			m.state[cmd.State] = param
+		}
+		for name, e := range cmd.set {
+			v, err := e.eval(vars)
+			if err != nil {
+				ctx.ErrorPushf(scpi.CodeExecutionError, "%v", err)
+				return scpi.ResErr
+			}
+			m.state[name] = v.String()
+		}
+		return scpi.ResOK
+	}
+
+	switch {
+	case cmd.expr != nil:
+		v, err := cmd.expr.eval(vars)
+		if err != nil {
+			ctx.ErrorPushf(scpi.CodeExecutionError, "%v", err)
+			return scpi.ResErr
+		}
+		ctx.ResultMnemonic(v.String())
+	case len(cmd.Responses) > 0:
+		ctx.ResultMnemonic(cmd.Responses[m.turn[cmd]%len(cmd.Responses)])
+		m.turn[cmd]++
+	case cmd.State != "":
+		ctx.ResultMnemonic(m.state[cmd.State])
+	default:
+		ctx.ResultMnemonic(cmd.Response)
+	}
+	return scpi.ResOK
+}
+
+// rawParams reads all remaining parameters and joins their program data
+// with commas
+func rawParams(ctx *scpi.Context) (string, error) {
+	var values []string
+	for {
+		param, err := ctx.Parameter(false)
+		if err != nil {
+			return "", err
+		}
+		if param.Kind() == scpi.KindNone {
+			return strings.Join(values, ","), nil
+		}
+		values = append(values, string(param.Data))
+	}
+}
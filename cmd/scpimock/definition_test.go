@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+const testDefinition = `{
+  "idn": ["ACME", "MOCK100", "0", "1.0"],
+  "commands": [
+    {"pattern": "MEASure:VOLTage?", "responses": ["1.01", "0.99"]},
+    {"pattern": "MEASure:CURRent?", "response": "0.5"},
+    {"pattern": "SOURce:FREQuency", "state": "freq", "default": "1000"},
+    {"pattern": "SOURce:FREQuency?", "state": "freq"},
+    {"pattern": "CALibrate", "error": -240}
+  ]
+}`
+
+func TestMock(t *testing.T) {
+	def, err := loadDefinition(strings.NewReader(testDefinition))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output strings.Builder
+	ctx := scpi.NewContext(newMock(def).commands(), &scpi.Interface{Write: output.Write}, 256)
+	ctx.SetIDN(def.IDN[0], def.IDN[1], def.IDN[2], def.IDN[3])
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"*IDN?", "ACME,MOCK100,0,1.0\n"},
+		{"MEAS:VOLT?", "1.01\n"},
+		{"MEAS:VOLT?", "0.99\n"},
+		{"MEAS:VOLT?", "1.01\n"},
+		{"MEAS:CURR?", "0.5\n"},
+		{"SOUR:FREQ?", "1000\n"},
+		{"SOUR:FREQ 2.5E3", ""},
+		{"SOUR:FREQ?", "2.5E3\n"},
+		{"*RST", ""},
+		{"SOUR:FREQ?", "1000\n"},
+		{"CAL", ""},
+		{"SYST:ERR?", "-240,\"Hardware error\"\n"},
+		{"SYST:ERR?", "0,\"No error\"\n"},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+}
+
+func TestLoadDefinitionErrors(t *testing.T) {
+	for _, input := range []string{
+		`{"commands": [{"response": "1"}]}`,
+		`{"commands": [{"pattern": "A?", "bogus": 1}]}`,
+		`not json`,
+	} {
+		if _, err := loadDefinition(strings.NewReader(input)); err == nil {
+			t.Errorf("loadDefinition(%s) succeeded, want error", input)
+		}
+	}
+}
+
+func TestMockExpressions(t *testing.T) {
+	def, err := loadDefinition(strings.NewReader(`{
+  "commands": [
+    {"pattern": "SOURce:VOLTage", "state": "volt", "default": "0"},
+    {"pattern": "OUTPut", "set": {"out": "cond(param == \"ON\" || param == 1, 1, 0)"}},
+    {"pattern": "OUTPut?", "state": "out", "default": "0"},
+    {"pattern": "MEASure:VOLTage?", "expr": "cond(out, volt * 2, 0)"},
+    {"pattern": "MEASure:BOGus?", "expr": "nope"}
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output strings.Builder
+	ctx := scpi.NewContext(newMock(def).commands(), &scpi.Interface{Write: output.Write}, 256)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"MEAS:VOLT?", "0\n"},
+		{"SOUR:VOLT 1.25", ""},
+		{"MEAS:VOLT?", "0\n"},
+		{"OUTP ON", ""},
+		{"OUTP?", "1\n"},
+		{"MEAS:VOLT?", "2.5\n"},
+		{"MEAS:BOG?", ""},
+		{"SYST:ERR?", "-200,\"Execution error;nope: undefined variable nope\"\n"},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+
+	// Set targets exist before the command setting them first runs
+	def, err = loadDefinition(strings.NewReader(`{
+  "commands": [
+    {"pattern": "SOURce:VOLTage", "state": "volt", "default": "1.5"},
+    {"pattern": "OUTPut", "set": {"out": "cond(param == \"ON\" || param == 1, 1, 0)"}},
+    {"pattern": "MEASure:VOLTage?", "expr": "cond(out, volt, 0)"}
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = scpi.NewContext(newMock(def).commands(), &scpi.Interface{Write: output.Write}, 256)
+	for _, tt := range []struct {
+		input string
+		want  string
+	}{
+		{"MEAS:VOLT?", "0\n"},
+		{"SYST:ERR?", "0,\"No error\"\n"},
+		{"OUTP ON", ""},
+		{"MEAS:VOLT?", "1.5\n"},
+	} {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s before OUTP = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+
+	if _, err := loadDefinition(strings.NewReader(`{"commands": [{"pattern": "A?", "expr": "1 +"}]}`)); err == nil {
+		t.Error("loadDefinition accepted a malformed expression")
+	}
+}
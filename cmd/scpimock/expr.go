@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// An expression computes a mock response or state value. It uses Go
+// expression syntax over numbers and strings: state variables are referred
+// to by name, numbers support the arithmetic and comparison operators, "+"
+// concatenates strings and the functions in exprFuncs are available, e.g.
+//
+//	freq * 2
+//	cond(out == "ON", volt, 0)
+//	round(uniform(0.99, 1.01) * volt, 4)
+type expression struct {
+	src  string
+	expr ast.Expr
+}
+
+// exprFuncs are the functions available to expressions
+var exprFuncs = map[string]func(args []value) (value, error){
+	"abs":   mathFunc(math.Abs),
+	"sqrt":  mathFunc(math.Sqrt),
+	"sin":   mathFunc(math.Sin),
+	"cos":   mathFunc(math.Cos),
+	"exp":   mathFunc(math.Exp),
+	"log10": mathFunc(math.Log10),
+	"min": func(args []value) (value, error) {
+		return numbersFunc(args, 2, func(n []float64) float64 { return math.Min(n[0], n[1]) })
+	},
+	"max": func(args []value) (value, error) {
+		return numbersFunc(args, 2, func(n []float64) float64 { return math.Max(n[0], n[1]) })
+	},
+	"round": func(args []value) (value, error) {
+		return numbersFunc(args, 2, func(n []float64) float64 {
+			scale := math.Pow(10, n[1])
+			return math.Round(n[0]*scale) / scale
+		})
+	},
+	"uniform": func(args []value) (value, error) {
+		return numbersFunc(args, 2, func(n []float64) float64 { return n[0] + rand.Float64()*(n[1]-n[0]) })
+	},
+	"cond": func(args []value) (value, error) {
+		if len(args) != 3 {
+			return value{}, fmt.Errorf("cond takes 3 arguments")
+		}
+		if args[0].truthy() {
+			return args[1], nil
+		}
+		return args[2], nil
+	},
+}
+
+// mathFunc adapts a one-argument math function
+func mathFunc(f func(float64) float64) func(args []value) (value, error) {
+	return func(args []value) (value, error) {
+		return numbersFunc(args, 1, func(n []float64) float64 { return f(n[0]) })
+	}
+}
+
+// numbersFunc checks that args are count numbers and applies f to them
+func numbersFunc(args []value, count int, f func([]float64) float64) (value, error) {
+	if len(args) != count {
+		return value{}, fmt.Errorf("takes %d arguments", count)
+	}
+	nums := make([]float64, count)
+	for i, a := range args {
+		n, ok := a.number()
+		if !ok {
+			return value{}, fmt.Errorf("argument %d is not a number: %q", i+1, a.text)
+		}
+		nums[i] = n
+	}
+	return numberValue(f(nums)), nil
+}
+
+// value is the result of an expression: a number or a string. State
+// variables hold text and are treated as numbers where they parse as one.
+type value struct {
+	text  string
+	num   float64
+	isNum bool
+}
+
+func numberValue(n float64) value { return value{num: n, isNum: true} }
+
+func textValue(s string) value { return value{text: s} }
+
+// number returns the numeric value of v
+func (v value) number() (float64, bool) {
+	if v.isNum {
+		return v.num, true
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v.text), 64)
+	return n, err == nil
+}
+
+// String formats v as response text
+func (v value) String() string {
+	if v.isNum {
+		if v.num == math.Trunc(v.num) && math.Abs(v.num) < 1e15 {
+			return strconv.FormatFloat(v.num, 'f', -1, 64)
+		}
+		return strconv.FormatFloat(v.num, 'G', -1, 64)
+	}
+	return v.text
+}
+
+// truthy reports whether v counts as true: a non-zero number, ON or a
+// non-empty string other than OFF
+func (v value) truthy() bool {
+	if n, ok := v.number(); ok {
+		return n != 0
+	}
+	return v.text != "" && !strings.EqualFold(v.text, "OFF")
+}
+
+// parseExpression parses src
+func parseExpression(src string) (*expression, error) {
+	e, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	return &expression{src: src, expr: e}, nil
+}
+
+// eval evaluates the expression with the given variables
+func (e *expression) eval(vars map[string]string) (value, error) {
+	v, err := evalNode(e.expr, vars)
+	if err != nil {
+		return value{}, fmt.Errorf("%s: %w", e.src, err)
+	}
+	return v, nil
+}
+
+// evalNode evaluates one node of an expression
+func evalNode(node ast.Expr, vars map[string]string) (value, error) {
+	switch n := node.(type) {
+	case *ast.BasicLit:
+		switch n.Kind {
+		case token.INT, token.FLOAT:
+			f, err := strconv.ParseFloat(n.Value, 64)
+			return numberValue(f), err
+		case token.STRING, token.CHAR:
+			s, err := strconv.Unquote(n.Value)
+			return textValue(s), err
+		}
+
+	case *ast.Ident:
+		if s, ok := vars[n.Name]; ok {
+			return textValue(s), nil
+		}
+		return value{}, fmt.Errorf("undefined variable %s", n.Name)
+
+	case *ast.ParenExpr:
+		return evalNode(n.X, vars)
+
+	case *ast.UnaryExpr:
+		x, err := evalNode(n.X, vars)
+		if err != nil {
+			return value{}, err
+		}
+		switch n.Op {
+		case token.NOT:
+			return boolValue(!x.truthy()), nil
+		case token.SUB, token.ADD:
+			f, ok := x.number()
+			if !ok {
+				return value{}, fmt.Errorf("%s applied to %q", n.Op, x.text)
+			}
+			if n.Op == token.SUB {
+				f = -f
+			}
+			return numberValue(f), nil
+		}
+
+	case *ast.BinaryExpr:
+		return evalBinary(n, vars)
+
+	case *ast.CallExpr:
+		name, ok := n.Fun.(*ast.Ident)
+		if !ok {
+			break
+		}
+		f, ok := exprFuncs[name.Name]
+		if !ok {
+			return value{}, fmt.Errorf("undefined function %s", name.Name)
+		}
+		args := make([]value, len(n.Args))
+		for i, a := range n.Args {
+			v, err := evalNode(a, vars)
+			if err != nil {
+				return value{}, err
+			}
+			args[i] = v
+		}
+		v, err := f(args)
+		if err != nil {
+			return value{}, fmt.Errorf("%s: %w", name.Name, err)
+		}
+		return v, nil
+	}
+	return value{}, fmt.Errorf("unsupported expression %T", node)
+}
+
+// evalBinary evaluates a binary operation
+func evalBinary(n *ast.BinaryExpr, vars map[string]string) (value, error) {
+	x, err := evalNode(n.X, vars)
+	if err != nil {
+		return value{}, err
+	}
+	switch n.Op {
+	case token.LAND:
+		if !x.truthy() {
+			return boolValue(false), nil
+		}
+	case token.LOR:
+		if x.truthy() {
+			return boolValue(true), nil
+		}
+	}
+	y, err := evalNode(n.Y, vars)
+	if err != nil {
+		return value{}, err
+	}
+
+	switch n.Op {
+	case token.LAND, token.LOR:
+		return boolValue(y.truthy()), nil
+	}
+
+	a, aok := x.number()
+	b, bok := y.number()
+	if !aok || !bok {
+		switch n.Op {
+		case token.ADD:
+			return textValue(x.String() + y.String()), nil
+		case token.EQL:
+			return boolValue(strings.EqualFold(x.String(), y.String())), nil
+		case token.NEQ:
+			return boolValue(!strings.EqualFold(x.String(), y.String())), nil
+		}
+		return value{}, fmt.Errorf("%s applied to %q and %q", n.Op, x.String(), y.String())
+	}
+
+	switch n.Op {
+	case token.ADD:
+		return numberValue(a + b), nil
+	case token.SUB:
+		return numberValue(a - b), nil
+	case token.MUL:
+		return numberValue(a * b), nil
+	case token.QUO:
+		return numberValue(a / b), nil
+	case token.REM:
+		return numberValue(math.Mod(a, b)), nil
+	case token.EQL:
+		return boolValue(a == b), nil
+	case token.NEQ:
+		return boolValue(a != b), nil
+	case token.LSS:
+		return boolValue(a < b), nil
+	case token.LEQ:
+		return boolValue(a <= b), nil
+	case token.GTR:
+		return boolValue(a > b), nil
+	case token.GEQ:
+		return boolValue(a >= b), nil
+	}
+	return value{}, fmt.Errorf("unsupported operator %s", n.Op)
+}
+
+// boolValue returns 1 or 0, the SCPI boolean response
+func boolValue(b bool) value {
+	if b {
+		return numberValue(1)
+	}
+	return numberValue(0)
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestExpression(t *testing.T) {
+	vars := map[string]string{"volt": "2.5", "out": "ON", "name": "ACME"}
+
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"volt * 2", "5"},
+		{"-volt + 1", "-1.5"},
+		{"(1 + 2) * 3 % 4", "1"},
+		{"volt > 2 && volt < 3", "1"},
+		{"!(volt == 2.5)", "0"},
+		{`out == "on"`, "1"},
+		{`name + "-1"`, "ACME-1"},
+		{"cond(out, volt, 0)", "2.5"},
+		{"round(2/3, 3)", "0.667"},
+		{"max(volt, 4)", "4"},
+		{"abs(-3)", "3"},
+		{"1e20", "1E+20"},
+	}
+	for _, tt := range tests {
+		e, err := parseExpression(tt.src)
+		if err != nil {
+			t.Errorf("parseExpression(%s): %v", tt.src, err)
+			continue
+		}
+		got, err := e.eval(vars)
+		if err != nil {
+			t.Errorf("eval(%s): %v", tt.src, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("eval(%s) = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+
+	for _, src := range []string{"bogus + 1", "volt * name", "nope(1)", "min(1)", "volt[0]"} {
+		e, err := parseExpression(src)
+		if err != nil {
+			continue
+		}
+		if got, err := e.eval(vars); err == nil {
+			t.Errorf("eval(%s) = %s, want error", src, got)
+		}
+	}
+
+	v, _ := parseExpression("uniform(1, 2)")
+	for i := 0; i < 100; i++ {
+		got, _ := v.eval(nil)
+		if n, _ := got.number(); n < 1 || n >= 2 {
+			t.Fatalf("uniform(1, 2) = %v", n)
+		}
+	}
+}
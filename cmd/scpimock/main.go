@@ -0,0 +1,73 @@
+// Command scpimock serves a mock instrument described by a JSON definition
+// over TCP, so host software can be developed against it without writing
+// any Go code:
+//
+//	scpimock -addr :5025 instrument.json
+//
+// The definition lists the *IDN? strings and the commands with canned,
+// rotating, stateful or computed responses:
+//
+//	{
+//	  "idn": ["ACME", "MOCK100", "0", "1.0"],
+//	  "commands": [
+//	    {"pattern": "MEASure:CURRent?", "responses": ["1.01", "0.99"]},
+//	    {"pattern": "SOURce:VOLTage", "state": "volt", "default": "0"},
+//	    {"pattern": "SOURce:VOLTage?", "state": "volt"},
+//	    {"pattern": "OUTPut", "set": {"out": "cond(param == \"ON\" || param == 1, 1, 0)"}},
+//	    {"pattern": "MEASure:VOLTage?", "expr": "cond(out, round(volt * uniform(0.999, 1.001), 4), 0)"},
+//	    {"pattern": "CALibrate", "error": -240}
+//	  ]
+//	}
+//
+// Expressions use Go syntax over the state variables, the parameters of the
+// command as "param", and the functions abs, sqrt, sin, cos, exp, log10,
+// min, max, round(x, digits), uniform(lo, hi) and cond(c, then, else).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+	"github.com/Nine-Fives/go-scpi-parser/scpiserver"
+)
+
+func main() {
+	addr := flag.String("addr", scpiserver.DefaultAddr, "data port address")
+	control := flag.String("control", "", "control port address, e.g. "+scpiserver.DefaultControlAddr)
+	telnet := flag.String("telnet", "", "telnet console address, e.g. "+scpiserver.DefaultTelnetAddr)
+	announce := flag.Bool("announce", false, "announce the data port over mDNS")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] definition.json\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	def, err := loadDefinition(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("%s: %v", flag.Arg(0), err)
+	}
+
+	m := newMock(def)
+	srv := scpiserver.New(m.commands(), scpiserver.Options{
+		ControlAddr: *control,
+		TelnetAddr:  *telnet,
+		Announce:    *announce,
+		Setup: func(ctx *scpi.Context) {
+			ctx.SetIDN(def.IDN[0], def.IDN[1], def.IDN[2], def.IDN[3])
+		},
+	})
+	log.Printf("serving %s on %s", def.IDN[1], *addr)
+	log.Fatal(srv.ListenAndServe(*addr))
+}
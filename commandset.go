@@ -0,0 +1,73 @@
+package scpi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SetCommandSetVersion sets the semantic version of the command set reported
+// by SystemCommandVersionQ, e.g. "2.1.0". Bump it on deliberate changes; the
+// hash appended to it catches the rest.
+func (c *Context) SetCommandSetVersion(version string) {
+	c.cmdSetVersion = version
+}
+
+// CommandSetVersion returns the command set version with the command set
+// hash as semantic version build metadata, e.g. "2.1.0+3f9a0c12d4e5b6a7".
+// The version defaults to "0.0.0".
+func (c *Context) CommandSetVersion() string {
+	version := c.cmdSetVersion
+	if version == "" {
+		version = "0.0.0"
+	}
+	return version + "+" + c.CommandSetHash()
+}
+
+// CommandSetHash returns a hash of the command tree: the patterns, aliases
+// and parameter schemas of the commands and the aliases of the active
+// personality. It changes whenever a command is added, removed or renamed,
+// so host drivers can detect a firmware with a different command set.
+func (c *Context) CommandSetHash() string {
+	commands := c.table.Load().commands
+	lines := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		var sb strings.Builder
+		sb.WriteString(cmd.Pattern)
+		for _, alias := range cmd.Aliases {
+			sb.WriteString(" = " + alias)
+		}
+		for _, p := range cmd.Params {
+			sb.WriteString(" " + p.Name + "=")
+			for i, kind := range p.Kinds {
+				if i > 0 {
+					sb.WriteByte('|')
+				}
+				sb.WriteString(strconv.Itoa(int(kind)))
+			}
+			if p.Optional {
+				sb.WriteByte('?')
+			}
+		}
+		lines = append(lines, sb.String())
+	}
+	sort.Strings(lines)
+	if c.persona != nil {
+		// Aliases are tried in order, so their order is part of the set
+		for _, alias := range c.persona.Aliases {
+			lines = append(lines, alias.Pattern+" -> "+alias.Target)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SystemCommandVersionQ implements a vendor query, e.g.
+// SYSTem:COMMand:VERSion?, answering CommandSetVersion as a string
+func SystemCommandVersionQ(ctx *Context) Result {
+	ctx.ResultText(ctx.CommandSetVersion())
+	return ResOK
+}
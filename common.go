@@ -0,0 +1,88 @@
+package scpi
+
+import "strings"
+
+// commonCommands are the commands IEEE 488.2 section 10 mandates, wired to
+// the Context's status model, error queue and identification
+var commonCommands = []*Command{
+	{Pattern: "*CLS", Callback: CoreCls},
+	{Pattern: "*ESE", Callback: CoreEse},
+	{Pattern: "*ESE?", Callback: CoreEseQ},
+	{Pattern: "*ESR?", Callback: CoreEsrQ},
+	{Pattern: "*IDN?", Callback: CoreIdnQ},
+	{Pattern: "*OPC", Callback: CoreOpc},
+	{Pattern: "*OPC?", Callback: CoreOpcQ},
+	{Pattern: "*RST", Callback: CoreRst},
+	{Pattern: "*SRE", Callback: CoreSre},
+	{Pattern: "*SRE?", Callback: CoreSreQ},
+	{Pattern: "*STB?", Callback: CoreStbQ},
+	{Pattern: "*TST?", Callback: CoreTstQ},
+	{Pattern: "*WAI", Callback: CoreWai},
+}
+
+// RegisterCommonCommands registers the IEEE 488.2 mandated common commands
+// that are not registered yet, so an application only implements the ones
+// it wants to behave differently. *RST calls Interface.Reset. Each Context
+// gets its own copies of the commands, returning the error of the first
+// one AddCommand rejects.
+func (c *Context) RegisterCommonCommands() error {
+	for _, common := range commonCommands {
+		found := c.findCommand(common.Pattern)
+		if found == nil || strings.HasSuffix(found.Pattern, "?") != strings.HasSuffix(common.Pattern, "?") {
+			cmd := *common
+			if err := c.AddCommand(&cmd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CoreCls implements *CLS with ClearStatus
+func CoreCls(ctx *Context) Result {
+	ctx.ClearStatus()
+	return ResOK
+}
+
+// ClearStatus clears the status data structures as *CLS does (IEEE 488.2
+// 10.3): the error queue, the standard event status register and the
+// STATus event registers are emptied and a pending *OPC is cancelled.
+// Unread output of earlier program messages is discarded too, unless a
+// response to the current one has begun.
+func (c *Context) ClearStatus() {
+	c.errorQueue = c.errorQueue[:0]
+	c.cancelOpc()
+	if c.firstOutput {
+		c.clearOutput()
+	}
+
+	c.statusMu.Lock()
+	defer c.statusUnlock()
+	c.regs[RegESR] = 0
+	c.regs[RegSTB] &^= StbErrorQueue
+	for _, r := range c.statusRoots {
+		r.clearEvents()
+	}
+}
+
+// clearEvents clears the event registers of r and its sub-registers;
+// statusMu must be held
+func (r *StatusRegister) clearEvents() {
+	for _, child := range r.children {
+		child.clearEvents()
+	}
+	r.event = 0
+	r.summarize()
+}
+
+// CoreRst implements *RST by calling Interface.Reset, if set
+func CoreRst(ctx *Context) Result {
+	if ctx.iface == nil || ctx.iface.Reset == nil {
+		return ResOK
+	}
+	if err := ctx.iface.Reset(); err != nil {
+		ctx.ErrorPushf(CodeExecutionError, "%v", err)
+		return ResErr
+	}
+	return ResOK
+}
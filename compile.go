@@ -0,0 +1,225 @@
+package scpi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PatternError describes a malformed command pattern, which would never
+// match any header
+type PatternError struct {
+	Pattern string
+	Reason  string
+}
+
+func (e *PatternError) Error() string {
+	return fmt.Sprintf("pattern %q: %s", e.Pattern, e.Reason)
+}
+
+// Compile checks every command pattern. It returns a *PatternError for each
+// malformed pattern, joined with errors.Join, so an instrument can refuse to
+// start with a broken table.
+func (c *Context) Compile() error {
+	var errs []error
+	for _, cmd := range c.table.Load().commands {
+		for _, pattern := range append([]string{cmd.Pattern}, cmd.Aliases...) {
+			if reason := checkPattern(pattern); reason != "" {
+				errs = append(errs, &PatternError{Pattern: pattern, Reason: reason})
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkPattern returns why pattern is malformed, or "" if it is well formed
+func checkPattern(pattern string) string {
+	if pattern == "" {
+		return "empty pattern"
+	}
+	body := strings.TrimSuffix(pattern, "?")
+	if strings.Contains(body, "?") {
+		return "'?' before the end"
+	}
+
+	depth := 0
+	for i := 0; i < len(body); i++ {
+		switch body[i] {
+		case '[':
+			depth++
+			if i+1 < len(body) && body[i+1] == ']' {
+				return "empty optional node"
+			}
+		case ']':
+			depth--
+			if depth < 0 {
+				return "unbalanced ']'"
+			}
+		}
+	}
+	if depth > 0 {
+		return "unbalanced '['"
+	}
+
+	body, _ = suffixDefaults(body)
+	for _, variant := range patternVariants(body) {
+		parts := strings.Split(strings.TrimPrefix(variant, ":"), ":")
+		for i, part := range parts {
+			if part == "*" && i > 0 && i == len(parts)-1 {
+				continue // Wildcard subtree
+			}
+			if reason := checkPatternNode(part, i == 0 && len(parts) == 1); reason != "" {
+				return reason
+			}
+		}
+	}
+	return ""
+}
+
+// checkPatternNode returns why one ':'-separated node of a pattern is
+// malformed, or "" if it is well formed. A '*' is only allowed to start a
+// common command, which has a single node, and a literal node (=NODE)
+// cannot take a numeric suffix.
+func checkPatternNode(part string, only bool) string {
+	if literal, ok := strings.CutPrefix(part, "="); ok {
+		if literal == "" {
+			return "empty literal node"
+		}
+		if strings.Contains(literal, "#") {
+			return fmt.Sprintf("numeric suffix in literal node %s", part)
+		}
+		part = literal
+	}
+	if part == "" {
+		return "empty node"
+	}
+	for i := 0; i < len(part); i++ {
+		b := part[i]
+		switch {
+		case isAlpha(b), isDigit(b):
+		case b == '#':
+			if i != len(part)-1 {
+				return fmt.Sprintf("stray '#' in node %s", part)
+			}
+			if i == 0 {
+				return "numeric suffix without a mnemonic"
+			}
+		case b == '*' && i == 0 && only:
+		default:
+			return fmt.Sprintf("invalid character %q in node %s", b, part)
+		}
+	}
+	return ""
+}
+
+// Overlap is a pair of command patterns of the same query form that a
+// header can match both of. Of the two, Pattern was registered first and
+// wins; Shadowed is never reached by Header.
+type Overlap struct {
+	Pattern  string
+	Shadowed string
+	Header   string // A header matching both, e.g. "MEAS:VOLT?"
+}
+
+func (o Overlap) String() string {
+	return fmt.Sprintf("pattern %q shadowed by %q for header %s", o.Shadowed, o.Pattern, o.Header)
+}
+
+// Overlaps reports the patterns and aliases shadowed by earlier ones, such
+// as "MEASure:VOLTage[:DC]?" registered after "MEAS:VOLT?", so accidental
+// shadowing can be caught at startup. Wildcard patterns, which only catch
+// what nothing else matches, and malformed patterns are skipped.
+func (c *Context) Overlaps() []Overlap {
+	type entry struct {
+		cmd      int
+		pattern  string
+		query    bool
+		variants [][]string
+	}
+	var entries []entry
+	for i, cmd := range c.table.Load().commands {
+		for _, pattern := range append([]string{cmd.Pattern}, cmd.Aliases...) {
+			if isWildcard(pattern) || checkPattern(pattern) != "" {
+				continue
+			}
+			e := entry{cmd: i, pattern: pattern, query: strings.HasSuffix(pattern, "?")}
+			body, _ := suffixDefaults(strings.TrimSuffix(pattern, "?"))
+			for _, variant := range patternVariants(body) {
+				e.variants = append(e.variants, strings.Split(strings.TrimPrefix(variant, ":"), ":"))
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	var overlaps []Overlap
+	for j, later := range entries {
+		for _, earlier := range entries[:j] {
+			if earlier.cmd == later.cmd || earlier.query != later.query {
+				continue
+			}
+			if header := overlapHeader(earlier.variants, later.variants); header != "" {
+				if later.query {
+					header += "?"
+				}
+				overlaps = append(overlaps, Overlap{Pattern: earlier.pattern, Shadowed: later.pattern, Header: header})
+				break
+			}
+		}
+	}
+	return overlaps
+}
+
+// overlapHeader returns a header matching one of the variants a and one of
+// the variants b, or "" if there is none
+func overlapHeader(a, b [][]string) string {
+	for _, va := range a {
+		for _, vb := range b {
+			if len(va) != len(vb) {
+				continue
+			}
+			nodes := make([]string, len(va))
+			for i := range va {
+				if nodes[i] = overlapNode(va[i], vb[i]); nodes[i] == "" {
+					break
+				}
+			}
+			if nodes[len(nodes)-1] != "" {
+				return strings.Join(nodes, ":")
+			}
+		}
+	}
+	return ""
+}
+
+// overlapNode returns a header node matching both pattern nodes, or "" if
+// there is none. A common header node is one of the forms of either node.
+func overlapNode(a, b string) string {
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		for _, form := range nodeForms(pair[0]) {
+			if matchCommandParts(pair[1], form) {
+				return form
+			}
+		}
+	}
+	return ""
+}
+
+// nodeForms returns the header nodes written for pattern node part: its
+// short and long form, with suffix 1 if it takes one
+func nodeForms(part string) []string {
+	if literal, ok := strings.CutPrefix(part, "="); ok {
+		return []string{literal}
+	}
+	name, suffixed := strings.CutSuffix(part, "#")
+	long := strings.ToUpper(name)
+	forms := []string{long}
+	if short := strings.IndexFunc(name, func(r rune) bool { return r >= 'a' && r <= 'z' }); short >= 0 {
+		forms = append(forms, long[:short])
+	}
+	if suffixed {
+		for i := range forms {
+			forms[i] += "1"
+		}
+	}
+	return forms
+}
@@ -0,0 +1,480 @@
+package scpi
+
+import "fmt"
+
+// Standard SCPI error and event codes (SCPI-99 21.8). Positive codes are
+// left to the device.
+const (
+	CodeNoError = 0
+
+	// Command errors
+	CodeCommandError               = -100
+	CodeInvalidCharacter           = -101
+	CodeSyntaxError                = -102
+	CodeInvalidSeparator           = -103
+	CodeDataTypeError              = -104
+	CodeGETNotAllowed              = -105
+	CodeParameterNotAllowed        = -108
+	CodeMissingParameter           = -109
+	CodeCommandHeaderError         = -110
+	CodeHeaderSeparatorError       = -111
+	CodeProgramMnemonicTooLong     = -112
+	CodeUndefinedHeader            = -113
+	CodeHeaderSuffixOutOfRange     = -114
+	CodeUnexpectedParameterCount   = -115
+	CodeNumericDataError           = -120
+	CodeInvalidCharacterInNumber   = -121
+	CodeExponentTooLarge           = -123
+	CodeTooManyDigits              = -124
+	CodeNumericDataNotAllowed      = -128
+	CodeSuffixError                = -130
+	CodeInvalidSuffix              = -131
+	CodeSuffixTooLong              = -134
+	CodeSuffixNotAllowed           = -138
+	CodeCharacterDataError         = -140
+	CodeInvalidCharacterData       = -141
+	CodeCharacterDataTooLong       = -144
+	CodeCharacterDataNotAllowed    = -148
+	CodeStringDataError            = -150
+	CodeInvalidStringData          = -151
+	CodeStringDataNotAllowed       = -158
+	CodeBlockDataError             = -160
+	CodeInvalidBlockData           = -161
+	CodeBlockDataNotAllowed        = -168
+	CodeExpressionError            = -170
+	CodeInvalidExpression          = -171
+	CodeExpressionDataNotAllowed   = -178
+	CodeMacroError                 = -180
+	CodeInvalidOutsideMacroDef     = -181
+	CodeInvalidInsideMacroDef      = -183
+	CodeMacroParameterCommandError = -184
+
+	// Execution errors
+	CodeExecutionError              = -200
+	CodeInvalidWhileInLocal         = -201
+	CodeSettingsLostDueToRTL        = -202
+	CodeCommandProtected            = -203
+	CodeTriggerError                = -210
+	CodeTriggerIgnored              = -211
+	CodeArmIgnored                  = -212
+	CodeInitIgnored                 = -213
+	CodeTriggerDeadlock             = -214
+	CodeArmDeadlock                 = -215
+	CodeParameterError              = -220
+	CodeSettingsConflict            = -221
+	CodeDataOutOfRange              = -222
+	CodeTooMuchData                 = -223
+	CodeIllegalParameterValue       = -224
+	CodeOutOfMemory                 = -225
+	CodeListsNotSameLength          = -226
+	CodeDataCorruptOrStale          = -230
+	CodeDataQuestionable            = -231
+	CodeInvalidFormat               = -232
+	CodeInvalidVersion              = -233
+	CodeHardwareError               = -240
+	CodeHardwareMissing             = -241
+	CodeMassStorageError            = -250
+	CodeMissingMassStorage          = -251
+	CodeMissingMedia                = -252
+	CodeCorruptMedia                = -253
+	CodeMediaFull                   = -254
+	CodeDirectoryFull               = -255
+	CodeFileNameNotFound            = -256
+	CodeFileNameError               = -257
+	CodeMediaProtected              = -258
+	CodeExpressionExecutionError    = -260
+	CodeMathErrorInExpression       = -261
+	CodeMacroExecutionError         = -270
+	CodeMacroSyntaxError            = -271
+	CodeMacroExecutionFailed        = -272
+	CodeIllegalMacroLabel           = -273
+	CodeMacroParameterError         = -274
+	CodeMacroDefinitionTooLong      = -275
+	CodeMacroRecursionError         = -276
+	CodeMacroRedefinitionNotAllowed = -277
+	CodeMacroHeaderNotFound         = -278
+	CodeProgramError                = -280
+	CodeCannotCreateProgram         = -281
+	CodeIllegalProgramName          = -282
+	CodeIllegalVariableName         = -283
+	CodeProgramCurrentlyRunning     = -284
+	CodeProgramSyntaxError          = -285
+	CodeProgramRuntimeError         = -286
+	CodeMemoryUseError              = -290
+	CodeOutOfMemoryInUse            = -291
+	CodeReferencedNameNotExist      = -292
+	CodeReferencedNameExists        = -293
+	CodeIncompatibleType            = -294
+
+	// Device-specific errors
+	CodeDeviceSpecificError     = -300
+	CodeSystemError             = -310
+	CodeMemoryError             = -311
+	CodePUDMemoryLost           = -312
+	CodeCalibrationMemoryLost   = -313
+	CodeSaveRecallMemoryLost    = -314
+	CodeConfigurationMemoryLost = -315
+	CodeStorageFault            = -320
+	CodeStorageOutOfMemory      = -321
+	CodeSelfTestFailed          = -330
+	CodeCalibrationFailed       = -340
+	CodeQueueOverflow           = -350
+	CodeCommunicationError      = -360
+	CodeParityError             = -361
+	CodeFramingError            = -362
+	CodeInputBufferOverrun      = -363
+	CodeTimeOutError            = -365
+
+	// Query errors
+	CodeQueryError                  = -400
+	CodeQueryInterrupted            = -410
+	CodeQueryUnterminated           = -420
+	CodeQueryDeadlocked             = -430
+	CodeQueryUnterminatedIndefinite = -440
+
+	// Events
+	CodePowerOn           = -500
+	CodeUserRequest       = -600
+	CodeRequestControl    = -700
+	CodeOperationComplete = -800
+)
+
+// Sentinel errors for the standard codes, for errors.Is on the errors
+// returned by Parse, Input and the Param functions, e.g.
+// errors.Is(err, scpi.ErrUndefinedHeader). Matching is by code; errors.As
+// with an *Error gives the queued error with its Header and Position.
+var (
+	// Command errors
+	ErrCommandError               = &Error{Code: CodeCommandError}
+	ErrInvalidCharacter           = &Error{Code: CodeInvalidCharacter}
+	ErrSyntaxError                = &Error{Code: CodeSyntaxError}
+	ErrInvalidSeparator           = &Error{Code: CodeInvalidSeparator}
+	ErrDataTypeError              = &Error{Code: CodeDataTypeError}
+	ErrGETNotAllowed              = &Error{Code: CodeGETNotAllowed}
+	ErrParameterNotAllowed        = &Error{Code: CodeParameterNotAllowed}
+	ErrMissingParameter           = &Error{Code: CodeMissingParameter}
+	ErrCommandHeaderError         = &Error{Code: CodeCommandHeaderError}
+	ErrHeaderSeparatorError       = &Error{Code: CodeHeaderSeparatorError}
+	ErrProgramMnemonicTooLong     = &Error{Code: CodeProgramMnemonicTooLong}
+	ErrUndefinedHeader            = &Error{Code: CodeUndefinedHeader}
+	ErrHeaderSuffixOutOfRange     = &Error{Code: CodeHeaderSuffixOutOfRange}
+	ErrUnexpectedParameterCount   = &Error{Code: CodeUnexpectedParameterCount}
+	ErrNumericDataError           = &Error{Code: CodeNumericDataError}
+	ErrInvalidCharacterInNumber   = &Error{Code: CodeInvalidCharacterInNumber}
+	ErrExponentTooLarge           = &Error{Code: CodeExponentTooLarge}
+	ErrTooManyDigits              = &Error{Code: CodeTooManyDigits}
+	ErrNumericDataNotAllowed      = &Error{Code: CodeNumericDataNotAllowed}
+	ErrSuffixError                = &Error{Code: CodeSuffixError}
+	ErrInvalidSuffix              = &Error{Code: CodeInvalidSuffix}
+	ErrSuffixTooLong              = &Error{Code: CodeSuffixTooLong}
+	ErrSuffixNotAllowed           = &Error{Code: CodeSuffixNotAllowed}
+	ErrCharacterDataError         = &Error{Code: CodeCharacterDataError}
+	ErrInvalidCharacterData       = &Error{Code: CodeInvalidCharacterData}
+	ErrCharacterDataTooLong       = &Error{Code: CodeCharacterDataTooLong}
+	ErrCharacterDataNotAllowed    = &Error{Code: CodeCharacterDataNotAllowed}
+	ErrStringDataError            = &Error{Code: CodeStringDataError}
+	ErrInvalidStringData          = &Error{Code: CodeInvalidStringData}
+	ErrStringDataNotAllowed       = &Error{Code: CodeStringDataNotAllowed}
+	ErrBlockDataError             = &Error{Code: CodeBlockDataError}
+	ErrInvalidBlockData           = &Error{Code: CodeInvalidBlockData}
+	ErrBlockDataNotAllowed        = &Error{Code: CodeBlockDataNotAllowed}
+	ErrExpressionError            = &Error{Code: CodeExpressionError}
+	ErrInvalidExpression          = &Error{Code: CodeInvalidExpression}
+	ErrExpressionDataNotAllowed   = &Error{Code: CodeExpressionDataNotAllowed}
+	ErrMacroError                 = &Error{Code: CodeMacroError}
+	ErrInvalidOutsideMacroDef     = &Error{Code: CodeInvalidOutsideMacroDef}
+	ErrInvalidInsideMacroDef      = &Error{Code: CodeInvalidInsideMacroDef}
+	ErrMacroParameterCommandError = &Error{Code: CodeMacroParameterCommandError}
+
+	// Execution errors
+	ErrExecutionError              = &Error{Code: CodeExecutionError}
+	ErrInvalidWhileInLocal         = &Error{Code: CodeInvalidWhileInLocal}
+	ErrSettingsLostDueToRTL        = &Error{Code: CodeSettingsLostDueToRTL}
+	ErrCommandProtected            = &Error{Code: CodeCommandProtected}
+	ErrTriggerError                = &Error{Code: CodeTriggerError}
+	ErrTriggerIgnored              = &Error{Code: CodeTriggerIgnored}
+	ErrArmIgnored                  = &Error{Code: CodeArmIgnored}
+	ErrInitIgnored                 = &Error{Code: CodeInitIgnored}
+	ErrTriggerDeadlock             = &Error{Code: CodeTriggerDeadlock}
+	ErrArmDeadlock                 = &Error{Code: CodeArmDeadlock}
+	ErrParameterError              = &Error{Code: CodeParameterError}
+	ErrSettingsConflict            = &Error{Code: CodeSettingsConflict}
+	ErrDataOutOfRange              = &Error{Code: CodeDataOutOfRange}
+	ErrTooMuchData                 = &Error{Code: CodeTooMuchData}
+	ErrIllegalParameterValue       = &Error{Code: CodeIllegalParameterValue}
+	ErrOutOfMemory                 = &Error{Code: CodeOutOfMemory}
+	ErrListsNotSameLength          = &Error{Code: CodeListsNotSameLength}
+	ErrDataCorruptOrStale          = &Error{Code: CodeDataCorruptOrStale}
+	ErrDataQuestionable            = &Error{Code: CodeDataQuestionable}
+	ErrInvalidFormat               = &Error{Code: CodeInvalidFormat}
+	ErrInvalidVersion              = &Error{Code: CodeInvalidVersion}
+	ErrHardwareError               = &Error{Code: CodeHardwareError}
+	ErrHardwareMissing             = &Error{Code: CodeHardwareMissing}
+	ErrMassStorageError            = &Error{Code: CodeMassStorageError}
+	ErrMissingMassStorage          = &Error{Code: CodeMissingMassStorage}
+	ErrMissingMedia                = &Error{Code: CodeMissingMedia}
+	ErrCorruptMedia                = &Error{Code: CodeCorruptMedia}
+	ErrMediaFull                   = &Error{Code: CodeMediaFull}
+	ErrDirectoryFull               = &Error{Code: CodeDirectoryFull}
+	ErrFileNameNotFound            = &Error{Code: CodeFileNameNotFound}
+	ErrFileNameError               = &Error{Code: CodeFileNameError}
+	ErrMediaProtected              = &Error{Code: CodeMediaProtected}
+	ErrExpressionExecutionError    = &Error{Code: CodeExpressionExecutionError}
+	ErrMathErrorInExpression       = &Error{Code: CodeMathErrorInExpression}
+	ErrMacroExecutionError         = &Error{Code: CodeMacroExecutionError}
+	ErrMacroSyntaxError            = &Error{Code: CodeMacroSyntaxError}
+	ErrMacroExecutionFailed        = &Error{Code: CodeMacroExecutionFailed}
+	ErrIllegalMacroLabel           = &Error{Code: CodeIllegalMacroLabel}
+	ErrMacroParameterError         = &Error{Code: CodeMacroParameterError}
+	ErrMacroDefinitionTooLong      = &Error{Code: CodeMacroDefinitionTooLong}
+	ErrMacroRecursionError         = &Error{Code: CodeMacroRecursionError}
+	ErrMacroRedefinitionNotAllowed = &Error{Code: CodeMacroRedefinitionNotAllowed}
+	ErrMacroHeaderNotFound         = &Error{Code: CodeMacroHeaderNotFound}
+	ErrProgramError                = &Error{Code: CodeProgramError}
+	ErrCannotCreateProgram         = &Error{Code: CodeCannotCreateProgram}
+	ErrIllegalProgramName          = &Error{Code: CodeIllegalProgramName}
+	ErrIllegalVariableName         = &Error{Code: CodeIllegalVariableName}
+	ErrProgramCurrentlyRunning     = &Error{Code: CodeProgramCurrentlyRunning}
+	ErrProgramSyntaxError          = &Error{Code: CodeProgramSyntaxError}
+	ErrProgramRuntimeError         = &Error{Code: CodeProgramRuntimeError}
+	ErrMemoryUseError              = &Error{Code: CodeMemoryUseError}
+	ErrOutOfMemoryInUse            = &Error{Code: CodeOutOfMemoryInUse}
+	ErrReferencedNameNotExist      = &Error{Code: CodeReferencedNameNotExist}
+	ErrReferencedNameExists        = &Error{Code: CodeReferencedNameExists}
+	ErrIncompatibleType            = &Error{Code: CodeIncompatibleType}
+
+	// Device-specific errors
+	ErrDeviceSpecificError     = &Error{Code: CodeDeviceSpecificError}
+	ErrSystemError             = &Error{Code: CodeSystemError}
+	ErrMemoryError             = &Error{Code: CodeMemoryError}
+	ErrPUDMemoryLost           = &Error{Code: CodePUDMemoryLost}
+	ErrCalibrationMemoryLost   = &Error{Code: CodeCalibrationMemoryLost}
+	ErrSaveRecallMemoryLost    = &Error{Code: CodeSaveRecallMemoryLost}
+	ErrConfigurationMemoryLost = &Error{Code: CodeConfigurationMemoryLost}
+	ErrStorageFault            = &Error{Code: CodeStorageFault}
+	ErrStorageOutOfMemory      = &Error{Code: CodeStorageOutOfMemory}
+	ErrSelfTestFailed          = &Error{Code: CodeSelfTestFailed}
+	ErrCalibrationFailed       = &Error{Code: CodeCalibrationFailed}
+	ErrQueueOverflow           = &Error{Code: CodeQueueOverflow}
+	ErrCommunicationError      = &Error{Code: CodeCommunicationError}
+	ErrParityError             = &Error{Code: CodeParityError}
+	ErrFramingError            = &Error{Code: CodeFramingError}
+	ErrInputBufferOverrun      = &Error{Code: CodeInputBufferOverrun}
+	ErrTimeOutError            = &Error{Code: CodeTimeOutError}
+
+	// Query errors
+	ErrQueryError                  = &Error{Code: CodeQueryError}
+	ErrQueryInterrupted            = &Error{Code: CodeQueryInterrupted}
+	ErrQueryUnterminated           = &Error{Code: CodeQueryUnterminated}
+	ErrQueryDeadlocked             = &Error{Code: CodeQueryDeadlocked}
+	ErrQueryUnterminatedIndefinite = &Error{Code: CodeQueryUnterminatedIndefinite}
+
+	// Events
+	ErrPowerOn           = &Error{Code: CodePowerOn}
+	ErrUserRequest       = &Error{Code: CodeUserRequest}
+	ErrRequestControl    = &Error{Code: CodeRequestControl}
+	ErrOperationComplete = &Error{Code: CodeOperationComplete}
+
+	// ErrBufferOverflow is returned by Input when data overflows the input
+	// buffer
+	ErrBufferOverflow = ErrInputBufferOverrun
+)
+
+// errorMessages are the standard messages of the codes above
+var errorMessages = map[int16]string{
+	CodeNoError: "No error",
+
+	CodeCommandError:               "Command error",
+	CodeInvalidCharacter:           "Invalid character",
+	CodeSyntaxError:                "Syntax error",
+	CodeInvalidSeparator:           "Invalid separator",
+	CodeDataTypeError:              "Data type error",
+	CodeGETNotAllowed:              "GET not allowed",
+	CodeParameterNotAllowed:        "Parameter not allowed",
+	CodeMissingParameter:           "Missing parameter",
+	CodeCommandHeaderError:         "Command header error",
+	CodeHeaderSeparatorError:       "Header separator error",
+	CodeProgramMnemonicTooLong:     "Program mnemonic too long",
+	CodeUndefinedHeader:            "Undefined header",
+	CodeHeaderSuffixOutOfRange:     "Header suffix out of range",
+	CodeUnexpectedParameterCount:   "Unexpected number of parameters",
+	CodeNumericDataError:           "Numeric data error",
+	CodeInvalidCharacterInNumber:   "Invalid character in number",
+	CodeExponentTooLarge:           "Exponent too large",
+	CodeTooManyDigits:              "Too many digits",
+	CodeNumericDataNotAllowed:      "Numeric data not allowed",
+	CodeSuffixError:                "Suffix error",
+	CodeInvalidSuffix:              "Invalid suffix",
+	CodeSuffixTooLong:              "Suffix too long",
+	CodeSuffixNotAllowed:           "Suffix not allowed",
+	CodeCharacterDataError:         "Character data error",
+	CodeInvalidCharacterData:       "Invalid character data",
+	CodeCharacterDataTooLong:       "Character data too long",
+	CodeCharacterDataNotAllowed:    "Character data not allowed",
+	CodeStringDataError:            "String data error",
+	CodeInvalidStringData:          "Invalid string data",
+	CodeStringDataNotAllowed:       "String data not allowed",
+	CodeBlockDataError:             "Block data error",
+	CodeInvalidBlockData:           "Invalid block data",
+	CodeBlockDataNotAllowed:        "Block data not allowed",
+	CodeExpressionError:            "Expression error",
+	CodeInvalidExpression:          "Invalid expression",
+	CodeExpressionDataNotAllowed:   "Expression data not allowed",
+	CodeMacroError:                 "Macro error",
+	CodeInvalidOutsideMacroDef:     "Invalid outside macro definition",
+	CodeInvalidInsideMacroDef:      "Invalid inside macro definition",
+	CodeMacroParameterCommandError: "Macro parameter error",
+
+	CodeExecutionError:              "Execution error",
+	CodeInvalidWhileInLocal:         "Invalid while in local",
+	CodeSettingsLostDueToRTL:        "Settings lost due to rtl",
+	CodeCommandProtected:            "Command protected",
+	CodeTriggerError:                "Trigger error",
+	CodeTriggerIgnored:              "Trigger ignored",
+	CodeArmIgnored:                  "Arm ignored",
+	CodeInitIgnored:                 "Init ignored",
+	CodeTriggerDeadlock:             "Trigger deadlock",
+	CodeArmDeadlock:                 "Arm deadlock",
+	CodeParameterError:              "Parameter error",
+	CodeSettingsConflict:            "Settings conflict",
+	CodeDataOutOfRange:              "Data out of range",
+	CodeTooMuchData:                 "Too much data",
+	CodeIllegalParameterValue:       "Illegal parameter value",
+	CodeOutOfMemory:                 "Out of memory",
+	CodeListsNotSameLength:          "Lists not same length",
+	CodeDataCorruptOrStale:          "Data corrupt or stale",
+	CodeDataQuestionable:            "Data questionable",
+	CodeInvalidFormat:               "Invalid format",
+	CodeInvalidVersion:              "Invalid version",
+	CodeHardwareError:               "Hardware error",
+	CodeHardwareMissing:             "Hardware missing",
+	CodeMassStorageError:            "Mass storage error",
+	CodeMissingMassStorage:          "Missing mass storage",
+	CodeMissingMedia:                "Missing media",
+	CodeCorruptMedia:                "Corrupt media",
+	CodeMediaFull:                   "Media full",
+	CodeDirectoryFull:               "Directory full",
+	CodeFileNameNotFound:            "File name not found",
+	CodeFileNameError:               "File name error",
+	CodeMediaProtected:              "Media protected",
+	CodeExpressionExecutionError:    "Expression error",
+	CodeMathErrorInExpression:       "Math error in expression",
+	CodeMacroExecutionError:         "Macro error",
+	CodeMacroSyntaxError:            "Macro syntax error",
+	CodeMacroExecutionFailed:        "Macro execution error",
+	CodeIllegalMacroLabel:           "Illegal macro label",
+	CodeMacroParameterError:         "Macro parameter error",
+	CodeMacroDefinitionTooLong:      "Macro definition too long",
+	CodeMacroRecursionError:         "Macro recursion error",
+	CodeMacroRedefinitionNotAllowed: "Macro redefinition not allowed",
+	CodeMacroHeaderNotFound:         "Macro header not found",
+	CodeProgramError:                "Program error",
+	CodeCannotCreateProgram:         "Cannot create program",
+	CodeIllegalProgramName:          "Illegal program name",
+	CodeIllegalVariableName:         "Illegal variable name",
+	CodeProgramCurrentlyRunning:     "Program currently running",
+	CodeProgramSyntaxError:          "Program syntax error",
+	CodeProgramRuntimeError:         "Program runtime error",
+	CodeMemoryUseError:              "Memory use error",
+	CodeOutOfMemoryInUse:            "Out of memory",
+	CodeReferencedNameNotExist:      "Referenced name does not exist",
+	CodeReferencedNameExists:        "Referenced name already exists",
+	CodeIncompatibleType:            "Incompatible type",
+
+	CodeDeviceSpecificError:     "Device-specific error",
+	CodeSystemError:             "System error",
+	CodeMemoryError:             "Memory error",
+	CodePUDMemoryLost:           "PUD memory lost",
+	CodeCalibrationMemoryLost:   "Calibration memory lost",
+	CodeSaveRecallMemoryLost:    "Save/recall memory lost",
+	CodeConfigurationMemoryLost: "Configuration memory lost",
+	CodeStorageFault:            "Storage fault",
+	CodeStorageOutOfMemory:      "Out of memory",
+	CodeSelfTestFailed:          "Self-test failed",
+	CodeCalibrationFailed:       "Calibration failed",
+	CodeQueueOverflow:           "Queue overflow",
+	CodeCommunicationError:      "Communication error",
+	CodeParityError:             "Parity error in program message",
+	CodeFramingError:            "Framing error in program message",
+	CodeInputBufferOverrun:      "Input buffer overrun",
+	CodeTimeOutError:            "Time out error",
+
+	CodeQueryError:                  "Query error",
+	CodeQueryInterrupted:            "Query INTERRUPTED",
+	CodeQueryUnterminated:           "Query UNTERMINATED",
+	CodeQueryDeadlocked:             "Query DEADLOCKED",
+	CodeQueryUnterminatedIndefinite: "Query UNTERMINATED after indefinite response",
+
+	CodePowerOn:           "Power on",
+	CodeUserRequest:       "User request",
+	CodeRequestControl:    "Request control",
+	CodeOperationComplete: "Operation complete",
+}
+
+// IsCommandError reports whether e is a command error, -100 to -199
+func (e *Error) IsCommandError() bool {
+	return e.Code <= -100 && e.Code > -200
+}
+
+// IsExecutionError reports whether e is an execution error, -200 to -299
+func (e *Error) IsExecutionError() bool {
+	return e.Code <= -200 && e.Code > -300
+}
+
+// IsDeviceError reports whether e is a device-specific error, -300 to -399,
+// or a device-defined positive code
+func (e *Error) IsDeviceError() bool {
+	return e.Code > 0 || e.Code <= -300 && e.Code > -400
+}
+
+// IsQueryError reports whether e is a query error, -400 to -499
+func (e *Error) IsQueryError() bool {
+	return e.Code <= -400 && e.Code > -500
+}
+
+// ErrorMessage returns the standard message of an error or event code. For
+// a code without one it returns the message of its class, e.g. "Execution
+// error" for -299, or "" for device-defined positive codes.
+func ErrorMessage(code int16) string {
+	if msg, ok := errorMessages[code]; ok {
+		return msg
+	}
+	if code < 0 {
+		return errorMessages[code/100*100]
+	}
+	return ""
+}
+
+// ErrorPushf queues an error with a standard code and its standard message,
+// and device-dependent info formatted as its Detail
+func (c *Context) ErrorPushf(code int16, format string, args ...interface{}) {
+	c.ErrorPush(detailError(code, format, args...))
+}
+
+// detailError returns an error with a standard code and message and a
+// formatted Detail
+func detailError(code int16, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Info: ErrorMessage(code), Detail: fmt.Sprintf(format, args...)}
+}
+
+// failure is the Go error returned by Parse, Input and the Param functions
+// for a failure that queued a SCPI error. It reads as its description, and
+// errors.As and errors.Is find both the queued *Error and any error the
+// description wraps with %w.
+type failure struct {
+	desc error
+	err  *Error
+}
+
+func (f *failure) Error() string   { return f.desc.Error() }
+func (f *failure) Unwrap() []error { return []error{f.desc, f.err} }
+
+// fail queues err and returns a failure described by format and args
+func (c *Context) fail(err *Error, format string, args ...interface{}) error {
+	return &failure{desc: fmt.Errorf(format, args...), err: c.pushError(err)}
+}
+
+// NewError returns an error with a standard code and its standard message
+func NewError(code int16) *Error {
+	return &Error{Code: code, Info: ErrorMessage(code)}
+}
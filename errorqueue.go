@@ -0,0 +1,73 @@
+package scpi
+
+// defaultErrorQueueSize is the error queue capacity unless changed with
+// SetErrorQueueSize
+const defaultErrorQueueSize = 10
+
+// SetErrorQueueSize sets how many errors the error queue holds, at least 1.
+// Shrinking it below the number of queued errors overflows the queue: the
+// newest errors are dropped and the last one kept becomes -350, or with
+// SetErrorQueueDropOldest the oldest are dropped.
+func (c *Context) SetErrorQueueSize(n int) {
+	c.errorLimit = max(n, 1)
+	excess := len(c.errorQueue) - c.errorLimit
+	switch {
+	case excess <= 0:
+	case c.dropOldest:
+		c.errorQueue = append([]*Error(nil), c.errorQueue[excess:]...)
+	default:
+		c.errorQueue = c.errorQueue[:c.errorLimit]
+		c.errorQueue[c.errorLimit-1] = NewError(CodeQueueOverflow)
+	}
+}
+
+// SetErrorQueueDropOldest selects what ErrorPush does with a full queue:
+// drop the oldest error to make room for the new one, instead of keeping
+// the oldest and replacing the newest with -350 "Queue overflow" as SCPI
+// requires
+func (c *Context) SetErrorQueueDropOldest(on bool) {
+	c.dropOldest = on
+}
+
+// ErrorQueueSize returns the error queue capacity
+func (c *Context) ErrorQueueSize() int {
+	return c.errorLimit
+}
+
+// ErrorCount returns the number of errors in the error queue
+func (c *Context) ErrorCount() int {
+	return len(c.errorQueue)
+}
+
+// SystemErrorCountQ implements SYSTem:ERRor:COUNt?
+func SystemErrorCountQ(ctx *Context) Result {
+	ctx.ResultInt32(int32(ctx.ErrorCount()))
+	return ResOK
+}
+
+// ErrorPopAll removes and returns all errors, oldest first, clearing the
+// error queue bit of the status byte
+func (c *Context) ErrorPopAll() []*Error {
+	if len(c.errorQueue) == 0 {
+		return nil
+	}
+	errs := append([]*Error(nil), c.errorQueue...)
+	c.errorQueue = c.errorQueue[:0]
+	c.RegClear(RegSTB, StbErrorQueue)
+	return errs
+}
+
+// SystemErrorAllQ implements SYSTem:ERRor:ALL?, answering every queued
+// error as <code>,"<message>" pairs in one response and emptying the queue,
+// or 0,"No error" when it is empty
+func SystemErrorAllQ(ctx *Context) Result {
+	errs := ctx.ErrorPopAll()
+	if len(errs) == 0 {
+		ctx.ResultError(nil)
+		return ResOK
+	}
+	for _, err := range errs {
+		ctx.ResultError(err)
+	}
+	return ResOK
+}
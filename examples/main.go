@@ -86,19 +86,13 @@ func handleReset(ctx *scpi.Context) scpi.Result {
 func handleClear(ctx *scpi.Context) scpi.Result {
 	// *CLS command
 	fmt.Println("Clear status")
+	ctx.ClearStatus()
 	return scpi.ResOK
 }
 
 func handleSystemError(ctx *scpi.Context) scpi.Result {
 	// SYST:ERR? query
-	err := ctx.ErrorPop()
-	if err == nil {
-		ctx.ResultInt32(0)
-		ctx.ResultText("No error")
-	} else {
-		ctx.ResultInt32(int32(err.Code))
-		ctx.ResultText(err.Info)
-	}
+	ctx.ResultError(ctx.ErrorPop())
 	return scpi.ResOK
 }
 
@@ -137,7 +131,7 @@ func main() {
 			return nil
 		},
 		OnError: func(err *scpi.Error) {
-			fmt.Fprintf(os.Stderr, "SCPI Error %d: %s\n", err.Code, err.Info)
+			fmt.Fprintf(os.Stderr, "SCPI Error %d: %s\n", err.Code, err.Message())
 		},
 	}
 
@@ -189,90 +189,10 @@ func testChanlst(ctx *scpi.Context) scpi.Result {
 	return scpi.ResOK
 }
 
-// IEEE 488.2 command handlers
-
-func coreCls(ctx *scpi.Context) scpi.Result {
-	fmt.Fprintf(os.Stderr, "**CLS\r\n")
-	return scpi.ResOK
-}
-
-func coreEse(ctx *scpi.Context) scpi.Result {
-	// Stub: register operations not supported
-	return scpi.ResOK
-}
-
-func coreEseQ(ctx *scpi.Context) scpi.Result {
-	ctx.ResultInt32(0)
-	return scpi.ResOK
-}
-
-func coreEsrQ(ctx *scpi.Context) scpi.Result {
-	ctx.ResultInt32(0)
-	return scpi.ResOK
-}
-
-func coreIdnQ(ctx *scpi.Context) scpi.Result {
-	ctx.ResultText(scpiIDN1)
-	ctx.ResultText(scpiIDN2)
-	ctx.ResultText(scpiIDN3)
-	ctx.ResultText(scpiIDN4)
-	return scpi.ResOK
-}
-
-func coreOpc(ctx *scpi.Context) scpi.Result {
-	return scpi.ResOK
-}
-
-func coreOpcQ(ctx *scpi.Context) scpi.Result {
-	ctx.ResultInt32(1)
-	return scpi.ResOK
-}
-
-func coreRst(ctx *scpi.Context) scpi.Result {
-	fmt.Fprintf(os.Stderr, "**Reset\r\n")
-	return scpi.ResOK
-}
-
-func coreSre(ctx *scpi.Context) scpi.Result {
-	return scpi.ResOK
-}
-
-func coreSreQ(ctx *scpi.Context) scpi.Result {
-	ctx.ResultInt32(0)
-	return scpi.ResOK
-}
-
-func coreStbQ(ctx *scpi.Context) scpi.Result {
-	ctx.ResultInt32(0)
-	return scpi.ResOK
-}
-
-func coreTstQ(ctx *scpi.Context) scpi.Result {
-	ctx.ResultInt32(0)
-	return scpi.ResOK
-}
-
-func coreWai(ctx *scpi.Context) scpi.Result {
-	return scpi.ResOK
-}
-
 // Required SCPI command handlers
 
 func systemErrorNextQ(ctx *scpi.Context) scpi.Result {
-	err := ctx.ErrorPop()
-	if err == nil {
-		ctx.ResultInt32(0)
-		ctx.ResultText("No error")
-	} else {
-		ctx.ResultInt32(int32(err.Code))
-		ctx.ResultText(err.Info)
-	}
-	return scpi.ResOK
-}
-
-func systemErrorCountQ(ctx *scpi.Context) scpi.Result {
-	// Note: error queue count not exposed by Go library; return 0
-	ctx.ResultInt32(0)
+	ctx.ResultError(ctx.ErrorPop())
 	return scpi.ResOK
 }
 
@@ -281,26 +201,6 @@ func systemVersionQ(ctx *scpi.Context) scpi.Result {
 	return scpi.ResOK
 }
 
-// Status command handlers (stubs)
-
-func statusQuestionableEventQ(ctx *scpi.Context) scpi.Result {
-	ctx.ResultInt32(0)
-	return scpi.ResOK
-}
-
-func statusQuestionableEnable(ctx *scpi.Context) scpi.Result {
-	return scpi.ResOK
-}
-
-func statusQuestionableEnableQ(ctx *scpi.Context) scpi.Result {
-	ctx.ResultInt32(0)
-	return scpi.ResOK
-}
-
-func statusPreset(ctx *scpi.Context) scpi.Result {
-	return scpi.ResOK
-}
-
 // Stub query handler for unimplemented measurement commands
 func stubQ(ctx *scpi.Context) scpi.Result {
 	return scpi.ResOK
@@ -311,31 +211,16 @@ func systemCommTcpipControlQ(ctx *scpi.Context) scpi.Result {
 }
 
 var scpiCommands = []*scpi.Command{
-	// IEEE Mandated Commands (SCPI std V1999.0 4.1.1)
-	{Pattern: "*CLS", Callback: coreCls},
-	{Pattern: "*ESE", Callback: coreEse},
-	{Pattern: "*ESE?", Callback: coreEseQ},
-	{Pattern: "*ESR?", Callback: coreEsrQ},
-	{Pattern: "*IDN?", Callback: coreIdnQ},
-	{Pattern: "*OPC", Callback: coreOpc},
-	{Pattern: "*OPC?", Callback: coreOpcQ},
-	{Pattern: "*RST", Callback: coreRst},
-	{Pattern: "*SRE", Callback: coreSre},
-	{Pattern: "*SRE?", Callback: coreSreQ},
-	{Pattern: "*STB?", Callback: coreStbQ},
-	{Pattern: "*TST?", Callback: coreTstQ},
-	{Pattern: "*WAI", Callback: coreWai},
-
 	// Required SCPI commands (SCPI std V1999.0 4.2.1)
 	{Pattern: "SYSTem:ERRor[:NEXT]?", Callback: systemErrorNextQ},
-	{Pattern: "SYSTem:ERRor:COUNt?", Callback: systemErrorCountQ},
+	{Pattern: "SYSTem:ERRor:COUNt?", Callback: scpi.SystemErrorCountQ},
 	{Pattern: "SYSTem:VERSion?", Callback: systemVersionQ},
 
 	// Status commands
-	{Pattern: "STATus:QUEStionable[:EVENt]?", Callback: statusQuestionableEventQ},
-	{Pattern: "STATus:QUEStionable:ENABle", Callback: statusQuestionableEnable},
-	{Pattern: "STATus:QUEStionable:ENABle?", Callback: statusQuestionableEnableQ},
-	{Pattern: "STATus:PRESet", Callback: statusPreset},
+	{Pattern: "STATus:QUEStionable[:EVENt]?", Callback: scpi.StatusEventQ},
+	{Pattern: "STATus:QUEStionable:ENABle", Callback: scpi.StatusEnable},
+	{Pattern: "STATus:QUEStionable:ENABle?", Callback: scpi.StatusEnableQ},
+	{Pattern: "STATus:PRESet", Callback: scpi.StatusPreset},
 
 	// DMM
 	{Pattern: "MEASure:VOLTage:DC?", Callback: dmmMeasureVoltageDcQ},
@@ -369,7 +254,7 @@ func main() {
 			return nil
 		},
 		OnError: func(err *scpi.Error) {
-			fmt.Fprintf(os.Stderr, "**ERROR: %d, \"%s\"\r\n", err.Code, err.Info)
+			fmt.Fprintf(os.Stderr, "**ERROR: %d, \"%s\"\r\n", err.Code, err.Message())
 		},
 		Reset: func() error {
 			fmt.Fprintf(os.Stderr, "**Reset\r\n")
@@ -379,6 +264,10 @@ func main() {
 
 	ctx := scpi.NewContext(scpiCommands, iface, scpiInputBufferLength)
 	ctx.SetIDN(scpiIDN1, scpiIDN2, scpiIDN3, scpiIDN4)
+	if err := ctx.RegisterCommonCommands(); err != nil { // IEEE Mandated Commands (SCPI std V1999.0 4.1.1)
+		fmt.Fprintf(os.Stderr, "%v\r\n", err)
+		os.Exit(1)
+	}
 
 	fmt.Printf("SCPI Interactive demo\r\n")
 
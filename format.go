@@ -0,0 +1,205 @@
+package scpi
+
+import "math"
+
+// Default FORMat[:DATA] lengths when only the type is given
+const (
+	defaultRealLength    = 64
+	defaultIntegerLength = 16
+)
+
+// dataTypes lists the FORMat[:DATA] types
+var dataTypes = []ChoiceDef{
+	{Name: "ASCii", Tag: int32(DataASCII)},
+	{Name: "REAL", Tag: int32(DataReal)},
+	{Name: "INTeger", Tag: int32(DataInteger)},
+}
+
+// byteOrders lists the FORMat:BORDer choices
+var byteOrders = []ChoiceDef{
+	{Name: "NORMal", Tag: 0},
+	{Name: "SWAPped", Tag: 1},
+}
+
+// Format returns the FORMat subsystem state. It defaults to ASCII data in
+// normal (big-endian) byte order and may be modified directly.
+func (c *Context) Format() *DataFormat {
+	return &c.format
+}
+
+// arrayFormat returns the binary byte order selected by FORMat:BORDer
+func (f *DataFormat) arrayFormat() ArrayFormat {
+	if f.Swapped {
+		return FormatLittleEndian
+	}
+	return FormatBigEndian
+}
+
+// ResultArray writes values in the format selected with FORMat[:DATA] and
+// FORMat:BORDer: a comma-separated ASCII list, or a definite-length block of
+// REAL,32/64 or INTeger,16/32 values. Integer formats round each value,
+// saturating at the limits of the type; NaN is sent as 0.
+func (c *Context) ResultArray(values []float64) error {
+	f := c.Format()
+	switch f.Type {
+	case DataReal:
+		if f.Length == 32 {
+			singles := make([]float32, len(values))
+			for i, v := range values {
+				singles[i] = float32(v)
+			}
+			return c.ResultArrayFloat32(singles, f.arrayFormat())
+		}
+		return c.ResultArrayFloat64(values, f.arrayFormat())
+
+	case DataInteger:
+		if f.Length == 32 {
+			ints := make([]int32, len(values))
+			for i, v := range values {
+				ints[i] = int32(roundClamp(v, math.MinInt32, math.MaxInt32))
+			}
+			return c.ResultArrayInt32(ints, f.arrayFormat())
+		}
+		ints := make([]int16, len(values))
+		for i, v := range values {
+			ints[i] = int16(roundClamp(v, math.MinInt16, math.MaxInt16))
+		}
+		return c.ResultArrayInt16(ints, f.arrayFormat())
+
+	default:
+		return c.ResultArrayFloat64(values, FormatASCII)
+	}
+}
+
+// roundClamp rounds v to the nearest integer within [lo, hi], NaN to 0
+func roundClamp(v, lo, hi float64) float64 {
+	if math.IsNaN(v) {
+		return 0
+	}
+	return math.Max(lo, math.Min(hi, math.Round(v)))
+}
+
+// ParamDataArray reads array data in the format selected with
+// FORMat[:DATA]: the remaining comma-separated numeric parameters for ASCII,
+// or a single arbitrary block of binary values otherwise
+func (c *Context) ParamDataArray(mandatory bool) ([]float64, error) {
+	f := c.Format()
+	if f.Type == DataASCII {
+		var values []float64
+		for {
+			param, err := c.Parameter(mandatory && len(values) == 0)
+			if err != nil {
+				return nil, err
+			}
+			if param.Kind() == KindNone {
+				return values, nil
+			}
+			v, err := c.paramToFloat64(param)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+	}
+
+	data, err := c.ParamArbitraryBlock(mandatory)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	size := f.Length / 8
+	if size == 0 {
+		size = defaultRealLength / 8
+		if f.Type == DataInteger {
+			size = defaultIntegerLength / 8
+		}
+	}
+	if len(data)%size != 0 {
+		return nil, c.fail(NewError(CodeInvalidBlockData), "block length %d is not a multiple of %d", len(data), size)
+	}
+
+	order := byteOrder(f.arrayFormat())
+	values := make([]float64, len(data)/size)
+	for i := range values {
+		b := data[i*size:]
+		switch {
+		case f.Type == DataReal && size == 4:
+			values[i] = float64(math.Float32frombits(order.Uint32(b)))
+		case f.Type == DataReal:
+			values[i] = math.Float64frombits(order.Uint64(b))
+		case size == 4:
+			values[i] = float64(int32(order.Uint32(b)))
+		default:
+			values[i] = float64(int16(order.Uint16(b)))
+		}
+	}
+	return values, nil
+}
+
+// FormatData implements FORMat[:DATA] ASCii|REAL|INTeger[,<length>]
+func FormatData(ctx *Context) Result {
+	tag, err := ctx.ParamChoice(dataTypes, true)
+	if err != nil {
+		return ResErr
+	}
+	dataType := DataType(tag)
+
+	length, err := ctx.ParamInt32(false)
+	if err != nil {
+		return ResErr
+	}
+
+	switch {
+	case dataType == DataASCII:
+		length = 0
+	case length == 0 && dataType == DataReal:
+		length = defaultRealLength
+	case length == 0:
+		length = defaultIntegerLength
+	case dataType == DataReal && length != 32 && length != 64,
+		dataType == DataInteger && length != 16 && length != 32:
+		ctx.ErrorPush(NewError(CodeIllegalParameterValue))
+		return ResErr
+	}
+
+	f := ctx.Format()
+	f.Type = dataType
+	f.Length = int(length)
+	return ResOK
+}
+
+// FormatDataQ implements FORMat[:DATA]?, answering e.g. "ASC" or "REAL,64"
+func FormatDataQ(ctx *Context) Result {
+	f := ctx.Format()
+	switch f.Type {
+	case DataReal:
+		ctx.ResultMnemonic("REAL")
+	case DataInteger:
+		ctx.ResultMnemonic("INT")
+	default:
+		ctx.ResultMnemonic("ASC")
+		return ResOK
+	}
+	ctx.ResultInt32(int32(f.Length))
+	return ResOK
+}
+
+// FormatBorder implements FORMat:BORDer NORMal|SWAPped
+func FormatBorder(ctx *Context) Result {
+	tag, err := ctx.ParamChoice(byteOrders, true)
+	if err != nil {
+		return ResErr
+	}
+	ctx.Format().Swapped = tag == 1
+	return ResOK
+}
+
+// FormatBorderQ implements FORMat:BORDer?
+func FormatBorderQ(ctx *Context) Result {
+	if ctx.Format().Swapped {
+		ctx.ResultMnemonic("SWAP")
+	} else {
+		ctx.ResultMnemonic("NORM")
+	}
+	return ResOK
+}
@@ -128,6 +128,7 @@ func runGoParser(data []byte) goParserResult {
 
 	ctx := scpi.NewContext(commands, iface, 256)
 	ctx.SetIDN("FUZZ", "INST", "0", "1.0")
+	ctx.SetFloatFormat("%.15g") // libscpi's SCPI_DoubleToStr
 	ctx.Input(data)
 
 	return goParserResult{
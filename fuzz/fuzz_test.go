@@ -28,7 +28,8 @@ func normalizeOutput(s string) string {
 }
 
 // outputsEquivalent compares parser outputs, allowing for numeric
-// formatting differences (C uses "%.15lg" for doubles, Go uses "%g").
+// formatting differences. The Go harness formats doubles with "%.15g" like
+// C, but C's ResultFloat uses plain "%g".
 func outputsEquivalent(cOut, goOut string) bool {
 	if cOut == goOut {
 		return true
@@ -173,6 +174,11 @@ func FuzzRawInput(f *testing.F) {
 		"INVALID:CMD\n",
 		// Whitespace variations
 		"TEST:INT32  42\n",
+		// Digit grouping and stray characters in numbers
+		"TEST:INT32 1_000\n",
+		"TEST:INT32 1,000\n",
+		"TEST:DOUB 1.2.3\n",
+		"TEST:INT32 #HFG\n",
 	}
 	for _, s := range seeds {
 		f.Add([]byte(s))
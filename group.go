@@ -0,0 +1,74 @@
+package scpi
+
+import "strings"
+
+// CommandGroup registers commands whose patterns share a prefix, so a large
+// subsystem states it once and a typo in it is caught once:
+//
+//	g := ctx.Group("SENSe#:VOLTage")
+//	g.Add("RANGe", setRange).Add("RANGe?", getRange).Add("RANGe:AUTO", setAuto)
+//	if err := g.Err(); err != nil { ... }
+type CommandGroup struct {
+	ctx    *Context
+	prefix string
+	err    error
+}
+
+// Group starts a group of commands under prefix. A malformed prefix is
+// reported by Err and nothing is registered.
+func (c *Context) Group(prefix string) *CommandGroup {
+	g := &CommandGroup{ctx: c, prefix: prefix}
+	if reason := checkPattern(prefix); reason != "" || strings.HasSuffix(prefix, "?") {
+		if reason == "" {
+			reason = "query form in a group prefix"
+		}
+		g.err = &PatternError{Pattern: prefix, Reason: reason}
+	}
+	return g
+}
+
+// Group starts a nested group under the prefix of g
+func (g *CommandGroup) Group(prefix string) *CommandGroup {
+	sub := g.ctx.Group(g.pattern(prefix))
+	if g.err != nil {
+		sub.err = g.err
+	}
+	return sub
+}
+
+// Add registers callback for the pattern below the group prefix, e.g.
+// "RANGe" or "RANGe:AUTO?". A pattern starting with ':' or "[:" is appended
+// as is, so "[:DC]?" and "?" extend the prefix node itself.
+func (g *CommandGroup) Add(pattern string, callback func(*Context) Result) *CommandGroup {
+	return g.AddCommand(&Command{Pattern: pattern, Callback: callback})
+}
+
+// AddCommand registers a copy of cmd with the group prefix prepended to its
+// pattern and aliases
+func (g *CommandGroup) AddCommand(cmd *Command) *CommandGroup {
+	if g.err != nil {
+		return g
+	}
+	prefixed := *cmd
+	prefixed.Pattern = g.pattern(cmd.Pattern)
+	prefixed.Aliases = nil
+	for _, alias := range cmd.Aliases {
+		prefixed.Aliases = append(prefixed.Aliases, g.pattern(alias))
+	}
+	g.err = g.ctx.AddCommand(&prefixed)
+	return g
+}
+
+// Err returns the first error of the group: a malformed prefix or pattern.
+// Commands after it were not registered.
+func (g *CommandGroup) Err() error {
+	return g.err
+}
+
+// pattern joins the group prefix and pattern
+func (g *CommandGroup) pattern(pattern string) string {
+	if pattern == "" || pattern == "?" || strings.HasPrefix(pattern, ":") || strings.HasPrefix(pattern, "[:") {
+		return g.prefix + pattern
+	}
+	return g.prefix + ":" + pattern
+}
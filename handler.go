@@ -0,0 +1,66 @@
+package scpi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Error formats e the way SYSTem:ERRor? answers it, e.g. -222,"Data out of
+// range", so an *Error can be returned as a Go error
+func (e *Error) Error() string {
+	return strconv.Itoa(int(e.Code)) + `,"` + e.Message() + `"`
+}
+
+// Is reports whether target is an *Error with the same code, so
+// errors.Is(err, scpi.ErrMissingParameter) tells why a Parse, Input or Param
+// call failed
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Message returns the message of e, the standard one for its code when
+// Info is empty, with its Detail appended after a semicolon, e.g.
+// "Undefined header;MEAS:BOGUS?"
+func (e *Error) Message() string {
+	info := e.Info
+	if info == "" {
+		info = ErrorMessage(e.Code)
+	}
+	if e.Detail == "" {
+		return info
+	}
+	return info + ";" + e.Detail
+}
+
+// Errorf returns an *Error with the given code and a formatted message, for
+// handlers adapted with Handle
+func Errorf(code int16, format string, args ...interface{}) error {
+	return &Error{Code: code, Info: fmt.Sprintf(format, args...)}
+}
+
+// Handle adapts a handler returning a Go error to a Command callback. A nil
+// error is ResOK. An *Error anywhere in the chain is queued as is; any other
+// error queues -200 with its text, unless the handler already queued an
+// error, e.g. through a failed Param call whose error it returned.
+func Handle(handler func(ctx *Context) error) func(ctx *Context) Result {
+	return func(ctx *Context) Result {
+		err := handler(ctx)
+		if err == nil {
+			return ResOK
+		}
+
+		// A failed Param call queued its error already
+		var queued *failure
+		if !errors.As(err, &queued) {
+			var scpiErr *Error
+			if errors.As(err, &scpiErr) {
+				ctx.ErrorPush(scpiErr)
+			} else if !ctx.cmdError {
+				ctx.ErrorPushf(CodeExecutionError, "%v", err)
+			}
+		}
+		return ResErr
+	}
+}
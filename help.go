@@ -0,0 +1,72 @@
+package scpi
+
+import "strings"
+
+// paramKindNames names the parameter kinds in help signatures
+var paramKindNames = map[ParamKind]string{
+	KindNumeric:           "numeric",
+	KindNondecimalNumeric: "nondecimal",
+	KindString:            "string",
+	KindMnemonic:          "mnemonic",
+	KindBlock:             "block",
+	KindExpression:        "expression",
+}
+
+// Help returns the help line for cmd: its pattern, a parameter signature
+// built from Params, e.g. "<level:numeric>[,<mode:mnemonic>]", and its
+// Description
+func (cmd *Command) Help() string {
+	var sb strings.Builder
+	sb.WriteString(cmd.Pattern)
+	for i, p := range cmd.Params {
+		sep := " "
+		if i > 0 {
+			sep = ","
+		}
+		arg := "<" + p.Name
+		if len(p.Kinds) > 0 {
+			names := make([]string, len(p.Kinds))
+			for j, kind := range p.Kinds {
+				names[j] = paramKindNames[kind]
+			}
+			arg += ":" + strings.Join(names, "|")
+		}
+		arg += ">"
+		if p.Optional {
+			sb.WriteString("[" + sep + arg + "]")
+		} else {
+			sb.WriteString(sep + arg)
+		}
+	}
+	if cmd.Description != "" {
+		sb.WriteString(" - " + cmd.Description)
+	}
+	return sb.String()
+}
+
+// SystemHelpQ implements SYSTem:HELP? <header>, answering the Help line of
+// the command the quoted header runs, or -224 if none does
+func SystemHelpQ(ctx *Context) Result {
+	header, err := ctx.ParamString(true)
+	if err != nil {
+		return ResErr
+	}
+	cmd := ctx.findCommand(strings.TrimSpace(header))
+	if cmd == nil {
+		ctx.ErrorPush(NewError(CodeIllegalParameterValue))
+		return ResErr
+	}
+	ctx.ResultText(cmd.Help())
+	return ResOK
+}
+
+// SystemHelpHeadersQ implements SYSTem:HELP:HEADers?, answering the
+// registered patterns one per line in a definite-length block
+func SystemHelpHeadersQ(ctx *Context) Result {
+	var sb strings.Builder
+	for _, cmd := range ctx.table.Load().commands {
+		sb.WriteString(cmd.Pattern + "\n")
+	}
+	ctx.ResultArbitraryBlock([]byte(sb.String()))
+	return ResOK
+}
@@ -0,0 +1,102 @@
+package hislip
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Message types (IVI-6.1 table 4)
+const (
+	msgInitialize                      = 0
+	msgInitializeResponse              = 1
+	msgFatalError                      = 2
+	msgError                           = 3
+	msgAsyncLock                       = 4
+	msgAsyncLockResponse               = 5
+	msgData                            = 6
+	msgDataEnd                         = 7
+	msgDeviceClearComplete             = 8
+	msgDeviceClearAcknowledge          = 9
+	msgAsyncRemoteLocalControl         = 10
+	msgAsyncRemoteLocalResponse        = 11
+	msgTrigger                         = 12
+	msgInterrupted                     = 13
+	msgAsyncInterrupted                = 14
+	msgAsyncMaximumMessageSize         = 15
+	msgAsyncMaximumMessageSizeResponse = 16
+	msgAsyncInitialize                 = 17
+	msgAsyncInitializeResponse         = 18
+	msgAsyncDeviceClear                = 19
+	msgAsyncServiceRequest             = 20
+	msgAsyncStatusQuery                = 21
+	msgAsyncStatusResponse             = 22
+	msgAsyncDeviceClearAcknowledge     = 23
+	msgAsyncLockInfo                   = 24
+	msgAsyncLockInfoResponse           = 25
+)
+
+// Fatal error codes
+const (
+	fatalBadHeader      = 1
+	fatalInitialization = 3
+)
+
+// Non-fatal error codes
+const (
+	errorUnidentified     = 0
+	errorUnrecognizedType = 1
+	errorTooLarge         = 4
+)
+
+// headerSize is the size of a message header: "HS", type, control code,
+// message parameter and payload length
+const headerSize = 16
+
+var (
+	errBadHeader = errors.New("hislip: poorly formed message header")
+	errTooLarge  = errors.New("hislip: message too large")
+)
+
+// message is a HiSLIP message
+type message struct {
+	typ     byte
+	control byte
+	param   uint32
+	payload []byte
+}
+
+// readMessage reads a message with a payload of at most max bytes. The
+// payload of a larger message is skipped and errTooLarge returned with its
+// header, so the connection can continue.
+func readMessage(r io.Reader, max uint64) (message, error) {
+	var h [headerSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return message{}, err
+	}
+	if h[0] != 'H' || h[1] != 'S' {
+		return message{}, errBadHeader
+	}
+
+	m := message{typ: h[2], control: h[3], param: binary.BigEndian.Uint32(h[4:])}
+	size := binary.BigEndian.Uint64(h[8:])
+	if size > max {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return message{}, err
+		}
+		return m, errTooLarge
+	}
+	m.payload = make([]byte, size)
+	_, err := io.ReadFull(r, m.payload)
+	return m, err
+}
+
+// writeMessage writes m with its header in one write
+func writeMessage(w io.Writer, m message) error {
+	buf := make([]byte, headerSize, headerSize+len(m.payload))
+	buf[0], buf[1], buf[2], buf[3] = 'H', 'S', m.typ, m.control
+	binary.BigEndian.PutUint32(buf[4:], m.param)
+	binary.BigEndian.PutUint64(buf[8:], uint64(len(m.payload)))
+	_, err := w.Write(append(buf, m.payload...))
+	return err
+}
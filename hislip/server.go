@@ -0,0 +1,512 @@
+// Package hislip serves a SCPI command set over HiSLIP (IVI-6.1), the
+// protocol of TCPIP::host::hislip0::INSTR VISA resources. Each client
+// session has a synchronous channel carrying program and response messages
+// and an asynchronous channel for device clear, status queries, locking
+// and service requests.
+//
+// The server speaks protocol version 1.1 in synchronized mode; clients
+// offering 2.0 negotiate down to it. All sessions share the one Context,
+// as they share an instrument.
+package hislip
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+const (
+	DefaultAddr           = ":4880"
+	DefaultMaxMessageSize = 1 << 20
+)
+
+// protocolVersion is the highest version the server offers, 1.1
+const protocolVersion = 0x0101
+
+// vendorID is the two-character vendor code sent in AsyncInitializeResponse
+const vendorID = 'G'<<8 | 'O'
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close
+var ErrServerClosed = errors.New("hislip: server closed")
+
+// Options configures a Server
+type Options struct {
+	BufferSize     int                     // Input buffer size, 1024 when zero
+	MaxMessageSize uint64                  // Largest payload accepted, DefaultMaxMessageSize when zero
+	Setup          func(ctx *scpi.Context) // Called once on the Context, e.g. to SetIDN
+}
+
+// Server runs a Context for HiSLIP sessions
+type Server struct {
+	opts Options
+	ctx  *scpi.Context
+	done chan struct{} // Closed by Close
+
+	mu       sync.Mutex // Serializes access to ctx and the session state
+	cur      *session   // Session whose message is executing
+	sessions map[uint16]*session
+	nextID   uint16
+	owner    *session      // Session holding the lock, nil when unlocked
+	unlocked chan struct{} // Closed when the lock is released
+
+	connMu sync.Mutex
+	conns  map[net.Conn]struct{}
+	ln     net.Listener
+	closed bool
+}
+
+// session is a client session with its two channels
+type session struct {
+	id      uint16
+	sync    net.Conn
+	output  []byte // Response data of the executing message
+	maxSize uint64 // Largest payload the client accepts
+
+	asyncMu sync.Mutex // Serializes writes on async
+	async   net.Conn   // Nil until AsyncInitialize
+
+	// A response was sent that the client has not reported as delivered
+	unread atomic.Bool
+}
+
+// New creates a server for commands
+func New(commands []*scpi.Command, opts Options) *Server {
+	if opts.BufferSize == 0 {
+		opts.BufferSize = 1024
+	}
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+
+	s := &Server{
+		opts:     opts,
+		done:     make(chan struct{}),
+		sessions: make(map[uint16]*session),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.ctx = scpi.NewContext(commands, &scpi.Interface{
+		Write: func(data []byte) (int, error) {
+			if s.cur != nil {
+				s.cur.output = append(s.cur.output, data...)
+			}
+			return len(data), nil
+		},
+		OnSRQ: func() { go s.serviceRequest() },
+	}, opts.BufferSize)
+	if opts.Setup != nil {
+		opts.Setup(s.ctx)
+	}
+	return s
+}
+
+// Context returns the Context commands are executed on
+func (s *Server) Context() *scpi.Context {
+	return s.ctx
+}
+
+// ListenAndServe listens on addr (DefaultAddr when empty) and serves
+// sessions until Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts the synchronous and asynchronous channels of sessions on
+// ln. It blocks until Close is called or ln fails.
+func (s *Server) Serve(ln net.Listener) error {
+	s.connMu.Lock()
+	if s.closed {
+		s.connMu.Unlock()
+		return ErrServerClosed
+	}
+	s.ln = ln
+	s.connMu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.connMu.Lock()
+			closed := s.closed
+			s.connMu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.connMu.Lock()
+		s.conns[conn] = struct{}{}
+		s.connMu.Unlock()
+
+		go func() {
+			s.serveConn(conn)
+			conn.Close()
+			s.connMu.Lock()
+			delete(s.conns, conn)
+			s.connMu.Unlock()
+		}()
+	}
+}
+
+// Close stops the listener and closes all open connections
+func (s *Server) Close() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// serveConn serves a new connection as the synchronous or asynchronous
+// channel its first message initializes
+func (s *Server) serveConn(conn net.Conn) {
+	m, err := readMessage(conn, s.opts.MaxMessageSize)
+	switch {
+	case err == errBadHeader:
+		fatal(conn, fatalBadHeader, err.Error())
+	case err != nil:
+	case m.typ == msgInitialize:
+		s.serveSync(conn, m)
+	case m.typ == msgAsyncInitialize:
+		s.serveAsync(conn, m)
+	default:
+		fatal(conn, fatalInitialization, "expected Initialize or AsyncInitialize")
+	}
+}
+
+// fatal sends a FatalError message; the connection is closed afterwards
+func fatal(conn net.Conn, code byte, text string) {
+	writeMessage(conn, message{typ: msgFatalError, control: code, payload: []byte(text)})
+}
+
+// serveSync answers Initialize and then handles the messages of the
+// synchronous channel until it closes, which ends the session
+func (s *Server) serveSync(conn net.Conn, init message) {
+	version := uint16(init.param >> 16)
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	for s.sessions[s.nextID] != nil || s.nextID == 0 {
+		s.nextID++
+	}
+	sess := &session{id: s.nextID, sync: conn, maxSize: s.opts.MaxMessageSize}
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+	defer s.closeSession(sess)
+
+	// Control code 0: synchronized mode
+	err := writeMessage(conn, message{typ: msgInitializeResponse, param: uint32(version)<<16 | uint32(sess.id)})
+	for err == nil {
+		var m message
+		m, err = readMessage(conn, s.opts.MaxMessageSize)
+		switch {
+		case err == errTooLarge:
+			err = writeMessage(conn, message{typ: msgError, control: errorTooLarge})
+		case err == errBadHeader:
+			fatal(conn, fatalBadHeader, err.Error())
+		case err != nil:
+		case m.typ == msgData, m.typ == msgDataEnd:
+			err = s.data(sess, m, m.payload)
+		case m.typ == msgTrigger:
+			err = s.data(sess, m, []byte("*TRG\n"))
+		case m.typ == msgDeviceClearComplete:
+			err = s.clearComplete(sess)
+		case m.typ == msgFatalError:
+			return
+		case m.typ == msgError:
+		default:
+			err = writeMessage(conn, message{typ: msgError, control: errorUnrecognizedType})
+		}
+	}
+}
+
+// closeSession forgets sess, releasing its lock and closing its channels
+func (s *Server) closeSession(sess *session) {
+	s.mu.Lock()
+	delete(s.sessions, sess.id)
+	if s.owner == sess {
+		s.release()
+	}
+	s.mu.Unlock()
+
+	sess.sync.Close()
+	sess.asyncMu.Lock()
+	if sess.async != nil {
+		sess.async.Close()
+	}
+	sess.asyncMu.Unlock()
+}
+
+// data executes a Data, DataEnd or Trigger message once no other session
+// holds the lock, then sends the response produced by a DataEnd message
+// with the message ID of the request. A new message arriving while the
+// client has not read the previous response interrupts that query: -410 is
+// queued and Interrupted is sent on both channels, so the client discards
+// what it has not read.
+func (s *Server) data(sess *session, m message, input []byte) error {
+	if !s.access(sess) {
+		return ErrServerClosed
+	}
+	defer s.mu.Unlock()
+
+	// Control code bit 0: RMT-delivered
+	if m.control&1 != 0 {
+		sess.unread.Store(false)
+	}
+	if sess.unread.Swap(false) {
+		s.ctx.ErrorPush(scpi.NewError(scpi.CodeQueryInterrupted))
+		if err := writeMessage(sess.sync, message{typ: msgInterrupted, param: m.param}); err != nil {
+			return err
+		}
+		sess.writeAsync(message{typ: msgAsyncInterrupted, param: m.param})
+	}
+
+	s.cur = sess
+	s.ctx.Input(input)
+	if m.typ != msgData {
+		s.ctx.Input(nil)
+	}
+	s.cur = nil
+	if m.typ == msgData || len(sess.output) == 0 {
+		return nil
+	}
+
+	out := sess.output
+	sess.output = nil
+	sess.unread.Store(true)
+	for {
+		chunk := message{typ: msgDataEnd, param: m.param, payload: out}
+		if uint64(len(out)) > sess.maxSize {
+			chunk.typ, chunk.payload = msgData, out[:sess.maxSize]
+		}
+		if err := writeMessage(sess.sync, chunk); err != nil || chunk.typ == msgDataEnd {
+			return err
+		}
+		out = out[len(chunk.payload):]
+	}
+}
+
+// access locks mu for sess once no other session holds the lock. It
+// returns false with mu released if the server is closed meanwhile.
+func (s *Server) access(sess *session) bool {
+	s.mu.Lock()
+	for s.owner != nil && s.owner != sess {
+		unlocked := s.unlocked
+		s.mu.Unlock()
+		select {
+		case <-unlocked:
+		case <-s.done:
+			return false
+		}
+		s.mu.Lock()
+	}
+	return true
+}
+
+// clearComplete finishes a device clear started with AsyncDeviceClear:
+// the Context is device-cleared, which also rearms it after the abort,
+// and the client is told the clear is done
+func (s *Server) clearComplete(sess *session) error {
+	s.mu.Lock()
+	s.ctx.DeviceClear()
+	sess.output = nil
+	sess.unread.Store(false)
+	s.mu.Unlock()
+
+	return writeMessage(sess.sync, message{typ: msgDeviceClearAcknowledge})
+}
+
+// serveAsync attaches an asynchronous channel to its session and handles
+// its messages until it closes
+func (s *Server) serveAsync(conn net.Conn, init message) {
+	s.mu.Lock()
+	sess := s.sessions[uint16(init.param)]
+	s.mu.Unlock()
+	if sess == nil {
+		fatal(conn, fatalInitialization, "unknown session")
+		return
+	}
+
+	sess.asyncMu.Lock()
+	if sess.async != nil {
+		sess.asyncMu.Unlock()
+		fatal(conn, fatalInitialization, "session already has an asynchronous channel")
+		return
+	}
+	sess.async = conn
+	sess.asyncMu.Unlock()
+
+	err := sess.writeAsync(message{typ: msgAsyncInitializeResponse, param: vendorID})
+	for err == nil {
+		var m message
+		m, err = readMessage(conn, s.opts.MaxMessageSize)
+		switch {
+		case err == errTooLarge:
+			err = sess.writeAsync(message{typ: msgError, control: errorTooLarge})
+		case err == errBadHeader:
+			fatal(conn, fatalBadHeader, err.Error())
+		case err != nil:
+		case m.typ == msgAsyncMaximumMessageSize:
+			err = s.maximumMessageSize(sess, m)
+		case m.typ == msgAsyncDeviceClear:
+			// Abort first: a running command holds mu until it returns
+			s.ctx.Abort()
+			err = sess.writeAsync(message{typ: msgAsyncDeviceClearAcknowledge})
+		case m.typ == msgAsyncStatusQuery:
+			err = sess.writeAsync(message{typ: msgAsyncStatusResponse, control: s.statusQuery(sess, m)})
+		case m.typ == msgAsyncLock:
+			err = sess.writeAsync(message{typ: msgAsyncLockResponse, control: s.asyncLock(sess, m)})
+		case m.typ == msgAsyncLockInfo:
+			err = sess.writeAsync(s.lockInfo())
+		case m.typ == msgAsyncRemoteLocalControl:
+			err = sess.writeAsync(message{typ: msgAsyncRemoteLocalResponse})
+		case m.typ == msgFatalError:
+			return
+		case m.typ == msgError:
+		default:
+			err = sess.writeAsync(message{typ: msgError, control: errorUnrecognizedType})
+		}
+	}
+}
+
+// writeAsync sends m on the asynchronous channel, if there is one yet
+func (sess *session) writeAsync(m message) error {
+	sess.asyncMu.Lock()
+	defer sess.asyncMu.Unlock()
+	if sess.async == nil {
+		return nil
+	}
+	return writeMessage(sess.async, m)
+}
+
+// maximumMessageSize records the largest payload the client accepts, so
+// longer responses are split, and answers with the largest the server
+// accepts
+func (s *Server) maximumMessageSize(sess *session, m message) error {
+	if len(m.payload) != 8 {
+		return sess.writeAsync(message{typ: msgError, control: errorUnidentified})
+	}
+	if size := binary.BigEndian.Uint64(m.payload); size > 0 {
+		s.mu.Lock()
+		sess.maxSize = size
+		s.mu.Unlock()
+	}
+
+	reply := message{typ: msgAsyncMaximumMessageSizeResponse, payload: make([]byte, 8)}
+	binary.BigEndian.PutUint64(reply.payload, s.opts.MaxMessageSize)
+	return sess.writeAsync(reply)
+}
+
+// statusQuery answers AsyncStatusQuery with a serial poll of the Context.
+// MAV is reported while the client has not read the last response.
+func (s *Server) statusQuery(sess *session, m message) byte {
+	if m.control&1 != 0 {
+		sess.unread.Store(false)
+	}
+	stb := s.ctx.SerialPoll()
+	if sess.unread.Load() {
+		stb |= byte(scpi.StbMAV)
+	}
+	return stb
+}
+
+// asyncLock requests or releases the exclusive lock. A request waits up to
+// the timeout in the message parameter, in milliseconds, and is answered
+// 1 on success and 0 on timeout; shared locks are not supported and
+// answered 3 (error). A release is answered 1, or 3 without the lock.
+func (s *Server) asyncLock(sess *session, m message) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.control == 0 {
+		if s.owner != sess {
+			return 3
+		}
+		s.release()
+		return 1
+	}
+	if len(m.payload) > 0 {
+		return 3
+	}
+
+	timer := time.NewTimer(time.Duration(m.param) * time.Millisecond)
+	defer timer.Stop()
+	for s.owner != nil && s.owner != sess {
+		unlocked := s.unlocked
+		s.mu.Unlock()
+		select {
+		case <-unlocked:
+			s.mu.Lock()
+		case <-timer.C:
+			s.mu.Lock()
+			return 0
+		case <-s.done:
+			s.mu.Lock()
+			return 0
+		}
+	}
+	if s.owner == nil {
+		s.owner = sess
+		s.unlocked = make(chan struct{})
+	}
+	return 1
+}
+
+// release releases the lock; mu must be held
+func (s *Server) release() {
+	s.owner = nil
+	close(s.unlocked)
+}
+
+// lockInfo answers AsyncLockInfo: control code 1 when the exclusive lock
+// is held, and the number of sessions holding a lock as parameter
+func (s *Server) lockInfo() message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner == nil {
+		return message{typ: msgAsyncLockInfoResponse}
+	}
+	return message{typ: msgAsyncLockInfoResponse, control: 1, param: 1}
+}
+
+// serviceRequest sends AsyncServiceRequest with the status byte to every
+// session. It is called whenever the master summary status of the
+// Context's status byte is set.
+func (s *Server) serviceRequest() {
+	stb := byte(s.ctx.RegGet(scpi.RegSTB))
+
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		sess.writeAsync(message{typ: msgAsyncServiceRequest, control: stb})
+	}
+}
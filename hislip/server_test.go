@@ -0,0 +1,200 @@
+package hislip
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// client is one HiSLIP session with both channels open
+type client struct {
+	t           *testing.T
+	sync, async net.Conn
+	id          uint16
+}
+
+// send writes a message on conn
+func (c *client) send(conn net.Conn, m message) {
+	c.t.Helper()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := writeMessage(conn, m); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads a message from conn and checks its type
+func (c *client) expect(conn net.Conn, typ byte) message {
+	c.t.Helper()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	m, err := readMessage(conn, 1<<20)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if m.typ != typ {
+		c.t.Fatalf("message type %d (control %d, %q), want %d", m.typ, m.control, m.payload, typ)
+	}
+	return m
+}
+
+// connect opens a session on the server at addr
+func connect(t *testing.T, addr string) *client {
+	t.Helper()
+
+	c := &client{t: t}
+	var err error
+	if c.sync, err = net.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.sync.Close() })
+	c.send(c.sync, message{typ: msgInitialize, param: 0x0200<<16 | 'X'<<8 | 'Y', payload: []byte("hislip0")})
+	m := c.expect(c.sync, msgInitializeResponse)
+	if version := m.param >> 16; version != protocolVersion || m.control != 0 {
+		t.Errorf("InitializeResponse version %#x, control %d", version, m.control)
+	}
+	c.id = uint16(m.param)
+
+	if c.async, err = net.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.async.Close() })
+	c.send(c.async, message{typ: msgAsyncInitialize, param: uint32(c.id)})
+	if m := c.expect(c.async, msgAsyncInitializeResponse); m.param != vendorID {
+		t.Errorf("vendor ID %#x", m.param)
+	}
+	return c
+}
+
+func startServer(t *testing.T) (*Server, string) {
+	t.Helper()
+
+	s := New([]*scpi.Command{
+		{Pattern: "*IDN?", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.ResultText("ACME")
+			return scpi.ResOK
+		}},
+	}, Options{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return s, ln.Addr().String()
+}
+
+func TestDataExchange(t *testing.T) {
+	_, addr := startServer(t)
+	c := connect(t, addr)
+
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, 4)
+	c.send(c.async, message{typ: msgAsyncMaximumMessageSize, payload: size})
+	c.expect(c.async, msgAsyncMaximumMessageSizeResponse)
+
+	// The 7-byte response is split to the client's maximum of 4
+	c.send(c.sync, message{typ: msgDataEnd, param: 0xFFFFFF00, payload: []byte("*IDN?")})
+	if m := c.expect(c.sync, msgData); m.param != 0xFFFFFF00 || string(m.payload) != `"ACM` {
+		t.Errorf("Data %#x %q", m.param, m.payload)
+	}
+	if m := c.expect(c.sync, msgDataEnd); string(m.payload) != "E\"\n" {
+		t.Errorf("DataEnd %q", m.payload)
+	}
+
+	// MAV is set until the client reports the response delivered
+	c.send(c.async, message{typ: msgAsyncStatusQuery, param: 0xFFFFFF02})
+	if m := c.expect(c.async, msgAsyncStatusResponse); m.control != byte(scpi.StbMAV) {
+		t.Errorf("status %#x, want MAV", m.control)
+	}
+	c.send(c.async, message{typ: msgAsyncStatusQuery, control: 1, param: 0xFFFFFF02})
+	if m := c.expect(c.async, msgAsyncStatusResponse); m.control != 0 {
+		t.Errorf("status %#x after delivery, want 0", m.control)
+	}
+}
+
+func TestInterrupted(t *testing.T) {
+	s, addr := startServer(t)
+	c := connect(t, addr)
+
+	c.send(c.sync, message{typ: msgDataEnd, param: 0xFFFFFF00, payload: []byte("*IDN?\n")})
+	c.expect(c.sync, msgDataEnd)
+
+	// A new query without RMT-delivered interrupts the unread response
+	c.send(c.sync, message{typ: msgDataEnd, param: 0xFFFFFF02, payload: []byte("*IDN?\n")})
+	if m := c.expect(c.sync, msgInterrupted); m.param != 0xFFFFFF02 {
+		t.Errorf("Interrupted message ID %#x", m.param)
+	}
+	c.expect(c.async, msgAsyncInterrupted)
+	c.expect(c.sync, msgDataEnd)
+	if err := s.Context().ErrorPop(); err == nil || err.Code != scpi.CodeQueryInterrupted {
+		t.Errorf("error queue %v, want -410", err)
+	}
+
+	c.send(c.sync, message{typ: msgDataEnd, control: 1, param: 0xFFFFFF04, payload: []byte("*IDN?\n")})
+	c.expect(c.sync, msgDataEnd)
+}
+
+func TestDeviceClear(t *testing.T) {
+	s, addr := startServer(t)
+	c := connect(t, addr)
+
+	c.send(c.sync, message{typ: msgData, param: 0xFFFFFF00, payload: []byte("*ID")})
+	c.send(c.async, message{typ: msgAsyncDeviceClear})
+	c.expect(c.async, msgAsyncDeviceClearAcknowledge)
+	select {
+	case <-s.Context().Aborted():
+	default:
+		t.Error("AsyncDeviceClear did not abort the Context")
+	}
+
+	// The partial message is discarded and the Context rearmed
+	c.send(c.sync, message{typ: msgDeviceClearComplete})
+	c.expect(c.sync, msgDeviceClearAcknowledge)
+	select {
+	case <-s.Context().Aborted():
+		t.Error("Context still aborted after DeviceClearComplete")
+	default:
+	}
+	c.send(c.sync, message{typ: msgDataEnd, param: 0xFFFFFF00, payload: []byte("*IDN?\n")})
+	if m := c.expect(c.sync, msgDataEnd); string(m.payload) != "\"ACME\"\n" {
+		t.Errorf("response %q", m.payload)
+	}
+}
+
+func TestLockAndServiceRequest(t *testing.T) {
+	s, addr := startServer(t)
+	a, b := connect(t, addr), connect(t, addr)
+
+	a.send(a.async, message{typ: msgAsyncLock, control: 1, param: 0})
+	if m := a.expect(a.async, msgAsyncLockResponse); m.control != 1 {
+		t.Errorf("lock request answered %d, want 1", m.control)
+	}
+	b.send(b.async, message{typ: msgAsyncLock, control: 1, param: 10})
+	if m := b.expect(b.async, msgAsyncLockResponse); m.control != 0 {
+		t.Errorf("lock request of another session answered %d, want 0", m.control)
+	}
+	b.send(b.async, message{typ: msgAsyncLockInfo})
+	if m := b.expect(b.async, msgAsyncLockInfoResponse); m.control != 1 || m.param != 1 {
+		t.Errorf("lock info %d,%d, want 1,1", m.control, m.param)
+	}
+
+	// The other session's data waits for the release
+	b.send(b.sync, message{typ: msgDataEnd, param: 0xFFFFFF00, payload: []byte("*IDN?\n")})
+	a.send(a.async, message{typ: msgAsyncLock, control: 0})
+	if m := a.expect(a.async, msgAsyncLockResponse); m.control != 1 {
+		t.Errorf("lock release answered %d, want 1", m.control)
+	}
+	b.expect(b.sync, msgDataEnd)
+
+	s.Context().RegSet(scpi.RegSRE, 1)
+	s.Context().RegSet(scpi.RegSTB, 1)
+	for _, c := range []*client{a, b} {
+		if m := c.expect(c.async, msgAsyncServiceRequest); m.control != 0x41 {
+			t.Errorf("service request status %#x, want 0x41", m.control)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Package hostcompat replays I/O traces recorded between a host application
+// and a real instrument against a scpi.Context, and reports every response
+// that differs from what the recorded instrument returned. It is intended for
+// instrument-replacement projects where an existing host program must keep
+// working unchanged against the new implementation.
+package hostcompat
+
+import (
+	"bytes"
+	"strings"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// Direction tells whether a trace entry was sent by the host or returned by
+// the instrument
+type Direction int
+
+const (
+	DirWrite Direction = iota // Host to instrument
+	DirRead                   // Instrument to host
+)
+
+// Entry is a single recorded transfer from an I/O trace
+type Entry struct {
+	Line int // Line number in the trace file, for reporting
+	Dir  Direction
+	Data string
+}
+
+// Mismatch describes a recorded response that the Context did not reproduce
+type Mismatch struct {
+	Line    int    // Line of the recorded read in the trace file
+	Command string // Last command written before the read
+	Want    string // Response recorded from the original instrument
+	Got     string // Response produced by the Context
+}
+
+// Run replays entries against ctx. Writes are fed to ctx.Input and reads are
+// compared with the responses the Context wrote to output, which must be the
+// buffer the Context's Interface.Write appends to. Trailing line terminators
+// are ignored on both sides. Responses produced but never read by the host
+// are discarded at the next write, as a device clear would.
+func Run(ctx *scpi.Context, output *bytes.Buffer, entries []Entry) []Mismatch {
+	var mismatches []Mismatch
+	var pending []string
+	var lastCommand string
+
+	for _, e := range entries {
+		switch e.Dir {
+		case DirWrite:
+			lastCommand = trimTerminator(e.Data)
+			output.Reset()
+			ctx.Input([]byte(lastCommand + "\n"))
+			pending = splitResponses(output.String())
+			output.Reset()
+
+		case DirRead:
+			want := trimTerminator(e.Data)
+			got := ""
+			if len(pending) > 0 {
+				got = pending[0]
+				pending = pending[1:]
+			}
+			if got != want {
+				mismatches = append(mismatches, Mismatch{
+					Line:    e.Line,
+					Command: lastCommand,
+					Want:    want,
+					Got:     got,
+				})
+			}
+		}
+	}
+
+	return mismatches
+}
+
+// splitResponses splits Context output into one string per response message
+func splitResponses(out string) []string {
+	var responses []string
+	for _, line := range strings.Split(out, "\n") {
+		line = trimTerminator(line)
+		if line != "" {
+			responses = append(responses, line)
+		}
+	}
+	return responses
+}
+
+// trimTerminator removes trailing line terminators from a message
+func trimTerminator(s string) string {
+	return strings.TrimRight(s, "\r\n")
+}
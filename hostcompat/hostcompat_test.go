@@ -0,0 +1,124 @@
+package hostcompat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+func newTestContext() (*scpi.Context, *bytes.Buffer) {
+	output := &bytes.Buffer{}
+	commands := []*scpi.Command{
+		{Pattern: "*IDN?", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.ResultText("ACME")
+			ctx.ResultText("X1")
+			return scpi.ResOK
+		}},
+		{Pattern: "MEASure:VOLTage?", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.ResultDouble(1.5)
+			return scpi.ResOK
+		}},
+		{Pattern: "*RST", Callback: func(ctx *scpi.Context) scpi.Result {
+			return scpi.ResOK
+		}},
+	}
+	iface := &scpi.Interface{Write: output.Write}
+	return scpi.NewContext(commands, iface, 256), output
+}
+
+func TestParseNITrace(t *testing.T) {
+	trace := `1.  viOpenDefaultRM (0x00001000)
+Process ID: 0x00001234         Thread ID: 0x00005678
+2.  viWrite (TCPIP0::10.0.0.2::inst0::INSTR (0x00000001), "*IDN?.", 6 (0x6), 6 (0x6))
+3.  viRead (TCPIP0::10.0.0.2::inst0::INSTR (0x00000001), ""ACME","X1".", 1024 (0x400), 12 (0xC))
+4.  viWrite (TCPIP0::10.0.0.2::inst0::INSTR (0x00000001), "*RST\n", 5 (0x5), 5 (0x5))
+`
+	entries, err := ParseNITrace(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("ParseNITrace error: %v", err)
+	}
+
+	want := []Entry{
+		{Line: 3, Dir: DirWrite, Data: "*IDN?"},
+		{Line: 4, Dir: DirRead, Data: `"ACME","X1"`},
+		{Line: 5, Dir: DirWrite, Data: "*RST\n"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("ParseNITrace got %d entries, want %d: %v", len(entries), len(want), entries)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestParseIOMonitor(t *testing.T) {
+	export := "Index,Function,Session,Data\n" +
+		"1,viWrite,1,MEAS:VOLT?\\n\n" +
+		"2,viRead,1,1.5\\n\n" +
+		"3,viClose,1,\n"
+
+	entries, err := ParseIOMonitor(strings.NewReader(export))
+	if err != nil {
+		t.Fatalf("ParseIOMonitor error: %v", err)
+	}
+
+	want := []Entry{
+		{Line: 2, Dir: DirWrite, Data: "MEAS:VOLT?\n"},
+		{Line: 3, Dir: DirRead, Data: "1.5\n"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("ParseIOMonitor got %d entries, want %d: %v", len(entries), len(want), entries)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	if _, err := ParseIOMonitor(strings.NewReader("Index,Session\n")); err == nil {
+		t.Error("ParseIOMonitor without Function/Data columns should fail")
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx, output := newTestContext()
+
+	entries := []Entry{
+		{Line: 1, Dir: DirWrite, Data: "*IDN?\n"},
+		{Line: 2, Dir: DirRead, Data: "\"ACME\",\"X1\"\n"},
+		{Line: 3, Dir: DirWrite, Data: "MEAS:VOLT?"},
+		{Line: 4, Dir: DirRead, Data: "1.25"},
+		{Line: 5, Dir: DirWrite, Data: "*RST"},
+		{Line: 6, Dir: DirRead, Data: "0"},
+	}
+
+	mismatches := Run(ctx, output, entries)
+	if len(mismatches) != 2 {
+		t.Fatalf("Run got %d mismatches, want 2: %+v", len(mismatches), mismatches)
+	}
+
+	if m := mismatches[0]; m.Line != 4 || m.Command != "MEAS:VOLT?" || m.Want != "1.25" || m.Got != "1.5" {
+		t.Errorf("mismatch 0 = %+v", m)
+	}
+	if m := mismatches[1]; m.Line != 6 || m.Command != "*RST" || m.Got != "" {
+		t.Errorf("mismatch 1 = %+v", m)
+	}
+}
+
+func TestRunCompoundQuery(t *testing.T) {
+	ctx, output := newTestContext()
+
+	entries := []Entry{
+		{Line: 1, Dir: DirWrite, Data: "*IDN?\n*IDN?"},
+		{Line: 2, Dir: DirRead, Data: "\"ACME\",\"X1\""},
+		{Line: 3, Dir: DirRead, Data: "\"ACME\",\"X1\""},
+	}
+
+	if mismatches := Run(ctx, output, entries); len(mismatches) != 0 {
+		t.Errorf("Run got mismatches: %+v", mismatches)
+	}
+}
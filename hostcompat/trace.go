@@ -0,0 +1,159 @@
+package hostcompat
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// writeFuncs and readFuncs list the VISA calls whose buffer is captured as a
+// write or read entry. Other calls in a trace are skipped.
+var (
+	writeFuncs = []string{"viWrite", "viPrintf", "viVPrintf", "viBufWrite", "viWriteAsync"}
+	readFuncs  = []string{"viRead", "viScanf", "viVScanf", "viBufRead", "viReadAsync"}
+)
+
+// niCallLine matches a numbered call in an NI I/O Trace text export, e.g.
+// `12.  viWrite (TCPIP0::10.0.0.2::inst0::INSTR (0x00000001), "*IDN?.", 6 (0x6), 6 (0x6))`
+var niCallLine = regexp.MustCompile(`^\s*\d+\.\s+(vi\w+)\s*\((.*)\)\s*$`)
+
+// ParseNITrace reads the text export of an NI I/O Trace capture. Only the
+// buffer argument of write and read calls is kept. NI renders non-printable
+// bytes as '.', so a trailing '.' is taken to be the message terminator.
+func ParseNITrace(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		m := niCallLine.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+
+		dir, ok := callDirection(m[1])
+		if !ok {
+			continue
+		}
+
+		args := m[2]
+		first := strings.Index(args, "\"")
+		last := strings.LastIndex(args, "\"")
+		if first < 0 || last <= first {
+			return nil, fmt.Errorf("line %d: %s call without buffer argument", line, m[1])
+		}
+
+		data := unescapeTrace(args[first+1 : last])
+		if strings.HasSuffix(data, ".") {
+			data = data[:len(data)-1]
+		}
+		entries = append(entries, Entry{Line: line, Dir: dir, Data: data})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// ParseIOMonitor reads the CSV export of a Keysight IO Monitor capture. The
+// header row must name a "Function" column and a "Data" (or "Buffer") column;
+// other columns are ignored.
+func ParseIOMonitor(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading IO Monitor header: %w", err)
+	}
+
+	funcCol, dataCol := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "function":
+			funcCol = i
+		case "data", "buffer":
+			dataCol = i
+		}
+	}
+	if funcCol < 0 || dataCol < 0 {
+		return nil, fmt.Errorf("IO Monitor export needs Function and Data columns")
+	}
+
+	var entries []Entry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if funcCol >= len(record) || dataCol >= len(record) {
+			continue
+		}
+
+		dir, ok := callDirection(strings.TrimSpace(record[funcCol]))
+		if !ok {
+			continue
+		}
+
+		line, _ := reader.FieldPos(dataCol)
+		entries = append(entries, Entry{Line: line, Dir: dir, Data: unescapeTrace(record[dataCol])})
+	}
+
+	return entries, nil
+}
+
+// callDirection classifies a VISA function name as a write or a read
+func callDirection(name string) (Direction, bool) {
+	for _, f := range writeFuncs {
+		if strings.EqualFold(name, f) {
+			return DirWrite, true
+		}
+	}
+	for _, f := range readFuncs {
+		if strings.EqualFold(name, f) {
+			return DirRead, true
+		}
+	}
+	return 0, false
+}
+
+// unescapeTrace decodes the backslash escapes trace tools use for control
+// characters (\n, \r, \t and \\)
+func unescapeTrace(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
@@ -48,6 +48,27 @@ func isHexDigit(c byte) bool {
 	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
 }
 
+// skipProgramData advances to the ';' or newline ending the program data of
+// a command. Strings and arbitrary blocks are skipped whole, so a ';' inside
+// them does not end the command.
+func (l *lexState) skipProgramData() {
+	for !l.isEOS() {
+		switch l.peek() {
+		case ';', '\n', '\r':
+			return
+		case '"', '\'':
+			if _, n := l.lexStringProgramData(); n > 0 {
+				continue
+			}
+		case '#':
+			if _, n := l.lexArbitraryBlock(); n > 0 {
+				continue
+			}
+		}
+		l.advance(1)
+	}
+}
+
 // lexWhitespace consumes whitespace characters
 func (l *lexState) lexWhitespace() (Token, int) {
 	start := l.pos
@@ -453,25 +474,47 @@ func (l *lexState) lexProgramExpression() (Token, int) {
 	return Token{Type: TokenUnknown}, 0
 }
 
-// lexSuffixProgramData parses unit suffixes
+// lexSuffixProgramData parses unit suffixes per IEEE 488.2 7.7.3.
+// A suffix is an optional leading '/' followed by one or more unit elements
+// separated by '/' or '.', where each element is a run of letters (multiplier
+// and unit) with an optional exponent, e.g. "MV", "V/S", "M2", "/S" or "A.S-1".
 func (l *lexState) lexSuffixProgramData() (Token, int) {
 	start := l.pos
 
-	if !isAlpha(l.peek()) {
-		return Token{Type: TokenUnknown}, 0
-	}
-
-	for !l.isEOS() && isAlpha(l.peek()) {
+	if l.peek() == '/' {
 		l.advance(1)
 	}
 
-	if l.pos > start {
-		return Token{
-			Type: TokenSuffixProgramData,
-			Data: l.buffer[start:l.pos],
-			Pos:  start,
-		}, l.pos - start
+	for {
+		if !isAlpha(l.peek()) {
+			l.pos = start
+			return Token{Type: TokenUnknown}, 0
+		}
+
+		for !l.isEOS() && isAlpha(l.peek()) {
+			l.advance(1)
+		}
+
+		// Optional exponent, possibly negative
+		if l.peek() == '-' && l.pos+1 < l.len && isDigit(l.buffer[l.pos+1]) {
+			l.advance(1)
+		}
+		for !l.isEOS() && isDigit(l.peek()) {
+			l.advance(1)
+		}
+
+		// Another element follows only if a separator is directly followed by a letter
+		if (l.peek() == '/' || l.peek() == '.') && l.pos+1 < l.len && isAlpha(l.buffer[l.pos+1]) {
+			l.advance(1)
+			continue
+		}
+
+		break
 	}
 
-	return Token{Type: TokenUnknown}, 0
+	return Token{
+		Type: TokenSuffixProgramData,
+		Data: l.buffer[start:l.pos],
+		Pos:  start,
+	}, l.pos - start
 }
@@ -0,0 +1,198 @@
+package scpi
+
+import "strings"
+
+// commandTable is a snapshot of the registered commands and the index built
+// from them. It is never modified; AddCommand and RemoveCommand replace it
+// as a whole, so Parse can run concurrently with them.
+type commandTable struct {
+	commands  []*Command
+	tree      *commandNode
+	wildcards []int // Indices of the wildcard patterns, tried last
+	depth     int   // Depth of the deepest pattern or alias
+}
+
+// newCommandTable indexes commands
+func newCommandTable(commands []*Command) *commandTable {
+	t := &commandTable{commands: commands}
+	t.tree, t.wildcards = buildCommandTree(commands)
+	for _, cmd := range commands {
+		t.depth = max(t.depth, headerDepth(cmd.Pattern))
+		for _, alias := range cmd.Aliases {
+			t.depth = max(t.depth, headerDepth(alias))
+		}
+	}
+	return t
+}
+
+// AddCommand registers cmd after the commands already registered, returning
+// a *PatternError if one of its patterns is malformed. It may be called
+// from any goroutine while the parser is running, e.g. by plug-in modules;
+// messages parsed afterwards can use it.
+func (c *Context) AddCommand(cmd *Command) error {
+	for _, pattern := range append([]string{cmd.Pattern}, cmd.Aliases...) {
+		if reason := checkPattern(pattern); reason != "" {
+			return &PatternError{Pattern: pattern, Reason: reason}
+		}
+	}
+
+	c.tableMu.Lock()
+	defer c.tableMu.Unlock()
+	old := c.table.Load().commands
+	commands := append(old[:len(old):len(old)], cmd)
+	c.table.Store(newCommandTable(commands))
+	return nil
+}
+
+// RemoveCommand unregisters the commands registered with exactly the given
+// pattern, reporting whether there were any. Like AddCommand it may be
+// called while the parser is running; a callback already running finishes.
+func (c *Context) RemoveCommand(pattern string) bool {
+	c.tableMu.Lock()
+	defer c.tableMu.Unlock()
+
+	old := c.table.Load().commands
+	commands := make([]*Command, 0, len(old))
+	for _, cmd := range old {
+		if cmd.Pattern != pattern {
+			commands = append(commands, cmd)
+		}
+	}
+	if len(commands) == len(old) {
+		return false
+	}
+	c.table.Store(newCommandTable(commands))
+	return true
+}
+
+// commandNode is a node of the command tree findCommand dispatches with.
+// Each header node is looked up by its upper-case short or long form, so
+// dispatch costs a map lookup per node instead of matching every pattern.
+// A key can lead to several children, e.g. "ABC" to both ABC and ABCdef.
+type commandNode struct {
+	long     string                    // Upper-case long form of the pattern node
+	exact    map[string][]*commandNode // Children keyed by short and long form
+	suffixed map[string][]*commandNode // Children taking a numeric suffix, keyed without it
+	literal  map[string]*commandNode   // Children of =NODE pattern nodes, keyed case-sensitively
+	cmds     []int                     // Indices into Context.commands ending here
+}
+
+// buildCommandTree indexes every optional-node variant of every pattern and
+// alias, and returns the indices of the wildcard patterns separately
+func buildCommandTree(commands []*Command) (*commandNode, []int) {
+	root := &commandNode{}
+	var wildcards []int
+	for i, cmd := range commands {
+		if isWildcard(cmd.Pattern) {
+			wildcards = append(wildcards, i)
+			continue
+		}
+		root.add(cmd.Pattern, i)
+		for _, alias := range cmd.Aliases {
+			root.add(alias, i)
+		}
+	}
+	return root, wildcards
+}
+
+// add indexes every optional-node variant of pattern as command i
+func (n *commandNode) add(pattern string, i int) {
+	pattern, _ = suffixDefaults(strings.TrimSuffix(pattern, "?"))
+	for _, variant := range patternVariants(pattern) {
+		node := n
+		for _, part := range strings.Split(strings.TrimPrefix(variant, ":"), ":") {
+			node = node.child(part)
+		}
+		node.cmds = append(node.cmds, i)
+	}
+}
+
+// child returns the child for pattern node part, adding it if needed. As in
+// matchPattern, the short form ends at the first lower-case letter; a
+// literal node such as "=FWupd" has no short form and keeps its case.
+func (n *commandNode) child(part string) *commandNode {
+	if literal, ok := strings.CutPrefix(part, "="); ok {
+		if n.literal == nil {
+			n.literal = make(map[string]*commandNode)
+		}
+		if n.literal[literal] == nil {
+			n.literal[literal] = &commandNode{long: part}
+		}
+		return n.literal[literal]
+	}
+	children := &n.exact
+	if strings.Contains(part, "#") {
+		part = strings.ReplaceAll(part, "#", "")
+		children = &n.suffixed
+	}
+	if *children == nil {
+		*children = make(map[string][]*commandNode)
+	}
+
+	long := strings.ToUpper(part)
+	for _, child := range (*children)[long] {
+		if child.long == long {
+			return child
+		}
+	}
+	child := &commandNode{long: long}
+	(*children)[long] = append((*children)[long], child)
+	if short := strings.IndexFunc(part, func(r rune) bool { return r >= 'a' && r <= 'z' }); short >= 0 {
+		(*children)[long[:short]] = append((*children)[long[:short]], child)
+	}
+	return child
+}
+
+// lookup appends to found the indices of the commands matching the header
+// nodes parts
+func (n *commandNode) lookup(parts []string, found []int) []int {
+	if len(parts) == 0 {
+		return append(found, n.cmds...)
+	}
+	if child := n.literal[parts[0]]; child != nil {
+		found = child.lookup(parts[1:], found)
+	}
+	part := strings.ToUpper(parts[0])
+	for _, child := range n.exact[part] {
+		found = child.lookup(parts[1:], found)
+	}
+	for _, child := range n.suffixed[strings.TrimRight(part, "0123456789")] {
+		found = child.lookup(parts[1:], found)
+	}
+	return found
+}
+
+// isWildcard reports whether pattern catches a whole subtree, e.g.
+// "SYSTem:COMMunicate:*"
+func isWildcard(pattern string) bool {
+	return strings.HasSuffix(pattern, ":*") && len(pattern) > 2
+}
+
+// findWildcard returns the wildcard command whose prefix matches the most
+// leading nodes of the header nodes parts, leaving at least one unmatched.
+// Of equally specific ones the first registered wins.
+func (t *commandTable) findWildcard(parts []string) *Command {
+	var found *Command
+	depth := 0
+	for _, i := range t.wildcards {
+		cmd := t.commands[i]
+		prefix, _ := suffixDefaults(strings.TrimSuffix(cmd.Pattern, ":*"))
+		for _, variant := range patternVariants(prefix) {
+			d := strings.Count(strings.TrimPrefix(variant, ":"), ":") + 1
+			if d < len(parts) && d > depth && matchCommandParts(variant, strings.Join(parts[:d], ":")) {
+				found, depth = cmd, d
+			}
+		}
+	}
+	return found
+}
+
+// UnmatchedHeader returns the header a wildcard command such as
+// "SYSTem:COMMunicate:*" caught, e.g. "SYST:COMM:SER:BAUD?", so bridges can
+// forward it. It returns "" when the current command matched its pattern.
+func (c *Context) UnmatchedHeader() string {
+	if c.currentCmd == nil || !isWildcard(c.currentCmd.Pattern) {
+		return ""
+	}
+	return c.currentHeader
+}
@@ -0,0 +1,181 @@
+package scpi
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxMacroDepth bounds nested macro expansion, catching macros that invoke
+// themselves directly or through others
+const maxMacroDepth = 16
+
+// macro is a definition made with *DMC
+type macro struct {
+	label string // As defined, e.g. "SETup"
+	def   []byte // Program message units, with $1..$9 for parameters
+}
+
+// runMacro expands m with the parameters params and executes it as part of
+// the current program message
+func (c *Context) runMacro(m macro, params []byte, depth int) error {
+	if depth >= maxMacroDepth {
+		return c.fail(NewError(CodeMacroRecursionError), "macro %s nested too deeply", m.label)
+	}
+	args := splitMacroParams(params)
+
+	var sb strings.Builder
+	def := m.def
+	for i := 0; i < len(def); i++ {
+		if def[i] == '$' && i+1 < len(def) && def[i+1] >= '1' && def[i+1] <= '9' {
+			n := int(def[i+1] - '1')
+			if n >= len(args) {
+				return c.fail(detailError(CodeMacroParameterError, "$%d", n+1), "macro %s: missing parameter $%d", m.label, n+1)
+			}
+			sb.WriteString(args[n])
+			i++
+			continue
+		}
+		sb.WriteByte(def[i])
+	}
+	return c.execute([]byte(sb.String()), depth+1)
+}
+
+// splitMacroParams splits the parameters of a macro invocation at the
+// commas outside strings and expressions
+func splitMacroParams(params []byte) []string {
+	s := strings.TrimSpace(string(params))
+	if s == "" {
+		return nil
+	}
+	var args []string
+	var quote byte
+	nesting, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case quote != 0:
+			if b == quote {
+				quote = 0
+			}
+		case b == '"' || b == '\'':
+			quote = b
+		case b == '(':
+			nesting++
+		case b == ')':
+			nesting--
+		case b == ',' && nesting == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+// validMacroLabel reports whether label is a single program header
+func validMacroLabel(label string) bool {
+	state := &lexState{buffer: []byte(label), len: len(label)}
+	tok, length := state.lexProgramHeader()
+	return length == len(label) && tok.Type != TokenUnknown
+}
+
+// CoreDmc implements *DMC <label>,<block>, defining a macro and enabling
+// macro expansion. A label already defined is rejected with -277; one that
+// is not a program header, or names a registered common command, with -273.
+func CoreDmc(ctx *Context) Result {
+	label, err := ctx.ParamString(true)
+	if err != nil {
+		return ResErr
+	}
+	def, err := ctx.ParamArbitraryBlock(true)
+	if err != nil {
+		return ResErr
+	}
+
+	key := strings.ToUpper(label)
+	if !validMacroLabel(label) || strings.HasPrefix(label, "*") && ctx.findCommand(label) != nil {
+		ctx.ErrorPush(NewError(CodeIllegalMacroLabel))
+		return ResErr
+	}
+	if _, ok := ctx.macros[key]; ok {
+		ctx.ErrorPush(NewError(CodeMacroRedefinitionNotAllowed))
+		return ResErr
+	}
+	if ctx.macros == nil {
+		ctx.macros = make(map[string]macro)
+	}
+	ctx.macros[key] = macro{label: label, def: append([]byte(nil), def...)}
+	ctx.macrosOn = true
+	return ResOK
+}
+
+// CoreEmc implements *EMC <NRf>, enabling macro expansion for a non-zero
+// value. Definitions are kept while expansion is disabled.
+func CoreEmc(ctx *Context) Result {
+	on, err := ctx.ParamInt32(true)
+	if err != nil {
+		return ResErr
+	}
+	ctx.macrosOn = on != 0
+	return ResOK
+}
+
+// CoreEmcQ implements *EMC?
+func CoreEmcQ(ctx *Context) Result {
+	ctx.ResultBool(ctx.macrosOn)
+	return ResOK
+}
+
+// CoreGmcQ implements *GMC? <label>, answering the definition as a
+// definite-length block, or -278 for an undefined label
+func CoreGmcQ(ctx *Context) Result {
+	label, err := ctx.ParamString(true)
+	if err != nil {
+		return ResErr
+	}
+	m, ok := ctx.macros[strings.ToUpper(label)]
+	if !ok {
+		ctx.ErrorPush(NewError(CodeMacroHeaderNotFound))
+		return ResErr
+	}
+	ctx.ResultArbitraryBlock(m.def)
+	return ResOK
+}
+
+// CoreLmcQ implements *LMC?, answering the macro labels as strings in
+// alphabetical order, or "" when none is defined
+func CoreLmcQ(ctx *Context) Result {
+	if len(ctx.macros) == 0 {
+		ctx.ResultText("")
+		return ResOK
+	}
+	labels := make([]string, 0, len(ctx.macros))
+	for _, m := range ctx.macros {
+		labels = append(labels, m.label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		ctx.ResultText(label)
+	}
+	return ResOK
+}
+
+// CorePmc implements *PMC, deleting all macros
+func CorePmc(ctx *Context) Result {
+	clear(ctx.macros)
+	return ResOK
+}
+
+// CoreRmc implements *RMC <label>, deleting one macro, or -278 for an
+// undefined label
+func CoreRmc(ctx *Context) Result {
+	label, err := ctx.ParamString(true)
+	if err != nil {
+		return ResErr
+	}
+	key := strings.ToUpper(label)
+	if _, ok := ctx.macros[key]; !ok {
+		ctx.ErrorPush(NewError(CodeMacroHeaderNotFound))
+		return ResErr
+	}
+	delete(ctx.macros, key)
+	return ResOK
+}
@@ -0,0 +1,192 @@
+package scpi
+
+// OperationBit is a bit of the STATus:OPERation condition register, as
+// assigned by SCPI-99
+type OperationBit uint16
+
+const (
+	OperCalibrating  OperationBit = 1 << 0
+	OperSettling     OperationBit = 1 << 1
+	OperRanging      OperationBit = 1 << 2
+	OperSweeping     OperationBit = 1 << 3
+	OperMeasuring    OperationBit = 1 << 4
+	OperWaitTrigger  OperationBit = 1 << 5
+	OperWaitArm      OperationBit = 1 << 6
+	OperCorrecting   OperationBit = 1 << 7
+	OperInstrSummary OperationBit = 1 << 13
+	OperProgram      OperationBit = 1 << 14
+)
+
+// OperationStart marks an overlapped operation as pending and sets bits in
+// the OPERation condition register (OperationStatus) until the matching
+// OperationComplete. *OPC? and *WAI wait for all pending operations. It may
+// be called from any goroutine.
+func (c *Context) OperationStart(bits OperationBit) {
+	c.opMu.Lock()
+	if c.opPending == 0 {
+		c.opIdle = make(chan struct{})
+	}
+	c.opPending++
+	var changed OperationBit
+	for i := range c.opBits {
+		if bits&(1<<i) != 0 {
+			c.opBits[i]++
+			if c.opBits[i] == 1 {
+				changed |= 1 << i
+			}
+		}
+	}
+	c.opMu.Unlock()
+
+	c.syncOperation(changed)
+}
+
+// OperationComplete ends an operation begun with OperationStart with the
+// same bits. When the last pending operation completes, *WAI and *OPC?
+// return and a preceding *OPC sets the OPC bit of the standard event status
+// register. Calls without a pending operation are ignored.
+func (c *Context) OperationComplete(bits OperationBit) {
+	c.opMu.Lock()
+	if c.opPending == 0 {
+		c.opMu.Unlock()
+		return
+	}
+	var changed OperationBit
+	for i := range c.opBits {
+		if bits&(1<<i) != 0 && c.opBits[i] > 0 {
+			c.opBits[i]--
+			if c.opBits[i] == 0 {
+				changed |= 1 << i
+			}
+		}
+	}
+	c.opPending--
+	opc := false
+	if c.opPending == 0 {
+		close(c.opIdle)
+		opc, c.opcArmed = c.opcArmed, false
+	}
+	c.opMu.Unlock()
+
+	c.syncOperation(changed)
+	if opc {
+		c.RegSet(RegESR, EsrOPC)
+	}
+}
+
+// syncOperation updates the changed bits of the OPERation condition
+// register from the pending operations. It runs without opMu held, as the
+// update may call OnSRQ; the bits are read under statusMu, so concurrent
+// calls leave the register matching the last state.
+func (c *Context) syncOperation(changed OperationBit) {
+	if changed == 0 {
+		return
+	}
+	c.statusMu.Lock()
+	defer c.statusUnlock()
+	r := c.operStatus
+	r.setCondition(r.cond&^uint16(changed) | uint16(c.OperationCondition()&changed))
+}
+
+// RunOverlapped runs fn in its own goroutine as a pending operation with
+// bits set, e.g. for INITiate or a LIST sweep, and returns immediately
+func (c *Context) RunOverlapped(bits OperationBit, fn func()) {
+	c.OperationStart(bits)
+	go func() {
+		defer c.OperationComplete(bits)
+		fn()
+	}()
+}
+
+// OperationCondition returns the OPERation condition register: the bits of
+// all pending operations
+func (c *Context) OperationCondition() OperationBit {
+	c.opMu.Lock()
+	defer c.opMu.Unlock()
+
+	var cond OperationBit
+	for i, n := range c.opBits {
+		if n > 0 {
+			cond |= 1 << i
+		}
+	}
+	return cond
+}
+
+// OperationsPending returns the number of pending operations
+func (c *Context) OperationsPending() int {
+	c.opMu.Lock()
+	defer c.opMu.Unlock()
+	return c.opPending
+}
+
+// OperationsIdle returns a channel that is closed once no operation is
+// pending, which it already is when none was started
+func (c *Context) OperationsIdle() <-chan struct{} {
+	c.opMu.Lock()
+	defer c.opMu.Unlock()
+
+	if c.opPending == 0 {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+	return c.opIdle
+}
+
+// waitOperations blocks until no operation is pending or Abort is called,
+// reporting whether all operations completed
+func (c *Context) waitOperations() bool {
+	select {
+	case <-c.OperationsIdle():
+		return true
+	case <-c.Aborted():
+		return false
+	}
+}
+
+// CoreWai implements *WAI, waiting for pending operations to complete
+func CoreWai(ctx *Context) Result {
+	if !ctx.waitOperations() {
+		return ResErr
+	}
+	return ResOK
+}
+
+// CoreOpc implements *OPC, setting the OPC bit of the standard event status
+// register once the pending operations complete. *CLS and a device clear
+// cancel the wait.
+func CoreOpc(ctx *Context) Result {
+	ctx.opMu.Lock()
+	pending := ctx.opPending > 0
+	ctx.opcArmed = pending
+	ctx.opMu.Unlock()
+
+	if !pending {
+		ctx.RegSet(RegESR, EsrOPC)
+	}
+	return ResOK
+}
+
+// cancelOpc returns to the operation complete command idle state
+func (c *Context) cancelOpc() {
+	c.opMu.Lock()
+	c.opcArmed = false
+	c.opMu.Unlock()
+}
+
+// CoreOpcQ implements *OPC?, answering 1 once pending operations complete
+func CoreOpcQ(ctx *Context) Result {
+	if !ctx.waitOperations() {
+		return ResErr
+	}
+	ctx.ResultInt32(1)
+	return ResOK
+}
+
+// StatusOperationConditionQ implements STATus:OPERation:CONDition?, which
+// includes the bits of pending operations and any set by the application
+func StatusOperationConditionQ(ctx *Context) Result {
+	ctx.ResultInt32(int32(ctx.operStatus.Condition()))
+	return ResOK
+}
@@ -0,0 +1,66 @@
+package scpi
+
+// SetOutputQueue switches the output queue on or off. While it is on,
+// response messages are held by the Context instead of being written
+// through Interface.Write, for transports on which the controller requests
+// each response (GPIB, VXI-11, USBTMC), and the MAV bit of the status byte
+// is set while the queue holds unread data. Switching it off discards
+// queued data.
+func (c *Context) SetOutputQueue(on bool) {
+	c.outMu.Lock()
+	c.outQueueOn = on
+	c.outMu.Unlock()
+	if !on {
+		c.clearOutput()
+	}
+}
+
+// ReadOutput removes and returns up to size bytes of queued response data,
+// or all of it if size is not positive. MAV is cleared once the queue is
+// drained. It may be called from any goroutine.
+func (c *Context) ReadOutput(size int) []byte {
+	c.outMu.Lock()
+	n := len(c.outQueue)
+	if size > 0 && size < n {
+		n = size
+	}
+	data := append([]byte(nil), c.outQueue[:n]...)
+	c.outQueue = c.outQueue[n:]
+	empty := len(c.outQueue) == 0
+	c.outMu.Unlock()
+
+	if empty {
+		c.RegClear(RegSTB, StbMAV)
+	}
+	return data
+}
+
+// OutputPending returns the number of queued response bytes not yet read
+func (c *Context) OutputPending() int {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	return len(c.outQueue)
+}
+
+// queueOutput appends data to the output queue and sets MAV, reporting
+// whether the queue is on
+func (c *Context) queueOutput(data []byte) bool {
+	c.outMu.Lock()
+	if !c.outQueueOn {
+		c.outMu.Unlock()
+		return false
+	}
+	c.outQueue = append(c.outQueue, data...)
+	c.outMu.Unlock()
+
+	c.RegSet(RegSTB, StbMAV)
+	return true
+}
+
+// clearOutput discards the queued response data and clears MAV
+func (c *Context) clearOutput() {
+	c.outMu.Lock()
+	c.outQueue = nil
+	c.outMu.Unlock()
+	c.RegClear(RegSTB, StbMAV)
+}
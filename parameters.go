@@ -1,7 +1,9 @@
 package scpi
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -16,12 +18,12 @@ func (c *Context) Parameter(mandatory bool) (*Parameter, error) {
 
 	// Skip whitespace
 	state.lexWhitespace()
+	c.paramAt = state.pos
 
 	// Check if we're at the end
 	if state.isEOS() {
 		if mandatory {
-			c.ErrorPush(&Error{Code: -109, Info: "Missing parameter"})
-			return nil, fmt.Errorf("missing parameter")
+			return nil, c.fail(NewError(CodeMissingParameter), "missing parameter")
 		}
 		return &Parameter{Type: TokenUnknown}, nil
 	}
@@ -30,23 +32,49 @@ func (c *Context) Parameter(mandatory bool) (*Parameter, error) {
 	if c.inputCount > 0 {
 		tok, _ := state.lexComma()
 		if tok.Type != TokenComma {
-			c.ErrorPush(&Error{Code: -104, Info: "Invalid separator"})
-			return nil, fmt.Errorf("invalid separator")
+			return nil, c.fail(NewError(CodeInvalidSeparator), "invalid separator")
 		}
 		state.lexWhitespace()
+		c.paramAt = state.pos
 	}
 
 	c.inputCount++
 
 	// Parse program data
-	param := c.parseProgramData(state)
+	param := parseProgramData(state)
 	c.paramsPos = state.pos
 
+	// Data that no program data element accepts must not read as an absent
+	// parameter. IEEE 488.2 non-decimal numerics carry no sign, so "-#HFF"
+	// lands here too rather than being negated.
+	if param.Type == TokenUnknown {
+		if b := state.peek(); (b == '+' || b == '-') && state.pos+1 < state.len && state.buffer[state.pos+1] == '#' {
+			return nil, c.fail(NewError(CodeDataTypeError), "sign not allowed on non-decimal numeric")
+		}
+		return nil, c.fail(NewError(CodeDataTypeError), "invalid program data")
+	}
+
+	// A number must end at a separator. Anything else, as in "1_000",
+	// "1.2.3" or "#HFG", would otherwise be left over as a bogus parameter.
+	if !numberEnds(param, state) {
+		return nil, c.fail(NewError(CodeInvalidCharacterInNumber), "invalid character %q in number", state.peek())
+	}
+
 	return param, nil
 }
 
+// numberEnds reports whether a numeric param just lexed from state is
+// followed by whitespace, a comma or the end of the parameters
+func numberEnds(param *Parameter, state *lexState) bool {
+	if k := param.Kind(); k != KindNumeric && k != KindNondecimalNumeric || state.isEOS() {
+		return true
+	}
+	b := state.peek()
+	return isWhitespace(b) || b == ','
+}
+
 // parseProgramData parses a single parameter value
-func (c *Context) parseProgramData(state *lexState) *Parameter {
+func parseProgramData(state *lexState) *Parameter {
 	// Try different token types
 
 	// Try nondecimal numeric (hex, octal, binary)
@@ -197,13 +225,11 @@ func (c *Context) ParamBool(mandatory bool) (bool, error) {
 		case "OFF", "0":
 			return false, nil
 		default:
-			c.ErrorPush(&Error{Code: -108, Info: "Invalid parameter value"})
-			return false, fmt.Errorf("invalid boolean value: %s", str)
+			return false, c.fail(NewError(CodeIllegalParameterValue), "invalid boolean value: %s", str)
 		}
 	}
 
-	c.ErrorPush(&Error{Code: -104, Info: "Data type error"})
-	return false, fmt.Errorf("invalid data type for boolean")
+	return false, c.fail(NewError(CodeDataTypeError), "invalid data type for boolean")
 }
 
 // ParamArbitraryBlock reads a mandatory or optional arbitrary block parameter.
@@ -219,30 +245,36 @@ func (c *Context) ParamArbitraryBlock(mandatory bool) ([]byte, error) {
 	}
 
 	if param.Type != TokenArbitraryBlock {
-		c.ErrorPush(&Error{Code: -104, Info: "Data type error"})
-		return nil, fmt.Errorf("expected arbitrary block data")
+		return nil, c.fail(NewError(CodeDataTypeError), "expected arbitrary block data")
 	}
 
-	data := param.Data
+	payload, ok := blockPayload(param.Data)
+	if !ok {
+		return nil, c.fail(NewError(CodeInvalidBlockData), "invalid arbitrary block format")
+	}
+
+	return payload, nil
+}
+
+// blockPayload strips the header from arbitrary block data
+func blockPayload(data []byte) ([]byte, bool) {
 	if len(data) < 2 || data[0] != '#' {
-		c.ErrorPush(&Error{Code: -104, Info: "Invalid arbitrary block"})
-		return nil, fmt.Errorf("invalid arbitrary block format")
+		return nil, false
 	}
 
 	n := int(data[1] - '0')
 	if n == 0 {
 		// Indefinite length: data is everything after #0
-		return data[2:], nil
+		return data[2:], true
 	}
 
 	// Definite length: skip #, n digit, and n length digits
 	headerLen := 2 + n
 	if len(data) < headerLen {
-		c.ErrorPush(&Error{Code: -104, Info: "Invalid arbitrary block"})
-		return nil, fmt.Errorf("invalid arbitrary block format")
+		return nil, false
 	}
 
-	return data[headerLen:], nil
+	return data[headerLen:], true
 }
 
 // ParamChannelList reads a channel list parameter and returns all parsed entries.
@@ -259,16 +291,14 @@ func (c *Context) ParamChannelList(mandatory bool) ([]ChannelListEntry, error) {
 	}
 
 	if param.Type != TokenProgramExpression {
-		c.ErrorPush(&Error{Code: -104, Info: "Data type error"})
-		return nil, fmt.Errorf("expected channel list expression")
+		return nil, c.fail(NewError(CodeDataTypeError), "expected channel list expression")
 	}
 
 	data := string(param.Data)
 
 	// Validate channel list format: (@...)
 	if len(data) < 3 || data[0] != '(' || data[1] != '@' || data[len(data)-1] != ')' {
-		c.ErrorPush(&Error{Code: -104, Info: "Invalid channel list"})
-		return nil, fmt.Errorf("invalid channel list format")
+		return nil, c.fail(NewError(CodeInvalidExpression), "invalid channel list format")
 	}
 
 	inner := strings.TrimSpace(data[2 : len(data)-1])
@@ -287,8 +317,7 @@ func (c *Context) ParamChannelList(mandatory bool) ([]ChannelListEntry, error) {
 
 		entry, parseErr := parseChannelListEntry(part)
 		if parseErr != nil {
-			c.ErrorPush(&Error{Code: -104, Info: "Invalid channel list entry"})
-			return nil, parseErr
+			return nil, c.fail(NewError(CodeInvalidExpression), "%w", parseErr)
 		}
 		entries = append(entries, entry)
 	}
@@ -361,8 +390,7 @@ func (c *Context) ParamChoice(choices []ChoiceDef, mandatory bool) (int32, error
 	}
 
 	if param.Type != TokenProgramMnemonic {
-		c.ErrorPush(&Error{Code: -104, Info: "Data type error"})
-		return 0, fmt.Errorf("expected mnemonic for choice")
+		return 0, c.fail(NewError(CodeDataTypeError), "expected mnemonic for choice")
 	}
 
 	value := string(param.Data)
@@ -372,133 +400,360 @@ func (c *Context) ParamChoice(choices []ChoiceDef, mandatory bool) (int32, error
 		}
 	}
 
-	c.ErrorPush(&Error{Code: -108, Info: "Invalid parameter value"})
-	return 0, fmt.Errorf("invalid choice: %s", value)
+	return 0, c.fail(NewError(CodeIllegalParameterValue), "invalid choice: %s", value)
 }
 
-// paramToInt32 converts a parameter to int32
-func (c *Context) paramToInt32(param *Parameter) (int32, error) {
+// ParamNumber reads a numeric parameter that may carry a unit suffix or be
+// one of the special values MINimum, MAXimum, DEFault, UP, DOWN, NAN,
+// INFinity, NINF or AUTO. Suffix multipliers are applied to Value; the
+// parsed unit is reported in Unit for simple suffixes and in Terms always.
+func (c *Context) ParamNumber(mandatory bool) (Number, error) {
+	param, err := c.Parameter(mandatory)
+	if err != nil {
+		return Number{}, err
+	}
+
 	switch param.Type {
-	case TokenHexNum:
-		// Skip #H prefix
-		val, err := strconv.ParseInt(string(param.Data[2:]), 16, 32)
-		return int32(val), err
+	case TokenUnknown:
+		return Number{}, nil
 
-	case TokenOctNum:
-		// Skip #Q prefix
-		val, err := strconv.ParseInt(string(param.Data[2:]), 8, 32)
-		return int32(val), err
+	case TokenProgramMnemonic:
+		value := string(param.Data)
+		for _, special := range specialNumbers {
+			if !matchPattern(special.Name, value) {
+				continue
+			}
+			num := Number{Special: true, Tag: special.Tag}
+			switch SpecialNumber(special.Tag) {
+			case NumNaN:
+				num.Value = math.NaN()
+			case NumInf:
+				num.Value = math.Inf(1)
+			case NumNInf:
+				num.Value = math.Inf(-1)
+			}
+			return num, nil
+		}
+		return Number{}, c.fail(NewError(CodeIllegalParameterValue), "invalid special number: %s", value)
 
-	case TokenBinNum:
-		// Skip #B prefix
-		val, err := strconv.ParseInt(string(param.Data[2:]), 2, 32)
-		return int32(val), err
+	case TokenHexNum, TokenOctNum, TokenBinNum:
+		val, err := c.paramToInt64(param)
+		if err != nil {
+			return Number{}, err
+		}
+		return Number{Value: float64(val), Base: int8(param.Base()), Mult: 1}, nil
 
 	case TokenDecimalNumeric, TokenDecimalNumericWithSuffix:
-		// Extract numeric part (before any suffix)
-		numStr := string(param.Data)
-		if param.Type == TokenDecimalNumericWithSuffix {
-			// Find where suffix starts
-			for i, c := range numStr {
-				if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' {
-					numStr = numStr[:i]
-					break
-				}
-			}
+		numStr, suffix := splitNumericSuffix(param)
+		val, err := strconv.ParseFloat(numStr, 64)
+		if err != nil {
+			return Number{}, err
 		}
-		numStr = strings.TrimSpace(numStr)
-		// Use integer parse for values without decimal point or exponent
-		// to avoid float32 precision loss (e.g. INT32_MAX rounds in float32)
-		if !strings.Contains(numStr, ".") && !strings.ContainsAny(numStr, "eE") {
-			val, err := strconv.ParseInt(numStr, 10, 32)
-			return int32(val), err
+
+		num := Number{Value: val, Base: 10, Mult: 1}
+		if suffix == "" {
+			return num, nil
 		}
-		val, err := strconv.ParseFloat(numStr, 64)
-		return int32(val), err
+
+		mult, terms, err := parseSuffix(suffix)
+		if err != nil {
+			return Number{}, c.fail(NewError(CodeInvalidSuffix), "%w", err)
+		}
+		num.Value *= mult
+		num.Mult = mult
+		num.Terms = terms
+		num.Suffix = suffix
+		if len(terms) == 1 && terms[0].Exp == 1 {
+			num.Unit = terms[0].Unit
+		}
+		return num, nil
 
 	default:
-		c.ErrorPush(&Error{Code: -104, Info: "Data type error"})
-		return 0, fmt.Errorf("cannot convert to int32")
+		return Number{}, c.fail(NewError(CodeDataTypeError), "invalid data type for number")
+	}
+}
+
+// ParamNumberWithUnits reads a numeric parameter like ParamNumber for a
+// handler working in the given units. A value without a suffix is taken to
+// be in the preferred unit (SetUnitPreference) of the quantity the units
+// measure. A level in a logarithmic unit with a reference registered through
+// SetLogReference is converted to the linear unit when that unit is listed
+// and the logarithmic one is not; otherwise it is returned tagged with its
+// logarithmic unit. Temperatures are converted to the context's
+// TemperatureUnit. RawValue and RawUnit keep the value as it was received.
+// A suffix that yields none of the units is rejected with -131 naming the
+// expected ones.
+func (c *Context) ParamNumberWithUnits(units []Unit, mandatory bool) (Number, error) {
+	num, err := c.ParamNumber(mandatory)
+	if err != nil || num.Special {
+		return num, err
+	}
+	num.RawValue = num.Value
+	num.RawUnit = num.Unit
+
+	if num.Terms != nil && len(units) > 0 && !acceptsUnit(units, num.Unit) {
+		return Number{}, c.fail(detailError(CodeInvalidSuffix, "%s, expected %s", num.Suffix, unitList(units)), "unit %s not in %s", num.Suffix, unitList(units))
+	}
+
+	if num.Terms == nil {
+		for _, u := range units {
+			if pref, ok := c.unitPrefs[quantityOf(u)]; ok {
+				num.Unit = pref
+				break
+			}
+		}
+	}
+
+	if isTemperature(num.Unit) {
+		to := c.TemperatureUnit()
+		num.Value = convertTemperature(num.Value, num.Unit, to)
+		num.Unit = to
+		num.Terms = []UnitTerm{{Unit: to, Exp: 1}}
+		return num, nil
+	}
+
+	ref, ok := c.logRefs[num.Unit]
+	if !ok || containsUnit(units, num.Unit) || !containsUnit(units, ref.Unit) {
+		return num, nil
+	}
+
+	num.Value = ref.toLinear(num.Value)
+	num.Unit = ref.Unit
+	num.Terms = []UnitTerm{{Unit: ref.Unit, Exp: 1}}
+	return num, nil
+}
+
+// acceptsUnit reports whether a value in unit can be handed to a handler
+// working in units, directly or through the conversions
+// ParamNumberWithUnits applies. Logarithmic levels are always accepted since
+// they are handed over tagged with their unit when they cannot be converted.
+func acceptsUnit(units []Unit, unit Unit) bool {
+	if _, ok := logUnits[unit]; ok || unit == UnitDecibel || containsUnit(units, unit) {
+		return true
+	}
+	if isTemperature(unit) {
+		for _, u := range units {
+			if isTemperature(u) {
+				return true
+			}
+		}
+		return false
 	}
+	return false
+}
+
+// containsUnit reports whether unit is listed in units
+func containsUnit(units []Unit, unit Unit) bool {
+	for _, u := range units {
+		if u == unit {
+			return true
+		}
+	}
+	return false
+}
+
+// paramToInt32 converts a parameter to int32. Values outside the int32
+// range, including non-decimal ones such as #HFFFFFFFF, are rejected with
+// -222 rather than wrapped.
+func (c *Context) paramToInt32(param *Parameter) (int32, error) {
+	val, err := c.paramToInt64(param)
+	if err != nil {
+		return 0, err
+	}
+	if val < math.MinInt32 || val > math.MaxInt32 {
+		return 0, c.fail(NewError(CodeDataOutOfRange), "value %d out of int32 range", val)
+	}
+	return int32(val), nil
 }
 
 // paramToInt64 converts a parameter to int64
 func (c *Context) paramToInt64(param *Parameter) (int64, error) {
+	if k := param.Kind(); k != KindNumeric && k != KindNondecimalNumeric {
+		return 0, c.fail(NewError(CodeDataTypeError), "cannot convert to int64")
+	}
+	val, err := param.AsInt()
+	if errors.Is(err, strconv.ErrRange) {
+		return val, c.fail(NewError(CodeDataOutOfRange), "%w", err)
+	}
+	return val, err
+}
+
+// paramToFloat64 converts a parameter to float64
+func (c *Context) paramToFloat64(param *Parameter) (float64, error) {
+	if k := param.Kind(); k != KindNumeric && k != KindNondecimalNumeric {
+		return 0, c.fail(NewError(CodeDataTypeError), "cannot convert to float64")
+	}
+	return param.AsFloat()
+}
+
+// splitNumericSuffix splits a decimal numeric parameter into its number and
+// suffix text. The suffix is empty when the parameter carries none.
+func splitNumericSuffix(param *Parameter) (string, string) {
+	state := &lexState{
+		buffer: param.Data,
+		pos:    0,
+		len:    len(param.Data),
+	}
+
+	_, length := state.lexDecimalNumeric()
+	numStr := string(param.Data[:length])
+	if param.Type != TokenDecimalNumericWithSuffix {
+		return numStr, ""
+	}
+
+	state.lexWhitespace()
+	return numStr, string(param.Data[state.pos:])
+}
+
+// paramToString converts a parameter to string
+func (c *Context) paramToString(param *Parameter) (string, error) {
 	switch param.Type {
+	case TokenSingleQuoteData, TokenDoubleQuoteData:
+		// Remove quotes and unescape
+		str := string(param.Data[1 : len(param.Data)-1])
+		quote := string(param.Data[0])
+		str = strings.ReplaceAll(str, quote+quote, quote)
+		return str, nil
+
+	case TokenProgramMnemonic:
+		return string(param.Data), nil
+
+	default:
+		return string(param.Data), nil
+	}
+}
+
+// Kind reports what sort of program data the parameter holds
+func (p *Parameter) Kind() ParamKind {
+	switch p.Type {
+	case TokenDecimalNumeric, TokenDecimalNumericWithSuffix:
+		return KindNumeric
+	case TokenHexNum, TokenOctNum, TokenBinNum:
+		return KindNondecimalNumeric
+	case TokenSingleQuoteData, TokenDoubleQuoteData:
+		return KindString
+	case TokenProgramMnemonic:
+		return KindMnemonic
+	case TokenArbitraryBlock:
+		return KindBlock
+	case TokenProgramExpression:
+		return KindExpression
+	case TokenUnknown:
+		if len(p.Data) == 0 {
+			return KindNone
+		}
+	}
+	return KindInvalid
+}
+
+// Base returns the radix a numeric parameter was sent in: 16, 8 or 2 for
+// #H, #Q and #B values, 10 for decimal ones and 0 for other kinds
+func (p *Parameter) Base() int {
+	switch p.Type {
 	case TokenHexNum:
-		return strconv.ParseInt(string(param.Data[2:]), 16, 64)
+		return 16
+	case TokenOctNum:
+		return 8
+	case TokenBinNum:
+		return 2
+	case TokenDecimalNumeric, TokenDecimalNumericWithSuffix:
+		return 10
+	}
+	return 0
+}
+
+// AsString returns the text of a string parameter with its quotes removed
+// and doubled quotes unescaped. Other kinds return their program data as is.
+func (p *Parameter) AsString() string {
+	if p.Kind() == KindString {
+		str := string(p.Data[1 : len(p.Data)-1])
+		quote := string(p.Data[0])
+		return strings.ReplaceAll(str, quote+quote, quote)
+	}
+	return string(p.Data)
+}
+
+// AsInt returns the value of a numeric parameter. Decimal values with a
+// fraction are truncated and any suffix is ignored.
+func (p *Parameter) AsInt() (int64, error) {
+	switch p.Type {
+	case TokenHexNum:
+		return strconv.ParseInt(string(p.Data[2:]), 16, 64)
 
 	case TokenOctNum:
-		return strconv.ParseInt(string(param.Data[2:]), 8, 64)
+		return strconv.ParseInt(string(p.Data[2:]), 8, 64)
 
 	case TokenBinNum:
-		return strconv.ParseInt(string(param.Data[2:]), 2, 64)
+		return strconv.ParseInt(string(p.Data[2:]), 2, 64)
 
 	case TokenDecimalNumeric, TokenDecimalNumericWithSuffix:
-		numStr := string(param.Data)
-		if param.Type == TokenDecimalNumericWithSuffix {
-			for i, c := range numStr {
-				if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' {
-					numStr = numStr[:i]
-					break
-				}
-			}
-		}
-		numStr = strings.TrimSpace(numStr)
+		numStr, _ := splitNumericSuffix(p)
 		// Use integer parse for values without decimal point or exponent
 		if !strings.Contains(numStr, ".") && !strings.ContainsAny(numStr, "eE") {
 			return strconv.ParseInt(numStr, 10, 64)
 		}
 		val, err := strconv.ParseFloat(numStr, 64)
-		return int64(val), err
+		if err != nil {
+			return 0, err
+		}
+		// float64(math.MaxInt64) rounds up to 2^63, itself out of range
+		if val < math.MinInt64 || val >= math.MaxInt64 {
+			return 0, &strconv.NumError{Func: "ParseInt", Num: numStr, Err: strconv.ErrRange}
+		}
+		return int64(val), nil
 
 	default:
-		c.ErrorPush(&Error{Code: -104, Info: "Data type error"})
 		return 0, fmt.Errorf("cannot convert to int64")
 	}
 }
 
-// paramToFloat64 converts a parameter to float64
-func (c *Context) paramToFloat64(param *Parameter) (float64, error) {
-	switch param.Type {
-	case TokenHexNum, TokenOctNum, TokenBinNum:
-		// Convert to int first
-		val, err := c.paramToInt64(param)
+// AsFloat returns the value of a numeric parameter. Any suffix is ignored;
+// use Context.ParamNumber to have suffix multipliers applied.
+func (p *Parameter) AsFloat() (float64, error) {
+	switch p.Kind() {
+	case KindNondecimalNumeric:
+		val, err := p.AsInt()
 		return float64(val), err
 
-	case TokenDecimalNumeric, TokenDecimalNumericWithSuffix:
-		numStr := string(param.Data)
-		if param.Type == TokenDecimalNumericWithSuffix {
-			for i, c := range numStr {
-				if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' {
-					numStr = numStr[:i]
-					break
-				}
-			}
-		}
-		numStr = strings.TrimSpace(numStr)
+	case KindNumeric:
+		numStr, _ := splitNumericSuffix(p)
 		return strconv.ParseFloat(numStr, 64)
 
 	default:
-		c.ErrorPush(&Error{Code: -104, Info: "Data type error"})
 		return 0, fmt.Errorf("cannot convert to float64")
 	}
 }
 
-// paramToString converts a parameter to string
-func (c *Context) paramToString(param *Parameter) (string, error) {
-	switch param.Type {
-	case TokenSingleQuoteData, TokenDoubleQuoteData:
-		// Remove quotes and unescape
-		str := string(param.Data[1 : len(param.Data)-1])
-		quote := string(param.Data[0])
-		str = strings.ReplaceAll(str, quote+quote, quote)
-		return str, nil
+// AsBool returns the value of a boolean parameter: ON/OFF or a number,
+// where any non-zero value is true
+func (p *Parameter) AsBool() (bool, error) {
+	switch p.Kind() {
+	case KindMnemonic:
+		switch strings.ToUpper(string(p.Data)) {
+		case "ON":
+			return true, nil
+		case "OFF":
+			return false, nil
+		}
+		return false, fmt.Errorf("invalid boolean value: %s", p.Data)
 
-	case TokenProgramMnemonic:
-		return string(param.Data), nil
+	case KindNumeric, KindNondecimalNumeric:
+		val, err := p.AsFloat()
+		return val != 0, err
 
 	default:
-		return string(param.Data), nil
+		return false, fmt.Errorf("invalid data type for boolean")
+	}
+}
+
+// AsBlock returns the payload of an arbitrary block parameter
+func (p *Parameter) AsBlock() ([]byte, error) {
+	if p.Kind() != KindBlock {
+		return nil, fmt.Errorf("expected arbitrary block data")
+	}
+	payload, ok := blockPayload(p.Data)
+	if !ok {
+		return nil, fmt.Errorf("invalid arbitrary block format")
 	}
+	return payload, nil
 }
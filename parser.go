@@ -1,21 +1,31 @@
 package scpi
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // NewContext creates a new SCPI parser context
 func NewContext(commands []*Command, iface *Interface, bufferSize int) *Context {
 	ctx := &Context{
-		commands:    commands,
 		iface:       iface,
 		inputBuffer: make([]byte, bufferSize),
 		bufferPos:   0,
-		errorQueue:  make([]*Error, 0, 10),
+		errorQueue:  make([]*Error, 0, defaultErrorQueueSize),
+		errorLimit:  defaultErrorQueueSize,
 		firstOutput: true,
+		errPos:      -1,
 	}
+	ctx.operStatus = newStatusRegister(ctx, "OPERation", nil, StbOperation)
+	ctx.quesStatus = newStatusRegister(ctx, "QUEStionable", nil, StbQuestionable)
+	ctx.statusRoots = []*StatusRegister{ctx.operStatus, ctx.quesStatus}
+	ctx.table.Store(newCommandTable(commands))
 	return ctx
 }
 
@@ -37,28 +47,70 @@ func (c *Context) GetUserContext() interface{} {
 	return c.userContext
 }
 
-// ErrorPush adds an error to the error queue
+// ErrorPush adds an error to the error queue, setting the error queue bit
+// of the status byte and the standard event status bit of its class. When
+// the queue is full its newest entry is replaced by -350 "Queue overflow",
+// unless SetErrorQueueDropOldest was called. Errors pushed while parsing
+// are given the header, position and phase they were found at; err
+// itself is not modified, so a shared *Error may be pushed.
 func (c *Context) ErrorPush(err *Error) {
-	if len(c.errorQueue) < cap(c.errorQueue) {
+	c.pushError(err)
+}
+
+// pushError queues a copy of err and returns the copy
+func (c *Context) pushError(err *Error) *Error {
+	e := *err
+	err = &e
+	if c.errPos >= 0 && err.Header == "" {
+		err.Header, err.Position = c.errHeader, c.errPos+c.paramAt
+		err.Phase = c.phase
+		if err.IsCommandError() {
+			// Command errors, e.g. of Param calls, are about the input
+			err.Phase = PhaseParse
+		}
+	}
+	switch {
+	case len(c.errorQueue) < c.errorLimit:
 		c.errorQueue = append(c.errorQueue, err)
-	} else {
-		// Queue full, remove oldest
+	case c.dropOldest:
 		c.errorQueue = append(c.errorQueue[1:], err)
+	default:
+		// Queue full: the newest entry becomes -350, once (SCPI-99 21.8.1)
+		c.errorQueue[len(c.errorQueue)-1] = NewError(CodeQueueOverflow)
 	}
 	c.cmdError = true
 
-	if c.iface != nil && c.iface.OnError != nil {
+	c.statusMu.Lock()
+	c.regWrite(RegESR, c.regs[RegESR]|errorEvent(err.Code))
+	c.regs[RegSTB] |= StbErrorQueue
+	c.statusUnlock()
+
+	if c.iface == nil {
+		return err
+	}
+	if c.iface.OnError != nil {
 		c.iface.OnError(err)
 	}
+	switch {
+	case err.Phase == PhaseParse && c.iface.OnParseError != nil:
+		c.iface.OnParseError(err)
+	case err.Phase == PhaseExecute && c.iface.OnCommandError != nil:
+		c.iface.OnCommandError(err)
+	}
+	return err
 }
 
-// ErrorPop removes and returns the oldest error
+// ErrorPop removes and returns the oldest error. The error queue bit of the
+// status byte is cleared once the queue is empty.
 func (c *Context) ErrorPop() *Error {
 	if len(c.errorQueue) == 0 {
 		return nil
 	}
 	err := c.errorQueue[0]
 	c.errorQueue = c.errorQueue[1:]
+	if len(c.errorQueue) == 0 {
+		c.RegClear(RegSTB, StbErrorQueue)
+	}
 	return err
 }
 
@@ -90,38 +142,78 @@ func matchPattern(pattern, value string) bool {
 	return false
 }
 
-// matchCommand checks if a command header matches a pattern
+// matchCommand checks if a command header matches a pattern. Each optional
+// node in brackets, e.g. "MEASure[:SCALar]:VOLTage[:DC]?", may be present or
+// omitted independently of the others. A node written "=NODE" only matches
+// NODE exactly, in the same case.
 func matchCommand(pattern, header string) bool {
 	// Remove trailing ? from both pattern and header for comparison
-	pattern = strings.TrimSuffix(pattern, "?")
+	pattern, _ = suffixDefaults(strings.TrimSuffix(pattern, "?"))
 	header = strings.TrimSuffix(header, "?")
 
-	// Remove optional parts from pattern (parts in brackets)
-	// For example, "VOLTage[:DC]" becomes "VOLTage" when matching without optional part
-	// We'll try matching with and without optional parts
-	patternWithoutOptional := pattern
-	if strings.Contains(pattern, "[") && strings.Contains(pattern, "]") {
-		beforeIdx := strings.Index(pattern, "[")
-		afterIdx := strings.Index(pattern, "]")
-		patternWithoutOptional = pattern[:beforeIdx] + pattern[afterIdx+1:]
+	for _, variant := range patternVariants(pattern) {
+		if matchCommandParts(variant, header) {
+			return true
+		}
 	}
+	return false
+}
 
-	// Try matching without optional part first
-	if matchCommandParts(patternWithoutOptional, header) {
-		return true
+// suffixDefaults rewrites default numeric suffixes such as "CHANnel[1]" into
+// numeric suffix positions ("CHANnel#") and returns the default of each #
+// in pattern order, -1 for a plain #
+func suffixDefaults(pattern string) (string, []int32) {
+	if !strings.Contains(pattern, "#") && !strings.Contains(pattern, "[") {
+		return pattern, nil
 	}
 
-	// Try matching with optional part included
-	if strings.Contains(pattern, "[") && strings.Contains(pattern, "]") {
-		// Remove brackets but keep the content
-		patternWithOptional := strings.ReplaceAll(pattern, "[", "")
-		patternWithOptional = strings.ReplaceAll(patternWithOptional, "]", "")
-		if matchCommandParts(patternWithOptional, header) {
-			return true
+	var sb strings.Builder
+	var defaults []int32
+	for i := 0; i < len(pattern); i++ {
+		b := pattern[i]
+		if b == '#' {
+			defaults = append(defaults, -1)
+		} else if b == '[' && i > 0 && isAlpha(pattern[i-1]) {
+			end := i + 1
+			for end < len(pattern) && isDigit(pattern[end]) {
+				end++
+			}
+			if end > i+1 && end < len(pattern) && pattern[end] == ']' {
+				n, _ := strconv.Atoi(pattern[i+1 : end])
+				defaults = append(defaults, int32(n))
+				sb.WriteByte('#')
+				i = end
+				continue
+			}
 		}
+		sb.WriteByte(b)
 	}
+	return sb.String(), defaults
+}
 
-	return false
+// patternVariants expands the optional nodes of pattern into every
+// combination of them being omitted or included, starting with all of them
+// omitted. Nested brackets are expanded the same way.
+func patternVariants(pattern string) []string {
+	open := strings.IndexByte(pattern, '[')
+	if open < 0 {
+		return []string{pattern}
+	}
+	depth := 0
+	for i := open; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				before, inner, after := pattern[:open], pattern[open+1:i], pattern[i+1:]
+				return append(patternVariants(before+after), patternVariants(before+inner+after)...)
+			}
+		}
+	}
+	// Unbalanced bracket: match it literally, as no header contains one
+	return []string{pattern}
 }
 
 // matchCommandParts matches command pattern parts against header parts
@@ -148,6 +240,14 @@ func matchCommandParts(pattern, header string) bool {
 		part := patternParts[i]
 		hdr := headerParts[i]
 
+		// Literal node (=NODE) - exact and case-sensitive, no short form
+		if literal, ok := strings.CutPrefix(part, "="); ok {
+			if hdr != literal {
+				return false
+			}
+			continue
+		}
+
 		// Handle numeric suffix (#) - only strip digits from header if pattern has #
 		if strings.Contains(part, "#") {
 			part = strings.Replace(part, "#", "", -1)
@@ -162,14 +262,69 @@ func matchCommandParts(pattern, header string) bool {
 	return true
 }
 
-// findCommand finds a command that matches the given header
+// headerDepth returns the number of ':'-separated nodes in a header or, with
+// optional nodes included, in a pattern
+func headerDepth(header string) int {
+	header = strings.TrimPrefix(strings.NewReplacer("[", "", "]", "").Replace(header), ":")
+	return strings.Count(header, ":") + 1
+}
+
+// SetMaxHeaderDepth limits the number of ':'-separated nodes accepted in a
+// header; deeper headers are rejected with -113 before any pattern matching.
+// The default of 0 limits headers to the depth of the deepest pattern, which
+// no deeper header could match anyway, except for headers in the subtree of
+// a wildcard pattern, which may be of any depth.
+func (c *Context) SetMaxHeaderDepth(depth int) {
+	c.maxDepth = depth
+}
+
+// headerTooDeep reports whether header exceeds the header depth limit
+func (c *Context) headerTooDeep(header string) bool {
+	if c.maxDepth > 0 {
+		return headerDepth(header) > c.maxDepth
+	}
+	t := c.table.Load()
+	if headerDepth(header) <= max(t.depth, c.aliasDepth) {
+		return false
+	}
+	return len(t.wildcards) == 0 || t.findWildcard(headerParts(header)) == nil
+}
+
+// headerParts splits a header into its nodes, without the query mark
+func headerParts(header string) []string {
+	return strings.Split(strings.TrimPrefix(strings.TrimSuffix(header, "?"), ":"), ":")
+}
+
+// findCommand finds a command that matches the given header. A pattern of
+// the same form (query or not) as the header is preferred, so "OUTPut" and
+// "OUTPut?" can be registered in either order; with SetStrictQueryForm it is
+// required. Wildcard patterns are only tried when nothing else matches.
 func (c *Context) findCommand(header string) *Command {
-	for _, cmd := range c.commands {
-		if matchCommand(cmd.Pattern, header) {
-			return cmd
+	isQuery := strings.HasSuffix(header, "?")
+	parts := headerParts(header)
+	t := c.table.Load()
+
+	// Of the matching commands the first registered wins
+	best, fallback := -1, -1
+	for _, i := range t.tree.lookup(parts, nil) {
+		if strings.HasSuffix(t.commands[i].Pattern, "?") == isQuery {
+			if best < 0 || i < best {
+				best = i
+			}
+		} else if fallback < 0 || i < fallback {
+			fallback = i
 		}
 	}
-	return nil
+	if best >= 0 {
+		return t.commands[best]
+	}
+	if fallback >= 0 && !c.strictForm {
+		return t.commands[fallback]
+	}
+	if cmd := c.findAlias(t, header); cmd != nil {
+		return cmd
+	}
+	return t.findWildcard(parts)
 }
 
 // composeCompoundCommand implements IEEE 488.2 compound command path inheritance.
@@ -199,111 +354,214 @@ func composeCompoundCommand(prev, current string) string {
 	return prev[:lastColon+1] + current
 }
 
-// Parse parses a complete SCPI command line
+// Parse parses a complete SCPI command line. The responses of the queries
+// in one program message are joined with ';' into a single response message
+// (IEEE 488.2 section 8.4.1), terminated once at the end of the program
+// message or when parsing stops at an error.
 func (c *Context) Parse(data []byte) error {
 	c.outputCount = 0
 	c.firstOutput = true
+	c.writeErr = nil
+	defer c.endResponse()
 
-	state := &lexState{
-		buffer: data,
-		pos:    0,
-		len:    len(data),
-	}
+	return c.execute(data, 0)
+}
 
-	var prevHeader string
+// unit is one program message unit of a message, as found by a walker
+type unit struct {
+	pos      int    // Position of the header
+	header   string // Header as sent, empty when it is malformed
+	path     string // Header with the compound path applied
+	params   []byte // Program data, from its first non-whitespace byte
+	paramPos int    // Position of params
+	first    bool   // Starts a program message
+	last     bool   // Ends its program message
+	code     int16  // Error found in the header; the walk stops there
+}
 
-	for !state.isEOS() {
-		// Skip whitespace
-		state.lexWhitespace()
+// walker steps through the program message units of a message, the framing
+// shared by execute and Validate
+type walker struct {
+	state    *lexState
+	prev     string // Path the next header inherits from (IEEE 488.2 section 7.2)
+	mnemonic bool   // Check the length of program mnemonics
+	newMsg   bool   // The next unit starts a program message
+}
 
+// newWalker returns a walker over data
+func newWalker(data []byte, checkMnemonic bool) *walker {
+	return &walker{
+		state:    &lexState{buffer: data, pos: 0, len: len(data)},
+		mnemonic: checkMnemonic,
+		newMsg:   true,
+	}
+}
+
+// next returns the next unit, or false at the end of the message. Bare
+// newlines are skipped as empty program messages.
+func (w *walker) next() (unit, bool) {
+	state := w.state
+	for {
+		state.lexWhitespace()
 		if state.isEOS() {
+			return unit{}, false
+		}
+		if b := state.peek(); b != '\n' && b != '\r' {
 			break
 		}
+		state.lexNewLine()
+		w.prev = ""
+	}
 
-		// Skip bare newlines/carriage returns (empty messages per IEEE 488.2)
-		if b := state.peek(); b == '\n' || b == '\r' {
-			state.lexNewLine()
-			prevHeader = ""
-			continue
+	u := unit{pos: state.pos, first: w.newMsg}
+	w.newMsg = false
+	header, length := state.lexProgramHeader()
+	if length == 0 || header.Type == TokenUnknown {
+		u.code = CodeCommandError
+		return u, true
+	}
+	u.header = string(header.Data)
+	if w.mnemonic && longMnemonic(u.header) != "" {
+		u.code = CodeProgramMnemonicTooLong
+		return u, true
+	}
+	u.path = composeCompoundCommand(w.prev, u.header)
+
+	state.lexWhitespace()
+	u.paramPos = state.pos
+	state.skipProgramData()
+	u.params = state.buffer[u.paramPos:state.pos]
+
+	// A semicolon lets the next header inherit the path
+	if tok, _ := state.lexSemicolon(); tok.Type == TokenSemicolon {
+		w.prev = u.path
+		return u, true
+	}
+	state.lexNewLine()
+	w.prev = ""
+	w.newMsg = true
+	u.last = true
+	return u, true
+}
+
+// execute runs the commands in data. Macro expansions run nested at depth
+// greater than 0, as part of the program message that invoked them.
+func (c *Context) execute(data []byte, depth int) error {
+	if depth == 0 {
+		defer func() { c.errPos, c.phase = -1, PhaseNone }()
+	}
+
+	w := newWalker(data, c.checkMnemonic)
+	for {
+		u, ok := w.next()
+		if !ok {
+			break
 		}
 
-		// Parse program header (command)
-		header, length := state.lexProgramHeader()
-		if length == 0 || header.Type == TokenUnknown {
-			// Invalid command
-			c.ErrorPush(&Error{Code: -100, Info: "Invalid command"})
-			return fmt.Errorf("invalid command at position %d", state.pos)
+		if depth == 0 && u.first {
+			c.messageID.Add(1)
+			c.msgStart = u.pos
 		}
 
-		// Compose compound command path (IEEE 488.2 section 7.2)
-		headerStr := composeCompoundCommand(prevHeader, string(header.Data))
+		c.locate(depth, u.header, u.pos)
+		switch u.code {
+		case CodeCommandError:
+			return c.fail(NewError(CodeCommandError), "invalid command at position %d", u.pos)
+		case CodeProgramMnemonicTooLong:
+			return c.fail(NewError(CodeProgramMnemonicTooLong), "program mnemonic too long at position %d", u.pos)
+		}
+
+		if c.macrosOn {
+			if m, ok := c.macros[strings.ToUpper(u.header)]; ok {
+				if err := c.runMacro(m, u.params, depth); err != nil {
+					return err
+				}
+				if u.last && depth == 0 {
+					c.endResponse()
+				}
+				w.prev = ""
+				continue
+			}
+		}
+
+		c.locate(depth, u.path, u.pos)
+		if c.headerTooDeep(u.path) {
+			return c.fail(NewError(CodeUndefinedHeader), "header too deep at position %d", u.pos)
+		}
 
 		// Find matching command
-		cmd := c.findCommand(headerStr)
+		cmd := c.findCommand(u.path)
 		if cmd == nil {
-			c.ErrorPush(&Error{Code: -113, Info: fmt.Sprintf("Undefined header: %s", headerStr)})
-			return fmt.Errorf("undefined header: %s", headerStr)
+			return c.fail(detailError(CodeUndefinedHeader, "%s", u.path), "undefined header: %s", u.path)
 		}
 
 		// Set current command
 		c.currentCmd = cmd
-		c.currentHeader = headerStr
+		c.currentHeader = u.path
 		c.cmdError = false
 		c.inputCount = 0
+		c.outputCount = 0
 
-		// Skip whitespace before parameters
-		state.lexWhitespace()
-
-		// Store parameter data position
-		paramStart := state.pos
-
-		// Skip to end of command (semicolon or newline)
-		for !state.isEOS() {
-			ch := state.peek()
-			if ch == ';' || ch == '\n' || ch == '\r' {
-				break
-			}
-			state.advance(1)
-		}
-
-		paramEnd := state.pos
-		c.currentParams = data[paramStart:paramEnd]
+		c.locate(depth, u.path, u.paramPos)
+		c.currentParams = u.params
 		c.paramsPos = 0
 
 		// Execute command callback
-		if cmd.Callback != nil {
-			result := cmd.Callback(c)
+		callback := cmd.Callback
+		if c.simulate && cmd.Simulate != nil {
+			callback = cmd.Simulate
+		}
+		if cmd.Params != nil && !c.readArgs(cmd) {
+			callback = nil
+		}
+		if callback != nil {
+			c.phase = PhaseExecute
+			result := callback(c)
 			if result != ResOK {
 				if !c.cmdError {
-					c.ErrorPush(&Error{Code: -200, Info: "Execution error"})
+					c.ErrorPush(NewError(CodeExecutionError))
 				}
+			} else if c.checkTrailing && cmd.Params == nil && !c.cmdError && c.hasUnreadParams() {
+				c.ErrorPush(NewError(CodeParameterNotAllowed))
 			}
 		}
-
-		// Skip terminator
-		if !state.isEOS() {
-			tok, _ := state.lexSemicolon()
-			if tok.Type == TokenSemicolon {
-				// Semicolon: next command inherits path context
-				prevHeader = headerStr
-			} else {
-				state.lexNewLine()
-				prevHeader = ""
-			}
-		} else {
-			prevHeader = ""
+		if c.writeErr != nil {
+			// The transport failed: the rest of the message is not executed
+			return c.writeErr
 		}
 
-		// Write output newline if needed
-		if !c.firstOutput {
-			c.writeNewLine()
+		if u.last && depth == 0 {
+			c.endResponse()
 		}
 	}
 
-	return nil
+	return c.writeErr
+}
+
+// locate records where the errors pushed next are found: while parsing the
+// header at pos of the program message, or its parameters starting there.
+// Errors in macro expansions keep the location of the macro invocation.
+func (c *Context) locate(depth int, header string, pos int) {
+	if depth > 0 {
+		return
+	}
+	c.errHeader, c.errPos = header, pos-c.msgStart
+	c.paramAt = 0
+	c.phase = PhaseParse
+}
+
+// endResponse terminates the response message if anything was written
+func (c *Context) endResponse() {
+	if !c.firstOutput && c.writeErr == nil {
+		c.writeNewLine()
+		c.firstOutput = true
+	}
 }
 
-// Input processes incoming data and parses complete command lines
+// Input processes incoming data and parses complete command lines. An
+// error only discards the line it occurred in: the following lines are
+// still parsed, and the first error is returned. A line overflowing the
+// input buffer is discarded up to its terminator.
 func (c *Context) Input(data []byte) error {
 	if len(data) == 0 {
 		// Parse what we have in buffer
@@ -315,31 +573,174 @@ func (c *Context) Input(data []byte) error {
 		return nil
 	}
 
-	// Add data to buffer
-	for _, b := range data {
-		if c.bufferPos >= len(c.inputBuffer) {
-			c.ErrorPush(&Error{Code: -350, Info: "Input buffer overflow"})
-			c.bufferPos = 0
-			return fmt.Errorf("input buffer overflow")
+	var first error
+	for len(data) > 0 {
+		// Take up to and including the next line terminator
+		line := data
+		complete := false
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, complete = data[:i+1], true
 		}
+		data = data[len(line):]
 
-		c.inputBuffer[c.bufferPos] = b
-		c.bufferPos++
-
-		// Check for line terminator
-		if b == '\n' {
-			// Parse complete line
-			err := c.Parse(c.inputBuffer[:c.bufferPos])
+		if c.overflow {
+			// Rest of a line that overflowed the buffer
+			c.overflow = !complete
+			continue
+		}
+		if c.bufferPos+len(line) > len(c.inputBuffer) {
 			c.bufferPos = 0
-			if err != nil {
-				return err
+			c.overflow = !complete
+			err := c.fail(NewError(CodeInputBufferOverrun), "input buffer overflow")
+			if first == nil {
+				first = err
 			}
+			continue
 		}
+		if !complete {
+			c.bufferPos += copy(c.inputBuffer[c.bufferPos:], line)
+			break
+		}
+
+		// Parse a complete line in place when nothing is buffered
+		if c.bufferPos > 0 {
+			c.bufferPos += copy(c.inputBuffer[c.bufferPos:], line)
+			line = c.inputBuffer[:c.bufferPos]
+		}
+		err := c.Parse(line)
+		c.bufferPos = 0
+		if first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// DeviceClear performs an IEEE 488.2 device clear (DCL/SDC): input not yet
+// parsed and unread output are discarded and a pending *OPC is cancelled.
+// The error queue and the other status are left unchanged.
+func (c *Context) DeviceClear() {
+	c.bufferPos = 0
+	c.overflow = false
+	c.cancelOpc()
+	c.clearOutput()
+
+	c.abortMu.Lock()
+	select {
+	case <-c.abortChan():
+		c.abort = make(chan struct{})
+	default:
+	}
+	c.abortMu.Unlock()
+}
+
+// Abort asks a long-running callback to stop early, typically because a
+// device clear arrived out of band. It may be called from any goroutine;
+// callbacks observe it through Aborted. The next DeviceClear rearms it.
+func (c *Context) Abort() {
+	c.abortMu.Lock()
+	abort := c.abortChan()
+	select {
+	case <-abort:
+	default:
+		close(abort)
+	}
+	c.abortMu.Unlock()
+}
+
+// Aborted returns a channel that is closed once Abort has been called
+func (c *Context) Aborted() <-chan struct{} {
+	c.abortMu.Lock()
+	defer c.abortMu.Unlock()
+	return c.abortChan()
+}
+
+// abortChan returns the abort channel, creating it on first use so a zero
+// Context can be aborted. abortMu must be held.
+func (c *Context) abortChan() chan struct{} {
+	if c.abort == nil {
+		c.abort = make(chan struct{})
+	}
+	return c.abort
+}
+
+// SetCheckTrailingParams enables reporting -108 "Parameter not allowed" when
+// a callback succeeds without reading all parameters it was sent, e.g. for
+// "*RST 5". It is off by default for backward compatibility.
+func (c *Context) SetCheckTrailingParams(enable bool) {
+	c.checkTrailing = enable
+}
+
+// SetStrictQueryForm enables rejecting a header whose query form differs from
+// every matching pattern with -113 "Undefined header", e.g. "*RST?" when only
+// "*RST" is registered, as IEEE 488.2 requires. It is off by default, when
+// such a header falls back to the pattern of the other form.
+func (c *Context) SetStrictQueryForm(enable bool) {
+	c.strictForm = enable
+}
+
+// MaxMnemonicLength is the IEEE 488.2 limit on program mnemonic length
+const MaxMnemonicLength = 12
+
+// SetCheckMnemonicLength enables rejecting headers with a mnemonic longer
+// than MaxMnemonicLength with -112 "Program mnemonic too long". Enabling it
+// also checks the command patterns and returns CheckPatterns' error, if any.
+// It is off by default.
+func (c *Context) SetCheckMnemonicLength(enable bool) error {
+	c.checkMnemonic = enable
+	if enable {
+		return CheckPatterns(c.table.Load().commands)
 	}
+	return nil
+}
 
+// CheckPatterns reports the first command pattern with a mnemonic longer
+// than MaxMnemonicLength, counting its long form without the numeric suffix
+func CheckPatterns(commands []*Command) error {
+	for _, cmd := range commands {
+		for _, p := range append([]string{cmd.Pattern}, cmd.Aliases...) {
+			pattern := strings.NewReplacer("[", "", "]", "", "#", "", "?", "").Replace(p)
+			if m := longMnemonic(pattern); m != "" {
+				return fmt.Errorf("pattern %s: mnemonic %s exceeds %d characters", p, m, MaxMnemonicLength)
+			}
+		}
+	}
 	return nil
 }
 
+// longMnemonic returns the first mnemonic of header longer than
+// MaxMnemonicLength, ignoring a leading '*', a trailing '?' and numeric
+// suffixes, or "" if there is none
+func longMnemonic(header string) string {
+	header = strings.TrimSuffix(strings.TrimPrefix(header, "*"), "?")
+	for _, part := range strings.Split(header, ":") {
+		if len(strings.TrimRight(part, "0123456789")) > MaxMnemonicLength {
+			return part
+		}
+	}
+	return ""
+}
+
+// hasUnreadParams reports whether program data remains after the parameters
+// the current callback has read
+func (c *Context) hasUnreadParams() bool {
+	for _, b := range c.currentParams[c.paramsPos:] {
+		if !isWhitespace(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// MessageID returns the sequence number of the program message being or
+// last parsed. Numbers start at 1 and increase by one per message, so
+// callbacks, logs and asynchronous completions can tag their output with the
+// message that caused it. It may be called from any goroutine.
+func (c *Context) MessageID() uint64 {
+	return c.messageID.Load()
+}
+
 // IsCmd checks if the current command matches the given pattern
 func (c *Context) IsCmd(pattern string) bool {
 	if c.currentCmd == nil {
@@ -348,10 +749,67 @@ func (c *Context) IsCmd(pattern string) bool {
 	return matchCommand(pattern, c.currentCmd.Pattern)
 }
 
+// Command returns the command whose callback is running, so one callback
+// registered for several commands can tell them apart
+func (c *Context) Command() *Command {
+	return c.currentCmd
+}
+
+// Tag returns the Tag of the running command, 0 when there is none
+func (c *Context) Tag() int32 {
+	if c.currentCmd == nil {
+		return 0
+	}
+	return c.currentCmd.Tag
+}
+
+// CommandUserData returns the UserData of the running command, nil when
+// there is none
+func (c *Context) CommandUserData() interface{} {
+	if c.currentCmd == nil {
+		return nil
+	}
+	return c.currentCmd.UserData
+}
+
+// CommandHeader returns the header of the running command as the client
+// sent it, in its case and with its suffixes, completed with the path
+// inherited from the previous command of a compound message
+func (c *Context) CommandHeader() string {
+	return c.currentHeader
+}
+
+// IsQuery reports whether the header of the running command ends with '?',
+// for callbacks registered for both forms of a command
+func (c *Context) IsQuery() bool {
+	return strings.HasSuffix(c.currentHeader, "?")
+}
+
+// MatchedPattern returns the pattern the header of the running command
+// matched: its Pattern or one of its Aliases. A header reaching the command
+// through a personality alias or a wildcard reports Pattern.
+func (c *Context) MatchedPattern() string {
+	if c.currentCmd == nil {
+		return ""
+	}
+	if !matchCommand(c.currentCmd.Pattern, c.currentHeader) {
+		for _, alias := range c.currentCmd.Aliases {
+			if matchCommand(alias, c.currentHeader) {
+				return alias
+			}
+		}
+	}
+	return c.currentCmd.Pattern
+}
+
 // CommandNumbers extracts numeric suffixes from the current command header.
 // Pattern parts ending with # (e.g. "TEST#:NUMbers#") indicate positions where
 // numeric suffixes can appear. For example, header "TEST1:NUMBERS2" yields [1, 2].
 // If a suffix is absent, defaultValue is used. The returned slice has length count.
+// Suffix positions count every # in the pattern, so an omitted optional node
+// such as "[SOURce#:]" keeps its slot with defaultValue. A default suffix
+// written in the pattern, as in "OUTPut[1]", takes precedence over defaultValue.
+// For a header matching one of the command's Aliases, the alias is used.
 func (c *Context) CommandNumbers(count int, defaultValue int32) []int32 {
 	result := make([]int32, count)
 	for i := range result {
@@ -362,19 +820,38 @@ func (c *Context) CommandNumbers(count int, defaultValue int32) []int32 {
 		return result
 	}
 
-	pattern := strings.TrimSuffix(c.currentCmd.Pattern, "?")
-	pattern = strings.ReplaceAll(pattern, "[", "")
-	pattern = strings.ReplaceAll(pattern, "]", "")
-
+	pattern, defaults := suffixDefaults(strings.TrimSuffix(c.MatchedPattern(), "?"))
+	for i, d := range defaults {
+		if i < count && d >= 0 {
+			result[i] = d
+		}
+	}
 	header := strings.TrimSuffix(c.currentHeader, "?")
 
-	patternParts := strings.Split(pattern, ":")
-	headerParts := strings.Split(header, ":")
+	// Expand a copy of the pattern in which each # carries its position, so
+	// the variant the header matched tells which suffix each # stands for.
+	// A header that matches none, e.g. a personality alias, is aligned with
+	// the pattern with all optional nodes included.
+	variants := patternVariants(pattern)
+	positions := patternVariants(suffixPositions(pattern))
+	v := len(variants) - 1
+	for i, variant := range variants {
+		if matchCommandParts(variant, header) {
+			v = i
+			break
+		}
+	}
 
-	idx := 0
-	for i := 0; i < len(patternParts) && i < len(headerParts) && idx < count; i++ {
-		pp := patternParts[i]
-		if !strings.Contains(pp, "#") {
+	patternParts := strings.Split(strings.TrimPrefix(variants[v], ":"), ":")
+	positionParts := strings.Split(strings.TrimPrefix(positions[v], ":"), ":")
+	headerParts := strings.Split(strings.TrimPrefix(header, ":"), ":")
+	for i := 0; i < len(patternParts) && i < len(headerParts); i++ {
+		hash := strings.IndexByte(patternParts[i], '#')
+		if hash < 0 {
+			continue
+		}
+		idx := int(positionParts[i][hash] &^ 0x80)
+		if idx >= count {
 			continue
 		}
 
@@ -390,83 +867,260 @@ func (c *Context) CommandNumbers(count int, defaultValue int32) []int32 {
 				result[idx] = int32(val)
 			}
 		}
-		idx++
 	}
 
 	return result
 }
 
-// writeData writes data to output
+// suffixPositions returns pattern with each # replaced by 0x80 plus its
+// position among the #s and every other byte except brackets and colons
+// blanked, so it expands into variants aligned byte for byte with those of
+// pattern
+func suffixPositions(pattern string) string {
+	positions := []byte(pattern)
+	n := 0
+	for i, b := range positions {
+		switch b {
+		case '[', ']', ':':
+		case '#':
+			positions[i] = 0x80 | byte(n&0x7f)
+			n++
+		default:
+			positions[i] = ' '
+		}
+	}
+	return string(positions)
+}
+
+// writeData writes data to output, retrying short writes. When the
+// transport fails, -360 is queued once and the rest of the program message
+// is not executed.
 func (c *Context) writeData(data []byte) (int, error) {
-	if c.iface != nil && c.iface.Write != nil {
-		return c.iface.Write(data)
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	if c.queueOutput(data) {
+		return len(data), nil
+	}
+	if c.iface == nil || c.iface.Write == nil {
+		return 0, nil
+	}
+
+	written := 0
+	for written < len(data) {
+		n, err := c.iface.Write(data[written:])
+		if n > 0 {
+			written += n
+		}
+		if err == nil && n <= 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			c.writeErr = c.fail(NewError(CodeCommunicationError), "write response: %w", err)
+			return written, c.writeErr
+		}
+	}
+	return written, nil
+}
+
+// SetResponseTerminator sets the bytes ending each response message, e.g.
+// "\r\n". An empty terminator restores the default "\n".
+func (c *Context) SetResponseTerminator(term []byte) {
+	c.terminator = append([]byte(nil), term...)
+}
+
+// responseTerminator returns the bytes ending each response message
+func (c *Context) responseTerminator() []byte {
+	if len(c.terminator) == 0 {
+		return []byte("\n")
 	}
-	return 0, nil
+	return c.terminator
 }
 
-// writeNewLine writes a newline to output
+// writeNewLine writes the response terminator to output
 func (c *Context) writeNewLine() error {
-	c.writeData([]byte("\n"))
+	if _, err := c.writeData(c.responseTerminator()); err != nil {
+		return err
+	}
 	if c.iface != nil && c.iface.Flush != nil {
 		return c.iface.Flush()
 	}
 	return nil
 }
 
-// writeDelimiter writes a comma delimiter if needed
-func (c *Context) writeDelimiter() {
+// writeDelimiter writes a comma between the results of one command, or a
+// semicolon between the response units of commands in the same message
+func (c *Context) writeDelimiter() error {
+	var err error
 	if c.outputCount > 0 {
-		c.writeData([]byte(","))
+		_, err = c.writeData([]byte(","))
+	} else if !c.firstOutput {
+		_, err = c.writeData([]byte(";"))
 	}
+	return err
+}
+
+// writeResult writes one response data element, preceded by its delimiter,
+// and returns the first write error
+func (c *Context) writeResult(parts ...[]byte) error {
+	err := c.writeDelimiter()
+	for _, part := range parts {
+		if err != nil {
+			break
+		}
+		_, err = c.writeData(part)
+	}
+	c.outputCount++
+	c.firstOutput = false
+	return err
 }
 
 // ResultText writes a quoted string result
 func (c *Context) ResultText(text string) error {
-	c.writeDelimiter()
-	c.writeData([]byte("\""))
 	// Escape quotes in text
 	escaped := strings.ReplaceAll(text, "\"", "\"\"")
-	c.writeData([]byte(escaped))
-	c.writeData([]byte("\""))
-	c.outputCount++
-	c.firstOutput = false
-	return nil
+	return c.writeResult([]byte("\"" + escaped + "\""))
 }
 
 // ResultInt32 writes a 32-bit integer result
 func (c *Context) ResultInt32(value int32) error {
-	c.writeDelimiter()
-	c.writeData([]byte(fmt.Sprintf("%d", value)))
-	c.outputCount++
-	c.firstOutput = false
-	return nil
+	return c.writeResult([]byte(fmt.Sprintf("%d", value)))
 }
 
 // ResultInt64 writes a 64-bit integer result
 func (c *Context) ResultInt64(value int64) error {
-	c.writeDelimiter()
-	c.writeData([]byte(fmt.Sprintf("%d", value)))
-	c.outputCount++
-	c.firstOutput = false
-	return nil
+	return c.writeResult([]byte(fmt.Sprintf("%d", value)))
+}
+
+// ResultUInt32 writes a 32-bit unsigned integer result
+func (c *Context) ResultUInt32(value uint32) error {
+	return c.writeResult([]byte(strconv.FormatUint(uint64(value), 10)))
+}
+
+// ResultUInt64 writes a 64-bit unsigned integer result
+func (c *Context) ResultUInt64(value uint64) error {
+	return c.writeResult([]byte(strconv.FormatUint(value, 10)))
+}
+
+// ResultInt32Base writes value as #H, #Q or #B non-decimal numeric data for
+// base 16, 8 or 2, and as a decimal integer otherwise. Handlers can pass the
+// Base of the parameter they were sent to answer in the same notation.
+// Negative values are written in non-decimal bases as their 32-bit two's
+// complement, so -1 becomes #HFFFFFFFF.
+func (c *Context) ResultInt32Base(value int32, base int) error {
+	if !isNondecimalBase(base) {
+		return c.ResultInt32(value)
+	}
+	return c.ResultUInt32Base(uint32(value), base)
+}
+
+// ResultInt64Base writes value like ResultInt32Base, using the 64-bit two's
+// complement for negative values
+func (c *Context) ResultInt64Base(value int64, base int) error {
+	if !isNondecimalBase(base) {
+		return c.ResultInt64(value)
+	}
+	return c.ResultUInt64Base(uint64(value), base)
+}
+
+// ResultUInt32Base writes value like ResultInt32Base
+func (c *Context) ResultUInt32Base(value uint32, base int) error {
+	return c.ResultUInt64Base(uint64(value), base)
+}
+
+// ResultUInt64Base writes value like ResultInt32Base
+func (c *Context) ResultUInt64Base(value uint64, base int) error {
+	var prefix string
+	switch base {
+	case 16:
+		prefix = "#H"
+	case 8:
+		prefix = "#Q"
+	case 2:
+		prefix = "#B"
+	default:
+		base = 10
+	}
+	return c.ResultMnemonic(prefix + strings.ToUpper(strconv.FormatUint(value, base)))
+}
+
+// isNondecimalBase reports whether base has an IEEE 488.2 non-decimal form
+func isNondecimalBase(base int) bool {
+	return base == 16 || base == 8 || base == 2
 }
 
 // ResultFloat writes a float32 result
 func (c *Context) ResultFloat(value float32) error {
-	c.writeDelimiter()
-	c.writeData([]byte(fmt.Sprintf("%g", value)))
-	c.outputCount++
-	c.firstOutput = false
-	return nil
+	return c.writeResult([]byte(fmt.Sprintf(c.floatVerb(), value)))
 }
 
 // ResultDouble writes a float64 result
 func (c *Context) ResultDouble(value float64) error {
-	c.writeDelimiter()
-	c.writeData([]byte(fmt.Sprintf("%g", value)))
-	c.outputCount++
-	c.firstOutput = false
-	return nil
+	return c.writeResult([]byte(fmt.Sprintf(c.floatVerb(), value)))
+}
+
+// SCPI-99 representations of not-a-number and infinity in responses
+const (
+	notANumberText       = "9.91E+37"
+	infinityText         = "9.9E+37"
+	negativeInfinityText = "-9.9E+37"
+)
+
+// ResultNotANumber writes the SCPI not-a-number value, 9.91E+37
+func (c *Context) ResultNotANumber() error {
+	return c.ResultMnemonic(notANumberText)
+}
+
+// ResultInfinity writes the SCPI positive infinity value, 9.9E+37
+func (c *Context) ResultInfinity() error {
+	return c.ResultMnemonic(infinityText)
+}
+
+// ResultNegativeInfinity writes the SCPI negative infinity value, -9.9E+37
+func (c *Context) ResultNegativeInfinity() error {
+	return c.ResultMnemonic(negativeInfinityText)
+}
+
+// ResultDoubleSpecial writes a float64 result like ResultDouble, but writes
+// NaN and infinities as the SCPI values 9.91E+37 and ±9.9E+37 instead of
+// "NaN" and "+Inf"
+func (c *Context) ResultDoubleSpecial(value float64) error {
+	switch {
+	case math.IsNaN(value):
+		return c.ResultNotANumber()
+	case math.IsInf(value, 1):
+		return c.ResultInfinity()
+	case math.IsInf(value, -1):
+		return c.ResultNegativeInfinity()
+	}
+	return c.ResultDouble(value)
+}
+
+// ResultDoubleFmt writes a float64 result with prec significant digits
+// ("%.<prec>g"), regardless of the context's float format
+func (c *Context) ResultDoubleFmt(value float64, prec int) error {
+	return c.writeResult([]byte(strconv.FormatFloat(value, 'g', prec, 64)))
+}
+
+// SetFloatFormat sets the fmt verb ResultFloat and ResultDouble format with,
+// e.g. "%.15g" to match C libscpi byte for byte. An empty format restores
+// the default "%g". Switching personality replaces it.
+func (c *Context) SetFloatFormat(format string) {
+	c.floatFormat = format
+}
+
+// FloatFormat returns the fmt verb set with SetFloatFormat or by the active
+// personality, or "" for the default
+func (c *Context) FloatFormat() string {
+	return c.floatFormat
+}
+
+// floatVerb returns the fmt verb used to format floating-point results
+func (c *Context) floatVerb() string {
+	if c.floatFormat == "" {
+		return "%g"
+	}
+	return c.floatFormat
 }
 
 // ResultBool writes a boolean result (0 or 1)
@@ -479,22 +1133,259 @@ func (c *Context) ResultBool(value bool) error {
 
 // ResultMnemonic writes a character data result
 func (c *Context) ResultMnemonic(data string) error {
-	c.writeDelimiter()
-	c.writeData([]byte(data))
-	c.outputCount++
-	c.firstOutput = false
-	return nil
+	return c.writeResult([]byte(data))
+}
+
+// ResultError writes the <code>,"<message>" pair answered by SYSTem:ERRor?,
+// with the error's Detail after a semicolon, or 0,"No error" for nil
+func (c *Context) ResultError(err *Error) error {
+	if err == nil {
+		c.ResultInt32(0)
+		return c.ResultText("No error")
+	}
+	c.ResultInt32(int32(err.Code))
+	return c.ResultText(err.Message())
+}
+
+// ResultDate writes the date of t as <year>,<month>,<day>, the form
+// answered by SYSTem:DATE?
+func (c *Context) ResultDate(t time.Time) error {
+	c.ResultInt32(int32(t.Year()))
+	c.ResultInt32(int32(t.Month()))
+	return c.ResultInt32(int32(t.Day()))
+}
+
+// ResultTime writes the time of day of t as <hour>,<minute>,<second>, the
+// form answered by SYSTem:TIME?
+func (c *Context) ResultTime(t time.Time) error {
+	c.ResultInt32(int32(t.Hour()))
+	c.ResultInt32(int32(t.Minute()))
+	return c.ResultInt32(int32(t.Second()))
+}
+
+// ResultTimestamp writes t as a quoted ISO 8601 string, e.g.
+// "2024-05-01T12:30:00Z"
+func (c *Context) ResultTimestamp(t time.Time) error {
+	return c.ResultText(t.Format(time.RFC3339))
+}
+
+// ResultChannelList writes entries as a SCPI channel list, e.g. (@1,3:5) or
+// (@1!2:3!4), the form ParamChannelList reads
+func (c *Context) ResultChannelList(entries []ChannelListEntry) error {
+	var sb strings.Builder
+	sb.WriteString("(@")
+	for i, entry := range entries {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		writeChannelAddress(&sb, entry.From)
+		if entry.IsRange {
+			sb.WriteByte(':')
+			writeChannelAddress(&sb, entry.To)
+		}
+	}
+	sb.WriteByte(')')
+	return c.ResultMnemonic(sb.String())
+}
+
+// writeChannelAddress writes the '!'-separated dimensions of one address
+func writeChannelAddress(sb *strings.Builder, values []int32) {
+	for i, v := range values {
+		if i > 0 {
+			sb.WriteByte('!')
+		}
+		sb.WriteString(strconv.FormatInt(int64(v), 10))
+	}
 }
 
 // ResultArbitraryBlock writes data in IEEE 488.2 definite-length arbitrary block format.
 // The output format is #<n><length><data> where n is the number of digits in the length.
 func (c *Context) ResultArbitraryBlock(data []byte) error {
-	c.writeDelimiter()
 	lengthStr := fmt.Sprintf("%d", len(data))
 	header := fmt.Sprintf("#%d%s", len(lengthStr), lengthStr)
-	c.writeData([]byte(header))
-	c.writeData(data)
-	c.outputCount++
-	c.firstOutput = false
+	return c.writeResult([]byte(header), data)
+}
+
+// blockChunkSize is the buffer size ResultArbitraryBlockReader streams with
+const blockChunkSize = 4096
+
+// ResultArbitraryBlockReader writes a definite-length arbitrary block of
+// length bytes read from r, passing the payload to Interface.Write in chunks
+// so it is never held in memory as a whole. If r ends early the block is
+// padded with zeros to keep the response framed, -200 is queued and the read
+// error is returned.
+func (c *Context) ResultArbitraryBlockReader(r io.Reader, length int64) error {
+	if length < 0 {
+		return fmt.Errorf("negative block length %d", length)
+	}
+
+	lengthStr := strconv.FormatInt(length, 10)
+	if err := c.writeResult([]byte(fmt.Sprintf("#%d%s", len(lengthStr), lengthStr))); err != nil {
+		return err
+	}
+
+	buf := make([]byte, min(length, blockChunkSize))
+	remaining := length
+	var readErr error
+	for remaining > 0 {
+		chunk := buf[:min(remaining, int64(len(buf)))]
+		if readErr == nil {
+			var n int
+			n, readErr = io.ReadFull(r, chunk)
+			if readErr != nil {
+				clear(chunk[n:])
+			}
+		} else {
+			clear(chunk)
+		}
+		if _, err := c.writeData(chunk); err != nil {
+			return err
+		}
+		remaining -= int64(len(chunk))
+	}
+
+	if readErr != nil {
+		if readErr == io.EOF {
+			readErr = io.ErrUnexpectedEOF
+		}
+		return c.fail(NewError(CodeExecutionError), "block payload: %w", readErr)
+	}
 	return nil
 }
+
+// ResultArbitraryBlockIndefinite writes an indefinite-length arbitrary block
+// (#0<data>) streamed from r until EOF, for payloads whose length is not
+// known up front. IEEE 488.2 requires such a block to end the response
+// message, so the response terminator is written here, Interface.End is called
+// if set and the response is flushed. Results added afterwards start a new
+// response message.
+func (c *Context) ResultArbitraryBlockIndefinite(r io.Reader) error {
+	if err := c.writeDelimiter(); err != nil {
+		return err
+	}
+	if _, err := c.writeData([]byte("#0")); err != nil {
+		return err
+	}
+
+	buf := make([]byte, blockChunkSize)
+	var readErr error
+	for readErr == nil {
+		var n int
+		n, readErr = r.Read(buf)
+		if n > 0 {
+			if _, err := c.writeData(buf[:n]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := c.writeData(c.responseTerminator()); err != nil {
+		return err
+	}
+	if c.iface != nil && c.iface.End != nil {
+		if err := c.iface.End(); err != nil {
+			return err
+		}
+	}
+	if c.iface != nil && c.iface.Flush != nil {
+		if err := c.iface.Flush(); err != nil {
+			return err
+		}
+	}
+	c.outputCount = 0
+	c.firstOutput = true
+
+	if readErr != io.EOF {
+		return c.fail(NewError(CodeExecutionError), "block payload: %w", readErr)
+	}
+	return nil
+}
+
+// ResultArrayFloat64 writes values as a comma-separated ASCII list or, for
+// FormatBigEndian and FormatLittleEndian, as a definite-length block of
+// IEEE 754 doubles in that byte order
+func (c *Context) ResultArrayFloat64(values []float64, format ArrayFormat) error {
+	if format == FormatASCII {
+		for _, v := range values {
+			if err := c.ResultDouble(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data := make([]byte, 8*len(values))
+	order := byteOrder(format)
+	for i, v := range values {
+		order.PutUint64(data[8*i:], math.Float64bits(v))
+	}
+	return c.ResultArbitraryBlock(data)
+}
+
+// ResultArrayFloat32 writes values like ResultArrayFloat64, using IEEE 754
+// singles for the binary formats
+func (c *Context) ResultArrayFloat32(values []float32, format ArrayFormat) error {
+	if format == FormatASCII {
+		for _, v := range values {
+			if err := c.ResultFloat(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data := make([]byte, 4*len(values))
+	order := byteOrder(format)
+	for i, v := range values {
+		order.PutUint32(data[4*i:], math.Float32bits(v))
+	}
+	return c.ResultArbitraryBlock(data)
+}
+
+// ResultArrayInt16 writes values like ResultArrayFloat64, using two's
+// complement 16-bit integers for the binary formats
+func (c *Context) ResultArrayInt16(values []int16, format ArrayFormat) error {
+	if format == FormatASCII {
+		for _, v := range values {
+			if err := c.ResultInt32(int32(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data := make([]byte, 2*len(values))
+	order := byteOrder(format)
+	for i, v := range values {
+		order.PutUint16(data[2*i:], uint16(v))
+	}
+	return c.ResultArbitraryBlock(data)
+}
+
+// ResultArrayInt32 writes values like ResultArrayFloat64, using two's
+// complement 32-bit integers for the binary formats
+func (c *Context) ResultArrayInt32(values []int32, format ArrayFormat) error {
+	if format == FormatASCII {
+		for _, v := range values {
+			if err := c.ResultInt32(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data := make([]byte, 4*len(values))
+	order := byteOrder(format)
+	for i, v := range values {
+		order.PutUint32(data[4*i:], uint32(v))
+	}
+	return c.ResultArbitraryBlock(data)
+}
+
+// byteOrder returns the byte order of a binary array format
+func byteOrder(format ArrayFormat) binary.ByteOrder {
+	if format == FormatLittleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
@@ -1,8 +1,13 @@
 package scpi
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMatchPattern(t *testing.T) {
@@ -890,12 +895,25 @@ func TestErrorPushPop(t *testing.T) {
 func TestErrorPushOverflow(t *testing.T) {
 	ctx := NewContext(nil, nil, 256)
 
-	// Push 11 errors into queue with capacity 10
-	for i := 0; i < 11; i++ {
+	// Push 12 errors into queue with capacity 10
+	for i := 0; i < 12; i++ {
 		ctx.ErrorPush(&Error{Code: int16(i), Info: "err"})
 	}
 
-	// First pop should return error with code 1 (code 0 was evicted)
+	// The oldest errors are kept and the newest entry is -350
+	var codes []int16
+	for err := ctx.ErrorPop(); err != nil; err = ctx.ErrorPop() {
+		codes = append(codes, err.Code)
+	}
+	if got := fmt.Sprint(codes); got != "[0 1 2 3 4 5 6 7 8 -350]" {
+		t.Errorf("queue after overflow = %s, want [0 1 2 3 4 5 6 7 8 -350]", got)
+	}
+
+	// With SetErrorQueueDropOldest code 0 is evicted instead
+	ctx.SetErrorQueueDropOldest(true)
+	for i := 0; i < 11; i++ {
+		ctx.ErrorPush(&Error{Code: int16(i), Info: "err"})
+	}
 	err := ctx.ErrorPop()
 	if err == nil || err.Code != 1 {
 		t.Errorf("ErrorPop() after overflow = %v, want code 1", err)
@@ -1610,6 +1628,94 @@ func TestIsCmd(t *testing.T) {
 	}
 }
 
+func TestCommandTag(t *testing.T) {
+	var tags []int32
+	var patterns []string
+	callback := func(ctx *Context) Result {
+		tags = append(tags, ctx.Tag())
+		patterns = append(patterns, ctx.Command().Pattern)
+		return ResOK
+	}
+	commands := []*Command{
+		{Pattern: "SOURce:VOLTage:MINimum?", Callback: callback, Tag: 1},
+		{Pattern: "SOURce:VOLTage:MAXimum?", Callback: callback, Tag: 2},
+	}
+	ctx := NewContext(commands, &Interface{Write: func(data []byte) (int, error) { return len(data), nil }}, 256)
+	if ctx.Tag() != 0 || ctx.Command() != nil {
+		t.Errorf("Tag() = %d, Command() = %v outside callback, want 0, nil", ctx.Tag(), ctx.Command())
+	}
+
+	ctx.Input([]byte("SOUR:VOLT:MAX?;MIN?\n"))
+	if fmt.Sprint(tags) != "[2 1]" {
+		t.Errorf("tags = %v, want [2 1]", tags)
+	}
+	if fmt.Sprint(patterns) != "[SOURce:VOLTage:MAXimum? SOURce:VOLTage:MINimum?]" {
+		t.Errorf("patterns = %v", patterns)
+	}
+}
+
+func TestCommandUserData(t *testing.T) {
+	type channel struct{ addr int }
+	var got []int
+	callback := func(ctx *Context) Result {
+		got = append(got, ctx.CommandUserData().(*channel).addr)
+		return ResOK
+	}
+	commands := []*Command{
+		{Pattern: "OUTPut:LEFT", Callback: callback, UserData: &channel{4}},
+		{Pattern: "OUTPut:RIGHt", Callback: callback, UserData: &channel{7}},
+	}
+	ctx := NewContext(commands, nil, 256)
+	if ctx.CommandUserData() != nil {
+		t.Error("CommandUserData() outside callback is not nil")
+	}
+	ctx.Input([]byte("OUTP:RIGH;LEFT\n"))
+	if fmt.Sprint(got) != "[7 4]" {
+		t.Errorf("user data = %v, want [7 4]", got)
+	}
+}
+
+func TestCommandHeader(t *testing.T) {
+	var headers, patterns []string
+	callback := func(ctx *Context) Result {
+		headers = append(headers, ctx.CommandHeader())
+		patterns = append(patterns, ctx.MatchedPattern())
+		return ResOK
+	}
+	commands := []*Command{
+		{Pattern: "SOURce#:VOLTage", Callback: callback},
+		{Pattern: "SOURce#:CURRent", Aliases: []string{"SOURce#:AMPS"}, Callback: callback},
+	}
+	ctx := NewContext(commands, nil, 256)
+	if ctx.CommandHeader() != "" || ctx.MatchedPattern() != "" {
+		t.Error("header or pattern set outside callback")
+	}
+	ctx.Input([]byte("sour2:Volt 1;amps 2\n"))
+	if want := "[sour2:Volt sour2:amps]"; fmt.Sprint(headers) != want {
+		t.Errorf("headers = %v, want %s", headers, want)
+	}
+	if want := "[SOURce#:VOLTage SOURce#:AMPS]"; fmt.Sprint(patterns) != want {
+		t.Errorf("patterns = %v, want %s", patterns, want)
+	}
+}
+
+func TestIsQuery(t *testing.T) {
+	var got []bool
+	callback := func(ctx *Context) Result {
+		got = append(got, ctx.IsQuery())
+		return ResOK
+	}
+	commands := []*Command{
+		{Pattern: "OUTPut", Callback: callback},
+		{Pattern: "OUTPut?", Callback: callback},
+	}
+	ctx := NewContext(commands, nil, 256)
+	ctx.Input([]byte("OUTP ON;OUTP?\n"))
+	if fmt.Sprint(got) != "[false true]" {
+		t.Errorf("IsQuery() = %v, want [false true]", got)
+	}
+}
+
 func TestLexColon(t *testing.T) {
 	state := &lexState{buffer: []byte(":"), pos: 0, len: 1}
 	tok, length := state.lexColon()
@@ -1719,6 +1825,62 @@ func TestInputBufferOverflow(t *testing.T) {
 	}
 }
 
+func TestInputFragmented(t *testing.T) {
+	commands := []*Command{
+		{Pattern: "ECHO?", Callback: func(ctx *Context) Result {
+			v, _ := ctx.ParamInt32(true)
+			ctx.ResultInt32(v)
+			return ResOK
+		}},
+	}
+	message := []byte("ECHO? 1;:ECHO? 22\nECHO? 333\n\nECHO? 4444\n")
+	want := "1;22\n333\n4444\n"
+
+	for _, size := range []int{1, 2, 3, 7, 11, len(message)} {
+		var output strings.Builder
+		ctx := NewContext(commands, &Interface{Write: output.Write}, 32)
+		for i := 0; i < len(message); i += size {
+			if err := ctx.Input(message[i:min(i+size, len(message))]); err != nil {
+				t.Fatalf("chunk size %d: %v", size, err)
+			}
+		}
+		if output.String() != want {
+			t.Errorf("chunk size %d: output = %q, want %q", size, output.String(), want)
+		}
+	}
+
+	// A line that exactly fills the buffer still fits
+	var output strings.Builder
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 9)
+	ctx.Input([]byte("ECHO? 5"))
+	if err := ctx.Input([]byte("6\n")); err != nil || output.String() != "56\n" {
+		t.Errorf("full buffer: output = %q, err = %v", output.String(), err)
+	}
+	if err := ctx.Input([]byte("ECHO? 5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Input([]byte("67\n")); err == nil {
+		t.Error("line one byte over the buffer size accepted")
+	}
+}
+
+// BenchmarkInputFragmented feeds a 4 KB program message one byte at a time
+func BenchmarkInputFragmented(b *testing.B) {
+	commands := []*Command{
+		{Pattern: "SOURce:LIST:VOLTage", Callback: func(ctx *Context) Result { return ResOK }},
+	}
+	message := []byte("SOUR:LIST:VOLT " + strings.Repeat("1.25,", 800) + "1.25\n")
+	ctx := NewContext(commands, &Interface{}, 8192)
+
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range message {
+			ctx.Input(message[j : j+1])
+		}
+	}
+}
+
 func TestMatchCommandOptionalParts(t *testing.T) {
 	tests := []struct {
 		pattern string
@@ -1731,6 +1893,18 @@ func TestMatchCommandOptionalParts(t *testing.T) {
 		{"VOLTage[:DC]", "VOLT:DC", true},
 		{"VOLTage[:DC]", "VOLTAGE:DC", true},
 		{"VOLTage[:DC]", "VOLT:AC", false},
+		// Several optional parts, each present or omitted independently
+		{"MEASure[:SCALar]:VOLTage[:DC]?", "MEAS:VOLT?", true},
+		{"MEASure[:SCALar]:VOLTage[:DC]?", "MEAS:SCAL:VOLT?", true},
+		{"MEASure[:SCALar]:VOLTage[:DC]?", "MEAS:VOLT:DC?", true},
+		{"MEASure[:SCALar]:VOLTage[:DC]?", "MEASURE:SCALAR:VOLTAGE:DC?", true},
+		{"MEASure[:SCALar]:VOLTage[:DC]?", "MEAS:DC?", false},
+		{"MEASure[:SCALar]:VOLTage[:DC]?", "MEAS:VOLT:SCAL?", false},
+		{"[SOURce]:VOLTage[:LEVel][:IMMediate][:AMPLitude]", "VOLT:IMM", true},
+		{"[SOURce]:VOLTage[:LEVel][:IMMediate][:AMPLitude]", "SOUR:VOLT:LEV:AMPL", true},
+		// Nested optional parts
+		{"TRIGger[:SEQuence[:IMMediate]]", "TRIG:SEQ:IMM", true},
+		{"TRIGger[:SEQuence[:IMMediate]]", "TRIG:IMM", false},
 		// Leading colon in header
 		{":MEASure:VOLTage", ":MEAS:VOLT", true},
 	}
@@ -1782,6 +1956,14 @@ func TestLexSuffixProgramData(t *testing.T) {
 		{"Hz", "Hz", 2},
 		{"123", "", 0},
 		{"", "", 0},
+		{"V/S", "V/S", 3},
+		{"M2", "M2", 2},
+		{"/S", "/S", 2},
+		{"A.S-1", "A.S-1", 5},
+		{"KOHM,1", "KOHM", 4},
+		{"V/", "V", 1},
+		{"V/1", "V", 1},
+		{"/", "", 0},
 	}
 
 	for _, tt := range tests {
@@ -2504,3 +2686,3886 @@ func TestCommandNumbersNoCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSuffix(t *testing.T) {
+	tests := []struct {
+		suffix string
+		mult   float64
+		terms  []UnitTerm
+	}{
+		{"V", 1, []UnitTerm{{UnitVolt, 1}}},
+		{"mV", 1e-3, []UnitTerm{{UnitVolt, 1}}},
+		{"KOHM", 1e3, []UnitTerm{{UnitOhm, 1}}},
+		{"MOHM", 1e6, []UnitTerm{{UnitOhm, 1}}},
+		{"MHZ", 1e6, []UnitTerm{{UnitHertz, 1}}},
+		{"MAHZ", 1e6, []UnitTerm{{UnitHertz, 1}}},
+		{"MA", 1e-3, []UnitTerm{{UnitAmper, 1}}},
+		{"UA", 1e-6, []UnitTerm{{UnitAmper, 1}}},
+		{"NS", 1e-9, []UnitTerm{{UnitSecond, 1}}},
+		{"PF", 1e-12, []UnitTerm{{UnitFarad, 1}}},
+		{"GHZ", 1e9, []UnitTerm{{UnitHertz, 1}}},
+		{"M", 1, []UnitTerm{{UnitMeter, 1}}},
+		{"V/S", 1, []UnitTerm{{UnitVolt, 1}, {UnitSecond, -1}}},
+		{"KV/US", 1e9, []UnitTerm{{UnitVolt, 1}, {UnitSecond, -1}}},
+		{"M2", 1, []UnitTerm{{UnitMeter, 2}}},
+		{"MM2", 1e-6, []UnitTerm{{UnitMeter, 2}}},
+		{"/S", 1, []UnitTerm{{UnitSecond, -1}}},
+		{"A.S", 1, []UnitTerm{{UnitAmper, 1}, {UnitSecond, 1}}},
+		{"S-1", 1, []UnitTerm{{UnitSecond, -1}}},
+		{"DB", 1, []UnitTerm{{UnitDecibel, 1}}},
+		{"DBM", 1, []UnitTerm{{UnitDBm, 1}}},
+		{"dBuV", 1, []UnitTerm{{UnitDBuV, 1}}},
+		{"CEL", 1, []UnitTerm{{UnitCelsius, 1}}},
+		{"FAR", 1, []UnitTerm{{UnitFahrenheit, 1}}},
+		{"K", 1, []UnitTerm{{UnitKelvin, 1}}},
+		{"MK", 1e-3, []UnitTerm{{UnitKelvin, 1}}},
+		{"KV", 1e3, []UnitTerm{{UnitVolt, 1}}},
+		{"KPAL", 1e3, []UnitTerm{{UnitPascal, 1}}},
+		{"MBAR", 1e-3, []UnitTerm{{UnitBar, 1}}},
+		{"PCT", 1, []UnitTerm{{UnitPercent, 1}}},
+		{"PPM", 1, []UnitTerm{{UnitPPM, 1}}},
+		{"DBW", 1, []UnitTerm{{UnitDBW, 1}}},
+		{"DBV", 1, []UnitTerm{{UnitDBV, 1}}},
+		{"PA", 1e-12, []UnitTerm{{UnitAmper, 1}}},
+	}
+
+	for _, tt := range tests {
+		mult, terms, err := parseSuffix(tt.suffix)
+		if err != nil {
+			t.Errorf("parseSuffix(%q) error: %v", tt.suffix, err)
+			continue
+		}
+		if diff := mult - tt.mult; diff > tt.mult*1e-12 || diff < -tt.mult*1e-12 {
+			t.Errorf("parseSuffix(%q) mult = %g, want %g", tt.suffix, mult, tt.mult)
+		}
+		if len(terms) != len(tt.terms) {
+			t.Errorf("parseSuffix(%q) terms = %v, want %v", tt.suffix, terms, tt.terms)
+			continue
+		}
+		for i := range terms {
+			if terms[i] != tt.terms[i] {
+				t.Errorf("parseSuffix(%q) terms = %v, want %v", tt.suffix, terms, tt.terms)
+				break
+			}
+		}
+	}
+
+	for _, bad := range []string{"", "XYZ", "KX", "V/XYZ"} {
+		if _, _, err := parseSuffix(bad); err == nil {
+			t.Errorf("parseSuffix(%q) should fail", bad)
+		}
+	}
+}
+
+func TestParamNumber(t *testing.T) {
+	tests := []struct {
+		input   string
+		value   float64
+		unit    Unit
+		special bool
+		tag     int32
+		base    int8
+	}{
+		{"3.3", 3.3, UnitNone, false, 0, 10},
+		{"100 mV", 0.1, UnitVolt, false, 0, 10},
+		{"1.5KOHM", 1500, UnitOhm, false, 0, 10},
+		{"2.5e3 HZ", 2500, UnitHertz, false, 0, 10},
+		{"10 V/S", 10, UnitNone, false, 0, 10},
+		{"#HFF", 255, UnitNone, false, 0, 16},
+		{"#B101", 5, UnitNone, false, 0, 2},
+		{"MIN", 0, UnitNone, true, int32(NumMin), 0},
+		{"maximum", 0, UnitNone, true, int32(NumMax), 0},
+		{"DEF", 0, UnitNone, true, int32(NumDef), 0},
+		{"AUTO", 0, UnitNone, true, int32(NumAuto), 0},
+	}
+
+	for _, tt := range tests {
+		var got Number
+		var gotErr error
+		commands := []*Command{
+			{
+				Pattern: "TEST",
+				Callback: func(ctx *Context) Result {
+					got, gotErr = ctx.ParamNumber(true)
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, nil, 256)
+		ctx.Input([]byte("TEST " + tt.input + "\n"))
+
+		if gotErr != nil {
+			t.Errorf("ParamNumber(%q) error: %v", tt.input, gotErr)
+			continue
+		}
+		if diff := got.Value - tt.value; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("ParamNumber(%q) value = %g, want %g", tt.input, got.Value, tt.value)
+		}
+		if got.Unit != tt.unit {
+			t.Errorf("ParamNumber(%q) unit = %v, want %v", tt.input, got.Unit, tt.unit)
+		}
+		if got.Special != tt.special || got.Tag != tt.tag {
+			t.Errorf("ParamNumber(%q) special = %v/%d, want %v/%d", tt.input, got.Special, got.Tag, tt.special, tt.tag)
+		}
+		if got.Base != tt.base {
+			t.Errorf("ParamNumber(%q) base = %d, want %d", tt.input, got.Base, tt.base)
+		}
+	}
+}
+
+func TestParamNumberCompoundSuffix(t *testing.T) {
+	var got Number
+	commands := []*Command{
+		{
+			Pattern: "TEST",
+			Callback: func(ctx *Context) Result {
+				got, _ = ctx.ParamNumber(true)
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, nil, 256)
+	ctx.Input([]byte("TEST 5 MV/US\n"))
+
+	if got.Value != 5e3 || got.Mult != 1e3 {
+		t.Errorf("ParamNumber(5 MV/US) = %g (mult %g), want 5000 (mult 1000)", got.Value, got.Mult)
+	}
+	want := []UnitTerm{{UnitVolt, 1}, {UnitSecond, -1}}
+	if len(got.Terms) != 2 || got.Terms[0] != want[0] || got.Terms[1] != want[1] {
+		t.Errorf("ParamNumber(5 MV/US) terms = %v, want %v", got.Terms, want)
+	}
+}
+
+func TestParamNumberErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		code  int16
+	}{
+		{"5 XYZ", -131},
+		{"BOGUS", -224},
+		{"\"text\"", -104},
+	}
+
+	for _, tt := range tests {
+		var gotErr error
+		commands := []*Command{
+			{
+				Pattern: "TEST",
+				Callback: func(ctx *Context) Result {
+					_, gotErr = ctx.ParamNumber(true)
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, nil, 256)
+		ctx.Input([]byte("TEST " + tt.input + "\n"))
+
+		if gotErr == nil {
+			t.Errorf("ParamNumber(%q) should fail", tt.input)
+		}
+		if e := ctx.ErrorPop(); e == nil || e.Code != tt.code {
+			t.Errorf("ParamNumber(%q) error = %v, want code %d", tt.input, e, tt.code)
+		}
+	}
+}
+
+func TestParamDoubleExponentWithSuffix(t *testing.T) {
+	var result float64
+	commands := []*Command{
+		{
+			Pattern: "TEST",
+			Callback: func(ctx *Context) Result {
+				result, _ = ctx.ParamDouble(true)
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, nil, 256)
+	ctx.Input([]byte("TEST 1e3V\n"))
+
+	if result != 1000 {
+		t.Errorf("ParamDouble(1e3V) = %g, want 1000", result)
+	}
+}
+
+func TestParamNumberWithUnitsLogarithmic(t *testing.T) {
+	tests := []struct {
+		input string
+		refs  bool
+		units []Unit
+		value float64
+		unit  Unit
+	}{
+		{"10 DBM", false, []Unit{UnitWatt}, 10, UnitDBm},
+		{"10 DBM", true, []Unit{UnitWatt}, 0.01, UnitWatt},
+		{"0 DBM", true, []Unit{UnitWatt}, 1e-3, UnitWatt},
+		{"10 DBM", true, []Unit{UnitWatt, UnitDBm}, 10, UnitDBm},
+		{"10 DBM", true, []Unit{UnitVolt}, 10, UnitDBm},
+		{"20 DBUV", true, []Unit{UnitVolt}, 1e-5, UnitVolt},
+		{"3 DB", true, []Unit{UnitWatt}, 3, UnitDecibel},
+		{"2 W", true, []Unit{UnitWatt}, 2, UnitWatt},
+	}
+
+	for _, tt := range tests {
+		var got Number
+		var gotErr error
+		commands := []*Command{
+			{
+				Pattern: "TEST",
+				Callback: func(ctx *Context) Result {
+					got, gotErr = ctx.ParamNumberWithUnits(tt.units, true)
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, nil, 256)
+		if tt.refs {
+			ctx.SetLogReference(UnitDBm, DBmReference)
+			ctx.SetLogReference(UnitDBuV, DBuVReference)
+		}
+		ctx.Input([]byte("TEST " + tt.input + "\n"))
+
+		if gotErr != nil {
+			t.Errorf("ParamNumberWithUnits(%q) error: %v", tt.input, gotErr)
+			continue
+		}
+		if diff := got.Value - tt.value; diff > tt.value*1e-12 || diff < -tt.value*1e-12 {
+			t.Errorf("ParamNumberWithUnits(%q) value = %g, want %g", tt.input, got.Value, tt.value)
+		}
+		if got.Unit != tt.unit {
+			t.Errorf("ParamNumberWithUnits(%q) unit = %v, want %v", tt.input, got.Unit, tt.unit)
+		}
+	}
+}
+
+func TestDeviceClear(t *testing.T) {
+	var output strings.Builder
+	commands := []*Command{
+		{
+			Pattern: "*IDN?",
+			Callback: func(ctx *Context) Result {
+				ctx.ResultText("ACME")
+				return ResOK
+			},
+		},
+	}
+	iface := &Interface{
+		Write: func(data []byte) (int, error) {
+			return output.Write(data)
+		},
+	}
+	ctx := NewContext(commands, iface, 256)
+	ctx.ErrorPush(&Error{Code: -100, Info: "Command error"})
+
+	ctx.Input([]byte("GARBAGE:PARTIAL"))
+	ctx.DeviceClear()
+	ctx.Input([]byte("*IDN?\n"))
+
+	if output.String() != "\"ACME\"\n" {
+		t.Errorf("output after DeviceClear = %q, want %q", output.String(), "\"ACME\"\n")
+	}
+	if e := ctx.ErrorPop(); e == nil || e.Code != -100 {
+		t.Errorf("DeviceClear should keep the error queue, got %v", e)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	ctx := NewContext(nil, nil, 256)
+
+	select {
+	case <-ctx.Aborted():
+		t.Fatal("Aborted() closed before Abort")
+	default:
+	}
+
+	ctx.Abort()
+	ctx.Abort() // must not panic on a second call
+	select {
+	case <-ctx.Aborted():
+	default:
+		t.Fatal("Aborted() not closed after Abort")
+	}
+
+	ctx.DeviceClear()
+	select {
+	case <-ctx.Aborted():
+		t.Fatal("DeviceClear should rearm Aborted()")
+	default:
+	}
+
+	// A zero Context creates its abort channel on first use
+	var zero Context
+	aborted := zero.Aborted()
+	zero.Abort()
+	select {
+	case <-aborted:
+	default:
+		t.Fatal("zero Context: Aborted() not closed after Abort")
+	}
+}
+
+func TestParamNumberWithUnitsTemperature(t *testing.T) {
+	tests := []struct {
+		input    string
+		base     Unit
+		value    float64
+		rawValue float64
+		rawUnit  Unit
+	}{
+		{"25CEL", UnitNone, 25, 25, UnitCelsius},
+		{"298.15K", UnitCelsius, 25, 298.15, UnitKelvin},
+		{"212 FAR", UnitCelsius, 100, 212, UnitFahrenheit},
+		{"25 CEL", UnitKelvin, 298.15, 25, UnitCelsius},
+		{"100 CEL", UnitFahrenheit, 212, 100, UnitCelsius},
+		{"500 MK", UnitKelvin, 0.5, 0.5, UnitKelvin},
+	}
+
+	for _, tt := range tests {
+		var got Number
+		var gotErr error
+		commands := []*Command{
+			{
+				Pattern: "TEST",
+				Callback: func(ctx *Context) Result {
+					got, gotErr = ctx.ParamNumberWithUnits([]Unit{UnitCelsius}, true)
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, nil, 256)
+		if tt.base != UnitNone {
+			ctx.SetTemperatureUnit(tt.base)
+		}
+		ctx.Input([]byte("TEST " + tt.input + "\n"))
+
+		if gotErr != nil {
+			t.Errorf("ParamNumberWithUnits(%q) error: %v", tt.input, gotErr)
+			continue
+		}
+		if diff := got.Value - tt.value; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("ParamNumberWithUnits(%q) value = %g, want %g", tt.input, got.Value, tt.value)
+		}
+		if got.Unit != ctx.TemperatureUnit() {
+			t.Errorf("ParamNumberWithUnits(%q) unit = %v, want %v", tt.input, got.Unit, ctx.TemperatureUnit())
+		}
+		if diff := got.RawValue - tt.rawValue; diff > 1e-9 || diff < -1e-9 || got.RawUnit != tt.rawUnit {
+			t.Errorf("ParamNumberWithUnits(%q) raw = %g %v, want %g %v", tt.input, got.RawValue, got.RawUnit, tt.rawValue, tt.rawUnit)
+		}
+	}
+}
+
+func TestParameterKind(t *testing.T) {
+	type result struct {
+		kind ParamKind
+		str  string
+		num  float64
+	}
+	var got []result
+	commands := []*Command{
+		{
+			Pattern: "TEST",
+			Callback: func(ctx *Context) Result {
+				for {
+					p, err := ctx.Parameter(false)
+					if err != nil || p.Kind() == KindNone {
+						break
+					}
+					num, _ := p.AsFloat()
+					got = append(got, result{p.Kind(), p.AsString(), num})
+				}
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, nil, 256)
+	ctx.Input([]byte("TEST 1.5 V, #H1F, 'it''s', MAX, #13abc, (@1:3)\n"))
+
+	want := []result{
+		{KindNumeric, "1.5 V", 1.5},
+		{KindNondecimalNumeric, "#H1F", 31},
+		{KindString, "it's", 0},
+		{KindMnemonic, "MAX", 0},
+		{KindBlock, "#13abc", 0},
+		{KindExpression, "(@1:3)", 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d parameters, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("parameter %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParameterAccessors(t *testing.T) {
+	intParam := &Parameter{Type: TokenBinNum, Data: []byte("#B101")}
+	if v, err := intParam.AsInt(); err != nil || v != 5 {
+		t.Errorf("AsInt(#B101) = %d, %v, want 5", v, err)
+	}
+
+	boolTests := []struct {
+		param *Parameter
+		want  bool
+	}{
+		{&Parameter{Type: TokenProgramMnemonic, Data: []byte("on")}, true},
+		{&Parameter{Type: TokenProgramMnemonic, Data: []byte("OFF")}, false},
+		{&Parameter{Type: TokenDecimalNumeric, Data: []byte("0")}, false},
+		{&Parameter{Type: TokenDecimalNumeric, Data: []byte("2")}, true},
+	}
+	for _, tt := range boolTests {
+		if v, err := tt.param.AsBool(); err != nil || v != tt.want {
+			t.Errorf("AsBool(%s) = %v, %v, want %v", tt.param.Data, v, err, tt.want)
+		}
+	}
+
+	block := &Parameter{Type: TokenArbitraryBlock, Data: []byte("#15hello")}
+	if v, err := block.AsBlock(); err != nil || string(v) != "hello" {
+		t.Errorf("AsBlock(#15hello) = %q, %v, want hello", v, err)
+	}
+
+	str := &Parameter{Type: TokenDoubleQuoteData, Data: []byte(`"x"`)}
+	if _, err := str.AsInt(); err == nil {
+		t.Error("AsInt on string should fail")
+	}
+	if _, err := str.AsBool(); err == nil {
+		t.Error("AsBool on string should fail")
+	}
+	if _, err := str.AsBlock(); err == nil {
+		t.Error("AsBlock on string should fail")
+	}
+	if k := (&Parameter{Type: TokenUnknown}).Kind(); k != KindNone {
+		t.Errorf("Kind of absent parameter = %v, want KindNone", k)
+	}
+}
+
+func TestPersonality(t *testing.T) {
+	var output strings.Builder
+	commands := []*Command{
+		{Pattern: "*IDN?", Callback: CoreIdnQ},
+		{Pattern: "SYSTem:VERSion?", Callback: SystemVersionQ},
+		{Pattern: "SYSTem:PERSona?", Callback: SystemPersonaQ},
+		{Pattern: "SYSTem:PERSona", Callback: SystemPersona},
+		{Pattern: "MEASure:VOLTage:DC?", Callback: func(ctx *Context) Result {
+			ctx.ResultDouble(1.0 / 3)
+			return ResOK
+		}},
+	}
+	iface := &Interface{
+		Write: func(data []byte) (int, error) {
+			return output.Write(data)
+		},
+	}
+	ctx := NewContext(commands, iface, 256)
+	ctx.AddPersonality(&Personality{
+		Name: "MODERN",
+		IDN:  [4]string{"ACME", "X2000", "0", "2.0"},
+	})
+	ctx.AddPersonality(&Personality{
+		Name:        "LEGACY",
+		IDN:         [4]string{"ACME", "X100", "0", "1.0"},
+		SCPIVersion: "1994.0",
+		FloatFormat: "%.4E",
+		Options:     []string{"OPT1"},
+		Aliases:     []AliasDef{{"MEASure:DCVolts?", "MEASure:VOLTage:DC?"}},
+	})
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"*IDN?", "ACME,X2000,0,2.0\n"},
+		{"SYST:VERS?", "1999.0\n"},
+		{"SYST:PERS?", "MODERN\n"},
+		{"MEAS:DCV?", ""},
+		{"SYST:PERS LEGACY", ""},
+		{"SYST:PERS?", "LEGACY\n"},
+		{"*IDN?", "ACME,X100,0,1.0\n"},
+		{"SYST:VERS?", "1994.0\n"},
+		{"MEAS:DCV?", "3.3333E-01\n"},
+		{"SYST:PERS 'modern'", ""},
+		{"MEAS:VOLT:DC?", "0.3333333333333333\n"},
+	}
+
+	for _, tt := range tests {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s: output = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+
+	for ctx.ErrorPop() != nil {
+	}
+	ctx.Input([]byte("SYST:PERS BOGUS\n"))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -224 {
+		t.Errorf("SYST:PERS BOGUS error = %v, want -224", e)
+	}
+	if ctx.Personality().Name != "MODERN" {
+		t.Errorf("Personality() = %s after failed switch, want MODERN", ctx.Personality().Name)
+	}
+	if err := ctx.SetPersonality("legacy"); err != nil || len(ctx.Options()) != 1 {
+		t.Errorf("SetPersonality(legacy) = %v, options %v", err, ctx.Options())
+	}
+}
+
+func TestFindCommandPrefersSameForm(t *testing.T) {
+	var called string
+	commands := []*Command{
+		{Pattern: "OUTPut", Callback: func(ctx *Context) Result { called = "set"; return ResOK }},
+		{Pattern: "OUTPut?", Callback: func(ctx *Context) Result { called = "query"; return ResOK }},
+		{Pattern: "MEASure?", Callback: func(ctx *Context) Result { called = "measure"; return ResOK }},
+	}
+	ctx := NewContext(commands, nil, 256)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"OUTP?", "query"},
+		{"OUTP ON", "set"},
+		{"MEAS", "measure"},
+	}
+	for _, tt := range tests {
+		called = ""
+		ctx.Input([]byte(tt.input + "\n"))
+		if called != tt.want {
+			t.Errorf("%s called %q, want %q", tt.input, called, tt.want)
+		}
+	}
+}
+
+func TestStrictQueryForm(t *testing.T) {
+	var called string
+	commands := []*Command{
+		{Pattern: "*RST", Callback: func(ctx *Context) Result { called = "rst"; return ResOK }},
+		{Pattern: "MEASure?", Callback: func(ctx *Context) Result { called = "measure"; return ResOK }},
+		{Pattern: "OUTPut", Callback: func(ctx *Context) Result { called = "set"; return ResOK }},
+		{Pattern: "OUTPut?", Callback: func(ctx *Context) Result { called = "query"; return ResOK }},
+	}
+	ctx := NewContext(commands, nil, 256)
+	ctx.SetStrictQueryForm(true)
+	ctx.AddPersonality(&Personality{Name: "OLD", Aliases: []AliasDef{{"RESet", "*RST"}}})
+
+	tests := []struct {
+		input string
+		want  string // Callback run, "" for -113
+	}{
+		{"*RST", "rst"},
+		{"*RST?", ""},
+		{"MEAS?", "measure"},
+		{"MEAS", ""},
+		{"OUTP?", "query"},
+		{"OUTP ON", "set"},
+		{"RES", "rst"},
+		{"RES?", ""},
+	}
+	for _, tt := range tests {
+		called = ""
+		ctx.Input([]byte(tt.input + "\n"))
+		if called != tt.want {
+			t.Errorf("%s called %q, want %q", tt.input, called, tt.want)
+		}
+		e := ctx.ErrorPop()
+		if tt.want == "" && (e == nil || e.Code != -113) {
+			t.Errorf("%s queued %v, want -113", tt.input, e)
+		} else if tt.want != "" && e != nil {
+			t.Errorf("%s queued %d, %s", tt.input, e.Code, e.Info)
+		}
+	}
+}
+
+func TestUnitPreferences(t *testing.T) {
+	var output strings.Builder
+	var got Number
+	commands := []*Command{
+		{Pattern: "UNIT:TEMPerature?", Callback: UnitTemperatureQ},
+		{Pattern: "UNIT:TEMPerature", Callback: UnitTemperature},
+		{Pattern: "UNIT:POWer?", Callback: UnitPowerQ},
+		{Pattern: "UNIT:POWer", Callback: UnitPower},
+		{Pattern: "TEMPerature", Callback: func(ctx *Context) Result {
+			got, _ = ctx.ParamNumberWithUnits([]Unit{UnitCelsius}, true)
+			return ResOK
+		}},
+		{Pattern: "TEMPerature?", Callback: func(ctx *Context) Result {
+			ctx.ResultNumberWithUnit(25, UnitCelsius)
+			return ResOK
+		}},
+		{Pattern: "POWer", Callback: func(ctx *Context) Result {
+			got, _ = ctx.ParamNumberWithUnits([]Unit{UnitWatt}, true)
+			return ResOK
+		}},
+		{Pattern: "POWer?", Callback: func(ctx *Context) Result {
+			ctx.ResultNumberWithUnit(0.001, UnitWatt)
+			return ResOK
+		}},
+	}
+	iface := &Interface{
+		Write: func(data []byte) (int, error) {
+			return output.Write(data)
+		},
+	}
+	ctx := NewContext(commands, iface, 256)
+	ctx.SetLogReference(UnitDBm, DBmReference)
+
+	queries := []struct {
+		input string
+		want  string
+	}{
+		{"UNIT:TEMP?", "CEL\n"},
+		{"UNIT:POW?", "W\n"},
+		{"TEMP?", "25\n"},
+		{"POW?", "0.001\n"},
+		{"UNIT:TEMP K", ""},
+		{"UNIT:TEMP?", "K\n"},
+		{"TEMP?", "298.15\n"},
+		{"UNIT:POW DBM", ""},
+		{"UNIT:POW?", "DBM\n"},
+		{"POW?", "0\n"},
+	}
+	for _, tt := range queries {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s: output = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+
+	params := []struct {
+		input string
+		value float64
+		unit  Unit
+	}{
+		{"TEMP 300", 26.85, UnitCelsius},
+		{"TEMP 20 CEL", 20, UnitCelsius},
+		{"POW 10", 0.01, UnitWatt},
+		{"POW 2 W", 2, UnitWatt},
+	}
+	for _, tt := range params {
+		ctx.Input([]byte(tt.input + "\n"))
+		if diff := got.Value - tt.value; diff > 1e-9 || diff < -1e-9 || got.Unit != tt.unit {
+			t.Errorf("%s = %g %v, want %g %v", tt.input, got.Value, got.Unit, tt.value, tt.unit)
+		}
+	}
+	if got.RawUnit != UnitWatt {
+		t.Errorf("RawUnit = %v, want UnitWatt", got.RawUnit)
+	}
+}
+
+func TestCheckTrailingParams(t *testing.T) {
+	commands := []*Command{
+		{Pattern: "*RST", Callback: func(ctx *Context) Result { return ResOK }},
+		{Pattern: "VOLTage", Callback: func(ctx *Context) Result {
+			if _, err := ctx.ParamDouble(true); err != nil {
+				return ResErr
+			}
+			return ResOK
+		}},
+	}
+
+	tests := []struct {
+		input  string
+		strict bool
+		code   int16
+	}{
+		{"*RST 5", false, 0},
+		{"*RST 5", true, -108},
+		{"*RST   ", true, 0},
+		{"VOLT 1.5", true, 0},
+		{"VOLT 1.5, 2", true, -108},
+		{"VOLT 1.5, 2", false, 0},
+		{"VOLT", true, -109},
+	}
+
+	for _, tt := range tests {
+		ctx := NewContext(commands, nil, 256)
+		ctx.SetCheckTrailingParams(tt.strict)
+		ctx.Input([]byte(tt.input + "\n"))
+
+		var code int16
+		if e := ctx.ErrorPop(); e != nil {
+			code = e.Code
+		}
+		if code != tt.code {
+			t.Errorf("%q (strict=%v) error = %d, want %d", tt.input, tt.strict, code, tt.code)
+		}
+		if e := ctx.ErrorPop(); e != nil {
+			t.Errorf("%q (strict=%v) unexpected second error %d", tt.input, tt.strict, e.Code)
+		}
+	}
+}
+
+func TestResultArray(t *testing.T) {
+	tests := []struct {
+		name   string
+		result func(ctx *Context)
+		want   string
+	}{
+		{"float64 ascii", func(ctx *Context) { ctx.ResultArrayFloat64([]float64{1.5, -2, 0.25}, FormatASCII) }, "1.5,-2,0.25\n"},
+		{"float64 big", func(ctx *Context) { ctx.ResultArrayFloat64([]float64{1}, FormatBigEndian) }, "#18\x3f\xf0\x00\x00\x00\x00\x00\x00\n"},
+		{"float64 little", func(ctx *Context) { ctx.ResultArrayFloat64([]float64{1}, FormatLittleEndian) }, "#18\x00\x00\x00\x00\x00\x00\xf0\x3f\n"},
+		{"float32 ascii", func(ctx *Context) { ctx.ResultArrayFloat32([]float32{0.5, 3}, FormatASCII) }, "0.5,3\n"},
+		{"float32 big", func(ctx *Context) { ctx.ResultArrayFloat32([]float32{1, -2}, FormatBigEndian) }, "#18\x3f\x80\x00\x00\xc0\x00\x00\x00\n"},
+		{"int16 ascii", func(ctx *Context) { ctx.ResultArrayInt16([]int16{-1, 2, 32767}, FormatASCII) }, "-1,2,32767\n"},
+		{"int16 big", func(ctx *Context) { ctx.ResultArrayInt16([]int16{-1, 258}, FormatBigEndian) }, "#14\xff\xff\x01\x02\n"},
+		{"int16 little", func(ctx *Context) { ctx.ResultArrayInt16([]int16{258}, FormatLittleEndian) }, "#12\x02\x01\n"},
+		{"empty block", func(ctx *Context) { ctx.ResultArrayInt16(nil, FormatBigEndian) }, "#10\n"},
+	}
+
+	for _, tt := range tests {
+		var output strings.Builder
+		result := tt.result
+		commands := []*Command{
+			{
+				Pattern: "TRACe?",
+				Callback: func(ctx *Context) Result {
+					result(ctx)
+					return ResOK
+				},
+			},
+		}
+		iface := &Interface{
+			Write: func(data []byte) (int, error) {
+				return output.Write(data)
+			},
+		}
+		ctx := NewContext(commands, iface, 256)
+		ctx.Input([]byte("TRAC?\n"))
+
+		if output.String() != tt.want {
+			t.Errorf("%s: output = %q, want %q", tt.name, output.String(), tt.want)
+		}
+	}
+}
+
+func TestConvertUnit(t *testing.T) {
+	tests := []struct {
+		value float64
+		from  Unit
+		to    Unit
+		want  float64
+	}{
+		{1, UnitBar, UnitPascal, 1e5},
+		{50000, UnitPascal, UnitBar, 0.5},
+		{1, UnitPercent, UnitPPM, 1e4},
+		{0, UnitCelsius, UnitKelvin, 273.15},
+		{32, UnitFahrenheit, UnitCelsius, 0},
+		{0, UnitKelvin, UnitFahrenheit, -459.67},
+		{30, UnitDBm, UnitWatt, 1},
+		{1, UnitWatt, UnitDBm, 30},
+		{0, UnitDBW, UnitDBm, 30},
+		{120, UnitDBuV, UnitVolt, 1},
+		{0, UnitDBV, UnitDBuV, 120},
+		{2, UnitVolt, UnitVolt, 2},
+	}
+
+	for _, tt := range tests {
+		got, err := ConvertUnit(tt.value, tt.from, tt.to)
+		if err != nil {
+			t.Errorf("ConvertUnit(%g, %d, %d) error: %v", tt.value, tt.from, tt.to, err)
+			continue
+		}
+		if diff := got - tt.want; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("ConvertUnit(%g, %d, %d) = %g, want %g", tt.value, tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	bad := [][2]Unit{
+		{UnitVolt, UnitAmper},
+		{UnitBar, UnitCelsius},
+		{UnitDecibel, UnitWatt},
+		{UnitDBm, UnitVolt},
+		{UnitNone, UnitPercent},
+	}
+	for _, b := range bad {
+		if _, err := ConvertUnit(1, b[0], b[1]); err == nil {
+			t.Errorf("ConvertUnit(1, %d, %d) should fail", b[0], b[1])
+		}
+	}
+}
+
+func TestFormatSubsystem(t *testing.T) {
+	var output strings.Builder
+	var received []float64
+	var receivedErr error
+	commands := []*Command{
+		{Pattern: "FORMat[:DATA]?", Callback: FormatDataQ},
+		{Pattern: "FORMat[:DATA]", Callback: FormatData},
+		{Pattern: "FORMat:BORDer?", Callback: FormatBorderQ},
+		{Pattern: "FORMat:BORDer", Callback: FormatBorder},
+		{Pattern: "TRACe?", Callback: func(ctx *Context) Result {
+			ctx.ResultArray([]float64{1, -2})
+			return ResOK
+		}},
+		{Pattern: "TRACe:LIMits?", Callback: func(ctx *Context) Result {
+			ctx.ResultArray([]float64{1e10, -1e10, math.NaN()})
+			return ResOK
+		}},
+		{Pattern: "TRACe", Callback: func(ctx *Context) Result {
+			received, receivedErr = ctx.ParamDataArray(true)
+			return ResOK
+		}},
+	}
+	iface := &Interface{
+		Write: func(data []byte) (int, error) {
+			return output.Write(data)
+		},
+	}
+	ctx := NewContext(commands, iface, 256)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"FORM?", "ASC\n"},
+		{"FORM:BORD?", "NORM\n"},
+		{"TRAC?", "1,-2\n"},
+		{"FORM REAL", ""},
+		{"FORM?", "REAL,64\n"},
+		{"TRAC?", "#216\x3f\xf0\x00\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x00\n"},
+		{"FORM:DATA REAL,32", ""},
+		{"TRAC?", "#18\x3f\x80\x00\x00\xc0\x00\x00\x00\n"},
+		{"FORM:BORD SWAP", ""},
+		{"FORM:BORD?", "SWAP\n"},
+		{"TRAC?", "#18\x00\x00\x80\x3f\x00\x00\x00\xc0\n"},
+		{"FORM INT,32", ""},
+		{"FORM?", "INT,32\n"},
+		{"TRAC?", "#18\x01\x00\x00\x00\xfe\xff\xff\xff\n"},
+		{"FORM:BORD NORM;DATA INT", ""},
+		{"FORM?", "INT,16\n"},
+		{"TRAC?", "#14\x00\x01\xff\xfe\n"},
+		{"TRAC:LIM?", "#16\x7f\xff\x80\x00\x00\x00\n"},
+		{"FORM INT,32", ""},
+		{"TRAC:LIM?", "#212\x7f\xff\xff\xff\x80\x00\x00\x00\x00\x00\x00\x00\n"},
+		{"FORM INT", ""},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s: output = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+
+	ctx.Input([]byte("TRAC #14\x00\x05\xff\xfb\n"))
+	if receivedErr != nil || len(received) != 2 || received[0] != 5 || received[1] != -5 {
+		t.Errorf("ParamDataArray(INT,16 block) = %v, %v, want [5 -5]", received, receivedErr)
+	}
+
+	ctx.Input([]byte("TRAC #13\x00\x05\xff\n"))
+	if receivedErr == nil {
+		t.Error("ParamDataArray with odd block length should fail")
+	}
+
+	ctx.Input([]byte("FORM ASC\n"))
+	ctx.Input([]byte("TRAC 1.5, 2, #H10\n"))
+	if receivedErr != nil || len(received) != 3 || received[0] != 1.5 || received[2] != 16 {
+		t.Errorf("ParamDataArray(ASCII) = %v, %v, want [1.5 2 16]", received, receivedErr)
+	}
+
+	for ctx.ErrorPop() != nil {
+	}
+	ctx.Input([]byte("FORM REAL,16\n"))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -224 {
+		t.Errorf("FORM REAL,16 error = %v, want -224", e)
+	}
+}
+
+func TestParamInt32Range(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int32
+		ok    bool
+	}{
+		{"#H7FFFFFFF", math.MaxInt32, true},
+		{"#H80000000", 0, false},
+		{"#HFFFFFFFF", 0, false},
+		{"#Q17777777777", math.MaxInt32, true},
+		{"#Q20000000000", 0, false},
+		{"#B1111111111111111111111111111111", math.MaxInt32, true},
+		{"#B10000000000000000000000000000000", 0, false},
+		{"2147483647", math.MaxInt32, true},
+		{"2147483648", 0, false},
+		{"-2147483648", math.MinInt32, true},
+		{"-2147483649", 0, false},
+		{"2.147483647e9", math.MaxInt32, true},
+		{"1e10", 0, false},
+		{"#HFFFFFFFFFFFFFFFFF", 0, false},
+	}
+
+	for _, tt := range tests {
+		var got int32
+		var gotErr error
+		commands := []*Command{
+			{
+				Pattern: "TEST",
+				Callback: func(ctx *Context) Result {
+					got, gotErr = ctx.ParamInt32(true)
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, nil, 256)
+		ctx.Input([]byte("TEST " + tt.input + "\n"))
+
+		if tt.ok {
+			if gotErr != nil || got != tt.want {
+				t.Errorf("ParamInt32(%s) = %d, %v, want %d", tt.input, got, gotErr, tt.want)
+			}
+			continue
+		}
+		if gotErr == nil {
+			t.Errorf("ParamInt32(%s) = %d, want range error", tt.input, got)
+		}
+		if e := ctx.ErrorPop(); e == nil || e.Code != -222 {
+			t.Errorf("ParamInt32(%s) error = %v, want -222", tt.input, e)
+		}
+		if e := ctx.ErrorPop(); e != nil {
+			t.Errorf("ParamInt32(%s) pushed a second error %d", tt.input, e.Code)
+		}
+	}
+}
+
+func TestParamInt64Range(t *testing.T) {
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{"#H7FFFFFFFFFFFFFFF", true},
+		{"#H8000000000000000", false},
+		{"9223372036854775807", true},
+		{"9223372036854775808", false},
+		{"1e19", false},
+		{"-1e18", true},
+	}
+
+	for _, tt := range tests {
+		var gotErr error
+		commands := []*Command{
+			{
+				Pattern: "TEST",
+				Callback: func(ctx *Context) Result {
+					_, gotErr = ctx.ParamInt64(true)
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, nil, 256)
+		ctx.Input([]byte("TEST " + tt.input + "\n"))
+
+		if (gotErr == nil) != tt.ok {
+			t.Errorf("ParamInt64(%s) error = %v, want ok=%v", tt.input, gotErr, tt.ok)
+		}
+		if !tt.ok {
+			if e := ctx.ErrorPop(); e == nil || e.Code != -222 {
+				t.Errorf("ParamInt64(%s) error = %v, want -222", tt.input, e)
+			}
+		}
+	}
+}
+
+func TestSignedNondecimalRejected(t *testing.T) {
+	tests := []struct {
+		input string
+		ok    bool
+		want  int32
+	}{
+		{"#HFF", true, 255},
+		{"-#HFF", false, 0},
+		{"+#HFF", false, 0},
+		{"-#Q17", false, 0},
+		{"-#B101", false, 0},
+		{"- 5", false, 0},
+		{"-5", true, -5},
+		{"+5", true, 5},
+	}
+
+	for _, tt := range tests {
+		var got int32
+		var gotErr error
+		commands := []*Command{
+			{
+				Pattern: "TEST",
+				Callback: func(ctx *Context) Result {
+					got, gotErr = ctx.ParamInt32(true)
+					if gotErr != nil {
+						return ResErr
+					}
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, nil, 256)
+		ctx.Input([]byte("TEST " + tt.input + "\n"))
+
+		if tt.ok {
+			if gotErr != nil || got != tt.want {
+				t.Errorf("ParamInt32(%s) = %d, %v, want %d", tt.input, got, gotErr, tt.want)
+			}
+			continue
+		}
+		if gotErr == nil {
+			t.Errorf("ParamInt32(%s) = %d, want error", tt.input, got)
+		}
+		if e := ctx.ErrorPop(); e == nil || e.Code != -104 {
+			t.Errorf("ParamInt32(%s) error = %v, want -104", tt.input, e)
+		}
+	}
+}
+
+func TestResultArbitraryBlockReader(t *testing.T) {
+	payload := strings.Repeat("0123456789", 1000)
+
+	var output strings.Builder
+	var writes int
+	iface := &Interface{
+		Write: func(data []byte) (int, error) {
+			writes++
+			return output.Write(data)
+		},
+	}
+	commands := []*Command{
+		{
+			Pattern: "DATA?",
+			Callback: func(ctx *Context) Result {
+				if err := ctx.ResultArbitraryBlockReader(strings.NewReader(payload), int64(len(payload))); err != nil {
+					return ResErr
+				}
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, iface, 256)
+	ctx.Input([]byte("DATA?\n"))
+
+	want := "#510000" + payload + "\n"
+	if output.String() != want {
+		t.Errorf("block output = %q..., want %q...", output.String()[:20], want[:20])
+	}
+	if writes < 3 {
+		t.Errorf("payload written in %d calls, want it streamed in chunks", writes)
+	}
+}
+
+func TestResultArbitraryBlockReaderShort(t *testing.T) {
+	var output strings.Builder
+	var gotErr error
+	commands := []*Command{
+		{
+			Pattern: "DATA?",
+			Callback: func(ctx *Context) Result {
+				gotErr = ctx.ResultArbitraryBlockReader(strings.NewReader("ABC"), 5)
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+	ctx.Input([]byte("DATA?\n"))
+
+	if want := "#15ABC\x00\x00\n"; output.String() != want {
+		t.Errorf("short block output = %q, want %q", output.String(), want)
+	}
+	if gotErr == nil {
+		t.Error("expected error for short reader")
+	}
+	if e := ctx.ErrorPop(); e == nil || e.Code != -200 {
+		t.Errorf("error = %v, want -200", e)
+	}
+}
+
+func TestParameterBase(t *testing.T) {
+	tests := []struct {
+		input string
+		base  int
+		want  string
+	}{
+		{"#HFF", 16, "#HFF\n"},
+		{"#hff", 16, "#HFF\n"},
+		{"#Q17", 8, "#Q17\n"},
+		{"#B101", 2, "#B101\n"},
+		{"42", 10, "42\n"},
+		{"4.2E1", 10, "42\n"},
+	}
+
+	for _, tt := range tests {
+		var output strings.Builder
+		var gotBase int
+		commands := []*Command{
+			{
+				Pattern: "MASK",
+				Callback: func(ctx *Context) Result {
+					param, err := ctx.Parameter(true)
+					if err != nil {
+						return ResErr
+					}
+					gotBase = param.Base()
+					val, err := param.AsInt()
+					if err != nil {
+						return ResErr
+					}
+					ctx.ResultInt64Base(val, gotBase)
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+		ctx.Input([]byte("MASK " + tt.input + "\n"))
+
+		if gotBase != tt.base {
+			t.Errorf("Base(%s) = %d, want %d", tt.input, gotBase, tt.base)
+		}
+		if output.String() != tt.want {
+			t.Errorf("echo of %s = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+
+	var num Number
+	commands := []*Command{
+		{
+			Pattern: "MASK",
+			Callback: func(ctx *Context) Result {
+				num, _ = ctx.ParamNumber(true)
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, nil, 256)
+	ctx.Input([]byte("MASK #Q7\n"))
+	if num.Base != 8 || num.Value != 7 {
+		t.Errorf("ParamNumber(#Q7) = base %d value %v, want base 8 value 7", num.Base, num.Value)
+	}
+}
+
+func TestResultArbitraryBlockIndefinite(t *testing.T) {
+	var output strings.Builder
+	var endAt int
+	iface := &Interface{
+		Write: output.Write,
+		End: func() error {
+			endAt = output.Len()
+			return nil
+		},
+	}
+	commands := []*Command{
+		{
+			Pattern: "DATA?",
+			Callback: func(ctx *Context) Result {
+				if err := ctx.ResultArbitraryBlockIndefinite(strings.NewReader("AB\nC")); err != nil {
+					return ResErr
+				}
+				return ResOK
+			},
+		},
+		{
+			Pattern: "NUM?",
+			Callback: func(ctx *Context) Result {
+				ctx.ResultInt32(7)
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, iface, 256)
+	ctx.Input([]byte("DATA?\n"))
+
+	if want := "#0AB\nC\n"; output.String() != want {
+		t.Errorf("indefinite block output = %q, want %q", output.String(), want)
+	}
+	if endAt != output.Len() {
+		t.Errorf("End called after %d bytes, want %d", endAt, output.Len())
+	}
+
+	output.Reset()
+	ctx.Input([]byte("DATA?;NUM?\n"))
+	if want := "#0AB\nC\n7\n"; output.String() != want {
+		t.Errorf("output after indefinite block = %q, want %q", output.String(), want)
+	}
+}
+
+func TestFloatFormat(t *testing.T) {
+	var output strings.Builder
+	a, b := 0.1, 0.2
+	commands := []*Command{
+		{
+			Pattern: "VAL?",
+			Callback: func(ctx *Context) Result {
+				ctx.ResultDouble(a + b)
+				return ResOK
+			},
+		},
+		{
+			Pattern: "PREC?",
+			Callback: func(ctx *Context) Result {
+				ctx.ResultDoubleFmt(math.Pi, 4)
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+
+	tests := []struct {
+		format string
+		input  string
+		want   string
+	}{
+		{"", "VAL?", "0.30000000000000004\n"},
+		{"%.15g", "VAL?", "0.3\n"},
+		{"%.3E", "VAL?", "3.000E-01\n"},
+		{"%.15g", "PREC?", "3.142\n"},
+	}
+
+	for _, tt := range tests {
+		output.Reset()
+		ctx.SetFloatFormat(tt.format)
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s with format %q = %q, want %q", tt.input, tt.format, output.String(), tt.want)
+		}
+	}
+	if got := ctx.FloatFormat(); got != "%.15g" {
+		t.Errorf("FloatFormat() = %q, want %%.15g", got)
+	}
+}
+
+func TestSystemFirmwareUpdate(t *testing.T) {
+	var installed []byte
+	var rebooted bool
+	commands := []*Command{
+		{Pattern: "SYSTem:REBoot", Callback: SystemReboot},
+		{Pattern: "SYSTem:FIRMware:UPDate", Callback: SystemFirmwareUpdate},
+		{Pattern: "SYSTem:FIRMware:UPDate:ENABle", Callback: SystemFirmwareUpdateEnable},
+		{Pattern: "SYSTem:FIRMware:UPDate:ENABle?", Callback: SystemFirmwareUpdateEnableQ},
+	}
+	var output strings.Builder
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+
+	// Without hooks both commands fail
+	ctx.Input([]byte("SYST:REB\n"))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -200 {
+		t.Errorf("SYST:REB without hook error = %v, want -200", e)
+	}
+
+	ctx.SetSystemHooks(&SystemHooks{
+		Reboot: func() error {
+			rebooted = true
+			return nil
+		},
+		ValidateFirmware: func(image []byte, checksum string) error {
+			if checksum != fmt.Sprintf("%d", len(image)) {
+				return fmt.Errorf("checksum %s does not match", checksum)
+			}
+			return nil
+		},
+		InstallFirmware: func(image []byte) error {
+			installed = image
+			return nil
+		},
+	})
+
+	ctx.Input([]byte("SYST:REB\n"))
+	if !rebooted {
+		t.Error("SYST:REB did not call Reboot")
+	}
+
+	// Not enabled
+	ctx.Input([]byte("SYST:FIRM:UPD #14IMG1,'4'\n"))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -203 {
+		t.Errorf("update while disabled error = %v, want -203", e)
+	}
+
+	// Bad checksum, which also disables updates again
+	ctx.Input([]byte("SYST:FIRM:UPD:ENAB ON;:SYST:FIRM:UPD #14IMG1,'5'\n"))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -230 {
+		t.Errorf("update with bad checksum error = %v, want -230", e)
+	}
+	output.Reset()
+	ctx.Input([]byte("SYST:FIRM:UPD:ENAB?\n"))
+	if output.String() != "0\n" {
+		t.Errorf("SYST:FIRM:UPD:ENAB? after attempt = %q, want 0", output.String())
+	}
+
+	ctx.Input([]byte("SYST:FIRM:UPD:ENAB ON;:SYST:FIRM:UPD #14IMG1,'4'\n"))
+	if e := ctx.ErrorPop(); e != nil {
+		t.Errorf("unexpected error %d: %s", e.Code, e.Info)
+	}
+	if string(installed) != "IMG1" {
+		t.Errorf("installed image = %q, want IMG1", installed)
+	}
+
+	// Images larger than MaxImageSize are rejected
+	installed = nil
+	ctx.SetSystemHooks(&SystemHooks{MaxImageSize: 3, InstallFirmware: func(image []byte) error {
+		installed = image
+		return nil
+	}})
+	ctx.Input([]byte("SYST:FIRM:UPD:ENAB ON;:SYST:FIRM:UPD #14IMG1\n"))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -223 || installed != nil {
+		t.Errorf("oversized image error = %v, installed %q, want -223", e, installed)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	data := []byte("123456789")
+
+	// Standard check values
+	if err := VerifyChecksum(data, ChecksumCRC32, "cbf43926"); err != nil {
+		t.Errorf("CRC32 check value: %v", err)
+	}
+	if err := VerifyChecksum(data, ChecksumSHA256, "15E2B0D3C33891EBB0F1EF609EC419420C20E320CE94C65FBC8C3312448EB225"); err != nil {
+		t.Errorf("SHA256 check value: %v", err)
+	}
+	if err := VerifyChecksum(data, ChecksumCRC32, "CBF43927"); err == nil {
+		t.Error("expected mismatch error")
+	}
+	if err := VerifyChecksum(data, ChecksumCRC32, "XYZ"); err == nil {
+		t.Error("expected malformed checksum error")
+	}
+	if err := FirmwareChecksum(ChecksumCRC32)(data, "CBF43926"); err != nil {
+		t.Errorf("FirmwareChecksum: %v", err)
+	}
+}
+
+func TestParamArbitraryBlockChecked(t *testing.T) {
+	var got []byte
+	var gotErr error
+	commands := []*Command{
+		{
+			Pattern: "UPLoad",
+			Callback: func(ctx *Context) Result {
+				got, gotErr = ctx.ParamArbitraryBlockChecked(ChecksumCRC32, true)
+				if gotErr != nil {
+					return ResErr
+				}
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, nil, 256)
+
+	block := func(payload []byte) string {
+		return fmt.Sprintf("#1%d%s", len(payload), payload)
+	}
+	good := append([]byte("WAVE"), ChecksumCRC32.Sum([]byte("WAVE"))...)
+	ctx.Input([]byte("UPL " + block(good) + "\n"))
+	if gotErr != nil || string(got) != "WAVE" {
+		t.Errorf("checked block = %q, %v, want WAVE", got, gotErr)
+	}
+
+	bad := append([]byte("WAVX"), ChecksumCRC32.Sum([]byte("WAVE"))...)
+	for _, payload := range [][]byte{bad, []byte("AB")} {
+		ctx.Input([]byte("UPL " + block(payload) + "\n"))
+		if gotErr == nil {
+			t.Errorf("checked block %q: expected error", payload)
+		}
+		if e := ctx.ErrorPop(); e == nil || e.Code != -230 {
+			t.Errorf("checked block %q error = %v, want -230", payload, e)
+		}
+	}
+}
+
+func TestResultIntegerBase(t *testing.T) {
+	var output strings.Builder
+	commands := []*Command{
+		{
+			Pattern: "REG?",
+			Callback: func(ctx *Context) Result {
+				ctx.ResultInt32Base(255, 16)
+				ctx.ResultInt32Base(-1, 16)
+				ctx.ResultInt32Base(-1, 10)
+				ctx.ResultInt64Base(-1, 8)
+				ctx.ResultUInt32Base(10, 2)
+				ctx.ResultUInt32Base(0, 2)
+				ctx.ResultUInt64Base(math.MaxUint64, 16)
+				ctx.ResultUInt64Base(math.MaxUint64, 10)
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+	ctx.Input([]byte("REG?\n"))
+
+	want := "#HFF,#HFFFFFFFF,-1,#Q1777777777777777777777,#B1010,#B0,#HFFFFFFFFFFFFFFFF,18446744073709551615\n"
+	if output.String() != want {
+		t.Errorf("REG? = %q, want %q", output.String(), want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	called := false
+	callback := func(ctx *Context) Result {
+		called = true
+		return ResOK
+	}
+	commands := []*Command{
+		{
+			Pattern:  "SOURce:VOLTage",
+			Callback: callback,
+			Params: []ParamSpec{
+				{Name: "level", Kinds: []ParamKind{KindNumeric, KindMnemonic}},
+				{Name: "range", Kinds: []ParamKind{KindNumeric}, Optional: true},
+			},
+		},
+		{Pattern: "SOURce:CURRent", Callback: callback},
+		{Pattern: "*RST", Callback: callback, Params: []ParamSpec{}},
+	}
+	ctx := NewContext(commands, nil, 256)
+
+	tests := []struct {
+		input string
+		codes []int16
+		pos   []int
+	}{
+		{"SOUR:VOLT 5 V\n", nil, nil},
+		{"SOUR:VOLT MAX,10\n", nil, nil},
+		{"SOUR:VOLT\n", []int16{-109}, []int{9}},
+		{"SOUR:VOLT 'x'\n", []int16{-104}, []int{10}},
+		{"SOUR:VOLT 1,2,3\n", []int16{-108}, []int{14}},
+		{"SOUR:VOLT 1;CURR 'any',#HFF\n", nil, nil},
+		{"SOUR:VOLT -#HFF\n", []int16{-104}, []int{10}},
+		{"SOUR:VOLT 1_000\n", []int16{-121}, []int{11}},
+		{"*RST 1\n", []int16{-108}, []int{5}},
+		{"BOGus;*RST;SOUR:VOLT\n", []int16{-113, -109}, []int{0, 20}},
+	}
+
+	for _, tt := range tests {
+		diags := ctx.Validate([]byte(tt.input))
+		if len(diags) != len(tt.codes) {
+			t.Errorf("Validate(%q) = %v, want codes %v", tt.input, diags, tt.codes)
+			continue
+		}
+		for i, d := range diags {
+			if d.Code != tt.codes[i] || d.Pos != tt.pos[i] {
+				t.Errorf("Validate(%q)[%d] = %d at %d, want %d at %d", tt.input, i, d.Code, d.Pos, tt.codes[i], tt.pos[i])
+			}
+		}
+	}
+
+	if called {
+		t.Error("Validate invoked a callback")
+	}
+	if e := ctx.ErrorPop(); e != nil {
+		t.Errorf("Validate queued error %d", e.Code)
+	}
+}
+
+func TestResultUnsigned(t *testing.T) {
+	var output strings.Builder
+	commands := []*Command{
+		{
+			Pattern: "STATus:REGister?",
+			Callback: func(ctx *Context) Result {
+				ctx.ResultUInt32(math.MaxUint32)
+				ctx.ResultUInt32(0)
+				ctx.ResultUInt64(math.MaxUint64)
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+	ctx.Input([]byte("STAT:REG?\n"))
+
+	if want := "4294967295,0,18446744073709551615\n"; output.String() != want {
+		t.Errorf("STAT:REG? = %q, want %q", output.String(), want)
+	}
+}
+
+// memStore is an in-memory StateStore
+type memStore map[string][]byte
+
+func (m memStore) Load(name string) ([]byte, error) { return m[name], nil }
+
+func (m memStore) Save(name string, data []byte) error {
+	m[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func TestPowerOnType(t *testing.T) {
+	store := memStore{}
+	state := "default"
+	power := &PowerOn{
+		Store:    store,
+		Reset:    func() error { state = "default"; return nil },
+		Snapshot: func() ([]byte, error) { return []byte(state), nil },
+		Restore:  func(s []byte) error { state = string(s); return nil },
+	}
+	commands := []*Command{
+		{Pattern: "SYSTem:POWeron:TYPE", Callback: SystemPoweronType},
+		{Pattern: "SYSTem:POWeron:TYPE?", Callback: SystemPoweronTypeQ},
+	}
+
+	var output strings.Builder
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+	if err := ctx.SetPowerOn(power); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Input([]byte("SYST:POW:TYPE?\n"))
+	if output.String() != "RST\n" {
+		t.Errorf("default SYST:POW:TYPE? = %q, want RST", output.String())
+	}
+
+	ctx.Input([]byte("SYST:POW:TYPE LAST\n"))
+	state = "running"
+	if err := ctx.SaveLastState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Power cycle
+	state = ""
+	output.Reset()
+	ctx = NewContext(commands, &Interface{Write: output.Write}, 256)
+	if err := ctx.SetPowerOn(power); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.ApplyPowerOnState(); err != nil {
+		t.Fatal(err)
+	}
+	if state != "running" {
+		t.Errorf("LAST power-on state = %q, want running", state)
+	}
+	ctx.Input([]byte("SYST:POW:TYPE?\n"))
+	if output.String() != "LAST\n" {
+		t.Errorf("SYST:POW:TYPE? after power cycle = %q, want LAST", output.String())
+	}
+
+	// RCL0 without a saved slot falls back to the defaults
+	ctx.Input([]byte("SYST:POW:TYPE RCL0\n"))
+	if err := ctx.ApplyPowerOnState(); err != nil {
+		t.Fatal(err)
+	}
+	if state != "default" {
+		t.Errorf("RCL0 power-on state without slot 0 = %q, want default", state)
+	}
+	store["state.0"] = []byte("slot0")
+	ctx.ApplyPowerOnState()
+	if state != "slot0" {
+		t.Errorf("RCL0 power-on state = %q, want slot0", state)
+	}
+
+	ctx.Input([]byte("SYST:POW:TYPE BOGUS\n"))
+	if e := ctx.ErrorPop(); e == nil {
+		t.Error("expected error for invalid power-on type")
+	}
+}
+
+func TestPersistLastState(t *testing.T) {
+	store := memStore{}
+	saved := make(chan struct{}, 1)
+	power := &PowerOn{
+		Store: store,
+		Reset: func() error { return nil },
+		Snapshot: func() ([]byte, error) {
+			select {
+			case saved <- struct{}{}:
+			default:
+			}
+			return []byte("snap"), nil
+		},
+		Restore: func(s []byte) error { return nil },
+	}
+	ctx := NewContext(nil, nil, 256)
+	ctx.SetPowerOn(power)
+	ctx.SetPowerOnType(PowerOnLast)
+
+	stop := ctx.PersistLastState(time.Millisecond, nil)
+	defer stop()
+	select {
+	case <-saved:
+	case <-time.After(2 * time.Second):
+		t.Fatal("state was not persisted")
+	}
+}
+
+func TestResultError(t *testing.T) {
+	var output strings.Builder
+	commands := []*Command{
+		{
+			Pattern: "SYSTem:ERRor[:NEXT]?",
+			Callback: func(ctx *Context) Result {
+				ctx.ResultError(ctx.ErrorPop())
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+
+	ctx.Input([]byte("SYST:ERR?\n"))
+	if want := "0,\"No error\"\n"; output.String() != want {
+		t.Errorf("SYST:ERR? = %q, want %q", output.String(), want)
+	}
+
+	output.Reset()
+	ctx.ErrorPush(&Error{Code: -113, Info: `Undefined header: "X"`})
+	ctx.Input([]byte("SYST:ERR?\n"))
+	if want := "-113,\"Undefined header: \"\"X\"\"\"\n"; output.String() != want {
+		t.Errorf("SYST:ERR? = %q, want %q", output.String(), want)
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	var output strings.Builder
+	commands := []*Command{
+		{Pattern: "SYSTem:SIMulate", Callback: SystemSimulate},
+		{Pattern: "SYSTem:SIMulate?", Callback: SystemSimulateQ},
+		{
+			Pattern: "MEASure:VOLTage?",
+			Callback: func(ctx *Context) Result {
+				ctx.ResultDouble(1.5)
+				return ResOK
+			},
+			Simulate: func(ctx *Context) Result {
+				ctx.ResultDouble(9.5)
+				return ResOK
+			},
+		},
+		{
+			Pattern: "MEASure:CURRent?",
+			Callback: func(ctx *Context) Result {
+				ctx.ResultBool(ctx.Simulating())
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"MEAS:VOLT?", "1.5\n"},
+		{"SYST:SIM?", "0\n"},
+		{"SYST:SIM ON", ""},
+		{"SYST:SIM?", "1\n"},
+		{"MEAS:VOLT?", "9.5\n"},
+		{"MEAS:CURR?", "1\n"},
+		{"SYST:SIM OFF", ""},
+		{"MEAS:VOLT?", "1.5\n"},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+}
+
+func TestResultChannelList(t *testing.T) {
+	tests := []string{
+		"(@1,3:5)",
+		"(@1!2:3!4,5!6)",
+		"(@7)",
+		"(@)",
+	}
+
+	for _, input := range tests {
+		var output strings.Builder
+		commands := []*Command{
+			{
+				Pattern: "ROUTe:CLOSe?",
+				Callback: func(ctx *Context) Result {
+					entries, err := ctx.ParamChannelList(true)
+					if err != nil {
+						return ResErr
+					}
+					ctx.ResultChannelList(entries)
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+		ctx.Input([]byte("ROUT:CLOS? " + input + "\n"))
+
+		if output.String() != input+"\n" {
+			t.Errorf("ResultChannelList round trip of %s = %q", input, output.String())
+		}
+	}
+}
+
+func TestParamNumberWithUnitsMismatch(t *testing.T) {
+	tests := []struct {
+		input string
+		units []Unit
+		info  string
+	}{
+		{"10 OHM", []Unit{UnitVolt}, "Invalid suffix;OHM, expected V"},
+		{"10 MA", []Unit{UnitVolt, UnitWatt}, "Invalid suffix;MA, expected V, W"},
+		{"10 V/S", []Unit{UnitVolt}, "Invalid suffix;V/S, expected V"},
+		{"2 MM2", []Unit{UnitMeter}, "Invalid suffix;MM2, expected M"},
+		{"10 V", []Unit{UnitVolt}, ""},
+		{"10", []Unit{UnitVolt}, ""},
+		{"25 CEL", []Unit{UnitKelvin}, ""},
+		{"10 OHM", nil, ""},
+	}
+
+	for _, tt := range tests {
+		var gotErr error
+		commands := []*Command{
+			{
+				Pattern: "TEST",
+				Callback: func(ctx *Context) Result {
+					_, gotErr = ctx.ParamNumberWithUnits(tt.units, true)
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, nil, 256)
+		ctx.Input([]byte("TEST " + tt.input + "\n"))
+
+		e := ctx.ErrorPop()
+		if tt.info == "" {
+			if gotErr != nil || e != nil {
+				t.Errorf("ParamNumberWithUnits(%q) error = %v, %v, want none", tt.input, gotErr, e)
+			}
+			continue
+		}
+		if gotErr == nil || e == nil || e.Code != -131 || e.Message() != tt.info {
+			t.Errorf("ParamNumberWithUnits(%q) error = %v, %+v, want -131 %q", tt.input, gotErr, e, tt.info)
+		}
+	}
+}
+
+func TestInvalidCharacterInNumber(t *testing.T) {
+	tests := []struct {
+		input string
+		code  int16
+	}{
+		{"1_000", -121},
+		{"1.2.3", -121},
+		{"#HFG", -121},
+		{"5V_", -121},
+		{"1000", 0},
+		{"1 V", 0},
+		{"#HFF ", 0},
+		// A comma always separates parameters, so "1,000" is two of them
+		{"1,000", -108},
+	}
+
+	for _, tt := range tests {
+		commands := []*Command{
+			{
+				Pattern: "TEST",
+				Callback: func(ctx *Context) Result {
+					if _, err := ctx.ParamDouble(true); err != nil {
+						return ResErr
+					}
+					return ResOK
+				},
+			},
+		}
+		ctx := NewContext(commands, nil, 256)
+		ctx.SetCheckTrailingParams(true)
+		ctx.Input([]byte("TEST " + tt.input + "\n"))
+
+		e := ctx.ErrorPop()
+		if tt.code == 0 {
+			if e != nil {
+				t.Errorf("TEST %s: unexpected error %d", tt.input, e.Code)
+			}
+			continue
+		}
+		if e == nil || e.Code != tt.code {
+			t.Errorf("TEST %s: error = %v, want %d", tt.input, e, tt.code)
+		}
+		if e := ctx.ErrorPop(); e != nil {
+			t.Errorf("TEST %s: second error %d", tt.input, e.Code)
+		}
+	}
+}
+
+func TestResultSpecialValues(t *testing.T) {
+	var output strings.Builder
+	commands := []*Command{
+		{
+			Pattern: "FETCh?",
+			Callback: func(ctx *Context) Result {
+				ctx.ResultNotANumber()
+				ctx.ResultInfinity()
+				ctx.ResultNegativeInfinity()
+				ctx.ResultDoubleSpecial(math.NaN())
+				ctx.ResultDoubleSpecial(math.Inf(1))
+				ctx.ResultDoubleSpecial(math.Inf(-1))
+				ctx.ResultDoubleSpecial(1.5)
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+	ctx.Input([]byte("FETC?\n"))
+
+	want := "9.91E+37,9.9E+37,-9.9E+37,9.91E+37,9.9E+37,-9.9E+37,1.5\n"
+	if output.String() != want {
+		t.Errorf("FETC? = %q, want %q", output.String(), want)
+	}
+}
+
+func TestCheckMnemonicLength(t *testing.T) {
+	commands := []*Command{
+		{Pattern: "SOURce:FREQuency[:CW]", Callback: func(ctx *Context) Result { return ResOK }},
+		{Pattern: "OUTPut#:STATe?", Callback: func(ctx *Context) Result { return ResOK }},
+	}
+	ctx := NewContext(commands, nil, 256)
+	if err := ctx.SetCheckMnemonicLength(true); err != nil {
+		t.Fatalf("SetCheckMnemonicLength: %v", err)
+	}
+
+	tests := []struct {
+		input string
+		code  int16
+	}{
+		{"SOUR:FREQ:CW", 0},
+		{"OUTP12:STAT?", 0},
+		{"SOURCEXXXXXXX:FREQ", -112},
+		{"*ABCDEFGHIJKLM", -112},
+		{"SOUR:FREQUENCYXXXX", -112},
+	}
+	for _, tt := range tests {
+		ctx.Input([]byte(tt.input + "\n"))
+		e := ctx.ErrorPop()
+		if tt.code == 0 && e != nil {
+			t.Errorf("%s: unexpected error %d", tt.input, e.Code)
+		}
+		if tt.code != 0 && (e == nil || e.Code != tt.code) {
+			t.Errorf("%s: error = %v, want %d", tt.input, e, tt.code)
+		}
+	}
+
+	// Off by default: long headers are only undefined
+	ctx.SetCheckMnemonicLength(false)
+	ctx.Input([]byte("SOURCEXXXXXXX:FREQ\n"))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -113 {
+		t.Errorf("unchecked long header error = %v, want -113", e)
+	}
+
+	long := append(commands, &Command{Pattern: "MEASure:TEMPeratureSENSor?"})
+	if err := CheckPatterns(long); err == nil {
+		t.Error("CheckPatterns accepted a 17-character mnemonic")
+	}
+	if err := NewContext(long, nil, 256).SetCheckMnemonicLength(true); err == nil {
+		t.Error("SetCheckMnemonicLength accepted a 17-character mnemonic")
+	}
+}
+
+func TestResultTimestamp(t *testing.T) {
+	ts := time.Date(2024, time.May, 1, 9, 5, 7, 0, time.UTC)
+
+	var output strings.Builder
+	commands := []*Command{
+		{Pattern: "SYSTem:DATE?", Callback: func(ctx *Context) Result {
+			ctx.ResultDate(ts)
+			return ResOK
+		}},
+		{Pattern: "SYSTem:TIME?", Callback: func(ctx *Context) Result {
+			ctx.ResultTime(ts)
+			return ResOK
+		}},
+		{Pattern: "SYSTem:STAMp?", Callback: func(ctx *Context) Result {
+			ctx.ResultTimestamp(ts)
+			return ResOK
+		}},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"SYST:DATE?", "2024,5,1\n"},
+		{"SYST:TIME?", "9,5,7\n"},
+		{"SYST:STAM?", "\"2024-05-01T09:05:07Z\"\n"},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+}
+
+func TestResponseTerminator(t *testing.T) {
+	var output strings.Builder
+	commands := []*Command{
+		{Pattern: "*IDN?", Callback: func(ctx *Context) Result {
+			ctx.ResultMnemonic("ACME")
+			return ResOK
+		}},
+		{Pattern: "DATA?", Callback: func(ctx *Context) Result {
+			ctx.ResultArbitraryBlockIndefinite(strings.NewReader("AB"))
+			return ResOK
+		}},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+
+	ctx.SetResponseTerminator([]byte("\r\n"))
+	ctx.Input([]byte("*IDN?\n"))
+	ctx.Input([]byte("DATA?\n"))
+	if want := "ACME\r\n#0AB\r\n"; output.String() != want {
+		t.Errorf("CRLF output = %q, want %q", output.String(), want)
+	}
+
+	output.Reset()
+	ctx.SetResponseTerminator(nil)
+	ctx.Input([]byte("*IDN?\n"))
+	if output.String() != "ACME\n" {
+		t.Errorf("default output = %q, want %q", output.String(), "ACME\n")
+	}
+}
+
+func TestMaxHeaderDepth(t *testing.T) {
+	matched := false
+	commands := []*Command{
+		{Pattern: "SOURce:VOLTage[:LEVel]:IMMediate", Callback: func(ctx *Context) Result {
+			matched = true
+			return ResOK
+		}},
+	}
+	ctx := NewContext(commands, nil, 1<<16)
+
+	ctx.Input([]byte("SOUR:VOLT:LEV:IMM\n"))
+	if !matched {
+		t.Error("header at the deepest pattern depth was rejected")
+	}
+
+	deep := "SOUR" + strings.Repeat(":VOLT", 10000) + "\n"
+	ctx.Input([]byte(deep))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -113 {
+		t.Errorf("10k-node header error = %v, want -113", e)
+	}
+
+	ctx.SetMaxHeaderDepth(2)
+	matched = false
+	ctx.Input([]byte("SOUR:VOLT:IMM\n"))
+	if matched {
+		t.Error("header deeper than SetMaxHeaderDepth was accepted")
+	}
+	if e := ctx.ErrorPop(); e == nil || e.Code != -113 {
+		t.Errorf("header deeper than limit error = %v, want -113", e)
+	}
+}
+
+func TestCompoundQueryResponse(t *testing.T) {
+	var output strings.Builder
+	commands := []*Command{
+		{Pattern: "MEASure:VOLTage?", Callback: func(ctx *Context) Result {
+			ctx.ResultDouble(1.5)
+			return ResOK
+		}},
+		{Pattern: "MEASure:CURRent?", Callback: func(ctx *Context) Result {
+			ctx.ResultDouble(0.25)
+			return ResOK
+		}},
+		{Pattern: "MEASure:ALL?", Callback: func(ctx *Context) Result {
+			ctx.ResultDouble(1.5)
+			ctx.ResultDouble(0.25)
+			return ResOK
+		}},
+		{Pattern: "OUTPut", Callback: func(ctx *Context) Result { return ResOK }},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"MEAS:VOLT?;CURR?", "1.5;0.25\n"},
+		{"MEAS:ALL?;:MEAS:VOLT?", "1.5,0.25;1.5\n"},
+		{"OUTP;:MEAS:VOLT?;:OUTP;:MEAS:CURR?", "1.5;0.25\n"},
+		{"MEAS:VOLT?\nMEAS:CURR?", "1.5\n0.25\n"},
+		{"OUTP;:OUTP", ""},
+		// The response is terminated even when parsing stops at an error
+		{"MEAS:VOLT?;BOGus", "1.5\n"},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%q = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+}
+
+func TestResultShortWrites(t *testing.T) {
+	var output strings.Builder
+	iface := &Interface{Write: func(data []byte) (int, error) {
+		// Accept at most two bytes per call
+		n := min(len(data), 2)
+		output.Write(data[:n])
+		return n, nil
+	}}
+	commands := []*Command{
+		{Pattern: "TEST?", Callback: func(ctx *Context) Result {
+			ctx.ResultText("hello")
+			ctx.ResultArbitraryBlock([]byte("abcde"))
+			return ResOK
+		}},
+	}
+	ctx := NewContext(commands, iface, 256)
+
+	if err := ctx.Input([]byte("TEST?\n")); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\"hello\",#15abcde\n"; output.String() != want {
+		t.Errorf("output = %q, want %q", output.String(), want)
+	}
+}
+
+func TestResultWriteError(t *testing.T) {
+	errBroken := errors.New("broken pipe")
+	var output strings.Builder
+	var writes int
+	iface := &Interface{Write: func(data []byte) (int, error) {
+		writes++
+		if output.Len()+len(data) > 4 {
+			return 0, errBroken
+		}
+		return output.Write(data)
+	}}
+
+	var resultErrs []error
+	ranNext := false
+	commands := []*Command{
+		{Pattern: "TEST?", Callback: func(ctx *Context) Result {
+			resultErrs = append(resultErrs, ctx.ResultInt32(12), ctx.ResultInt32(345), ctx.ResultInt32(6))
+			return ResOK
+		}},
+		{Pattern: "NEXT?", Callback: func(ctx *Context) Result {
+			ranNext = true
+			ctx.ResultInt32(7)
+			return ResOK
+		}},
+	}
+	ctx := NewContext(commands, iface, 256)
+
+	err := ctx.Input([]byte("TEST?;:NEXT?\n"))
+	if !errors.Is(err, errBroken) {
+		t.Errorf("Input error = %v, want %v", err, errBroken)
+	}
+	if resultErrs[0] != nil || !errors.Is(resultErrs[1], errBroken) || !errors.Is(resultErrs[2], errBroken) {
+		t.Errorf("Result errors = %v, want nil then %v", resultErrs, errBroken)
+	}
+	if ranNext {
+		t.Error("command after the failed write ran")
+	}
+	if writes != 3 {
+		t.Errorf("Write called %d times, want 3 (no writes after the failure)", writes)
+	}
+	if e := ctx.ErrorPop(); e == nil || e.Code != CodeCommunicationError {
+		t.Errorf("ErrorPop() = %v, want -360", e)
+	}
+	if e := ctx.ErrorPop(); e != nil {
+		t.Errorf("second ErrorPop() = %v, want nil", e)
+	}
+
+	// The next message writes again
+	output.Reset()
+	if err := ctx.Input([]byte("NEXT?\n")); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "7\n" {
+		t.Errorf("output = %q, want %q", output.String(), "7\n")
+	}
+}
+
+func TestCommandSetVersion(t *testing.T) {
+	newCommands := func(extra ...*Command) []*Command {
+		return append([]*Command{
+			{Pattern: "SYSTem:COMMand:VERSion?", Callback: SystemCommandVersionQ},
+			{Pattern: "SOURce:VOLTage", Params: []ParamSpec{{Name: "level", Kinds: []ParamKind{KindNumeric}}}},
+		}, extra...)
+	}
+
+	var output strings.Builder
+	ctx := NewContext(newCommands(), &Interface{Write: output.Write}, 256)
+	ctx.SetCommandSetVersion("2.1.0")
+	hash := ctx.CommandSetHash()
+	if len(hash) != 16 {
+		t.Fatalf("CommandSetHash() = %q, want 16 hex digits", hash)
+	}
+
+	ctx.Input([]byte("SYST:COMM:VERS?\n"))
+	if want := "\"2.1.0+" + hash + "\"\n"; output.String() != want {
+		t.Errorf("SYST:COMM:VERS? = %q, want %q", output.String(), want)
+	}
+
+	// Order does not matter, the patterns and schemas do
+	cmds := newCommands()
+	cmds[0], cmds[1] = cmds[1], cmds[0]
+	if got := NewContext(cmds, nil, 256).CommandSetHash(); got != hash {
+		t.Errorf("hash of reordered commands = %s, want %s", got, hash)
+	}
+	added := NewContext(newCommands(&Command{Pattern: "OUTPut"}), nil, 256)
+	if added.CommandSetHash() == hash {
+		t.Error("adding a command did not change the hash")
+	}
+	cmds = newCommands()
+	cmds[1].Params[0].Optional = true
+	if NewContext(cmds, nil, 256).CommandSetHash() == hash {
+		t.Error("changing a parameter schema did not change the hash")
+	}
+	ctx.AddPersonality(&Personality{Name: "OLD", Aliases: []AliasDef{{"VOLTage", "SOURce:VOLTage"}}})
+	if ctx.CommandSetHash() == hash {
+		t.Error("personality aliases did not change the hash")
+	}
+
+	if got := NewContext(nil, nil, 256).CommandSetVersion(); !strings.HasPrefix(got, "0.0.0+") {
+		t.Errorf("default CommandSetVersion() = %q, want 0.0.0+<hash>", got)
+	}
+}
+
+func TestOptionalLeadingNode(t *testing.T) {
+	var got []string
+	record := func(ctx *Context) Result {
+		v, _ := ctx.ParamDouble(true)
+		n := ctx.CommandNumbers(2, 1)
+		got = append(got, fmt.Sprintf("%s %g %v", ctx.currentCmd.Pattern, v, n))
+		return ResOK
+	}
+	commands := []*Command{
+		{Pattern: "[SOURce:]VOLTage", Callback: record},
+		{Pattern: "[SOURce:]CURRent", Callback: record},
+		{Pattern: "[SOURce#:]OUTPut#", Callback: record},
+	}
+	ctx := NewContext(commands, &Interface{}, 256)
+
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"VOLT 5", []string{"[SOURce:]VOLTage 5 [1 1]"}},
+		{"SOUR:VOLT 5", []string{"[SOURce:]VOLTage 5 [1 1]"}},
+		{":SOURCE:VOLTAGE 5", []string{"[SOURce:]VOLTage 5 [1 1]"}},
+		{"SOUR:VOLT 5;CURR 2", []string{"[SOURce:]VOLTage 5 [1 1]", "[SOURce:]CURRent 2 [1 1]"}},
+		{"VOLT 5;CURR 2", []string{"[SOURce:]VOLTage 5 [1 1]", "[SOURce:]CURRent 2 [1 1]"}},
+		{"OUTP3 1", []string{"[SOURce#:]OUTPut# 1 [1 3]"}},
+		{"SOUR2:OUTP3 1", []string{"[SOURce#:]OUTPut# 1 [2 3]"}},
+	}
+	for _, tt := range tests {
+		got = nil
+		ctx.Input([]byte(tt.input + "\n"))
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%q ran %q, want %q", tt.input, got, tt.want)
+		}
+		if e := ctx.ErrorPop(); e != nil {
+			t.Errorf("%q queued %d, %s", tt.input, e.Code, e.Info)
+		}
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	var ids []uint64
+	record := func(ctx *Context) Result {
+		ids = append(ids, ctx.MessageID())
+		return ResOK
+	}
+	commands := []*Command{
+		{Pattern: "A", Callback: record},
+		{Pattern: "B", Callback: record},
+	}
+	ctx := NewContext(commands, &Interface{}, 256)
+
+	if id := ctx.MessageID(); id != 0 {
+		t.Errorf("MessageID() before any message = %d, want 0", id)
+	}
+	ctx.Input([]byte("A;B\n"))
+	ctx.Input([]byte("\n"))
+	ctx.Input([]byte("B\nA;:B\n"))
+	ctx.Input([]byte("BOGus\n"))
+	ctx.Input([]byte("A\n"))
+
+	want := []uint64{1, 1, 2, 3, 3, 5}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("message IDs = %v, want %v", ids, want)
+	}
+	if id := ctx.MessageID(); id != 5 {
+		t.Errorf("MessageID() = %d, want 5", id)
+	}
+}
+
+func TestDefaultNumericSuffix(t *testing.T) {
+	var got []int32
+	commands := []*Command{
+		{Pattern: "OUTPut[1]:STATe", Callback: func(ctx *Context) Result {
+			got = ctx.CommandNumbers(1, 99)
+			return ResOK
+		}},
+		{Pattern: "SOURce[2]:CHANnel#:VOLTage", Callback: func(ctx *Context) Result {
+			got = ctx.CommandNumbers(2, 99)
+			return ResOK
+		}},
+		{Pattern: "TRACe[0]?", Callback: func(ctx *Context) Result {
+			got = ctx.CommandNumbers(1, 99)
+			return ResOK
+		}},
+	}
+	ctx := NewContext(commands, &Interface{}, 256)
+
+	tests := []struct {
+		input string
+		want  []int32
+	}{
+		{"OUTP:STAT", []int32{1}},
+		{"OUTP1:STAT", []int32{1}},
+		{"OUTPUT3:STAT", []int32{3}},
+		{"SOUR:CHAN:VOLT", []int32{2, 99}},
+		{"SOUR4:CHAN5:VOLT", []int32{4, 5}},
+		{"TRAC?", []int32{0}},
+		{"TRAC7?", []int32{7}},
+	}
+	for _, tt := range tests {
+		got = nil
+		ctx.Input([]byte(tt.input + "\n"))
+		if e := ctx.ErrorPop(); e != nil {
+			t.Errorf("%s queued %d, %s", tt.input, e.Code, e.Info)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: CommandNumbers = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+
+	if matchCommand("OUTPut[1]:STATe", "OUTP1X:STAT") {
+		t.Error("OUTPut[1] matched a non-numeric suffix")
+	}
+}
+
+func TestOverlappedOperations(t *testing.T) {
+	release := make(chan struct{})
+	var output strings.Builder
+	var outMu sync.Mutex
+	iface := &Interface{Write: func(data []byte) (int, error) {
+		outMu.Lock()
+		defer outMu.Unlock()
+		return output.Write(data)
+	}}
+	commands := []*Command{
+		{Pattern: "INITiate", Callback: func(ctx *Context) Result {
+			ctx.RunOverlapped(OperMeasuring, func() { <-release })
+			return ResOK
+		}},
+		{Pattern: "*OPC?", Callback: CoreOpcQ},
+		{Pattern: "*WAI", Callback: CoreWai},
+		{Pattern: "STATus:OPERation:CONDition?", Callback: StatusOperationConditionQ},
+	}
+	ctx := NewContext(commands, iface, 256)
+
+	ctx.Input([]byte("*WAI;*OPC?\n"))
+	if output.String() != "1\n" {
+		t.Errorf("*OPC? while idle = %q, want %q", output.String(), "1\n")
+	}
+
+	output.Reset()
+	ctx.Input([]byte("INIT;:STAT:OPER:COND?\n"))
+	if output.String() != "16\n" {
+		t.Errorf("STAT:OPER:COND? while measuring = %q, want %q", output.String(), "16\n")
+	}
+	ctx.OperationStart(OperSweeping | OperMeasuring)
+	if got := ctx.OperationCondition(); got != OperSweeping|OperMeasuring {
+		t.Errorf("OperationCondition() = %d, want %d", got, OperSweeping|OperMeasuring)
+	}
+	ctx.OperationComplete(OperSweeping | OperMeasuring)
+	if n := ctx.OperationsPending(); n != 1 {
+		t.Errorf("OperationsPending() = %d, want 1", n)
+	}
+	if got := ctx.OperationCondition(); got != OperMeasuring {
+		t.Errorf("OperationCondition() after done = %d, want %d", got, OperMeasuring)
+	}
+
+	output.Reset()
+	answered := make(chan struct{})
+	go func() {
+		ctx.Input([]byte("*OPC?\n"))
+		close(answered)
+	}()
+	select {
+	case <-answered:
+		t.Fatal("*OPC? answered while an operation was pending")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-answered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("*OPC? not answered after the operation completed")
+	}
+	if output.String() != "1\n" {
+		t.Errorf("*OPC? = %q, want %q", output.String(), "1\n")
+	}
+	if got := ctx.OperationCondition(); got != 0 {
+		t.Errorf("OperationCondition() when idle = %d, want 0", got)
+	}
+}
+
+func TestOverlappedOperationAbort(t *testing.T) {
+	ctx := NewContext([]*Command{{Pattern: "*WAI", Callback: CoreWai}}, &Interface{}, 256)
+	ctx.OperationStart(OperSweeping)
+
+	go ctx.Abort()
+	ctx.Input([]byte("*WAI\n"))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -200 {
+		t.Errorf("aborted *WAI queued %v, want -200", e)
+	}
+}
+
+func TestOperationServiceRequest(t *testing.T) {
+	// OnSRQ runs without the operation lock, so it may query operations
+	var ctx *Context
+	pending := make(chan int, 2)
+	ctx = NewContext([]*Command{{Pattern: "*OPC", Callback: CoreOpc}}, &Interface{OnSRQ: func() {
+		pending <- ctx.OperationsPending()
+	}}, 256)
+	ctx.OperationStatus().SetEnable(uint16(OperMeasuring))
+	ctx.RegSet(RegSRE, StbOperation)
+
+	ctx.OperationStart(OperMeasuring)
+	if n := <-pending; n != 1 {
+		t.Errorf("OperationsPending() in OnSRQ = %d, want 1", n)
+	}
+
+	// *OPC completing with the operation requests service as well
+	ctx.RegClear(RegSRE, StbOperation)
+	ctx.RegSet(RegSRE, StbESB)
+	ctx.RegSet(RegESE, EsrOPC)
+	ctx.Input([]byte("*OPC\n"))
+	ctx.OperationComplete(OperMeasuring)
+	if n := <-pending; n != 0 {
+		t.Errorf("OperationsPending() in OnSRQ after completion = %d, want 0", n)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	var output strings.Builder
+	commands := []*Command{
+		{Pattern: "VOLTage", Callback: Handle(func(ctx *Context) error {
+			v, err := ctx.ParamDouble(true)
+			if err != nil {
+				return err
+			}
+			if v > 10 {
+				return Errorf(-222, "Data out of range: %g V", v)
+			}
+			return nil
+		})},
+		{Pattern: "WRAPped", Callback: Handle(func(ctx *Context) error {
+			return fmt.Errorf("relay: %w", Errorf(-240, "Hardware error"))
+		})},
+		{Pattern: "FAIL", Callback: Handle(func(ctx *Context) error {
+			return errors.New("boom")
+		})},
+		{Pattern: "VOLTage?", Callback: Handle(func(ctx *Context) error {
+			return ctx.ResultDouble(5)
+		})},
+	}
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+
+	tests := []struct {
+		input string
+		want  string // Queued error, "" for none
+	}{
+		{"VOLT 5", ""},
+		{"VOLT 12", `-222,"Data out of range: 12 V"`},
+		{"VOLT", `-109,"Missing parameter"`},
+		{"WRAP", `-240,"Hardware error"`},
+		{"FAIL", `-200,"Execution error;boom"`},
+		{"VOLT?", ""},
+	}
+	for _, tt := range tests {
+		ctx.Input([]byte(tt.input + "\n"))
+		got := ""
+		if e := ctx.ErrorPop(); e != nil {
+			got = e.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s queued %q, want %q", tt.input, got, tt.want)
+		}
+		if e := ctx.ErrorPop(); e != nil {
+			t.Errorf("%s queued a second error %q", tt.input, e.Error())
+		}
+	}
+	if output.String() != "5\n" {
+		t.Errorf("VOLT? = %q, want %q", output.String(), "5\n")
+	}
+}
+
+func TestCommandTreeMatchesPatterns(t *testing.T) {
+	patterns := []string{
+		"*IDN?", "*RST", "MEASure:VOLTage[:DC]?", "MEASure[:SCALar]:CURRent[:DC]?",
+		"[SOURce:]VOLTage", "[SOURce:]VOLTage?", "OUTPut#[:STATe]", "OUTPut[1]:PROTection",
+		"TEST#:NUMbers#", "SYSTem:ERRor[:NEXT]?", "CALibrate", "TRIGger[:SEQuence[:IMMediate]]",
+		"ABC", "ABCdef",
+	}
+	var commands []*Command
+	for _, p := range patterns {
+		commands = append(commands, &Command{Pattern: p})
+	}
+	ctx := NewContext(commands, nil, 256)
+
+	headers := []string{
+		"*IDN?", "*idn?", "*RST", "*RST?", "MEAS:VOLT?", "MEAS:VOLT:DC?", "MEASURE:VOLTAGE:DC",
+		"MEAS:SCAL:CURR?", "MEAS:CURR:DC?", "MEAS:SCALAR:CURRENT:DC?", "VOLT", "VOLT?",
+		"SOUR:VOLT", ":SOURCE:VOLTAGE?", "OUTP", "OUTP2", "OUTPUT12:STAT", "OUTP1:PROT",
+		"OUTP:PROT", "OUTPU:PROT", "TEST:NUM", "TEST3:NUMBERS4", "SYST:ERR?", "SYST:ERR:NEXT?",
+		"CAL", "CALIBRATE", "CALI", "TRIG", "TRIG:SEQ", "TRIG:SEQ:IMM", "TRIG:IMM", "ABC",
+		"ABCDEF", "ABCD", "MEAS", "", ":", "VOLT:DC",
+	}
+	for _, header := range headers {
+		var want *Command
+		isQuery := strings.HasSuffix(header, "?")
+		for _, cmd := range commands {
+			if matchCommand(cmd.Pattern, header) {
+				if strings.HasSuffix(cmd.Pattern, "?") == isQuery {
+					want = cmd
+					break
+				}
+				if want == nil {
+					want = cmd
+				}
+			}
+		}
+		if got := ctx.findCommand(header); got != want {
+			gotPattern, wantPattern := "<nil>", "<nil>"
+			if got != nil {
+				gotPattern = got.Pattern
+			}
+			if want != nil {
+				wantPattern = want.Pattern
+			}
+			t.Errorf("findCommand(%q) = %s, want %s", header, gotPattern, wantPattern)
+		}
+	}
+}
+
+// BenchmarkFindCommand dispatches among 500 registered commands
+func BenchmarkFindCommand(b *testing.B) {
+	var commands []*Command
+	for i := 0; i < 100; i++ {
+		for _, leaf := range []string{"VOLTage[:DC]?", "CURRent[:DC]?", "RANGe", "RANGe?", "NPLCycles"} {
+			commands = append(commands, &Command{Pattern: fmt.Sprintf("SENSe%d:%s", i, leaf)})
+		}
+	}
+	ctx := NewContext(commands, nil, 256)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if ctx.findCommand("SENSE99:NPLC") == nil {
+			b.Fatal("no match")
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	good := []string{
+		"*IDN?", "*RST", "MEASure:VOLTage[:DC]?", "[SOURce:]VOLTage", ":SYSTem:ERRor?",
+		"OUTPut#:STATe", "OUTPut[1]:STATe", "TRIGger[:SEQuence[:IMMediate]]",
+	}
+	var commands []*Command
+	for _, p := range good {
+		commands = append(commands, &Command{Pattern: p})
+	}
+	if err := NewContext(commands, nil, 256).Compile(); err != nil {
+		t.Errorf("Compile() of valid patterns = %v", err)
+	}
+
+	bad := map[string]string{
+		"":                    "empty pattern",
+		"MEASure:VOLTage[:DC": "unbalanced '['",
+		"MEASure:VOLTage]":    "unbalanced ']'",
+		"MEASure::VOLTage":    "empty node",
+		"MEASure:VOLTage:":    "empty node",
+		"VOLTage[]":           "empty optional node",
+		"OUT#Put":             "stray '#' in node OUT#Put",
+		"MEAS?:VOLT":          "'?' before the end",
+		"MEAS:VOLT AGE":       "invalid character ' ' in node VOLT AGE",
+		"SYSTem:*IDN":         "invalid character '*' in node *IDN",
+		"#:VOLT":              "numeric suffix without a mnemonic",
+	}
+	commands = append([]*Command(nil), commands...)
+	for p := range bad {
+		commands = append(commands, &Command{Pattern: p})
+	}
+	err := NewContext(commands, nil, 256).Compile()
+	if err == nil {
+		t.Fatal("Compile() accepted malformed patterns")
+	}
+	for p, reason := range bad {
+		want := (&PatternError{Pattern: p, Reason: reason}).Error()
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Compile() error does not report %s", want)
+		}
+	}
+	var perr *PatternError
+	if !errors.As(err, &perr) {
+		t.Errorf("Compile() error %T is not a *PatternError", err)
+	}
+	if n := strings.Count(err.Error(), "\n") + 1; n != len(bad) {
+		t.Errorf("Compile() reported %d errors, want %d", n, len(bad))
+	}
+}
+
+func TestWildcardCommand(t *testing.T) {
+	var caught []string
+	catch := func(name string) func(*Context) Result {
+		return func(ctx *Context) Result {
+			caught = append(caught, name+" "+ctx.UnmatchedHeader())
+			return ResOK
+		}
+	}
+	commands := []*Command{
+		{Pattern: "SYSTem:COMMunicate:LAN:ADDRess?", Callback: catch("exact")},
+		{Pattern: "SYSTem:COMMunicate:*", Callback: catch("comm")},
+		{Pattern: "SYSTem:COMMunicate:SERial:*", Callback: catch("serial")},
+		{Pattern: "SYSTem:*", Callback: catch("system")},
+		{Pattern: "SYSTem:COMMunicate[:SERial]:*", Callback: catch("shadowed")},
+	}
+	ctx := NewContext(commands, nil, 256)
+	if err := ctx.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"SYST:COMM:LAN:ADDR?", "exact "},
+		{"SYST:COMM:LAN:GATeway?", "comm SYST:COMM:LAN:GATeway?"},
+		{"SYST:COMM:SER:BAUD 9600", "serial SYST:COMM:SER:BAUD"},
+		{"SYST:COMM:SER:A:B:C:D:E:F?", "serial SYST:COMM:SER:A:B:C:D:E:F?"},
+		{"SYST:BEEP", "system SYST:BEEP"},
+		{"SYST:COMM:SER:BAUD 1;PAR NONE", "serial SYST:COMM:SER:BAUD,serial SYST:COMM:SER:PAR"},
+	}
+	for _, tt := range tests {
+		caught = nil
+		ctx.Input([]byte(tt.input + "\n"))
+		if got := strings.Join(caught, ","); got != tt.want {
+			t.Errorf("%s caught %q, want %q", tt.input, got, tt.want)
+		}
+		if e := ctx.ErrorPop(); e != nil {
+			t.Errorf("%s queued %d, %s", tt.input, e.Code, e.Info)
+		}
+	}
+
+	// Only headers outside the wildcard subtrees are limited to the depth of
+	// the deepest pattern by default, and all of them by SetMaxHeaderDepth
+	caught = nil
+	ctx.Input([]byte("MEAS:A:B:C:D:E:F?\n"))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -113 {
+		t.Errorf("deep header outside the wildcards queued %v, want -113", e)
+	}
+	ctx.SetMaxHeaderDepth(4)
+	ctx.Input([]byte("SYST:COMM:SER:A:B:C:D:E:F?\n"))
+	if e := ctx.ErrorPop(); len(caught) > 0 || e == nil || e.Code != -113 {
+		t.Errorf("header deeper than SetMaxHeaderDepth caught %q and queued %v, want -113", caught, e)
+	}
+	ctx.SetMaxHeaderDepth(0)
+
+	// The prefix itself and other subsystems are not caught
+	for _, input := range []string{"SYST", "MEAS:VOLT?"} {
+		caught = nil
+		ctx.Input([]byte(input + "\n"))
+		if e := ctx.ErrorPop(); len(caught) > 0 || e == nil || e.Code != -113 {
+			t.Errorf("%s caught %q and queued %v, want -113", input, caught, e)
+		}
+	}
+}
+
+func TestCommandAliases(t *testing.T) {
+	var got []string
+	commands := []*Command{
+		{Pattern: "SOURce:VOLTage:LIMit", Aliases: []string{"SOURce:VOLTage:PROTection[:LEVel]"}, Callback: func(ctx *Context) Result {
+			v, _ := ctx.ParamDouble(true)
+			got = append(got, fmt.Sprint(v))
+			return ResOK
+		}},
+		{Pattern: "OUTPut#:STATe", Aliases: []string{"CHANnel#:OUTPut"}, Callback: func(ctx *Context) Result {
+			got = append(got, fmt.Sprint(ctx.CommandNumbers(1, 1)))
+			return ResOK
+		}},
+	}
+	ctx := NewContext(commands, nil, 256)
+	if err := ctx.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.Input([]byte("SOUR:VOLT:LIM 5;PROT 6;PROT:LEV 7\n"))
+	ctx.Input([]byte("SOUR:VOLT:PROT 8\nOUTP2:STAT\nCHAN3:OUTP\n"))
+	if got, want := fmt.Sprint(got), "[5 6 7 8 [2] [3]]"; got != want {
+		t.Errorf("ran %s, want %s", got, want)
+	}
+	if e := ctx.ErrorPop(); e != nil {
+		t.Errorf("queued %d, %s", e.Code, e.Info)
+	}
+}
+
+func TestAddRemoveCommand(t *testing.T) {
+	var output strings.Builder
+	ctx := NewContext([]*Command{
+		{Pattern: "*IDN?", Callback: func(ctx *Context) Result {
+			ctx.ResultText("ACME")
+			return ResOK
+		}},
+	}, &Interface{Write: output.Write}, 256)
+
+	plugin := &Command{Pattern: "PLUGin:VERSion?", Callback: func(ctx *Context) Result {
+		ctx.ResultInt32(2)
+		return ResOK
+	}}
+	if err := ctx.AddCommand(plugin); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Input([]byte("PLUG:VERS?;*IDN?\n"))
+	if want := "2;\"ACME\"\n"; output.String() != want {
+		t.Errorf("output = %q, want %q", output.String(), want)
+	}
+
+	if !ctx.RemoveCommand("PLUGin:VERSion?") {
+		t.Error("RemoveCommand of a registered pattern returned false")
+	}
+	if ctx.RemoveCommand("PLUGin:VERSion?") {
+		t.Error("RemoveCommand of a removed pattern returned true")
+	}
+	ctx.Input([]byte("PLUG:VERS?\n"))
+	if e := ctx.ErrorPop(); e == nil || e.Code != -113 {
+		t.Errorf("removed command queued %v, want -113", e)
+	}
+
+	var perr *PatternError
+	if err := ctx.AddCommand(&Command{Pattern: "BAD[:NODE"}); !errors.As(err, &perr) {
+		t.Errorf("AddCommand of a malformed pattern = %v, want *PatternError", err)
+	}
+}
+
+func TestAddCommandWhileParsing(t *testing.T) {
+	ctx := NewContext([]*Command{
+		{Pattern: "BASE", Callback: func(ctx *Context) Result { return ResOK }},
+	}, &Interface{}, 256)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			pattern := fmt.Sprintf("DYNamic%d", i%4)
+			ctx.AddCommand(&Command{Pattern: pattern, Callback: func(ctx *Context) Result { return ResOK }})
+			ctx.RemoveCommand(pattern)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		ctx.Input([]byte("BASE;:DYN1\n"))
+	}
+	wg.Wait()
+
+	for e := ctx.ErrorPop(); e != nil; e = ctx.ErrorPop() {
+		if e.Code != -113 && e.Code != CodeQueueOverflow {
+			t.Errorf("queued %d, %s", e.Code, e.Info)
+		}
+	}
+}
+
+func TestCommandGroup(t *testing.T) {
+	var ran []string
+	record := func(name string) func(*Context) Result {
+		return func(ctx *Context) Result {
+			ran = append(ran, fmt.Sprint(name, ctx.CommandNumbers(1, 1)))
+			return ResOK
+		}
+	}
+	ctx := NewContext(nil, &Interface{}, 256)
+
+	g := ctx.Group("SENSe#:VOLTage")
+	g.Add("RANGe", record("range")).
+		Add("RANGe?", record("range?")).
+		Add("[:DC]:NPLCycles", record("nplc")).
+		Add("?", record("volt?"))
+	g.Group("RANGe").Add("AUTO", record("auto"))
+	g.AddCommand(&Command{Pattern: "RESolution", Aliases: []string{"RES:LEGacy"}, Callback: record("res")})
+	if err := g.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.Input([]byte("SENS2:VOLT:RANG 1;RANG?;RANG:AUTO ON\n"))
+	ctx.Input([]byte("SENS:VOLT:DC:NPLC 10;:SENS:VOLT:NPLC 1;:SENS3:VOLT?\n"))
+	ctx.Input([]byte("SENS:VOLT:RES 1;RES:LEG 1\n"))
+	want := "[range[2] range?[2] auto[2] nplc[1] nplc[1] volt?[3] res[1] res[1]]"
+	if got := fmt.Sprint(ran); got != want {
+		t.Errorf("ran %s, want %s", got, want)
+	}
+	if e := ctx.ErrorPop(); e != nil {
+		t.Errorf("queued %d, %s", e.Code, e.Info)
+	}
+
+	bad := ctx.Group("SENSe::VOLTage")
+	bad.Add("RANGe", record("range")).Add("RANGe?", record("range?"))
+	var perr *PatternError
+	if !errors.As(bad.Err(), &perr) || perr.Pattern != "SENSe::VOLTage" {
+		t.Errorf("Err() of a malformed prefix = %v", bad.Err())
+	}
+	if bad.Group("SUB").Err() == nil {
+		t.Error("nested group of a malformed group has no error")
+	}
+	if g.Add("BAD]", nil).Err() == nil {
+		t.Error("malformed pattern in a group not reported")
+	}
+}
+
+func TestSystemHelp(t *testing.T) {
+	commands := []*Command{
+		{Pattern: "SYSTem:HELP?", Callback: SystemHelpQ},
+		{Pattern: "SYSTem:HELP:HEADers?", Callback: SystemHelpHeadersQ},
+		{Pattern: "SOURce:VOLTage", Description: "Sets the output voltage", Params: []ParamSpec{
+			{Name: "level", Kinds: []ParamKind{KindNumeric, KindMnemonic}},
+			{Name: "slew", Kinds: []ParamKind{KindNumeric}, Optional: true},
+		}},
+		{Pattern: "MEASure:VOLTage?"},
+	}
+	var output strings.Builder
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`SYST:HELP? "sour:volt"`, "\"SOURce:VOLTage <level:numeric|mnemonic>[,<slew:numeric>] - Sets the output voltage\"\n"},
+		{`SYST:HELP? "MEAS:VOLT?"`, "\"MEASure:VOLTage?\"\n"},
+		{`SYST:HELP? "OUTP"`, ""},
+		{`SYST:HELP:HEAD?`, "#266SYSTem:HELP?\nSYSTem:HELP:HEADers?\nSOURce:VOLTage\nMEASure:VOLTage?\n\n"},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+	if err := ctx.ErrorPop(); err == nil || err.Code != -224 {
+		t.Errorf("unknown header error = %v, want -224", err)
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	var got []Arg
+	commands := []*Command{
+		{
+			Pattern: "SOURce:VOLTage",
+			Params: []ParamSpec{
+				{Name: "level", Kinds: []ParamKind{KindNumeric, KindMnemonic}, Units: []Unit{UnitVolt}, Min: -10, Max: 10},
+				{Name: "mode", Kinds: []ParamKind{KindMnemonic}, Optional: true, Choices: []ChoiceDef{{"FAST", 1}, {"SLOW", 2}}},
+			},
+			Callback: func(ctx *Context) Result {
+				got = []Arg{ctx.Arg(0), ctx.Arg(1)}
+				return ResOK
+			},
+		},
+		{
+			Pattern: "DISPlay:TEXT",
+			Params:  []ParamSpec{{Name: "text", Kinds: []ParamKind{KindString}}},
+			Callback: func(ctx *Context) Result {
+				got = []Arg{ctx.Arg(0)}
+				return ResOK
+			},
+		},
+	}
+	ctx := NewContext(commands, nil, 256)
+
+	tests := []struct {
+		input string
+		value float64
+		text  string
+		mode  int32
+		code  int16
+	}{
+		{"SOUR:VOLT 5", 5, "", 0, 0},
+		{"SOUR:VOLT 500 mV,SLOW", 0.5, "", 2, 0},
+		{"SOUR:VOLT MAX", 10, "MAX", 0, 0},
+		{"SOUR:VOLT 11", 0, "", 0, -222},
+		{"SOUR:VOLT 1,MEDium", 0, "", 0, -224},
+		{"SOUR:VOLT 1 A", 0, "", 0, -131},
+		{"SOUR:VOLT", 0, "", 0, -109},
+		{"SOUR:VOLT 1,FAST,2", 0, "", 0, -108},
+		{"DISP:TEXT 'hi'", 0, "hi", 0, 0},
+		{"DISP:TEXT 1", 0, "", 0, -104},
+	}
+	for _, tt := range tests {
+		got = nil
+		ctx.Input([]byte(tt.input + "\n"))
+		err := ctx.ErrorPop()
+		if tt.code != 0 {
+			if err == nil || err.Code != tt.code {
+				t.Errorf("%s queued %v, want %d", tt.input, err, tt.code)
+			}
+			if got != nil {
+				t.Errorf("%s ran the callback", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s queued %v", tt.input, err)
+			continue
+		}
+		if !got[0].Present || got[0].Number.Value != tt.value || got[0].Text != tt.text {
+			t.Errorf("%s: Arg(0) = %+v", tt.input, got[0])
+		}
+		if len(got) > 1 && (got[1].Present != (tt.mode != 0) || got[1].Choice != tt.mode) {
+			t.Errorf("%s: Arg(1) = %+v, want choice %d", tt.input, got[1], tt.mode)
+		}
+	}
+
+	// A callback may still read the declared parameters with Param*
+	var level float64
+	var mode int32
+	var paramErr error
+	ctx = NewContext([]*Command{{
+		Pattern: "SOURce:VOLTage",
+		Params:  commands[0].Params,
+		Callback: func(ctx *Context) Result {
+			if level, paramErr = ctx.ParamDouble(true); paramErr == nil {
+				mode, paramErr = ctx.ParamChoice([]ChoiceDef{{"FAST", 1}, {"SLOW", 2}}, true)
+			}
+			return ResOK
+		},
+	}}, nil, 256)
+	ctx.SetCheckTrailingParams(true)
+	ctx.Input([]byte("SOUR:VOLT 2.5,FAST\n"))
+	if paramErr != nil || level != 2.5 || mode != 1 {
+		t.Errorf("Param calls after Params = %g, %d, %v, want 2.5, 1", level, mode, paramErr)
+	}
+	if err := ctx.ErrorPop(); err != nil {
+		t.Errorf("Param calls after Params queued %v", err)
+	}
+}
+
+func TestLiteralPatternNode(t *testing.T) {
+	ran := 0
+	commands := []*Command{
+		{Pattern: "DIAGnostic:=xTalk2:STATe?", Callback: func(ctx *Context) Result {
+			ran++
+			return ResOK
+		}},
+	}
+	ctx := NewContext(commands, nil, 256)
+	if err := ctx.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"DIAG:xTalk2:STAT?", true},
+		{"diagnostic:xTalk2:state?", true},
+		{"DIAG:XTALK2:STAT?", false},
+		{"DIAG:xT:STAT?", false},
+		{"DIAG:xTalk:STAT?", false},
+	}
+	for _, tt := range tests {
+		if got := ctx.findCommand(tt.header) != nil; got != tt.want {
+			t.Errorf("findCommand(%q) found = %v, want %v", tt.header, got, tt.want)
+		}
+		if got := matchCommand(commands[0].Pattern, tt.header); got != tt.want {
+			t.Errorf("matchCommand(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+	ctx.Input([]byte("DIAG:xTalk2:STAT?\n"))
+	if ran != 1 {
+		t.Errorf("callback ran %d times, want 1", ran)
+	}
+
+	for _, pattern := range []string{"DIAG:=", "DIAG:=CH#", "DIAG:=x-y"} {
+		if checkPattern(pattern) == "" {
+			t.Errorf("checkPattern(%q) accepted a malformed literal node", pattern)
+		}
+	}
+}
+
+func TestCommandTree(t *testing.T) {
+	commands := []*Command{
+		{Pattern: "*IDN?"},
+		{Pattern: "MEASure[:SCALar]:VOLTage[:DC]?"},
+		{Pattern: "[SOURce:]VOLTage"},
+		{Pattern: "SOURce:VOLTage?"},
+		{Pattern: "OUTPut[1]:STATe", Aliases: []string{"OUTPut#:ENABle"}},
+	}
+	ctx := NewContext(commands, nil, 256)
+
+	var render func(nodes []*CommandTreeNode) string
+	render = func(nodes []*CommandTreeNode) string {
+		var parts []string
+		for _, n := range nodes {
+			s := n.Name + "/" + n.Short
+			if n.Suffix {
+				s += "#"
+			}
+			if n.Optional {
+				s = "[" + s + "]"
+			}
+			if n.Set {
+				s += "!"
+			}
+			if n.Query {
+				s += "?"
+			}
+			if len(n.Children) > 0 {
+				s += "(" + render(n.Children) + ")"
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, " ")
+	}
+
+	want := "*IDN/*IDN? " +
+		"MEASure/MEAS([SCALar/SCAL](VOLTage/VOLT([DC/DC]?))) " +
+		"[SOURce/SOUR](VOLTage/VOLT!?) " +
+		"OUTPut/OUTP#(STATe/STAT! ENABle/ENAB!)"
+	if got := render(ctx.CommandTree()); got != want {
+		t.Errorf("CommandTree() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	var volts []float64
+	commands := []*Command{
+		{Pattern: "*DMC", Callback: CoreDmc},
+		{Pattern: "*EMC", Callback: CoreEmc},
+		{Pattern: "*EMC?", Callback: CoreEmcQ},
+		{Pattern: "*GMC?", Callback: CoreGmcQ},
+		{Pattern: "*LMC?", Callback: CoreLmcQ},
+		{Pattern: "*PMC", Callback: CorePmc},
+		{Pattern: "*RMC", Callback: CoreRmc},
+		{Pattern: "*IDN?", Callback: func(ctx *Context) Result {
+			ctx.ResultText("ACME")
+			return ResOK
+		}},
+		{Pattern: "SOURce:VOLTage", Callback: func(ctx *Context) Result {
+			v, err := ctx.ParamDouble(true)
+			if err != nil {
+				return ResErr
+			}
+			volts = append(volts, v)
+			return ResOK
+		}},
+		{Pattern: "SOURce:VOLTage?", Callback: func(ctx *Context) Result {
+			ctx.ResultDouble(volts[len(volts)-1])
+			return ResOK
+		}},
+	}
+	var output strings.Builder
+	var err *Error
+	ctx := NewContext(commands, &Interface{Write: output.Write, OnError: func(e *Error) {
+		if err == nil {
+			err = e
+		}
+	}}, 256)
+
+	tests := []struct {
+		input string
+		want  string
+		code  int16
+	}{
+		{`*EMC?`, "0\n", 0},
+		{`*LMC?`, "\"\"\n", 0},
+		{`*DMC "SETUP",#218SOUR:VOLT $1;VOLT?`, "", 0},
+		{`*EMC?`, "1\n", 0},
+		{`SETUP 2.5`, "2.5\n", 0},
+		{`*IDN?;SETUP 3;*IDN?`, "\"ACME\";3;\"ACME\"\n", 0},
+		{`SETUP`, "", -274},
+		{`*GMC? "setup"`, "#218SOUR:VOLT $1;VOLT?\n", 0},
+		{`*DMC "SETUP",#10`, "", -277},
+		{`*DMC "*IDN?",#10`, "", -273},
+		{`*DMC "A B",#10`, "", -273},
+		{`*DMC "LOOP",#14LOOP`, "", 0},
+		{`LOOP`, "", -276},
+		{`*LMC?`, "\"LOOP\",\"SETUP\"\n", 0},
+		{`*EMC 0`, "", 0},
+		{`SETUP 4`, "", -113},
+		{`*EMC 1;*RMC "LOOP"`, "", 0},
+		{`*RMC "LOOP"`, "", -278},
+		{`*PMC`, "", 0},
+		{`*GMC? "SETUP"`, "", -278},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		err = nil
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s = %q, want %q", tt.input, output.String(), tt.want)
+		}
+		if tt.code == 0 && err != nil || tt.code != 0 && (err == nil || err.Code != tt.code) {
+			t.Errorf("%s queued %v, want %d", tt.input, err, tt.code)
+		}
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	commands := []*Command{
+		{Pattern: "MEAS:VOLT?"},
+		{Pattern: "MEASure:VOLTage[:DC]?"},
+		{Pattern: "MEASure:VOLTage"},
+		{Pattern: "CHANnel#:STATe", Aliases: []string{"CHANnel[1]:STATe"}},
+		{Pattern: "CHAN2:STATe"},
+		{Pattern: "DIAGnostic:=xTalk"},
+		{Pattern: "DIAGnostic:XTALk"},
+		{Pattern: "DIAGnostic:=XTALK"},
+		{Pattern: "SYSTem:*"},
+		{Pattern: "*RST"},
+		{Pattern: "*RST"},
+	}
+	ctx := NewContext(commands, nil, 256)
+
+	var got []string
+	for _, o := range ctx.Overlaps() {
+		got = append(got, o.String())
+	}
+	want := []string{
+		`pattern "MEASure:VOLTage[:DC]?" shadowed by "MEAS:VOLT?" for header MEAS:VOLT?`,
+		`pattern "CHAN2:STATe" shadowed by "CHANnel#:STATe" for header CHAN2:STATE`,
+		`pattern "DIAGnostic:XTALk" shadowed by "DIAGnostic:=xTalk" for header DIAGNOSTIC:xTalk`,
+		`pattern "DIAGnostic:=XTALK" shadowed by "DIAGnostic:XTALk" for header DIAGNOSTIC:XTALK`,
+		`pattern "*RST" shadowed by "*RST" for header *RST`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Overlaps() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestStatusModel(t *testing.T) {
+	commands := []*Command{
+		{Pattern: "*STB?", Callback: CoreStbQ},
+		{Pattern: "*SRE", Callback: CoreSre},
+		{Pattern: "*SRE?", Callback: CoreSreQ},
+		{Pattern: "*ESR?", Callback: CoreEsrQ},
+		{Pattern: "*ESE", Callback: CoreEse},
+		{Pattern: "*ESE?", Callback: CoreEseQ},
+	}
+	var output strings.Builder
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"*STB?", "0\n"},
+		{"BOGus", ""},
+		{"*ESR?", "32\n"},
+		{"*ESR?", "0\n"},
+		{"*ESE 60;*ESE?", "60\n"},
+		{"*SRE 255;*SRE?", "191\n"},
+		{"*STB?", "0\n"},
+		{"BOGus", ""},
+		{"*STB?", "96\n"},
+		{"*STB?", "96\n"},
+		{"*ESR?;*STB?", "32;0\n"},
+		{"*ESE 256", ""},
+		{"*ESE?", "60\n"},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s = %q, want %q", tt.input, output.String(), tt.want)
+		}
+		// Keep the error queue bit out of the status bytes above
+		for ctx.ErrorPop() != nil {
+		}
+	}
+
+	if got := ctx.RegGet(RegESR); got != EsrEXE {
+		t.Errorf("ESR after *ESE 256 = %d, want %d", got, EsrEXE)
+	}
+	ctx.RegClear(RegESR, 0xFF)
+	ctx.RegSet(RegSTB, 1|StbMSS)
+	if got := ctx.RegGet(RegSTB); got != 1|StbMSS {
+		t.Errorf("STB with bit 0 enabled = %d, want %d", got, 1|StbMSS)
+	}
+	ctx.RegClear(RegSRE, 1)
+	if got := ctx.RegGet(RegSTB); got != 1 {
+		t.Errorf("STB with bit 0 disabled = %d, want 1", got)
+	}
+	ctx.RegClear(RegSTB, 1)
+	ctx.RegSet(RegESR, EsrPON|EsrOPC)
+	if got := ctx.RegGet(RegESR); got != EsrPON|EsrOPC {
+		t.Errorf("ESR = %d, want %d", got, EsrPON|EsrOPC)
+	}
+	if got := ctx.RegGet(RegSTB); got != 0 {
+		t.Errorf("STB with PON and OPC not enabled = %d, want 0", got)
+	}
+}
+
+func TestStatusRegisters(t *testing.T) {
+	commands := append(StatusRegisterCommands("QUEStionable"), StatusRegisterCommands("QUEStionable:VOLTage")...)
+	commands = append(commands, StatusRegisterCommands("OPERation")...)
+	commands = append(commands, &Command{Pattern: "*STB?", Callback: CoreStbQ}, &Command{Pattern: "*SRE", Callback: CoreSre})
+	var output strings.Builder
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+	volt := ctx.QuestionableStatus().AddRegister("VOLTage", 1<<0)
+	if ctx.StatusRegister("QUES:VOLT") != volt || ctx.StatusRegister("QUEStionable:VOLTage") != volt {
+		t.Fatal("StatusRegister does not find the VOLTage sub-register")
+	}
+
+	run := func(input, want string) {
+		t.Helper()
+		output.Reset()
+		ctx.Input([]byte(input + "\n"))
+		if output.String() != want {
+			t.Errorf("%s = %q, want %q", input, output.String(), want)
+		}
+	}
+
+	run("STAT:QUES:VOLT:ENAB 6;ENAB?", "6\n")
+	run("STAT:QUES:ENAB 1;*SRE 8", "")
+	volt.SetCondition(1 << 1)
+	run("STAT:QUES:VOLT:COND?;:STAT:QUES:COND?;*STB?", "2;1;72\n")
+	run("STAT:QUES:VOLT?", "2\n")
+	run("STAT:QUES:VOLT:EVEN?;:STAT:QUES:COND?;*STB?", "0;0;72\n")
+	run("STAT:QUES?;*STB?", "1;0\n")
+
+	// Falling edges only latch with NTRansition
+	volt.ClearCondition(1 << 1)
+	run("STAT:QUES:VOLT?", "0\n")
+	run("STAT:QUES:VOLT:PTR 0;NTR 2;PTR?;NTR?", "0;2\n")
+	volt.SetCondition(1 << 1)
+	run("STAT:QUES:VOLT?", "0\n")
+	volt.ClearCondition(1 << 1)
+	run("STAT:QUES:VOLT?", "2\n")
+
+	// Pending operations set OPERation condition bits
+	ctx.OperationStart(OperMeasuring)
+	ctx.OperationStatus().SetCondition(1 << 8)
+	run("STAT:OPER:COND?", "272\n")
+	ctx.OperationComplete(OperMeasuring)
+	run("STAT:OPER:COND?;EVEN?", "256;272\n")
+
+	run("STAT:QUES:ENAB 32768", "")
+	if err := ctx.ErrorPop(); err == nil || err.Code != -222 {
+		t.Errorf("ENAB 32768 queued %v, want -222", err)
+	}
+}
+
+func TestRegisterCommonCommands(t *testing.T) {
+	resets := 0
+	var output strings.Builder
+	ctx := NewContext([]*Command{
+		{Pattern: "*TST?", Callback: func(ctx *Context) Result {
+			ctx.ResultInt32(7)
+			return ResOK
+		}},
+	}, &Interface{Write: output.Write, Reset: func() error {
+		resets++
+		return nil
+	}}, 256)
+	ctx.SetIDN("ACME", "PSU1", "42", "1.0")
+	if err := ctx.RegisterCommonCommands(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range ctx.table.Load().commands {
+		for _, common := range commonCommands {
+			if cmd == common {
+				t.Errorf("%s registered as the shared command", cmd.Pattern)
+			}
+		}
+	}
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"*IDN?", "ACME,PSU1,42,1.0\n"},
+		{"*TST?", "7\n"},
+		{"*RST", ""},
+		{"*ESE 1;*SRE 32;*OPC", ""},
+		{"*STB?", "96\n"},
+		{"*ESR?;*STB?", "1;0\n"},
+		{"BOGus", ""},
+		{"*CLS;*ESR?", "0\n"},
+		{"*OPC?;*WAI", "1\n"},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		ctx.Input([]byte(tt.input + "\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s = %q, want %q", tt.input, output.String(), tt.want)
+		}
+	}
+	if resets != 1 {
+		t.Errorf("*RST called Reset %d times, want 1", resets)
+	}
+	if err := ctx.ErrorPop(); err != nil {
+		t.Errorf("*CLS left %v queued", err)
+	}
+
+	ctx.OperationStart(OperMeasuring)
+	ctx.Input([]byte("*OPC\n"))
+	if ctx.RegGet(RegESR)&EsrOPC != 0 {
+		t.Error("*OPC set OPC with an operation pending")
+	}
+	ctx.OperationComplete(OperMeasuring)
+	deadline := time.Now().Add(time.Second)
+	for ctx.RegGet(RegESR)&EsrOPC == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if ctx.RegGet(RegESR)&EsrOPC == 0 {
+		t.Error("*OPC did not set OPC once the operation completed")
+	}
+}
+
+func TestServiceRequest(t *testing.T) {
+	srqs := 0
+	var ctx *Context
+	ctx = NewContext([]*Command{
+		{Pattern: "*SRE", Callback: CoreSre},
+		{Pattern: "*ESE", Callback: CoreEse},
+		{Pattern: "*ESR?", Callback: CoreEsrQ},
+	}, &Interface{
+		Write: func(data []byte) (int, error) { return len(data), nil },
+		OnSRQ: func() {
+			if ctx.RegGet(RegSTB)&StbMSS == 0 {
+				t.Error("OnSRQ called without MSS set")
+			}
+			srqs++
+		},
+	}, 256)
+
+	ctx.Input([]byte("*ESE 32;*SRE 32\n"))
+	ctx.Input([]byte("BOGus\n"))
+	ctx.Input([]byte("BOGus\n")) // MSS already set
+	if srqs != 1 {
+		t.Errorf("OnSRQ called %d times, want 1", srqs)
+	}
+	ctx.Input([]byte("*ESR?\n"))
+	ctx.Input([]byte("BOGus\n"))
+	if srqs != 2 {
+		t.Errorf("OnSRQ called %d times after *ESR? cleared MSS, want 2", srqs)
+	}
+}
+
+func TestOperationStartComplete(t *testing.T) {
+	var output strings.Builder
+	ctx := NewContext(nil, &Interface{Write: output.Write}, 256)
+	ctx.RegisterCommonCommands()
+
+	ctx.OperationStart(OperSweeping)
+	ctx.OperationStart(OperSweeping | OperMeasuring)
+	ctx.Input([]byte("*OPC\n"))
+	ctx.OperationComplete(OperSweeping | OperMeasuring)
+	if ctx.OperationCondition() != OperSweeping || ctx.OperationsPending() != 1 {
+		t.Errorf("after one completion: condition %d, pending %d", ctx.OperationCondition(), ctx.OperationsPending())
+	}
+	if ctx.RegGet(RegESR)&EsrOPC != 0 {
+		t.Error("OPC set with an operation pending")
+	}
+	ctx.OperationComplete(OperSweeping)
+	ctx.OperationComplete(OperSweeping) // Ignored
+	if ctx.OperationsPending() != 0 {
+		t.Errorf("pending = %d, want 0", ctx.OperationsPending())
+	}
+	output.Reset()
+	ctx.Input([]byte("*ESR?;*OPC?\n"))
+	if output.String() != "1;1\n" {
+		t.Errorf("*ESR?;*OPC? = %q, want %q", output.String(), "1;1\n")
+	}
+
+	// *CLS cancels a pending *OPC
+	ctx.OperationStart(OperMeasuring)
+	ctx.Input([]byte("*OPC;*CLS\n"))
+	ctx.OperationComplete(OperMeasuring)
+	if ctx.RegGet(RegESR) != 0 {
+		t.Errorf("ESR = %d after *CLS cancelled *OPC, want 0", ctx.RegGet(RegESR))
+	}
+}
+
+func TestStatusPreset(t *testing.T) {
+	commands := append(StatusRegisterCommands("QUEStionable"), StatusRegisterCommands("QUEStionable:VOLTage")...)
+	commands = append(commands, &Command{Pattern: "STATus:PRESet", Callback: StatusPreset})
+	var output strings.Builder
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+	volt := ctx.QuestionableStatus().AddRegister("VOLTage", 1<<0)
+
+	ctx.Input([]byte("STAT:QUES:ENAB 3;PTR 0;NTR 5;:STAT:QUES:VOLT:ENAB 0;NTR 1\n"))
+	volt.SetCondition(1 << 2)
+	output.Reset()
+	ctx.Input([]byte("STAT:PRES;:STAT:QUES:COND?;ENAB?;PTR?;NTR?;:STAT:QUES:VOLT:ENAB?;PTR?;NTR?;EVEN?\n"))
+	if want := "1;0;32767;0;32767;32767;0;4\n"; output.String() != want {
+		t.Errorf("after STAT:PRES = %q, want %q", output.String(), want)
+	}
+}
+
+func TestAddStatusRegister(t *testing.T) {
+	var output strings.Builder
+	commands := append(StatusRegisterCommands("QUEStionable"), &Command{Pattern: "*SRE", Callback: CoreSre})
+	ctx := NewContext(commands, &Interface{Write: output.Write}, 256)
+	fault, err := ctx.AddStatusRegister("FAULt", 1<<0)
+	if err != nil {
+		t.Fatalf("AddStatusRegister(FAULt): %v", err)
+	}
+	temp, err := ctx.AddStatusRegister("QUEStionable:TEMPerature", 1<<4)
+	if err != nil {
+		t.Fatalf("AddStatusRegister(QUEStionable:TEMPerature): %v", err)
+	}
+	if again, _ := ctx.AddStatusRegister("FAULt", 1<<0); again != fault {
+		t.Error("AddStatusRegister(FAULt) again did not return the existing register")
+	}
+	if _, err := ctx.AddStatusRegister("NONE:FAULt", 1<<0); err == nil {
+		t.Error("AddStatusRegister(NONE:FAULt) succeeded without a parent")
+	}
+
+	ctx.Input([]byte("*SRE 1;:STAT:FAUL:ENAB 2;:STAT:QUES:ENAB 16;TEMP:ENAB 1\n"))
+	fault.SetCondition(1 << 1)
+	temp.SetCondition(1 << 0)
+	if stb := ctx.RegGet(RegSTB); stb != 1<<0|StbQuestionable|StbMSS {
+		t.Errorf("STB = %d, want %d", stb, 1<<0|StbQuestionable|StbMSS)
+	}
+	ctx.Input([]byte("STAT:FAUL:COND?;EVEN?;:STAT:QUES:COND?;TEMP?\n"))
+	if want := "2;2;16;1\n"; output.String() != want {
+		t.Errorf("output = %q, want %q", output.String(), want)
+	}
+	if stb := ctx.RegGet(RegSTB); stb&(1<<0) != 0 {
+		t.Errorf("STB = %d after reading STAT:FAUL:EVEN?, want bit 0 clear", stb)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	var output strings.Builder
+	var errs []int16
+	ctx := NewContext([]*Command{{Pattern: "*TST?", Callback: CoreTstQ}}, &Interface{
+		Write:   output.Write,
+		OnError: func(err *Error) { errs = append(errs, err.Code) },
+	}, 256)
+
+	tests := []struct {
+		name    string
+		fn      func(*Context) (int32, error)
+		timeout time.Duration
+		want    string
+		errs    string
+	}{
+		{"none", nil, 0, "0\n", "[]"},
+		{"pass", func(*Context) (int32, error) { return 0, nil }, 0, "0\n", "[]"},
+		{"code", func(*Context) (int32, error) { return 42, nil }, 0, "42\n", "[-330]"},
+		{"error", func(*Context) (int32, error) { return 0, errors.New("ADC") }, 0, "1\n", "[-330]"},
+		{"timeout", func(*Context) (int32, error) {
+			time.Sleep(time.Second)
+			return 0, nil
+		}, 10 * time.Millisecond, "1\n", "[-330]"},
+	}
+	for _, tt := range tests {
+		output.Reset()
+		errs = nil
+		ctx.SetSelfTest(tt.fn, tt.timeout)
+		ctx.Input([]byte("*TST?\n"))
+		if output.String() != tt.want {
+			t.Errorf("%s: *TST? = %q, want %q", tt.name, output.String(), tt.want)
+		}
+		if got := fmt.Sprint(errs); got != tt.errs {
+			t.Errorf("%s: errors = %s, want %s", tt.name, got, tt.errs)
+		}
+	}
+}
+
+func TestOptionsQuery(t *testing.T) {
+	var output strings.Builder
+	ctx := NewContext([]*Command{{Pattern: "*OPT?", Callback: CoreOptQ}}, &Interface{Write: output.Write}, 256)
+
+	ctx.Input([]byte("*OPT?\n"))
+	ctx.SetOptions([]string{"MEM", "GPIB", "BW200"})
+	ctx.Input([]byte("*OPT?\n"))
+	if want := "0\nMEM,GPIB,BW200\n"; output.String() != want {
+		t.Errorf("*OPT? = %q, want %q", output.String(), want)
+	}
+
+	ctx.AddPersonality(&Personality{Name: "legacy", Options: []string{"OPT1"}})
+	if got := fmt.Sprint(ctx.Options()); got != "[OPT1]" {
+		t.Errorf("Options() after AddPersonality = %s, want [OPT1]", got)
+	}
+}
+
+// levelState is a StateMarshaler holding one setting
+type levelState struct{ level string }
+
+func (s *levelState) MarshalState() ([]byte, error) { return []byte(s.level), nil }
+
+func (s *levelState) UnmarshalState(state []byte) error {
+	s.level = string(state)
+	return nil
+}
+
+func TestSaveRecall(t *testing.T) {
+	var errs []string
+	ctx := NewContext([]*Command{
+		{Pattern: "*SAV", Callback: CoreSav},
+		{Pattern: "*RCL", Callback: CoreRcl},
+	}, &Interface{OnError: func(err *Error) { errs = append(errs, fmt.Sprint(err.Code)) }}, 256)
+
+	ctx.Input([]byte("*SAV 0\n"))
+	state := &levelState{level: "1.5"}
+	store := memStore{}
+	ctx.SetPowerOn(&PowerOn{Store: store, Reset: func() error { return nil }, State: state, Slots: 3})
+
+	ctx.Input([]byte("*SAV 2\n"))
+	state.level = "0"
+	ctx.Input([]byte("*RCL 2\n"))
+	if state.level != "1.5" || string(store["state.2"]) != "1.5" {
+		t.Errorf("after *SAV 2;*RCL 2 level = %q, slot = %q, want 1.5", state.level, store["state.2"])
+	}
+	ctx.Input([]byte("*SAV 3\n*RCL -1\n*RCL 1\n"))
+	if got := strings.Join(errs, ","); got != "-224,-224,-224,-200" {
+		t.Errorf("errors = %s, want -224,-224,-224,-200", got)
+	}
+}
+
+func TestPowerOnStatusClear(t *testing.T) {
+	commands := []*Command{
+		{Pattern: "*PSC", Callback: CorePsc},
+		{Pattern: "*PSC?", Callback: CorePscQ},
+		{Pattern: "*SRE", Callback: CoreSre},
+		{Pattern: "*ESE", Callback: CoreEse},
+	}
+	store := memStore{}
+	power := func() *Context {
+		ctx := NewContext(commands, nil, 256)
+		if err := ctx.SetPowerOn(&PowerOn{Store: store}); err != nil {
+			t.Fatalf("SetPowerOn: %v", err)
+		}
+		return ctx
+	}
+
+	ctx := power()
+	if !ctx.PowerOnStatusClear() {
+		t.Error("PowerOnStatusClear() = false by default, want true")
+	}
+	ctx.Input([]byte("*PSC 0;*SRE 48;*ESE 60\n"))
+	ctx = power()
+	if sre, ese := ctx.RegGet(RegSRE), ctx.RegGet(RegESE); ctx.PowerOnStatusClear() || sre != 48 || ese != 60 {
+		t.Errorf("after *PSC 0 power-on PSC %v, SRE %d, ESE %d, want false, 48, 60", ctx.PowerOnStatusClear(), sre, ese)
+	}
+
+	var output strings.Builder
+	ctx.iface = &Interface{Write: output.Write}
+	ctx.Input([]byte("*PSC 1;*PSC?\n"))
+	if output.String() != "1\n" {
+		t.Errorf("*PSC? = %q, want 1", output.String())
+	}
+	ctx = power()
+	if sre, ese := ctx.RegGet(RegSRE), ctx.RegGet(RegESE); sre != 0 || ese != 0 {
+		t.Errorf("after *PSC 1 power-on SRE %d, ESE %d, want 0", sre, ese)
+	}
+}
+
+func TestErrorQueueStatusBit(t *testing.T) {
+	var srq int
+	ctx := NewContext([]*Command{{Pattern: "*CLS", Callback: CoreCls}}, &Interface{OnSRQ: func() { srq++ }}, 256)
+	ctx.RegSet(RegSRE, StbErrorQueue)
+
+	ctx.ErrorPush(&Error{Code: -100, Info: "Command error"})
+	ctx.ErrorPush(&Error{Code: -200, Info: "Execution error"})
+	if ctx.RegGet(RegSTB)&StbErrorQueue == 0 || srq != 1 {
+		t.Errorf("after ErrorPush STB = %d, SRQs %d, want bit 2 set and 1 SRQ", ctx.RegGet(RegSTB), srq)
+	}
+	ctx.ErrorPop()
+	if ctx.RegGet(RegSTB)&StbErrorQueue == 0 {
+		t.Error("error queue bit cleared with an error left")
+	}
+	ctx.ErrorPop()
+	if ctx.RegGet(RegSTB)&StbErrorQueue != 0 {
+		t.Error("error queue bit set with the queue empty")
+	}
+
+	ctx.ErrorPush(&Error{Code: -100, Info: "Command error"})
+	ctx.Input([]byte("*CLS\n"))
+	if ctx.RegGet(RegSTB)&StbErrorQueue != 0 || srq != 2 {
+		t.Errorf("after *CLS STB = %d, SRQs %d, want bit 2 clear and 2 SRQs", ctx.RegGet(RegSTB), srq)
+	}
+}
+
+func TestOutputQueue(t *testing.T) {
+	var output strings.Builder
+	ctx := NewContext([]*Command{
+		{Pattern: "*IDN?", Callback: CoreIdnQ},
+		{Pattern: "*STB?", Callback: CoreStbQ},
+	}, &Interface{Write: output.Write}, 256)
+	ctx.SetIDN("ACME", "X1", "0", "1.0")
+	ctx.SetOutputQueue(true)
+
+	ctx.Input([]byte("*STB?\n"))
+	ctx.Input([]byte("*IDN?\n"))
+	if output.Len() != 0 {
+		t.Errorf("output written through Interface.Write: %q", output.String())
+	}
+	if ctx.RegGet(RegSTB)&StbMAV == 0 || ctx.OutputPending() != 16 {
+		t.Errorf("STB = %d, pending %d, want MAV set and 16 bytes", ctx.RegGet(RegSTB), ctx.OutputPending())
+	}
+	if got := string(ctx.ReadOutput(2)); got != "0\n" {
+		t.Errorf("ReadOutput(2) = %q, want \"0\\n\"", got)
+	}
+	if ctx.RegGet(RegSTB)&StbMAV == 0 {
+		t.Error("MAV cleared with output left")
+	}
+	if got := string(ctx.ReadOutput(0)); got != "ACME,X1,0,1.0\n" {
+		t.Errorf("ReadOutput(0) = %q, want the *IDN? response", got)
+	}
+	if ctx.RegGet(RegSTB)&StbMAV != 0 {
+		t.Error("MAV set with the output queue drained")
+	}
+
+	ctx.Input([]byte("*IDN?\n"))
+	ctx.DeviceClear()
+	if ctx.OutputPending() != 0 || ctx.RegGet(RegSTB)&StbMAV != 0 {
+		t.Errorf("after DeviceClear pending %d, STB %d, want 0", ctx.OutputPending(), ctx.RegGet(RegSTB))
+	}
+}
+
+func TestErrorCount(t *testing.T) {
+	var output strings.Builder
+	ctx := NewContext([]*Command{{Pattern: "SYSTem:ERRor:COUNt?", Callback: SystemErrorCountQ}}, &Interface{Write: output.Write}, 256)
+
+	ctx.Input([]byte("SYST:ERR:COUN?\n"))
+	ctx.ErrorPush(&Error{Code: -100, Info: "Command error"})
+	ctx.ErrorPush(&Error{Code: -200, Info: "Execution error"})
+	ctx.Input([]byte("SYST:ERR:COUN?\n"))
+	ctx.ErrorPop()
+	if ctx.ErrorCount() != 1 {
+		t.Errorf("ErrorCount() = %d after ErrorPop, want 1", ctx.ErrorCount())
+	}
+	if want := "0\n2\n"; output.String() != want {
+		t.Errorf("SYST:ERR:COUN? = %q, want %q", output.String(), want)
+	}
+}
+
+func TestErrorPopAll(t *testing.T) {
+	var output strings.Builder
+	ctx := NewContext([]*Command{{Pattern: "SYSTem:ERRor:ALL?", Callback: SystemErrorAllQ}}, &Interface{Write: output.Write}, 256)
+
+	ctx.ErrorPush(&Error{Code: -100, Info: "Command error"})
+	ctx.ErrorPush(&Error{Code: -222, Info: "Data out of range"})
+	ctx.Input([]byte("SYST:ERR:ALL?\n"))
+	ctx.Input([]byte("SYST:ERR:ALL?\n"))
+	if want := "-100,\"Command error\",-222,\"Data out of range\"\n0,\"No error\"\n"; output.String() != want {
+		t.Errorf("SYST:ERR:ALL? = %q, want %q", output.String(), want)
+	}
+	if ctx.ErrorCount() != 0 || ctx.RegGet(RegSTB)&StbErrorQueue != 0 {
+		t.Errorf("after SYST:ERR:ALL? count %d, STB %d, want 0", ctx.ErrorCount(), ctx.RegGet(RegSTB))
+	}
+
+	ctx.ErrorPush(&Error{Code: -113, Info: "Undefined header"})
+	if errs := ctx.ErrorPopAll(); len(errs) != 1 || errs[0].Code != -113 {
+		t.Errorf("ErrorPopAll() = %v, want the -113 error", errs)
+	}
+}
+
+func TestErrorQueueSize(t *testing.T) {
+	ctx := NewContext(nil, nil, 256)
+	if ctx.ErrorQueueSize() != 10 {
+		t.Errorf("ErrorQueueSize() = %d by default, want 10", ctx.ErrorQueueSize())
+	}
+
+	ctx.SetErrorQueueSize(3)
+	for i := int16(1); i <= 5; i++ {
+		ctx.ErrorPush(&Error{Code: -100 - i})
+	}
+	var codes []int16
+	for err := ctx.ErrorPop(); err != nil; err = ctx.ErrorPop() {
+		codes = append(codes, err.Code)
+	}
+	if got := fmt.Sprint(codes); got != "[-101 -102 -350]" {
+		t.Errorf("queue of 3 after 5 errors = %s, want [-101 -102 -350]", got)
+	}
+
+	// The queue keeps its size after being drained with ErrorPop
+	for i := int16(1); i <= 20; i++ {
+		ctx.ErrorPush(&Error{Code: -100 - i})
+		ctx.ErrorPop()
+	}
+	for i := int16(1); i <= 4; i++ {
+		ctx.ErrorPush(&Error{Code: -100 - i})
+	}
+	if ctx.ErrorCount() != 3 {
+		t.Errorf("ErrorCount() = %d, want 3", ctx.ErrorCount())
+	}
+
+	ctx.SetErrorQueueSize(1)
+	if errs := ctx.ErrorPopAll(); len(errs) != 1 || errs[0].Code != -350 {
+		t.Errorf("after shrinking to 1 the queue holds %v, want -350", errs)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	tests := []struct {
+		code int16
+		info string
+	}{
+		{CodeNoError, "No error"},
+		{CodeUndefinedHeader, "Undefined header"},
+		{CodeDataOutOfRange, "Data out of range"},
+		{CodeQueueOverflow, "Queue overflow"},
+		{-299, "Execution error"},
+		{42, ""},
+	}
+	for _, tt := range tests {
+		if err := NewError(tt.code); err.Code != tt.code || err.Info != tt.info {
+			t.Errorf("NewError(%d) = %d,%q, want %q", tt.code, err.Code, err.Info, tt.info)
+		}
+	}
+}
+
+func TestErrorDetail(t *testing.T) {
+	var output strings.Builder
+	ctx := NewContext([]*Command{{Pattern: "SYSTem:ERRor[:NEXT]?", Callback: func(ctx *Context) Result {
+		ctx.ResultError(ctx.ErrorPop())
+		return ResOK
+	}}}, &Interface{Write: output.Write}, 256)
+
+	ctx.Input([]byte("MEAS:BOGUS?\n"))
+	ctx.ErrorPushf(CodeDataOutOfRange, "level %g", 12.5)
+	ctx.Input([]byte("SYST:ERR?;ERR?\n"))
+	if want := "-113,\"Undefined header;MEAS:BOGUS?\";-222,\"Data out of range;level 12.5\"\n"; output.String() != want {
+		t.Errorf("SYST:ERR? = %q, want %q", output.String(), want)
+	}
+}
+
+func TestClearStatus(t *testing.T) {
+	var output strings.Builder
+	ctx := NewContext([]*Command{
+		{Pattern: "*CLS", Callback: CoreCls},
+		{Pattern: "*IDN?", Callback: CoreIdnQ},
+	}, &Interface{Write: output.Write}, 256)
+	ctx.SetIDN("ACME", "X1", "0", "1.0")
+	ctx.SetOutputQueue(true)
+
+	ctx.Input([]byte("*IDN?\nBOGus\n"))
+	ctx.QuestionableStatus().SetEnable(1)
+	ctx.QuestionableStatus().SetCondition(1)
+	ctx.Input([]byte("*CLS\n"))
+	if ctx.ErrorCount() != 0 || ctx.OutputPending() != 0 || ctx.RegGet(RegESR) != 0 || ctx.QuestionableStatus().Event() != 0 {
+		t.Errorf("after *CLS errors %d, output %d, ESR %d, QUES event %d, want 0",
+			ctx.ErrorCount(), ctx.OutputPending(), ctx.RegGet(RegESR), ctx.QuestionableStatus().Event())
+	}
+	if stb := ctx.RegGet(RegSTB); stb != 0 {
+		t.Errorf("STB after *CLS = %d, want 0", stb)
+	}
+
+	ctx.Input([]byte("*IDN?;*CLS\n"))
+	if got := string(ctx.ReadOutput(0)); got != "ACME,X1,0,1.0\n" {
+		t.Errorf("output of *IDN?;*CLS = %q, want the *IDN? response", got)
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	var errs []*Error
+	ctx := NewContext([]*Command{
+		{Pattern: "SOURce:VOLTage", Callback: func(ctx *Context) Result {
+			if _, err := ctx.ParamInt32(true); err != nil {
+				return ResErr
+			}
+			if _, err := ctx.ParamInt32(true); err != nil {
+				return ResErr
+			}
+			return ResOK
+		}},
+	}, &Interface{OnError: func(err *Error) { errs = append(errs, err) }}, 256)
+
+	tests := []struct {
+		input    string
+		header   string
+		position int
+	}{
+		{"SOUR:VOLT 1,2;BOGus", "SOUR:BOGus", 14},
+		{"SOUR:VOLT 1,2;VOLT 2, ABC", "SOUR:VOLT", 22},
+		{"SOUR:VOLT 1,2\nSOUR:VOLT 1,2;VOLT 1 2", "SOUR:VOLT", 21},
+		{"SOUR:VOLT 1,2;%", "", 14},
+	}
+	for _, tt := range tests {
+		errs = nil
+		ctx.Input([]byte(tt.input + "\n"))
+		if len(errs) != 1 || errs[0].Header != tt.header || errs[0].Position != tt.position {
+			for _, e := range errs {
+				t.Errorf("%q queued %d at %q, %d", tt.input, e.Code, e.Header, e.Position)
+			}
+			t.Errorf("%q: want one error at %q, %d", tt.input, tt.header, tt.position)
+		}
+	}
+
+	errs = nil
+	ctx.ErrorPush(NewError(CodeSystemError))
+	if errs[0].Header != "" || errs[0].Position != 0 {
+		t.Errorf("error pushed outside parsing located at %q, %d", errs[0].Header, errs[0].Position)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	var paramErr error
+	ctx := NewContext([]*Command{{Pattern: "SOURce:VOLTage", Callback: func(ctx *Context) Result {
+		_, paramErr = ctx.ParamInt32(true)
+		return ResOK
+	}}}, nil, 16)
+
+	err := ctx.Parse([]byte("SOUR:BOGus\n"))
+	var e *Error
+	if !errors.Is(err, ErrUndefinedHeader) || !errors.As(err, &e) || e.Header != "SOUR:BOGus" {
+		t.Errorf("Parse of an undefined header = %v, want -113 for SOUR:BOGus", err)
+	}
+	if err.Error() != "undefined header: SOUR:BOGus" {
+		t.Errorf("Parse error text = %q", err.Error())
+	}
+
+	ctx.Parse([]byte("SOUR:VOLT\n"))
+	if !errors.Is(paramErr, ErrMissingParameter) {
+		t.Errorf("ParamInt32 without a parameter = %v, want -109", paramErr)
+	}
+	ctx.Parse([]byte("SOUR:VOLT 9999999999\n"))
+	if !errors.Is(paramErr, ErrDataOutOfRange) {
+		t.Errorf("ParamInt32 of 9999999999 = %v, want -222", paramErr)
+	}
+
+	if err := ctx.Input([]byte("SOURce:VOLTage 1,2,3\n")); !errors.Is(err, ErrBufferOverflow) {
+		t.Errorf("Input overflowing the buffer = %v, want -363", err)
+	}
+	if got := ErrUndefinedHeader.Error(); got != `-113,"Undefined header"` {
+		t.Errorf("ErrUndefinedHeader.Error() = %s", got)
+	}
+}
+
+func TestErrorPhase(t *testing.T) {
+	var parseErrs, cmdErrs []string
+	ctx := NewContext([]*Command{{Pattern: "OUTPut", Callback: func(ctx *Context) Result {
+		on, err := ctx.ParamBool(true)
+		if err != nil {
+			return ResErr
+		}
+		if on {
+			ctx.ErrorPush(NewError(CodeHardwareError))
+			return ResErr
+		}
+		return ResOK
+	}}}, &Interface{
+		OnParseError:   func(err *Error) { parseErrs = append(parseErrs, fmt.Sprint(err.Code, " ", err.Header)) },
+		OnCommandError: func(err *Error) { cmdErrs = append(cmdErrs, fmt.Sprint(err.Code, " ", err.Header)) },
+	}, 256)
+
+	ctx.Input([]byte("OUTP ON;BOGus\n"))
+	ctx.Input([]byte("OUTP\n"))
+	ctx.ErrorPush(NewError(CodeSystemError))
+	if got := strings.Join(parseErrs, ","); got != "-113 BOGus,-109 OUTP" {
+		t.Errorf("parse errors = %s, want -113 BOGus,-109 OUTP", got)
+	}
+	if got := strings.Join(cmdErrs, ","); got != "-240 OUTP" {
+		t.Errorf("command errors = %s, want -240 OUTP", got)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		code                              int16
+		command, execution, device, query bool
+	}{
+		{-100, true, false, false, false},
+		{-199, true, false, false, false},
+		{-222, false, true, false, false},
+		{-350, false, false, true, false},
+		{42, false, false, true, false},
+		{-410, false, false, false, true},
+		{-500, false, false, false, false},
+		{0, false, false, false, false},
+	}
+	for _, tt := range tests {
+		e := &Error{Code: tt.code}
+		if e.IsCommandError() != tt.command || e.IsExecutionError() != tt.execution ||
+			e.IsDeviceError() != tt.device || e.IsQueryError() != tt.query {
+			t.Errorf("%d classified %v,%v,%v,%v, want %v,%v,%v,%v", tt.code,
+				e.IsCommandError(), e.IsExecutionError(), e.IsDeviceError(), e.IsQueryError(),
+				tt.command, tt.execution, tt.device, tt.query)
+		}
+	}
+}
+
+func TestSerialPoll(t *testing.T) {
+	ctx := NewContext(nil, &Interface{}, 256)
+	ctx.RegSet(RegSRE, StbMAV)
+	if got := ctx.SerialPoll(); got != 0 {
+		t.Errorf("SerialPoll() = %d, want 0", got)
+	}
+
+	ctx.RegSet(RegSTB, StbMAV)
+	if got := ctx.SerialPoll(); got != 0x50 {
+		t.Errorf("SerialPoll() = %#x, want 0x50", got)
+	}
+	if got := ctx.SerialPoll(); got != 0x10 {
+		t.Errorf("second SerialPoll() = %#x, want 0x10", got)
+	}
+	if got := ctx.RegGet(RegSTB); got != 0x50 {
+		t.Errorf("STB = %#x, want 0x50", got)
+	}
+
+	// RQS is cleared with MSS and set again by the next request
+	ctx.RegClear(RegSTB, StbMAV)
+	ctx.RegSet(RegSTB, StbMAV)
+	if got := ctx.SerialPoll(); got != 0x50 {
+		t.Errorf("SerialPoll() after a new request = %#x, want 0x50", got)
+	}
+}
+
+func TestErrorPushCopies(t *testing.T) {
+	shared := NewError(CodeHardwareError)
+	ctx := NewContext([]*Command{{Pattern: "OUTPut", Callback: func(ctx *Context) Result {
+		ctx.ErrorPush(shared)
+		ctx.ErrorPush(ErrHardwareMissing)
+		return ResErr
+	}}}, nil, 256)
+
+	ctx.Input([]byte("OUTP\n"))
+	if shared.Header != "" || ErrHardwareMissing.Header != "" {
+		t.Errorf("pushed errors modified: %q, %q", shared.Header, ErrHardwareMissing.Header)
+	}
+	got := ctx.ErrorPopAll()
+	if len(got) != 2 || got[0].Header != "OUTP" || got[1].Header != "OUTP" {
+		t.Errorf("queued errors = %v", got)
+	}
+}
+
+func TestInputContinuesAfterError(t *testing.T) {
+	var output strings.Builder
+	ctx := NewContext([]*Command{{Pattern: "TEST?", Callback: func(ctx *Context) Result {
+		ctx.ResultInt32(1)
+		return ResOK
+	}}}, &Interface{Write: output.Write}, 16)
+
+	err := ctx.Input([]byte("BOGus\nTEST?\nNONE\nTEST?\n"))
+	if !errors.Is(err, ErrUndefinedHeader) || output.String() != "1\n1\n" {
+		t.Errorf("Input = %q, %v, want both TEST? answered and -113", output.String(), err)
+	}
+	if errs := ctx.ErrorPopAll(); len(errs) != 2 {
+		t.Errorf("queued %v, want two -113", errs)
+	}
+
+	// The rest of an overflowing line is discarded, even across calls
+	output.Reset()
+	err = ctx.Input([]byte("TEST? 0123456789ABC"))
+	ctx.Input([]byte("0123456789\nTEST?\n"))
+	if !errors.Is(err, ErrBufferOverflow) || output.String() != "1\n" {
+		t.Errorf("Input after overflow = %q, %v, want one TEST? answered and -363", output.String(), err)
+	}
+}
+
+func TestPersonalityAliasOrder(t *testing.T) {
+	var ran string
+	record := func(name string) func(*Context) Result {
+		return func(*Context) Result {
+			ran = name
+			return ResOK
+		}
+	}
+	ctx := NewContext([]*Command{
+		{Pattern: "SOURce:VOLTage", Callback: record("volt")},
+		{Pattern: "SOURce:CURRent", Callback: record("curr")},
+	}, nil, 256)
+	ctx.AddPersonality(&Personality{Name: "OLD", Aliases: []AliasDef{
+		{"SET[:LEVel]", "SOURce:VOLTage"},
+		{"SET:LEVel", "SOURce:CURRent"},
+		{"SET:CURRent", "SOURce:CURRent"},
+	}})
+
+	for i := 0; i < 20; i++ {
+		ctx.Input([]byte("SET:LEV;:SET:CURR\n"))
+		if ran != "curr" {
+			t.Fatalf("SET:CURR ran %q, want curr", ran)
+		}
+		ctx.Input([]byte("SET:LEV\n"))
+		if ran != "volt" {
+			t.Fatalf("SET:LEV ran %q, want the first alias, volt", ran)
+		}
+	}
+}
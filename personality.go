@@ -0,0 +1,148 @@
+package scpi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultSCPIVersion is reported by SYSTem:VERSion? unless a personality
+// overrides it
+const defaultSCPIVersion = "1999.0"
+
+// AddPersonality registers a personality that SetPersonality and
+// SYSTem:PERSona can switch to. The first one added becomes active.
+func (c *Context) AddPersonality(p *Personality) {
+	c.personas = append(c.personas, p)
+	for _, alias := range p.Aliases {
+		c.aliasDepth = max(c.aliasDepth, headerDepth(alias.Pattern))
+	}
+	if c.persona == nil {
+		c.applyPersonality(p)
+	}
+}
+
+// SetPersonality switches to the registered personality with the given name,
+// compared case-insensitively
+func (c *Context) SetPersonality(name string) error {
+	for _, p := range c.personas {
+		if strings.EqualFold(p.Name, name) {
+			c.applyPersonality(p)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown personality: %s", name)
+}
+
+// Personality returns the active personality, or nil if none was added
+func (c *Context) Personality() *Personality {
+	return c.persona
+}
+
+// applyPersonality makes p the active personality
+func (c *Context) applyPersonality(p *Personality) {
+	c.persona = p
+	c.idn = p.IDN
+	c.options = p.Options
+	c.scpiVersion = p.SCPIVersion
+	c.floatFormat = p.FloatFormat
+}
+
+// IDN returns the identification strings set by SetIDN or the active
+// personality
+func (c *Context) IDN() [4]string {
+	return c.idn
+}
+
+// SetOptions sets the installed options *OPT? reports, e.g. licensed
+// features, until a personality is applied
+func (c *Context) SetOptions(options []string) {
+	c.options = options
+}
+
+// Options returns the option list set by SetOptions or the active
+// personality
+func (c *Context) Options() []string {
+	return c.options
+}
+
+// findAlias resolves header through the active personality's aliases, in
+// their order
+func (c *Context) findAlias(t *commandTable, header string) *Command {
+	if c.persona == nil {
+		return nil
+	}
+	for _, alias := range c.persona.Aliases {
+		if !matchCommand(alias.Pattern, header) {
+			continue
+		}
+		if c.strictForm && strings.HasSuffix(alias.Target, "?") != strings.HasSuffix(header, "?") {
+			continue
+		}
+		for _, cmd := range t.commands {
+			if cmd.Pattern == alias.Target {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+// CoreIdnQ implements *IDN? from the identification strings
+func CoreIdnQ(ctx *Context) Result {
+	for _, s := range ctx.idn {
+		ctx.ResultMnemonic(s)
+	}
+	return ResOK
+}
+
+// CoreOptQ implements *OPT?, answering the installed options separated by
+// commas, or 0 when there are none
+func CoreOptQ(ctx *Context) Result {
+	if len(ctx.options) == 0 {
+		ctx.ResultInt32(0)
+		return ResOK
+	}
+	for _, option := range ctx.options {
+		ctx.ResultMnemonic(option)
+	}
+	return ResOK
+}
+
+// SystemVersionQ implements SYSTem:VERSion?
+func SystemVersionQ(ctx *Context) Result {
+	version := ctx.scpiVersion
+	if version == "" {
+		version = defaultSCPIVersion
+	}
+	ctx.ResultMnemonic(version)
+	return ResOK
+}
+
+// SystemPersona implements SYSTem:PERSona <name>
+func SystemPersona(ctx *Context) Result {
+	param, err := ctx.Parameter(true)
+	if err != nil {
+		return ResErr
+	}
+
+	if k := param.Kind(); k != KindMnemonic && k != KindString {
+		ctx.ErrorPush(NewError(CodeDataTypeError))
+		return ResErr
+	}
+
+	if err := ctx.SetPersonality(param.AsString()); err != nil {
+		ctx.ErrorPush(NewError(CodeIllegalParameterValue))
+		return ResErr
+	}
+	return ResOK
+}
+
+// SystemPersonaQ implements SYSTem:PERSona?
+func SystemPersonaQ(ctx *Context) Result {
+	if ctx.persona == nil {
+		ctx.ErrorPush(NewError(CodeSettingsConflict))
+		return ResErr
+	}
+	ctx.ResultMnemonic(ctx.persona.Name)
+	return ResOK
+}
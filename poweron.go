@@ -0,0 +1,333 @@
+package scpi
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Names under which power-on data is kept in the StateStore
+const (
+	powerOnTypeName  = "poweron.type"
+	pscName          = "poweron.psc"
+	statusEnableName = "status.enable" // *SRE and *ESE, e.g. "32,60"
+	lastStateName    = "state.last"
+	slotStatePrefix  = "state." // followed by the slot number
+)
+
+// defaultStateSlots is the number of *SAV/*RCL slots unless PowerOn.Slots
+// sets it
+const defaultStateSlots = 10
+
+// powerOnTypes lists the SYSTem:POWeron:TYPE choices
+var powerOnTypes = []ChoiceDef{
+	{Name: "RST", Tag: int32(PowerOnReset)},
+	{Name: "RCL0", Tag: int32(PowerOnRecall0)},
+	{Name: "LAST", Tag: int32(PowerOnLast)},
+}
+
+// SetPowerOn installs the power-on configuration and loads the power-on type
+// from its store. Unless the stored *PSC flag is set, *SRE and *ESE get the
+// values they had before power-down.
+func (c *Context) SetPowerOn(p *PowerOn) error {
+	c.powerOn = p
+	c.powerOnType.Store(int32(PowerOnReset))
+	if err := c.loadPowerOnStatus(); err != nil {
+		return err
+	}
+
+	data, err := p.Store.Load(powerOnTypeName)
+	if err != nil || data == nil {
+		return err
+	}
+	t, err := strconv.Atoi(string(data))
+	if err != nil || t < int(PowerOnReset) || t > int(PowerOnLast) {
+		return fmt.Errorf("invalid stored power-on type %q", data)
+	}
+	c.powerOnType.Store(int32(t))
+	return nil
+}
+
+// loadPowerOnStatus loads the *PSC flag, set unless stored as 0, and with
+// it cleared restores *SRE and *ESE; with it set they stay cleared
+func (c *Context) loadPowerOnStatus() error {
+	store := c.powerOn.Store
+	data, err := store.Load(pscName)
+	if err != nil {
+		return err
+	}
+	c.psc.Store(string(data) != "0")
+	if c.psc.Load() {
+		return nil
+	}
+
+	data, err = store.Load(statusEnableName)
+	if err != nil || data == nil {
+		return err
+	}
+	var sre, ese uint16
+	if _, err := fmt.Sscanf(string(data), "%d,%d", &sre, &ese); err != nil {
+		return fmt.Errorf("invalid stored status enable registers %q", data)
+	}
+	c.statusMu.Lock()
+	c.regWrite(RegSRE, sre&^StbMSS)
+	c.regWrite(RegESE, ese)
+	c.statusUnlock()
+	return nil
+}
+
+// PowerOnStatusClear returns the *PSC flag: whether *SRE and *ESE are
+// cleared at power-on rather than restored
+func (c *Context) PowerOnStatusClear() bool {
+	return c.psc.Load()
+}
+
+// SetPowerOnStatusClear sets the *PSC flag and persists it. Clearing it
+// also saves the current *SRE and *ESE for the next power-up.
+func (c *Context) SetPowerOnStatusClear(clear bool) error {
+	if c.powerOn == nil {
+		return fmt.Errorf("power-on state not configured")
+	}
+	flag := "0"
+	if clear {
+		flag = "1"
+	}
+	if err := c.powerOn.Store.Save(pscName, []byte(flag)); err != nil {
+		return err
+	}
+	c.psc.Store(clear)
+	return c.saveStatusEnable()
+}
+
+// saveStatusEnable persists *SRE and *ESE while the *PSC flag is cleared
+func (c *Context) saveStatusEnable() error {
+	if c.powerOn == nil || c.psc.Load() {
+		return nil
+	}
+	value := fmt.Sprintf("%d,%d", c.RegGet(RegSRE), c.RegGet(RegESE))
+	return c.powerOn.Store.Save(statusEnableName, []byte(value))
+}
+
+// CorePsc implements *PSC <NRf>, setting the power-on status clear flag
+// for a non-zero value
+func CorePsc(ctx *Context) Result {
+	value, err := ctx.ParamInt32(true)
+	if err != nil {
+		return ResErr
+	}
+	if err := ctx.SetPowerOnStatusClear(value != 0); err != nil {
+		ctx.ErrorPushf(CodeExecutionError, "%v", err)
+		return ResErr
+	}
+	return ResOK
+}
+
+// CorePscQ implements *PSC?
+func CorePscQ(ctx *Context) Result {
+	ctx.ResultBool(ctx.PowerOnStatusClear())
+	return ResOK
+}
+
+// PowerOnType returns the state the instrument starts in
+func (c *Context) PowerOnType() PowerOnType {
+	return PowerOnType(c.powerOnType.Load())
+}
+
+// SetPowerOnType selects the state the instrument starts in and persists
+// the choice
+func (c *Context) SetPowerOnType(t PowerOnType) error {
+	if c.powerOn == nil {
+		return fmt.Errorf("power-on state not configured")
+	}
+	if err := c.powerOn.Store.Save(powerOnTypeName, []byte(strconv.Itoa(int(t)))); err != nil {
+		return err
+	}
+	c.powerOnType.Store(int32(t))
+	return nil
+}
+
+// ApplyPowerOnState puts the instrument in its power-on state, to be called
+// once at startup. A missing saved state falls back to the *RST defaults.
+func (c *Context) ApplyPowerOnState() error {
+	p := c.powerOn
+	if p == nil {
+		return fmt.Errorf("power-on state not configured")
+	}
+
+	var name string
+	switch c.PowerOnType() {
+	case PowerOnRecall0:
+		name = slotStatePrefix + "0"
+	case PowerOnLast:
+		name = lastStateName
+	}
+
+	if name != "" {
+		state, err := p.Store.Load(name)
+		if err != nil {
+			return err
+		}
+		if state != nil {
+			return p.restore(state)
+		}
+	}
+	return p.Reset()
+}
+
+// snapshot serializes the current state with Snapshot or State
+func (p *PowerOn) snapshot() ([]byte, error) {
+	switch {
+	case p.Snapshot != nil:
+		return p.Snapshot()
+	case p.State != nil:
+		return p.State.MarshalState()
+	}
+	return nil, fmt.Errorf("no state serializer configured")
+}
+
+// restore applies a serialized state with Restore or State
+func (p *PowerOn) restore(state []byte) error {
+	switch {
+	case p.Restore != nil:
+		return p.Restore(state)
+	case p.State != nil:
+		return p.State.UnmarshalState(state)
+	}
+	return fmt.Errorf("no state serializer configured")
+}
+
+// StateSlots returns the number of *SAV/*RCL slots, numbered from 0, or 0
+// if no power-on configuration is installed
+func (c *Context) StateSlots() int {
+	switch {
+	case c.powerOn == nil:
+		return 0
+	case c.powerOn.Slots > 0:
+		return c.powerOn.Slots
+	}
+	return defaultStateSlots
+}
+
+// SaveState stores a snapshot of the current state in a slot, as *SAV does.
+// Slot 0 is the state power-on type RCL0 starts in.
+func (c *Context) SaveState(slot int) error {
+	if slot < 0 || slot >= c.StateSlots() {
+		return fmt.Errorf("invalid state slot %d", slot)
+	}
+	state, err := c.powerOn.snapshot()
+	if err != nil {
+		return err
+	}
+	return c.powerOn.Store.Save(slotStatePrefix+strconv.Itoa(slot), state)
+}
+
+// RecallState applies the state saved in a slot, as *RCL does
+func (c *Context) RecallState(slot int) error {
+	if slot < 0 || slot >= c.StateSlots() {
+		return fmt.Errorf("invalid state slot %d", slot)
+	}
+	state, err := c.powerOn.Store.Load(slotStatePrefix + strconv.Itoa(slot))
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("no state saved in slot %d", slot)
+	}
+	return c.powerOn.restore(state)
+}
+
+// stateSlotParam reads the slot number parameter of *SAV and *RCL, pushing
+// -224 for a slot that does not exist
+func stateSlotParam(ctx *Context) (int, bool) {
+	slot, err := ctx.ParamInt32(true)
+	if err != nil {
+		return 0, false
+	}
+	if slot < 0 || int(slot) >= ctx.StateSlots() {
+		ctx.ErrorPushf(CodeIllegalParameterValue, "no state slot %d", slot)
+		return 0, false
+	}
+	return int(slot), true
+}
+
+// CoreSav implements *SAV <n>, saving the current state in slot n
+func CoreSav(ctx *Context) Result {
+	slot, ok := stateSlotParam(ctx)
+	if !ok {
+		return ResErr
+	}
+	if err := ctx.SaveState(slot); err != nil {
+		ctx.ErrorPushf(CodeExecutionError, "%v", err)
+		return ResErr
+	}
+	return ResOK
+}
+
+// CoreRcl implements *RCL <n>, applying the state saved in slot n
+func CoreRcl(ctx *Context) Result {
+	slot, ok := stateSlotParam(ctx)
+	if !ok {
+		return ResErr
+	}
+	if err := ctx.RecallState(slot); err != nil {
+		ctx.ErrorPushf(CodeExecutionError, "%v", err)
+		return ResErr
+	}
+	return ResOK
+}
+
+// SaveLastState stores a snapshot of the current state for power-on type
+// LAST. It does nothing for the other types.
+func (c *Context) SaveLastState() error {
+	p := c.powerOn
+	if p == nil || c.PowerOnType() != PowerOnLast {
+		return nil
+	}
+	state, err := p.snapshot()
+	if err != nil {
+		return err
+	}
+	return p.Store.Save(lastStateName, state)
+}
+
+// PersistLastState calls SaveLastState every interval until the returned
+// stop function is called. Errors are passed to onError if it is not nil.
+// Snapshot runs on a separate goroutine, so it must be safe to call while
+// commands execute.
+func (c *Context) PersistLastState(interval time.Duration, onError func(error)) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.SaveLastState(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// SystemPoweronType implements SYSTem:POWeron:TYPE RST|RCL0|LAST
+func SystemPoweronType(ctx *Context) Result {
+	tag, err := ctx.ParamChoice(powerOnTypes, true)
+	if err != nil {
+		return ResErr
+	}
+	if err := ctx.SetPowerOnType(PowerOnType(tag)); err != nil {
+		ctx.ErrorPushf(CodeExecutionError, "%v", err)
+		return ResErr
+	}
+	return ResOK
+}
+
+// SystemPoweronTypeQ implements SYSTem:POWeron:TYPE?
+func SystemPoweronTypeQ(ctx *Context) Result {
+	ctx.ResultMnemonic(powerOnTypes[ctx.PowerOnType()].Name)
+	return ResOK
+}
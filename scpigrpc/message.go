@@ -0,0 +1,149 @@
+package scpigrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Protocol buffer wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errBadMessage = errors.New("scpigrpc: malformed message")
+
+// Error is an entry of the error queue, the Error message of scpi.proto
+type Error struct {
+	Code    int32
+	Message string
+}
+
+// Status holds the status registers, the Status message of scpi.proto
+type Status struct {
+	StatusByte           uint32
+	ServiceRequestEnable uint32
+	EventStatus          uint32
+	EventStatusEnable    uint32
+}
+
+// appendVarint appends a field with a varint value
+func appendVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendBytes appends a length-delimited field
+func appendBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// marshal encodes e. Negative codes are sign-extended to 64 bits, as
+// proto3 encodes int32.
+func (e Error) marshal() []byte {
+	var b []byte
+	if e.Code != 0 {
+		b = appendVarint(b, 1, uint64(int64(e.Code)))
+	}
+	if e.Message != "" {
+		b = appendBytes(b, 2, []byte(e.Message))
+	}
+	return b
+}
+
+// marshal encodes s, leaving out zero registers as proto3 does
+func (s Status) marshal() []byte {
+	var b []byte
+	for i, v := range []uint32{s.StatusByte, s.ServiceRequestEnable, s.EventStatus, s.EventStatusEnable} {
+		if v != 0 {
+			b = appendVarint(b, i+1, uint64(v))
+		}
+	}
+	return b
+}
+
+// field is a decoded field: the value of a varint, or the data of a
+// length-delimited field
+type field struct {
+	num   int
+	value uint64
+	data  []byte
+}
+
+// unmarshal decodes the fields of a message, skipping fixed-size ones
+func unmarshal(msg []byte) ([]field, error) {
+	var fields []field
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, errBadMessage
+		}
+		msg = msg[n:]
+		f := field{num: int(key >> 3)}
+		switch key & 7 {
+		case wireVarint:
+			f.value, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return nil, errBadMessage
+			}
+			msg = msg[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return nil, errBadMessage
+			}
+			f.data = msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+		case wireFixed64:
+			if len(msg) < 8 {
+				return nil, errBadMessage
+			}
+			msg = msg[8:]
+			continue
+		case wireFixed32:
+			if len(msg) < 4 {
+				return nil, errBadMessage
+			}
+			msg = msg[4:]
+			continue
+		default:
+			return nil, errBadMessage
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// readFrame reads a length-prefixed gRPC message of at most max bytes
+func readFrame(r io.Reader, max int) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errCompressed
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if int64(size) > int64(max) {
+		return nil, errTooLarge
+	}
+	msg := make([]byte, size)
+	_, err := io.ReadFull(r, msg)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return msg, err
+}
+
+// writeFrame writes msg with its uncompressed length prefix
+func writeFrame(w io.Writer, msg []byte) error {
+	buf := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
@@ -0,0 +1,290 @@
+// Package scpigrpc serves a SCPI command set as the gRPC service defined in
+// scpi.proto, so clients get typed stubs while the instrument logic stays in
+// the command table. Execute and Query run program messages; StreamErrors
+// and StreamStatus follow the error queue and the status registers.
+//
+// Server is an http.Handler speaking gRPC over HTTP/2, with the protocol
+// buffer messages encoded by hand, so the package needs nothing beyond the
+// standard library. Serve it with TLS, which enables HTTP/2, e.g. with
+// http.ListenAndServeTLS. Execute and Query run on the same scpihttp.Runner
+// as the HTTP gateway and likewise drain the error queue into their reply.
+package scpigrpc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+	"github.com/Nine-Fives/go-scpi-parser/scpihttp"
+)
+
+// ServicePath prefixes the paths of the Instrument service's methods
+const ServicePath = "/scpi.v1.Instrument/"
+
+// gRPC status codes
+const (
+	codeOK                = 0
+	codeInvalidArgument   = 3
+	codeResourceExhausted = 8
+	codeUnimplemented     = 12
+	codeUnavailable       = 14
+)
+
+var (
+	errCompressed = errors.New("scpigrpc: compressed messages are not supported")
+	errTooLarge   = errors.New("scpigrpc: message too large")
+)
+
+// Options configures a Server
+type Options struct {
+	BufferSize int                     // Input buffer size, 1024 when zero
+	MaxMessage int                     // Largest request message accepted, 4 MiB when zero
+	Setup      func(ctx *scpi.Context) // Called once on the Context, e.g. to SetIDN
+}
+
+// Server runs the Instrument service on a Context
+type Server struct {
+	opts   Options
+	ctx    *scpi.Context
+	runner *scpihttp.Runner // Runs Execute and Query
+
+	subMu  sync.Mutex
+	subs   map[chan Error]struct{} // StreamErrors subscribers
+	done   chan struct{}           // Closed by Close
+	closed bool
+}
+
+// New creates a server for commands
+func New(commands []*scpi.Command, opts Options) *Server {
+	if opts.BufferSize == 0 {
+		opts.BufferSize = 1024
+	}
+	if opts.MaxMessage == 0 {
+		opts.MaxMessage = 4 << 20
+	}
+
+	s := &Server{
+		opts: opts,
+		subs: make(map[chan Error]struct{}),
+		done: make(chan struct{}),
+	}
+	s.runner = scpihttp.NewRunner(commands, scpi.Interface{OnError: s.publish}, opts.BufferSize)
+	s.ctx = s.runner.Context()
+	if opts.Setup != nil {
+		opts.Setup(s.ctx)
+	}
+	return s
+}
+
+// Context returns the Context commands are executed on
+func (s *Server) Context() *scpi.Context {
+	return s.ctx
+}
+
+// Close ends the running streams, letting an http.Server shut down
+func (s *Server) Close() error {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	return nil
+}
+
+// ServeHTTP handles a gRPC call. The status is sent in the grpc-status and
+// grpc-message trailers.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC over HTTP/2 only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	code, msg := s.call(w, r)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", percentEncode(msg))
+	}
+}
+
+// call reads the request message and runs the method, returning the status
+func (s *Server) call(w http.ResponseWriter, r *http.Request) (int, string) {
+	method, ok := strings.CutPrefix(r.URL.Path, ServicePath)
+	if !ok {
+		return codeUnimplemented, "unknown service " + r.URL.Path
+	}
+
+	req, err := readFrame(r.Body, s.opts.MaxMessage)
+	var fields []field
+	if err == nil {
+		fields, err = unmarshal(req)
+	}
+	switch {
+	case err == errCompressed:
+		return codeUnimplemented, err.Error()
+	case err == errTooLarge:
+		return codeResourceExhausted, err.Error()
+	case err != nil:
+		return codeInvalidArgument, err.Error()
+	}
+
+	switch method {
+	case "Execute", "Query":
+		var program string
+		for _, f := range fields {
+			if f.num == 1 {
+				program = string(f.data)
+			}
+		}
+		responses, errs := s.run(program)
+
+		// ExecuteResponse has the errors in field 1, QueryResponse in 2
+		var resp []byte
+		errField := 1
+		if method == "Query" {
+			for _, line := range responses {
+				resp = appendBytes(resp, 1, []byte(line))
+			}
+			errField = 2
+		}
+		for _, e := range errs {
+			resp = appendBytes(resp, errField, e.marshal())
+		}
+		writeFrame(w, resp)
+		return codeOK, ""
+
+	case "StreamErrors":
+		return s.streamErrors(w, r)
+
+	case "StreamStatus":
+		interval := 100 * time.Millisecond
+		for _, f := range fields {
+			if f.num == 1 && f.value > 0 {
+				interval = time.Duration(f.value) * time.Millisecond
+			}
+		}
+		return s.streamStatus(w, r, interval)
+	}
+	return codeUnimplemented, "unknown method " + method
+}
+
+// run executes each line of program as a program message, returning the
+// responses and the drained error queue
+func (s *Server) run(program string) ([]string, []Error) {
+	responses, queued := s.runner.Run(program)
+	var errs []Error
+	for _, e := range queued {
+		errs = append(errs, Error{Code: int32(e.Code), Message: e.Message()})
+	}
+	return responses, errs
+}
+
+// publish passes an error pushed on the Context to the StreamErrors
+// subscribers. A subscriber too slow to keep up misses errors rather than
+// stalling the Context.
+func (s *Server) publish(err *scpi.Error) {
+	e := Error{Code: int32(err.Code), Message: err.Message()}
+
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	for sub := range s.subs {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+}
+
+// streamErrors sends errors as they are pushed until the client cancels or
+// the server is closed
+func (s *Server) streamErrors(w http.ResponseWriter, r *http.Request) (int, string) {
+	sub := make(chan Error, 64)
+	s.subMu.Lock()
+	if s.closed {
+		s.subMu.Unlock()
+		return codeUnavailable, "server closed"
+	}
+	s.subs[sub] = struct{}{}
+	s.subMu.Unlock()
+	defer func() {
+		s.subMu.Lock()
+		delete(s.subs, sub)
+		s.subMu.Unlock()
+	}()
+
+	flush(w)
+	for {
+		select {
+		case e := <-sub:
+			if err := writeFrame(w, e.marshal()); err != nil {
+				return codeOK, ""
+			}
+			flush(w)
+		case <-r.Context().Done():
+			return codeOK, ""
+		case <-s.done:
+			return codeOK, ""
+		}
+	}
+}
+
+// streamStatus sends the status registers, then again whenever a check
+// every interval finds them changed
+func (s *Server) streamStatus(w http.ResponseWriter, r *http.Request, interval time.Duration) (int, string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last Status
+	for first := true; ; first = false {
+		status := Status{
+			StatusByte:           uint32(s.ctx.RegGet(scpi.RegSTB)),
+			ServiceRequestEnable: uint32(s.ctx.RegGet(scpi.RegSRE)),
+			EventStatus:          uint32(s.ctx.RegGet(scpi.RegESR)),
+			EventStatusEnable:    uint32(s.ctx.RegGet(scpi.RegESE)),
+		}
+		if first || status != last {
+			if err := writeFrame(w, status.marshal()); err != nil {
+				return codeOK, ""
+			}
+			flush(w)
+			last = status
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return codeOK, ""
+		case <-s.done:
+			return codeOK, ""
+		}
+	}
+}
+
+// flush sends what has been written so far
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// percentEncode encodes a grpc-message value: bytes outside printable
+// ASCII and '%' become %XX
+func percentEncode(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,167 @@
+package scpigrpc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+func startServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+
+	s := New([]*scpi.Command{
+		{Pattern: "*IDN?", Callback: scpi.CoreIdnQ},
+		{Pattern: "*ESE", Callback: scpi.CoreEse},
+		{Pattern: "MEASure:VOLTage?", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.ResultDouble(1.5)
+			return scpi.ResOK
+		}},
+	}, Options{Setup: func(ctx *scpi.Context) {
+		ctx.SetIDN("ACME", "RPC1", "0", "1.0")
+	}})
+	srv := httptest.NewUnstartedServer(s)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(func() {
+		s.Close()
+		srv.Close()
+	})
+	return s, srv
+}
+
+// call starts a call of method with the request message req
+func call(t *testing.T, srv *httptest.Server, method string, req []byte) *http.Response {
+	t.Helper()
+
+	var body bytes.Buffer
+	writeFrame(&body, req)
+	hreq, _ := http.NewRequest(http.MethodPost, srv.URL+ServicePath+method, &body)
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("TE", "trailers")
+	resp, err := srv.Client().Do(hreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("%s: %s over %s", method, resp.Status, resp.Proto)
+	}
+	return resp
+}
+
+// readFields reads a response message and decodes its fields
+func readFields(t *testing.T, r io.Reader) []field {
+	t.Helper()
+
+	msg, err := readFrame(r, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := unmarshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+// decodeError decodes an Error message
+func decodeError(t *testing.T, msg []byte) Error {
+	t.Helper()
+
+	fields, err := unmarshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Error
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			e.Code = int32(f.value)
+		case 2:
+			e.Message = string(f.data)
+		}
+	}
+	return e
+}
+
+func TestQuery(t *testing.T) {
+	_, srv := startServer(t)
+
+	resp := call(t, srv, "Query", appendBytes(nil, 1, []byte("*IDN?\nMEAS:VOLT?;BOGUS")))
+	var responses []string
+	var errs []Error
+	for _, f := range readFields(t, resp.Body) {
+		switch f.num {
+		case 1:
+			responses = append(responses, string(f.data))
+		case 2:
+			errs = append(errs, decodeError(t, f.data))
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+	if want := []string{"ACME,RPC1,0,1.0", "1.5"}; fmt.Sprint(responses) != fmt.Sprint(want) {
+		t.Errorf("responses = %q, want %q", responses, want)
+	}
+	if want := []Error{{Code: scpi.CodeUndefinedHeader, Message: "Undefined header;MEAS:BOGUS"}}; fmt.Sprint(errs) != fmt.Sprint(want) {
+		t.Errorf("errors = %v, want %v", errs, want)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("grpc-status = %q, want 0", status)
+	}
+
+	// Execute discards responses; the queue was drained by Query
+	resp = call(t, srv, "Execute", appendBytes(nil, 1, []byte("*IDN?")))
+	if fields := readFields(t, resp.Body); len(fields) != 0 {
+		t.Errorf("Execute response fields = %v", fields)
+	}
+
+	resp = call(t, srv, "Bogus", nil)
+	io.Copy(io.Discard, resp.Body)
+	if status := resp.Trailer.Get("Grpc-Status"); status != "12" {
+		t.Errorf("grpc-status of an unknown method = %q, want 12", status)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	s, srv := startServer(t)
+
+	errors := call(t, srv, "StreamErrors", nil)
+	status := call(t, srv, "StreamStatus", appendVarint(nil, 1, 10))
+	if fields := readFields(t, status.Body); len(fields) != 0 {
+		t.Errorf("initial status fields = %v, want none", fields)
+	}
+
+	// The subscription is made before the headers are sent
+	s.run("BOGUS\n*ESE 32")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if msg, _ := readFrame(errors.Body, 1<<20); fmt.Sprint(decodeError(t, msg)) != fmt.Sprint(Error{Code: -113, Message: "Undefined header;BOGUS"}) {
+			t.Errorf("streamed error = %v", decodeError(t, msg))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no error streamed")
+	}
+
+	// BOGUS sets CME in ESR, which *ESE 32 summarizes as ESB in the status
+	// byte; an update may come between the two
+	want := fmt.Sprint([]field{{num: 1, value: 32}, {num: 3, value: 32}, {num: 4, value: 32}})
+	for {
+		fields := readFields(t, status.Body)
+		if len(fields) == 3 {
+			if got := fmt.Sprint(fields); got != want {
+				t.Errorf("status fields = %s, want %s", got, want)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Package scpihttp exposes a SCPI command set over HTTP for scripts and
+// dashboards. GET /scpi?q=MEAS:VOLT%3F runs the program message in the q
+// parameter, POST /scpi runs the lines of the request body, and the
+// responses come back as text or, when the client asks for it, as JSON.
+//
+// After every request the error queue is drained into the reply, the way a
+// client would follow each message with SYSTem:ERRor:ALL?, so errors are
+// seen by the request that caused them and never pile up between requests.
+package scpihttp
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// Options configures a Gateway
+type Options struct {
+	BufferSize int                     // Input buffer size, 1024 when zero
+	MaxBody    int64                   // Largest POST body accepted, 1 MiB when zero
+	Setup      func(ctx *scpi.Context) // Called once on the Context, e.g. to SetIDN
+}
+
+// Gateway is an http.Handler running program messages on a Context
+type Gateway struct {
+	opts   Options
+	runner *Runner
+}
+
+// Reply is the JSON form of a gateway response
+type Reply struct {
+	Responses []string `json:"responses"` // One per program message that answered, without the terminator
+	Errors    []Error  `json:"errors"`    // The error queue after the messages ran
+}
+
+// Error is an entry of the error queue in a Reply
+type Error struct {
+	Code    int16  `json:"code"`
+	Message string `json:"message"`
+}
+
+// New creates a gateway for commands
+func New(commands []*scpi.Command, opts Options) *Gateway {
+	if opts.BufferSize == 0 {
+		opts.BufferSize = 1024
+	}
+	if opts.MaxBody == 0 {
+		opts.MaxBody = 1 << 20
+	}
+
+	g := &Gateway{opts: opts, runner: NewRunner(commands, scpi.Interface{}, opts.BufferSize)}
+	if opts.Setup != nil {
+		opts.Setup(g.runner.Context())
+	}
+	return g
+}
+
+// Context returns the Context commands are executed on
+func (g *Gateway) Context() *scpi.Context {
+	return g.runner.Context()
+}
+
+// ServeHTTP runs the program messages of a GET or POST request. The reply
+// is text/plain with the responses as the instrument sends them, or a JSON
+// Reply when the client accepts application/json or passes format=json.
+// Errors left in the queue make the status 422 Unprocessable Entity; in a
+// text reply they are listed in X-SCPI-Error headers as SYSTem:ERRor?
+// answers them.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var program string
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		program = r.URL.Query().Get("q")
+	case http.MethodPost:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, g.opts.MaxBody))
+		if err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		program = string(body)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.TrimSpace(program) == "" {
+		http.Error(w, "no program message", http.StatusBadRequest)
+		return
+	}
+
+	reply := g.run(program)
+
+	status := http.StatusOK
+	if len(reply.Errors) > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(reply)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, e := range reply.Errors {
+		w.Header().Add("X-SCPI-Error", (&scpi.Error{Code: e.Code, Info: e.Message}).Error())
+	}
+	w.WriteHeader(status)
+	for _, resp := range reply.Responses {
+		io.WriteString(w, resp+"\n")
+	}
+}
+
+// run executes each line of program as a program message and drains the
+// error queue
+func (g *Gateway) run(program string) Reply {
+	responses, errs := g.runner.Run(program)
+	reply := Reply{Responses: responses, Errors: []Error{}}
+	for _, e := range errs {
+		reply.Errors = append(reply.Errors, Error{Code: e.Code, Message: e.Message()})
+	}
+	return reply
+}
+
+// wantsJSON reports whether the client asked for a JSON reply
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(accept); err == nil && mt == "application/json" {
+			return true
+		}
+	}
+	return false
+}
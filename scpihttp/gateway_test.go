@@ -0,0 +1,103 @@
+package scpihttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+func testGateway(t *testing.T) (*Gateway, *httptest.Server) {
+	g := New([]*scpi.Command{
+		{Pattern: "*IDN?", Callback: scpi.CoreIdnQ},
+		{Pattern: "MEASure:VOLTage?", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.ResultDouble(1.5)
+			return scpi.ResOK
+		}},
+	}, Options{Setup: func(ctx *scpi.Context) {
+		ctx.SetIDN("ACME", "GW1", "0", "1.0")
+	}})
+	srv := httptest.NewServer(g)
+	t.Cleanup(srv.Close)
+	return g, srv
+}
+
+func TestGet(t *testing.T) {
+	_, srv := testGateway(t)
+
+	resp, err := http.Get(srv.URL + "/scpi?q=" + url.QueryEscape("MEAS:VOLT?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "1.5\n" {
+		t.Errorf("GET = %d %q, want 200 %q", resp.StatusCode, body, "1.5\n")
+	}
+
+	// Errors are reported and drained from the queue
+	resp, err = http.Get(srv.URL + "/scpi?q=" + url.QueryEscape("BOGUS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	want := `-113,"Undefined header;BOGUS"`
+	if got := resp.Header.Values("X-SCPI-Error"); resp.StatusCode != http.StatusUnprocessableEntity || fmt.Sprint(got) != fmt.Sprint([]string{want}) {
+		t.Errorf("GET BOGUS = %d %q, want 422 [%s]", resp.StatusCode, got, want)
+	}
+
+	resp, err = http.Get(srv.URL + "/scpi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET without q = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestPostJSON(t *testing.T) {
+	g, srv := testGateway(t)
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/scpi", strings.NewReader("*IDN?\r\nMEAS:VOLT?;BOGUS\n\n"))
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var reply Reply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	want := Reply{
+		Responses: []string{"ACME,GW1,0,1.0", "1.5"},
+		Errors:    []Error{{Code: scpi.CodeUndefinedHeader, Message: "Undefined header;MEAS:BOGUS"}},
+	}
+	if resp.StatusCode != http.StatusUnprocessableEntity || fmt.Sprint(reply) != fmt.Sprint(want) {
+		t.Errorf("POST = %d %v, want 422 %v", resp.StatusCode, reply, want)
+	}
+	if n := g.Context().ErrorCount(); n != 0 {
+		t.Errorf("%d errors left in the queue", n)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, srv.URL+"/scpi", strings.NewReader("*IDN?"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("PUT = %d, want 405", resp.StatusCode)
+	}
+}
@@ -0,0 +1,61 @@
+package scpihttp
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// Runner runs the program messages of one request at a time on a Context
+// and collects their responses and the error queue, for gateways that
+// answer each request as a whole. Gateway and the scpigrpc server use it.
+type Runner struct {
+	ctx *scpi.Context
+
+	mu        sync.Mutex   // Serializes Run
+	out       bytes.Buffer // Output of the current response message
+	responses []string     // Response messages of the current Run
+}
+
+// NewRunner creates a Runner for commands. The Write and Flush functions of
+// iface are replaced by the Runner's own; its other fields, e.g. OnError,
+// are used as set.
+func NewRunner(commands []*scpi.Command, iface scpi.Interface, bufferSize int) *Runner {
+	r := &Runner{}
+	iface.Write = r.out.Write
+	iface.Flush = r.flush
+	r.ctx = scpi.NewContext(commands, &iface, bufferSize)
+	return r
+}
+
+// Context returns the Context commands are executed on
+func (r *Runner) Context() *scpi.Context {
+	return r.ctx
+}
+
+// Run executes each line of program as a program message, returning the
+// responses without their terminator and the drained error queue
+func (r *Runner) Run(program string) ([]string, []*scpi.Error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.responses = []string{}
+	if !strings.HasSuffix(program, "\n") {
+		program += "\n"
+	}
+	r.ctx.Input([]byte(program))
+	r.out.Reset()
+
+	responses := r.responses
+	r.responses = nil
+	return responses, r.ctx.ErrorPopAll()
+}
+
+// flush ends a response message, called by the Context after its terminator
+func (r *Runner) flush() error {
+	r.responses = append(r.responses, strings.TrimSuffix(r.out.String(), "\n"))
+	r.out.Reset()
+	return nil
+}
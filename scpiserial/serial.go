@@ -0,0 +1,185 @@
+// Package scpiserial runs a SCPI command set on a serial port, or on any
+// io.ReadWriteCloser carrying a byte stream from a host such as a UART
+// device file or a USB CDC-ACM gadget. It turns the CR, LF and CR LF line
+// ends hosts send into program messages, optionally honours XON/XOFF flow
+// control, and can parse an unterminated line after a period of silence.
+package scpiserial
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// ErrPortClosed is returned by Serve after Close
+var ErrPortClosed = errors.New("scpiserial: port closed")
+
+// Flow control characters
+const (
+	xon  = 0x11
+	xoff = 0x13
+)
+
+// Options configures a Port
+type Options struct {
+	BufferSize int                     // Input buffer size, 1024 when zero
+	Terminator string                  // Response terminator, "\n" when empty
+	XonXoff    bool                    // Honour XOFF/XON from the host and remove them from input
+	FlushAfter time.Duration           // Parse an unterminated line after this much silence, 0 to wait for its end
+	Setup      func(ctx *scpi.Context) // Called once on the Context, e.g. to SetIDN
+}
+
+// Port runs a Context on a serial byte stream
+type Port struct {
+	rw   io.ReadWriteCloser
+	opts Options
+	ctx  *scpi.Context
+
+	mu     sync.Mutex
+	resume *sync.Cond // Signalled on XON and Close
+	paused bool       // XOFF received
+	closed bool
+}
+
+// New creates a port serving commands on rw
+func New(rw io.ReadWriteCloser, commands []*scpi.Command, opts Options) *Port {
+	if opts.BufferSize == 0 {
+		opts.BufferSize = 1024
+	}
+
+	p := &Port{rw: rw, opts: opts}
+	p.resume = sync.NewCond(&p.mu)
+	p.ctx = scpi.NewContext(commands, &scpi.Interface{Write: p.write}, opts.BufferSize)
+	if opts.Terminator != "" {
+		p.ctx.SetResponseTerminator([]byte(opts.Terminator))
+	}
+	if opts.Setup != nil {
+		opts.Setup(p.ctx)
+	}
+	return p
+}
+
+// Context returns the Context commands are executed on
+func (p *Port) Context() *scpi.Context {
+	return p.ctx
+}
+
+// Serve reads program messages from the port and executes them until the
+// port fails or Close is called. It returns the read error, or
+// ErrPortClosed after Close.
+func (p *Port) Serve() error {
+	chunks := make(chan []byte)
+	errc := make(chan error, 1)
+	go p.read(chunks, errc)
+
+	var flush <-chan time.Time
+	cr, partial := false, false
+	line := make([]byte, 0, 256)
+	for {
+		select {
+		case data := <-chunks:
+			for _, b := range data {
+				if b == '\n' && cr {
+					cr = false
+					continue
+				}
+				cr = b == '\r'
+				if cr {
+					b = '\n'
+				}
+				line = append(line, b)
+				if b == '\n' {
+					p.ctx.Input(line)
+					line, partial = line[:0], false
+				}
+			}
+			if len(line) > 0 {
+				p.ctx.Input(line)
+				line, partial = line[:0], true
+			}
+			flush = nil
+			if partial && p.opts.FlushAfter > 0 {
+				flush = time.After(p.opts.FlushAfter)
+			}
+
+		case <-flush:
+			p.ctx.Input(nil)
+			flush, partial = nil, false
+
+		case err := <-errc:
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return ErrPortClosed
+			}
+			return err
+		}
+	}
+}
+
+// Close closes the port, releasing a response held back by XOFF
+func (p *Port) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.resume.Broadcast()
+	p.mu.Unlock()
+	return p.rw.Close()
+}
+
+// read passes what the host sends to chunks, handling flow control
+// characters as they arrive so they take effect while a command is running,
+// and sends the error that ended reading to errc
+func (p *Port) read(chunks chan<- []byte, errc chan<- error) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := p.rw.Read(buf)
+		if data := p.flow(buf[:n]); len(data) > 0 {
+			chunks <- append([]byte(nil), data...)
+		}
+		if err != nil {
+			errc <- err
+			return
+		}
+	}
+}
+
+// flow removes XON and XOFF from data and pauses or resumes output on them
+// when Options.XonXoff is set
+func (p *Port) flow(data []byte) []byte {
+	if !p.opts.XonXoff {
+		return data
+	}
+
+	rest := data[:0]
+	for _, b := range data {
+		switch b {
+		case xon, xoff:
+			p.mu.Lock()
+			p.paused = b == xoff
+			p.resume.Broadcast()
+			p.mu.Unlock()
+		default:
+			rest = append(rest, b)
+		}
+	}
+	return rest
+}
+
+// write sends a response to the port, waiting while the host has sent XOFF
+func (p *Port) write(data []byte) (int, error) {
+	p.mu.Lock()
+	for p.paused && !p.closed {
+		p.resume.Wait()
+	}
+	closed := p.closed
+	p.mu.Unlock()
+
+	if closed {
+		return 0, ErrPortClosed
+	}
+	return p.rw.Write(data)
+}
@@ -0,0 +1,86 @@
+package scpiserial
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// startPort serves a test command set on one end of a pipe and returns the
+// host end
+func startPort(t *testing.T, opts Options) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	host, device := net.Pipe()
+	p := New(device, []*scpi.Command{
+		{Pattern: "*IDN?", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.ResultText("ACME")
+			return scpi.ResOK
+		}},
+	}, opts)
+	go p.Serve()
+	t.Cleanup(func() {
+		p.Close()
+		host.Close()
+	})
+	return host, bufio.NewReader(host)
+}
+
+// send writes data to the port
+func send(t *testing.T, host net.Conn, data string) {
+	t.Helper()
+
+	host.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := host.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect reads a response from the port and compares it with want
+func expect(t *testing.T, host net.Conn, r *bufio.Reader, want string) {
+	t.Helper()
+
+	host.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	if got != want {
+		t.Errorf("response = %q, want %q", got, want)
+	}
+}
+
+func TestLineEnds(t *testing.T) {
+	host, r := startPort(t, Options{Terminator: "\r\n"})
+
+	for _, input := range []string{"*IDN?\r", "*IDN?\n", "*IDN?\r\n", "*ID", "N?\r"} {
+		send(t, host, input)
+		if input == "*ID" {
+			continue
+		}
+		expect(t, host, r, "\"ACME\"\r\n")
+	}
+}
+
+func TestFlushAfter(t *testing.T) {
+	host, r := startPort(t, Options{FlushAfter: 20 * time.Millisecond})
+
+	send(t, host, "*IDN?")
+	expect(t, host, r, "\"ACME\"\n")
+}
+
+func TestXonXoff(t *testing.T) {
+	host, r := startPort(t, Options{XonXoff: true})
+
+	send(t, host, "\x13*IDN?\n")
+	host.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if got, err := r.ReadString('\n'); err == nil {
+		t.Fatalf("response %q sent after XOFF", got)
+	}
+
+	send(t, host, "\x11")
+	expect(t, host, r, "\"ACME\"\n")
+}
@@ -0,0 +1,375 @@
+package scpiserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Service types announced by ServeMDNS
+const (
+	ServiceSCPIRaw = "_scpi-raw._tcp"
+	ServiceLXI     = "_lxi._tcp"
+)
+
+// DNS record types and classes (RFC 1035, 2782, 6762)
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN    = 1
+	dnsCacheFlush = 0x8000
+	dnsUnicast    = 0x8000
+
+	mdnsPort = 5353
+	mdnsTTL  = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+var errBadDNSMessage = errors.New("scpiserver: malformed DNS message")
+
+// ListenMDNS opens the IPv4 mDNS multicast socket for ServeMDNS
+func ListenMDNS() (net.PacketConn, error) {
+	return net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+}
+
+// mdnsService is what ServeMDNS announces: the data port under a service
+// instance named after the identification strings
+type mdnsService struct {
+	instance string // Service instance name, e.g. "ACME MOCK100 1234"
+	host     string // Host name, e.g. "bench3.local"
+	port     int
+	webPort  int // Port announced as ServiceLXI, 0 for none
+	txt      []string
+}
+
+// ServeMDNS announces the data port on port as ServiceSCPIRaw over
+// multicast DNS on conn, usually from ListenMDNS, and answers queries for it
+// until Close is called or conn fails. ServiceLXI is only announced, for the
+// web pages, with Options.WebPort. The instance name and TXT records are
+// taken from the Context's identification strings.
+func (s *Server) ServeMDNS(conn net.PacketConn, port int) error {
+	svc := s.mdnsService(port)
+
+	s.connMu.Lock()
+	if s.closed {
+		s.connMu.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.mdns, s.mdnsSvc = conn, svc
+	s.connMu.Unlock()
+
+	// Announce twice, one second apart (RFC 6762 8.3)
+	go func() {
+		conn.WriteTo(svc.response(nil, mdnsTTL), mdnsGroup)
+		time.Sleep(time.Second)
+		conn.WriteTo(svc.response(nil, mdnsTTL), mdnsGroup)
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.connMu.Lock()
+			closed := s.closed
+			s.connMu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		id, questions, unicast, err := parseQuery(buf[:n])
+		if err != nil {
+			continue
+		}
+		// Legacy unicast queries come from a port other than 5353 and
+		// expect a conventional DNS reply with their ID (RFC 6762 6.7)
+		legacy := false
+		if addr, ok := from.(*net.UDPAddr); ok && addr.Port != mdnsPort {
+			legacy = true
+		}
+		var match []dnsQuestion
+		for _, q := range questions {
+			if svc.answers(q) {
+				match = append(match, q)
+			}
+		}
+		if len(match) == 0 {
+			continue
+		}
+		switch {
+		case legacy:
+			conn.WriteTo(svc.response(&dnsQuery{id: id, questions: match}, 10), from)
+		case unicast:
+			conn.WriteTo(svc.response(nil, mdnsTTL), from)
+		default:
+			conn.WriteTo(svc.response(nil, mdnsTTL), mdnsGroup)
+		}
+	}
+}
+
+// goodbye withdraws the announcement with zero TTL records; connMu must be
+// held
+func (s *Server) goodbye() {
+	if s.mdns == nil {
+		return
+	}
+	s.mdns.WriteTo(s.mdnsSvc.response(nil, 0), mdnsGroup)
+	s.mdns.Close()
+}
+
+// mdnsService builds the announced service from the identification strings
+// of the Context, or of a fresh one with Options.PerConnection
+func (s *Server) mdnsService(port int) *mdnsService {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = s.newContext(func(data []byte) (int, error) { return len(data), nil }, nil)
+	}
+	idn := ctx.IDN()
+
+	instance := strings.Join(strings.Fields(strings.Join(idn[:3], " ")), " ")
+	if instance == "" {
+		instance = "SCPI instrument"
+	}
+	host, _ := os.Hostname()
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		host = host[:i]
+	}
+	if host == "" {
+		host = "instrument"
+	}
+
+	return &mdnsService{
+		instance: instance,
+		host:     host + ".local",
+		port:     port,
+		webPort:  s.opts.WebPort,
+		txt: []string{
+			"txtvers=1",
+			"Manufacturer=" + idn[0],
+			"Model=" + idn[1],
+			"SerialNumber=" + idn[2],
+			"FirmwareVersion=" + idn[3],
+		},
+	}
+}
+
+// dnsQuestion is a question of a query
+type dnsQuestion struct {
+	name string
+	typ  uint16
+}
+
+// dnsQuery is a legacy unicast query a response is echoing
+type dnsQuery struct {
+	id        uint16
+	questions []dnsQuestion
+}
+
+// parseQuery decodes the ID and questions of a query, and whether any
+// question asks for a unicast response
+func parseQuery(msg []byte) (uint16, []dnsQuestion, bool, error) {
+	if len(msg) < 12 || msg[2]&0x80 != 0 { // Responses are ignored
+		return 0, nil, false, errBadDNSMessage
+	}
+	id := binary.BigEndian.Uint16(msg)
+	count := int(binary.BigEndian.Uint16(msg[4:]))
+
+	var questions []dnsQuestion
+	unicast := false
+	off := 12
+	for i := 0; i < count; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return 0, nil, false, errBadDNSMessage
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		class := binary.BigEndian.Uint16(msg[next+2:])
+		unicast = unicast || class&dnsUnicast != 0
+		questions = append(questions, dnsQuestion{name: name, typ: typ})
+		off = next + 4
+	}
+	return id, questions, unicast, nil
+}
+
+// readName decodes the possibly compressed name at off and returns it
+// without the trailing dot, with the offset following it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errBadDNSMessage
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errBadDNSMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errBadDNSMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// services returns the service types announced with their ports
+func (svc *mdnsService) services() map[string]int {
+	services := map[string]int{ServiceSCPIRaw: svc.port}
+	if svc.webPort != 0 {
+		services[ServiceLXI] = svc.webPort
+	}
+	return services
+}
+
+// serviceName returns the name of the instance of a service type
+func (svc *mdnsService) serviceName(typ string) string {
+	return svc.instance + "." + typ + ".local"
+}
+
+// answers reports whether q asks for one of the service's records
+func (svc *mdnsService) answers(q dnsQuestion) bool {
+	is := func(name string, types ...uint16) bool {
+		if !strings.EqualFold(q.name, name) {
+			return false
+		}
+		for _, t := range types {
+			if q.typ == t || q.typ == dnsTypeANY {
+				return true
+			}
+		}
+		return false
+	}
+
+	if is("_services._dns-sd._udp.local", dnsTypePTR) || is(svc.host, dnsTypeA) {
+		return true
+	}
+	for typ := range svc.services() {
+		if is(typ+".local", dnsTypePTR) || is(svc.serviceName(typ), dnsTypeSRV, dnsTypeTXT) {
+			return true
+		}
+	}
+	return false
+}
+
+// response encodes a response with all of the service's records, echoing
+// the ID and questions of a legacy unicast query when there is one.
+// Answering with every record keeps resolution to a single round trip.
+func (svc *mdnsService) response(legacy *dnsQuery, ttl uint32) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // Response, authoritative
+	if legacy != nil {
+		binary.BigEndian.PutUint16(msg[0:], legacy.id)
+		binary.BigEndian.PutUint16(msg[4:], uint16(len(legacy.questions)))
+		for _, q := range legacy.questions {
+			msg = appendName(msg, q.name)
+			msg = binary.BigEndian.AppendUint16(msg, q.typ)
+			msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+		}
+	}
+
+	// Unique records set the cache-flush bit, except in legacy replies
+	flush := uint16(dnsCacheFlush)
+	if legacy != nil {
+		flush = 0
+	}
+	records := 0
+	record := func(name string, typ, class uint16, data []byte) {
+		msg = appendName(msg, name)
+		msg = binary.BigEndian.AppendUint16(msg, typ)
+		msg = binary.BigEndian.AppendUint16(msg, class)
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+		msg = append(msg, data...)
+		records++
+	}
+
+	var txt []byte
+	for _, s := range svc.txt {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		txt = append(append(txt, byte(len(s))), s...)
+	}
+	services := svc.services()
+	for _, typ := range []string{ServiceSCPIRaw, ServiceLXI} {
+		port, ok := services[typ]
+		if !ok {
+			continue
+		}
+		srv := make([]byte, 6)
+		binary.BigEndian.PutUint16(srv[4:], uint16(port))
+		srv = appendName(srv, svc.host)
+
+		record("_services._dns-sd._udp.local", dnsTypePTR, dnsClassIN, appendName(nil, typ+".local"))
+		record(typ+".local", dnsTypePTR, dnsClassIN, appendName(nil, svc.serviceName(typ)))
+		record(svc.serviceName(typ), dnsTypeSRV, dnsClassIN|flush, srv)
+		record(svc.serviceName(typ), dnsTypeTXT, dnsClassIN|flush, txt)
+	}
+	for _, ip := range hostAddrs() {
+		record(svc.host, dnsTypeA, dnsClassIN|flush, ip)
+	}
+
+	binary.BigEndian.PutUint16(msg[6:], uint16(records))
+	return msg
+}
+
+// appendName appends the uncompressed encoding of a dotted name. Labels
+// may contain spaces and dots are only separators, as instance names need.
+func appendName(b []byte, name string) []byte {
+	// The instance label is everything before the service type
+	labels := strings.Split(name, ".")
+	for _, typ := range []string{ServiceSCPIRaw, ServiceLXI} {
+		if suffix := "." + typ + ".local"; strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			labels = append([]string{strings.TrimSuffix(name, suffix)}, strings.Split(typ+".local", ".")...)
+		}
+	}
+	for _, l := range labels {
+		if len(l) > 63 {
+			l = l[:63]
+		}
+		b = append(append(b, byte(len(l))), l...)
+	}
+	return append(b, 0)
+}
+
+// hostAddrs returns the host's IPv4 addresses, the loopback address only
+// when it has no other
+func hostAddrs() []net.IP {
+	addrs, _ := net.InterfaceAddrs()
+	var ips []net.IP
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			if ip4 := ipnet.IP.To4(); ip4 != nil {
+				ips = append(ips, ip4)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		ips = append(ips, net.IPv4(127, 0, 0, 1).To4())
+	}
+	return ips
+}
@@ -0,0 +1,100 @@
+package scpiserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+func TestServeMDNS(t *testing.T) {
+	s := New(testCommands(), Options{WebPort: 8080, Setup: func(ctx *scpi.Context) {
+		ctx.SetIDN("ACME", "MOCK100", "1234", "1.0")
+	}})
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeMDNS(conn, 5025)
+	t.Cleanup(func() { s.Close() })
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// Queries for other names are not answered; a legacy unicast query for
+	// the service type is, with its ID and question
+	other := []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	other = append(appendName(other, "_http._tcp.local"), 0, dnsTypePTR, 0, dnsClassIN)
+	client.WriteTo(other, conn.LocalAddr())
+	query := []byte{0x12, 0x34, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	query = append(appendName(query, "_scpi-raw._tcp.local"), 0, dnsTypePTR, 0, dnsClassIN)
+	client.WriteTo(query, conn.LocalAddr())
+
+	buf := make([]byte, 9000)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := buf[:n]
+	if id := binary.BigEndian.Uint16(msg); id != 0x1234 {
+		t.Fatalf("response ID = %#x, want 0x1234", id)
+	}
+
+	// parseQuery ignores responses, so clear the QR bit
+	_, questions, _, err := parseQuery(append([]byte{0, 0, 0}, msg[3:]...))
+	if err != nil || len(questions) != 1 || questions[0].name != "_scpi-raw._tcp.local" {
+		t.Fatalf("echoed questions = %v, %v", questions, err)
+	}
+
+	// Collect the records by name and type
+	records := make(map[string][]byte)
+	off := len(query)
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:])); i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		size := int(binary.BigEndian.Uint16(msg[next+8:]))
+		records[fmt.Sprint(name, "/", typ)] = msg[next+10 : next+10+size]
+		if typ == dnsTypePTR && name == "_scpi-raw._tcp.local" {
+			target, _, _ := readName(msg, next+10)
+			if target != "ACME MOCK100 1234._scpi-raw._tcp.local" {
+				t.Errorf("PTR target = %q", target)
+			}
+		}
+		off = next + 10 + size
+	}
+
+	srv, ok := records["ACME MOCK100 1234._scpi-raw._tcp.local/33"]
+	if !ok || binary.BigEndian.Uint16(srv[4:]) != 5025 {
+		t.Errorf("SRV record = % x, want port 5025", srv)
+	}
+	srv, ok = records["ACME MOCK100 1234._lxi._tcp.local/33"]
+	if !ok || binary.BigEndian.Uint16(srv[4:]) != 8080 {
+		t.Errorf("LXI SRV record = % x, want port 8080", srv)
+	}
+	txt := string(records["ACME MOCK100 1234._lxi._tcp.local/16"])
+	want := "\x09txtvers=1\x11Manufacturer=ACME\x0dModel=MOCK100\x11SerialNumber=1234\x13FirmwareVersion=1.0"
+	if txt != want {
+		t.Errorf("TXT record = %q, want %q", txt, want)
+	}
+}
+
+func TestMDNSWithoutWebPort(t *testing.T) {
+	svc := New(testCommands(), Options{}).mdnsService(5025)
+	if svc.answers(dnsQuestion{name: "_lxi._tcp.local", typ: dnsTypePTR}) {
+		t.Error("_lxi._tcp answered without Options.WebPort")
+	}
+	if msg := svc.response(nil, mdnsTTL); strings.Contains(string(msg), "_lxi") {
+		t.Error("_lxi._tcp announced without Options.WebPort")
+	}
+}
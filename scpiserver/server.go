@@ -0,0 +1,469 @@
+// Package scpiserver serves a SCPI command set over raw TCP sockets, the
+// transport VISA exposes as "SOCKET" resources (TCPIP::host::5025::SOCKET).
+// Besides the data port it can run the conventional control port, over
+// which clients issue device clear while the data connection is busy and
+// receive service request notifications, and a telnet console for typing
+// commands interactively. The data port can be announced over mDNS for
+// discovery.
+//
+// By default every connection shares one Context, as on an instrument with a
+// single parser. With Options.PerConnection each connection gets a Context of
+// its own built from the same command table, so error queues, status
+// registers and partial input do not leak between clients, and connections
+// run their commands concurrently.
+package scpiserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+const (
+	DefaultAddr        = ":5025"
+	DefaultControlAddr = ":5125"
+)
+
+// controlHeader is the query answering the control port number
+const controlHeader = "SYSTem:COMMunication:TCPIP:CONTROL?"
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close
+var ErrServerClosed = errors.New("scpiserver: server closed")
+
+// Options configures a Server
+type Options struct {
+	BufferSize  int                          // Input buffer size, 1024 when zero
+	ControlAddr string                       // Control port address, empty to disable it
+	Setup       func(ctx *scpi.Context)      // Called on every new Context, e.g. to SetIDN
+	StatusByte  func(ctx *scpi.Context) byte // Answers SPOLL on the control port, the built-in status byte when nil
+
+	PerConnection bool   // Give each data connection its own Context
+	TelnetAddr    string // Telnet console address, empty to disable it
+	Prompt        string // Telnet console prompt, DefaultPrompt when empty
+	Announce      bool   // Announce the data port over mDNS from ListenAndServe
+	WebPort       int    // Port of the instrument's web pages, announced as _lxi._tcp when set
+
+	// TLSConfig, when set, runs every port over TLS. Set its ClientAuth and
+	// ClientCAs to require clients to present a trusted certificate.
+	TLSConfig *tls.Config
+}
+
+// Server runs a Context on a TCP data port and, optionally, a control port
+type Server struct {
+	opts     Options
+	ctx      *scpi.Context // Shared Context, nil with Options.PerConnection
+	commands []*scpi.Command
+
+	mu  sync.Mutex // Serializes access to ctx, out and cur
+	out io.Writer  // Connection the current command was received on
+	cur *session   // Session the current command was received on
+
+	sessMu   sync.Mutex // Guards the session state, never held while a command runs
+	sessions map[*session]struct{}
+	owner    *session // Session holding the lock, nil when unlocked
+	nextID   int
+
+	connMu  sync.Mutex
+	conns   map[net.Conn]struct{}
+	ctrls   map[net.Conn]struct{}
+	data    net.Listener
+	control net.Listener
+	telnet  net.Listener
+	mdns    net.PacketConn
+	mdnsSvc *mdnsService
+	closed  bool
+}
+
+// New creates a server for commands. SYSTem:COMMunication:TCPIP:CONTROL? is
+// answered with the control port number unless commands, or those
+// Options.Setup adds, already define it.
+func New(commands []*scpi.Command, opts Options) *Server {
+	if opts.BufferSize == 0 {
+		opts.BufferSize = 1024
+	}
+
+	s := &Server{
+		opts:     opts,
+		conns:    make(map[net.Conn]struct{}),
+		ctrls:    make(map[net.Conn]struct{}),
+		sessions: make(map[*session]struct{}),
+	}
+
+	all := make([]*scpi.Command, 0, len(commands)+4)
+	for _, cmd := range commands {
+		all = append(all, s.counted(cmd))
+	}
+	all = append(all, s.sessionCommands()...)
+	s.commands = all
+
+	if !opts.PerConnection {
+		s.ctx = s.newContext(func(data []byte) (int, error) {
+			if s.out == nil {
+				return len(data), nil
+			}
+			return s.out.Write(data)
+		}, func() error { return flush(s.out) })
+	}
+	return s
+}
+
+// ListenAndServe creates a server for commands and serves it on addr, the
+// way most instruments need it
+func ListenAndServe(addr string, commands []*scpi.Command, opts Options) error {
+	return New(commands, opts).ListenAndServe(addr)
+}
+
+// newContext creates a Context on the server's command table that sends its
+// responses through write and flush and runs Options.Setup on it
+func (s *Server) newContext(write func([]byte) (int, error), flush func() error) *scpi.Context {
+	var ctx *scpi.Context
+	iface := &scpi.Interface{
+		Write: write,
+		Flush: flush,
+		OnSRQ: func() {
+			s.ServiceRequest(byte(ctx.RegGet(scpi.RegSTB)))
+		},
+	}
+
+	ctx = scpi.NewContext(s.commands, iface, s.opts.BufferSize)
+	if s.opts.Setup != nil {
+		s.opts.Setup(ctx)
+	}
+	if !defines(ctx, controlHeader) {
+		ctx.AddCommand(&scpi.Command{Pattern: controlHeader, Callback: s.controlQuery})
+	}
+	return ctx
+}
+
+// flusher is implemented by the writers of connections that treat the end
+// of a response message specially, like the telnet console
+type flusher interface {
+	Flush() error
+}
+
+// flush ends a response message sent on out
+func flush(out io.Writer) error {
+	if f, ok := out.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// defines reports whether a command of ctx answers header
+func defines(ctx *scpi.Context, header string) bool {
+	for _, d := range ctx.Validate([]byte(header + "\n")) {
+		if d.Code == scpi.CodeUndefinedHeader {
+			return false
+		}
+	}
+	return true
+}
+
+// Context returns the Context commands are executed on, or nil when each
+// connection has its own
+func (s *Server) Context() *scpi.Context {
+	return s.ctx
+}
+
+// target is a Context with the mutex serializing it
+type target struct {
+	ctx *scpi.Context
+	mu  *sync.Mutex
+}
+
+// targets returns the shared Context, or the Contexts of all open sessions
+// with Options.PerConnection. The sessions are listed under sessMu, which a
+// running command does not hold, so a device clear can abort it.
+func (s *Server) targets() []target {
+	if s.ctx != nil {
+		return []target{{s.ctx, &s.mu}}
+	}
+
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+	all := make([]target, 0, len(s.sessions))
+	for sess := range s.sessions {
+		all = append(all, target{sess.ctx, &sess.mu})
+	}
+	return all
+}
+
+// input runs data on the Context of sess, sending the responses to out.
+// Sessions with a Context of their own run concurrently.
+func (s *Server) input(sess *session, out io.Writer, data []byte) {
+	if sess.ctx != nil {
+		sess.mu.Lock()
+		sess.ctx.Input(data)
+		sess.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	s.out, s.cur = out, sess
+	s.ctx.Input(data)
+	s.out, s.cur = nil, nil
+	s.mu.Unlock()
+}
+
+// ListenAndServe listens on addr (DefaultAddr when empty) and on the control
+// and telnet addresses from Options, announces the data port over mDNS with
+// Options.Announce, then serves connections until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+
+	data, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	var control net.Listener
+	if s.opts.ControlAddr != "" {
+		control, err = net.Listen("tcp", s.opts.ControlAddr)
+		if err != nil {
+			data.Close()
+			return err
+		}
+	}
+	var telnet net.Listener
+	var mdns net.PacketConn
+	if s.opts.TelnetAddr != "" {
+		telnet, err = net.Listen("tcp", s.opts.TelnetAddr)
+	}
+	if err == nil && s.opts.Announce {
+		mdns, err = ListenMDNS()
+	}
+	if err != nil {
+		for _, l := range []net.Listener{data, control, telnet} {
+			if l != nil {
+				l.Close()
+			}
+		}
+		return err
+	}
+
+	// A failing telnet console stops the server with its error
+	telnetErr := make(chan error, 1)
+	if telnet != nil {
+		go func() {
+			if err := s.ServeTelnet(telnet); err != ErrServerClosed {
+				telnetErr <- err
+				s.Close()
+			}
+		}()
+	}
+	if mdns != nil {
+		go s.ServeMDNS(mdns, data.Addr().(*net.TCPAddr).Port)
+	}
+
+	err = s.Serve(data, control)
+	select {
+	case terr := <-telnetErr:
+		return terr
+	default:
+		return err
+	}
+}
+
+// Serve accepts data connections on data and control connections on control,
+// which may be nil. With Options.TLSConfig the listeners are wrapped to
+// accept TLS connections. It blocks until Close is called or data fails.
+func (s *Server) Serve(data, control net.Listener) error {
+	if s.opts.TLSConfig != nil {
+		data = tls.NewListener(data, s.opts.TLSConfig)
+		if control != nil {
+			control = tls.NewListener(control, s.opts.TLSConfig)
+		}
+	}
+
+	s.connMu.Lock()
+	if s.closed {
+		s.connMu.Unlock()
+		return ErrServerClosed
+	}
+	s.data = data
+	s.control = control
+	s.connMu.Unlock()
+
+	if control != nil {
+		go s.acceptLoop(control, s.serveControl)
+	}
+	return s.acceptLoop(data, s.serveData)
+}
+
+// ControlPort returns the port the control listener is bound to, or 0 when
+// the control port is not running
+func (s *Server) ControlPort() int {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.control == nil {
+		return 0
+	}
+	if addr, ok := s.control.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// Close stops the listeners and closes all open connections
+func (s *Server) Close() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	s.closed = true
+	var err error
+	if s.data != nil {
+		err = s.data.Close()
+	}
+	if s.control != nil {
+		s.control.Close()
+	}
+	if s.telnet != nil {
+		s.telnet.Close()
+	}
+	s.goodbye()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// acceptLoop accepts connections on ln and handles each with serve
+func (s *Server) acceptLoop(ln net.Listener, serve func(net.Conn)) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.connMu.Lock()
+			closed := s.closed
+			s.connMu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.connMu.Lock()
+		s.conns[conn] = struct{}{}
+		s.connMu.Unlock()
+
+		go func() {
+			serve(conn)
+			conn.Close()
+			s.connMu.Lock()
+			delete(s.conns, conn)
+			s.connMu.Unlock()
+		}()
+	}
+}
+
+// serveData feeds everything received on a data connection to the Context
+// and sends the responses back on the same connection
+func (s *Server) serveData(conn net.Conn) {
+	sess := s.openSession(conn, conn)
+	defer s.closeSession(sess)
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			s.input(sess, conn, buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ServiceRequest notifies every control connection that the instrument
+// requests service, sending "SRQ,<stb>" with the status byte in decimal.
+// It is called whenever the master summary status of the Context's status
+// byte is set.
+func (s *Server) ServiceRequest(stb byte) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	msg := []byte(fmt.Sprintf("SRQ,%d\n", stb))
+	for conn := range s.ctrls {
+		conn.Write(msg)
+	}
+}
+
+// serveControl handles the line-based control protocol. "DCL" aborts the
+// command in progress, performs a device clear and is acknowledged with "DCL"
+// once complete; like a GPIB device clear it leaves the status registers
+// alone. "SPOLL" is answered with the serial poll status byte in decimal,
+// whose bit 6 is set once per service request. With
+// Options.PerConnection both act on every open session: DCL clears them all
+// and SPOLL answers their status bytes or'ed together.
+func (s *Server) serveControl(conn net.Conn) {
+	s.connMu.Lock()
+	s.ctrls[conn] = struct{}{}
+	s.connMu.Unlock()
+	defer func() {
+		s.connMu.Lock()
+		delete(s.ctrls, conn)
+		s.connMu.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var reply string
+		switch strings.ToUpper(strings.TrimSpace(scanner.Text())) {
+		case "DCL":
+			// Abort first: a running callback holds its mutex until it
+			// returns
+			targets := s.targets()
+			for _, t := range targets {
+				t.ctx.Abort()
+			}
+			for _, t := range targets {
+				t.mu.Lock()
+				t.ctx.DeviceClear()
+				t.mu.Unlock()
+			}
+			reply = "DCL\n"
+
+		case "SPOLL":
+			var stb byte
+			for _, t := range s.targets() {
+				if s.opts.StatusByte != nil {
+					t.mu.Lock()
+					stb |= s.opts.StatusByte(t.ctx)
+					t.mu.Unlock()
+				} else {
+					stb |= t.ctx.SerialPoll()
+				}
+			}
+			reply = fmt.Sprintf("%d\n", stb)
+
+		default:
+			continue
+		}
+
+		s.connMu.Lock()
+		_, err := conn.Write([]byte(reply))
+		s.connMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// controlQuery implements SYSTem:COMMunication:TCPIP:CONTROL?
+func (s *Server) controlQuery(ctx *scpi.Context) scpi.Result {
+	port := s.ControlPort()
+	if port == 0 {
+		return scpi.ResErr
+	}
+	ctx.ResultInt32(int32(port))
+	return scpi.ResOK
+}
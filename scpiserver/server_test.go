@@ -0,0 +1,499 @@
+package scpiserver
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// startServer runs s on loopback listeners and returns their addresses
+func startServer(t *testing.T, s *Server, withControl bool) (string, string) {
+	t.Helper()
+
+	data, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var control net.Listener
+	controlAddr := ""
+	if withControl {
+		control, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		controlAddr = control.Addr().String()
+	}
+
+	go s.Serve(data, control)
+	t.Cleanup(func() { s.Close() })
+	return data.Addr().String(), controlAddr
+}
+
+// query sends line on conn and returns the response line
+func query(t *testing.T, conn net.Conn, r *bufio.Reader, line string) string {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading response to %q: %v", line, err)
+	}
+	return strings.TrimRight(resp, "\n")
+}
+
+func testCommands() []*scpi.Command {
+	return []*scpi.Command{
+		{Pattern: "*IDN?", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.ResultText("ACME")
+			return scpi.ResOK
+		}},
+		{Pattern: "SYSTem:ERRor?", Callback: func(ctx *scpi.Context) scpi.Result {
+			err := ctx.ErrorPop()
+			if err == nil {
+				ctx.ResultInt32(0)
+			} else {
+				ctx.ResultInt32(int32(err.Code))
+			}
+			return scpi.ResOK
+		}},
+	}
+}
+
+func TestServeData(t *testing.T) {
+	s := New(testCommands(), Options{})
+	addr, _ := startServer(t, s, false)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if got := query(t, conn, r, "*IDN?"); got != `"ACME"` {
+		t.Errorf("*IDN? = %q, want %q", got, `"ACME"`)
+	}
+}
+
+func TestControlPortQuery(t *testing.T) {
+	s := New(testCommands(), Options{})
+	addr, controlAddr := startServer(t, s, true)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	_, port, _ := net.SplitHostPort(controlAddr)
+	if got := query(t, conn, r, "SYST:COMM:TCPIP:CONTROL?"); got != port {
+		t.Errorf("SYST:COMM:TCPIP:CONTROL? = %q, want %q", got, port)
+	}
+	if got := strconv.Itoa(s.ControlPort()); got != port {
+		t.Errorf("ControlPort() = %s, want %s", got, port)
+	}
+}
+
+func TestControlPortQueryOverride(t *testing.T) {
+	own := &scpi.Command{Pattern: "SYSTem:COMMunication:TCPIP:CONTrol?", Callback: func(ctx *scpi.Context) scpi.Result {
+		ctx.ResultInt32(5000)
+		return scpi.ResOK
+	}}
+	servers := map[string]*Server{
+		"commands": New(append(testCommands(), own), Options{}),
+		"Setup": New(testCommands(), Options{Setup: func(ctx *scpi.Context) {
+			ctx.AddCommand(own)
+		}}),
+	}
+	for name, s := range servers {
+		addr, _ := startServer(t, s, true)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if got := query(t, conn, bufio.NewReader(conn), "SYST:COMM:TCPIP:CONT?"); got != "5000" {
+			t.Errorf("CONTROL? defined in %s = %q, want 5000", name, got)
+		}
+	}
+}
+
+func TestControlPortQueryWithoutControl(t *testing.T) {
+	s := New(testCommands(), Options{})
+	addr, _ := startServer(t, s, false)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.Write([]byte("SYST:COMM:TCPIP:CONTROL?\n"))
+	if got := query(t, conn, r, "SYST:ERR?"); got != "-200" {
+		t.Errorf("SYST:ERR? after CONTROL? without control port = %q, want -200", got)
+	}
+}
+
+func TestControlPortDeviceClear(t *testing.T) {
+	s := New(testCommands(), Options{})
+	addr, controlAddr := startServer(t, s, true)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	ctrl, err := net.Dial("tcp", controlAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	cr := bufio.NewReader(ctrl)
+
+	// Leave a partial command in the input buffer, then clear it
+	conn.Write([]byte("BOGUS:COMMAND"))
+	time.Sleep(50 * time.Millisecond)
+
+	if got := query(t, ctrl, cr, "DCL"); got != "DCL" {
+		t.Fatalf("DCL acknowledgement = %q, want DCL", got)
+	}
+	if got := query(t, conn, r, "*IDN?"); got != `"ACME"` {
+		t.Errorf("*IDN? after device clear = %q, want %q", got, `"ACME"`)
+	}
+}
+
+func TestControlPortAbort(t *testing.T) {
+	started := make(chan struct{})
+	commands := append(testCommands(), &scpi.Command{
+		Pattern: "SLOW",
+		Callback: func(ctx *scpi.Context) scpi.Result {
+			close(started)
+			select {
+			case <-ctx.Aborted():
+				return scpi.ResOK
+			case <-time.After(5 * time.Second):
+				return scpi.ResErr
+			}
+		},
+	})
+	s := New(commands, Options{})
+	addr, controlAddr := startServer(t, s, true)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	ctrl, err := net.Dial("tcp", controlAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	cr := bufio.NewReader(ctrl)
+
+	conn.Write([]byte("SLOW\n"))
+	<-started
+
+	start := time.Now()
+	if got := query(t, ctrl, cr, "DCL"); got != "DCL" {
+		t.Fatalf("DCL acknowledgement = %q, want DCL", got)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("DCL took %v, callback was not aborted", elapsed)
+	}
+	if got := query(t, conn, r, "SYST:ERR?"); got != "0" {
+		t.Errorf("SYST:ERR? after aborted command = %q, want 0", got)
+	}
+}
+
+func TestControlPortServiceRequest(t *testing.T) {
+	s := New(testCommands(), Options{
+		StatusByte: func(ctx *scpi.Context) byte { return 0x44 },
+	})
+	_, controlAddr := startServer(t, s, true)
+
+	ctrl, err := net.Dial("tcp", controlAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	cr := bufio.NewReader(ctrl)
+
+	if got := query(t, ctrl, cr, "SPOLL"); got != "68" {
+		t.Errorf("SPOLL = %q, want 68", got)
+	}
+
+	s.ServiceRequest(0x50)
+	ctrl.SetDeadline(time.Now().Add(2 * time.Second))
+	got, err := cr.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "SRQ,80\n" {
+		t.Errorf("service request notification = %q, want %q", got, "SRQ,80\n")
+	}
+}
+
+func TestStatusServiceRequest(t *testing.T) {
+	s := New(testCommands(), Options{})
+	_, controlAddr := startServer(t, s, true)
+
+	ctrl, err := net.Dial("tcp", controlAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	cr := bufio.NewReader(ctrl)
+	if got := query(t, ctrl, cr, "SPOLL"); got != "0" {
+		t.Errorf("SPOLL = %q, want 0", got)
+	}
+
+	s.Context().RegSet(scpi.RegSRE, 1)
+	s.Context().RegSet(scpi.RegSTB, 1)
+	ctrl.SetDeadline(time.Now().Add(2 * time.Second))
+	got, err := cr.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "SRQ,65\n" {
+		t.Errorf("service request notification = %q, want %q", got, "SRQ,65\n")
+	}
+	if got := query(t, ctrl, cr, "SPOLL"); got != "65" {
+		t.Errorf("SPOLL = %q, want 65", got)
+	}
+
+	// The poll cleared RQS; MSS stays set while the condition lasts
+	if got := query(t, ctrl, cr, "SPOLL"); got != "1" {
+		t.Errorf("second SPOLL = %q, want 1", got)
+	}
+	if got := s.Context().RegGet(scpi.RegSTB); got != 65 {
+		t.Errorf("STB = %d, want 65", got)
+	}
+}
+
+func TestSessionStatistics(t *testing.T) {
+	s := New(testCommands(), Options{})
+	addr, _ := startServer(t, s, false)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, bufio.NewReader(conn)
+	}
+	a, ra := dial()
+	query(t, a, ra, "*IDN?") // Opens session 1 before b connects
+	b, rb := dial()
+	query(t, b, rb, "*IDN?")
+	query(t, b, rb, "*IDN?")
+
+	if got := query(t, a, ra, "SYST:LOCK:OWN?"); got != "0" {
+		t.Errorf("SYST:LOCK:OWN? = %q, want 0", got)
+	}
+	if got := query(t, b, rb, "SYST:STAT?;:SYST:ERR?"); got != "-203" {
+		t.Errorf("SYST:STAT? without lock = %q, want -203", got)
+	}
+	if got := query(t, a, ra, "SYST:LOCK:REQ?"); got != "1" {
+		t.Errorf("SYST:LOCK:REQ? = %q, want 1", got)
+	}
+	if got := query(t, b, rb, "SYST:LOCK:REQ?"); got != "0" {
+		t.Errorf("second SYST:LOCK:REQ? = %q, want 0", got)
+	}
+
+	want := `1,"*IDN?",1,0,2,"*IDN?",2,0,2,"SYSTem:ERRor?",1,0`
+	if got := query(t, a, ra, "SYST:STAT?"); got != want {
+		t.Errorf("SYST:STAT? = %q, want %q", got, want)
+	}
+
+	stats := s.Statistics()
+	if len(stats) != 2 || stats[1].Patterns["*IDN?"].Count != 2 {
+		t.Errorf("Statistics() = %+v", stats)
+	}
+
+	a.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for query(t, b, rb, "SYST:LOCK:OWN?") != "0" {
+		if time.Now().After(deadline) {
+			t.Fatal("lock not released when its owner disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := query(t, b, rb, "SYST:LOCK:REQ?"); got != "1" {
+		t.Errorf("SYST:LOCK:REQ? after owner left = %q, want 1", got)
+	}
+}
+
+func TestPerConnection(t *testing.T) {
+	var setups atomic.Int32
+	s := New(testCommands(), Options{
+		PerConnection: true,
+		Setup:         func(ctx *scpi.Context) { setups.Add(1) },
+	})
+	if s.Context() != nil {
+		t.Error("shared Context with PerConnection")
+	}
+	addr, _ := startServer(t, s, false)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, bufio.NewReader(conn)
+	}
+	a, ra := dial()
+	b, rb := dial()
+
+	// A partial message and its error stay on the connection that sent it
+	a.Write([]byte("BOGus"))
+	if got := query(t, b, rb, "*IDN?"); got != `"ACME"` {
+		t.Errorf("*IDN? = %q, want \"ACME\"", got)
+	}
+	if got := query(t, a, ra, ":CMD\nSYSTem:ERRor?"); got != "-113" {
+		t.Errorf("SYSTem:ERRor? on the sender = %q, want -113", got)
+	}
+	if got := query(t, b, rb, "SYSTem:ERRor?"); got != "0" {
+		t.Errorf("SYSTem:ERRor? on the other connection = %q, want 0", got)
+	}
+	if n := setups.Load(); n != 2 {
+		t.Errorf("Setup ran %d times, want 2", n)
+	}
+}
+
+func TestPerConnectionAbort(t *testing.T) {
+	started := make(chan struct{})
+	commands := append(testCommands(), &scpi.Command{
+		Pattern: "SLOW",
+		Callback: func(ctx *scpi.Context) scpi.Result {
+			close(started)
+			select {
+			case <-ctx.Aborted():
+				return scpi.ResOK
+			case <-time.After(5 * time.Second):
+				return scpi.ResErr
+			}
+		},
+	})
+	s := New(commands, Options{PerConnection: true})
+	addr, controlAddr := startServer(t, s, true)
+
+	dial := func(addr string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, bufio.NewReader(conn)
+	}
+	a, ra := dial(addr)
+	b, rb := dial(addr)
+	ctrl, cr := dial(controlAddr)
+
+	a.Write([]byte("SLOW\n"))
+	<-started
+
+	// Other connections keep running while SLOW does, and DCL aborts it
+	start := time.Now()
+	if got := query(t, b, rb, "*IDN?"); got != `"ACME"` {
+		t.Errorf("*IDN? during SLOW = %q, want \"ACME\"", got)
+	}
+	if got := query(t, ctrl, cr, "DCL"); got != "DCL" {
+		t.Fatalf("DCL acknowledgement = %q, want DCL", got)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("*IDN? and DCL took %v, want them to run during SLOW", elapsed)
+	}
+	if got := query(t, a, ra, "SYST:ERR?"); got != "0" {
+		t.Errorf("SYST:ERR? after aborted command = %q, want 0", got)
+	}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1 usable by
+// both ends of a connection, and a pool trusting it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "scpiserver test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	s := New(testCommands(), Options{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}})
+	addr, _ := startServer(t, s, false)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := query(t, conn, bufio.NewReader(conn), "*IDN?"); got != `"ACME"` {
+		t.Errorf("*IDN? = %q, want %q", got, `"ACME"`)
+	}
+
+	// Without a client certificate the server rejects the handshake
+	anon, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+	if err != nil {
+		return
+	}
+	defer anon.Close()
+	anon.SetDeadline(time.Now().Add(2 * time.Second))
+	anon.Write([]byte("*IDN?\n"))
+	if resp, err := bufio.NewReader(anon).ReadString('\n'); err == nil {
+		t.Errorf("client without certificate got %q", resp)
+	}
+}
@@ -0,0 +1,237 @@
+package scpiserver
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// session is one data connection
+type session struct {
+	id     int
+	remote string
+	start  time.Time
+	stats  map[string]*PatternStats
+	ctx    *scpi.Context // Own Context with Options.PerConnection
+	mu     sync.Mutex    // Serializes ctx
+}
+
+// PatternStats counts the commands one session ran with one pattern
+type PatternStats struct {
+	Count  int       // Commands executed
+	Errors int       // Commands whose callback failed
+	Last   time.Time // Time of the last one
+}
+
+// SessionStats holds the command statistics of one data connection
+type SessionStats struct {
+	Session  int    // Session number, as reported by SYSTem:LOCK:OWNer?
+	Remote   string // Remote address of the connection
+	Start    time.Time
+	Patterns map[string]PatternStats // Keyed by command pattern
+}
+
+// openSession registers a new data or console connection whose responses
+// are sent to out
+func (s *Server) openSession(conn net.Conn, out io.Writer) *session {
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+
+	s.nextID++
+	sess := &session{
+		id:     s.nextID,
+		remote: conn.RemoteAddr().String(),
+		start:  time.Now(),
+		stats:  make(map[string]*PatternStats),
+	}
+	if s.opts.PerConnection {
+		sess.ctx = s.newContext(out.Write, func() error { return flush(out) })
+	}
+	s.sessions[sess] = struct{}{}
+	return sess
+}
+
+// closeSession forgets a data connection and releases its lock
+func (s *Server) closeSession(sess *session) {
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+
+	delete(s.sessions, sess)
+	if s.owner == sess {
+		s.owner = nil
+	}
+}
+
+// Statistics returns the per-pattern command statistics of every open
+// session, ordered by session number
+func (s *Server) Statistics() []SessionStats {
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+	return s.statistics()
+}
+
+// statistics implements Statistics with sessMu held
+func (s *Server) statistics() []SessionStats {
+	all := make([]SessionStats, 0, len(s.sessions))
+	for sess := range s.sessions {
+		st := SessionStats{
+			Session:  sess.id,
+			Remote:   sess.remote,
+			Start:    sess.start,
+			Patterns: make(map[string]PatternStats, len(sess.stats)),
+		}
+		for pattern, ps := range sess.stats {
+			st.Patterns[pattern] = *ps
+		}
+		all = append(all, st)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Session < all[j].Session })
+	return all
+}
+
+// counted returns a copy of cmd whose callbacks record statistics for the
+// session they run on
+func (s *Server) counted(cmd *scpi.Command) *scpi.Command {
+	c := *cmd
+	c.Callback = s.countedCallback(cmd.Pattern, cmd.Callback)
+	c.Simulate = s.countedCallback(cmd.Pattern, cmd.Simulate)
+	return &c
+}
+
+// countedCallback wraps callback to record its execution, and returns nil
+// for a nil callback
+func (s *Server) countedCallback(pattern string, callback func(*scpi.Context) scpi.Result) func(*scpi.Context) scpi.Result {
+	if callback == nil {
+		return nil
+	}
+	return func(ctx *scpi.Context) scpi.Result {
+		result := callback(ctx)
+		if cur := s.current(ctx); cur != nil {
+			s.sessMu.Lock()
+			ps := cur.stats[pattern]
+			if ps == nil {
+				ps = &PatternStats{}
+				cur.stats[pattern] = ps
+			}
+			ps.Count++
+			if result != scpi.ResOK {
+				ps.Errors++
+			}
+			ps.Last = time.Now()
+			s.sessMu.Unlock()
+		}
+		return result
+	}
+}
+
+// current returns the session a command running on ctx was received on
+func (s *Server) current(ctx *scpi.Context) *session {
+	if s.ctx != nil {
+		// The running command holds mu
+		return s.cur
+	}
+
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+	for sess := range s.sessions {
+		if sess.ctx == ctx {
+			return sess
+		}
+	}
+	return nil
+}
+
+// sessionCommands returns the lock and statistics commands. The lock is
+// advisory for ordinary commands; it reserves SYSTem:STATistics? to its
+// owner.
+func (s *Server) sessionCommands() []*scpi.Command {
+	return []*scpi.Command{
+		{Pattern: "SYSTem:LOCK:REQuest?", Callback: s.lockRequestQ},
+		{Pattern: "SYSTem:LOCK:RELease", Callback: s.lockRelease},
+		{Pattern: "SYSTem:LOCK:OWNer?", Callback: s.lockOwnerQ},
+		{Pattern: "SYSTem:STATistics?", Callback: s.statisticsQ},
+	}
+}
+
+// lockRequestQ implements SYSTem:LOCK:REQuest?, answering 1 when the
+// session holds the lock afterwards and 0 when another session does
+func (s *Server) lockRequestQ(ctx *scpi.Context) scpi.Result {
+	cur := s.current(ctx)
+	s.sessMu.Lock()
+	if s.owner == nil {
+		s.owner = cur
+	}
+	owned := s.owner != nil && s.owner == cur
+	s.sessMu.Unlock()
+
+	ctx.ResultBool(owned)
+	return scpi.ResOK
+}
+
+// lockRelease implements SYSTem:LOCK:RELease
+func (s *Server) lockRelease(ctx *scpi.Context) scpi.Result {
+	cur := s.current(ctx)
+	s.sessMu.Lock()
+	owned := s.owner != nil && s.owner == cur
+	if owned {
+		s.owner = nil
+	}
+	s.sessMu.Unlock()
+
+	if !owned {
+		ctx.ErrorPush(scpi.NewError(scpi.CodeSettingsConflict))
+		return scpi.ResErr
+	}
+	return scpi.ResOK
+}
+
+// lockOwnerQ implements SYSTem:LOCK:OWNer?, answering the session number
+// of the lock owner or 0 when unlocked
+func (s *Server) lockOwnerQ(ctx *scpi.Context) scpi.Result {
+	id := 0
+	s.sessMu.Lock()
+	if s.owner != nil {
+		id = s.owner.id
+	}
+	s.sessMu.Unlock()
+	ctx.ResultInt32(int32(id))
+	return scpi.ResOK
+}
+
+// statisticsQ implements SYSTem:STATistics?, available to the lock owner
+// only. It answers <session>,<pattern>,<count>,<errors> for every pattern
+// each open session has used.
+func (s *Server) statisticsQ(ctx *scpi.Context) scpi.Result {
+	cur := s.current(ctx)
+	s.sessMu.Lock()
+	owned := s.owner != nil && s.owner == cur
+	var stats []SessionStats
+	if owned {
+		stats = s.statistics()
+	}
+	s.sessMu.Unlock()
+
+	if !owned {
+		ctx.ErrorPush(scpi.NewError(scpi.CodeCommandProtected))
+		return scpi.ResErr
+	}
+	for _, st := range stats {
+		patterns := make([]string, 0, len(st.Patterns))
+		for pattern := range st.Patterns {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			ps := st.Patterns[pattern]
+			ctx.ResultInt32(int32(st.Session))
+			ctx.ResultText(pattern)
+			ctx.ResultInt32(int32(ps.Count))
+			ctx.ResultInt32(int32(ps.Errors))
+		}
+	}
+	return scpi.ResOK
+}
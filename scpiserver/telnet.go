@@ -0,0 +1,218 @@
+package scpiserver
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// DefaultTelnetAddr is the conventional address of an instrument's telnet
+// console
+const DefaultTelnetAddr = ":5024"
+
+// DefaultPrompt is shown by the telnet console when Options.Prompt is empty
+const DefaultPrompt = "SCPI> "
+
+// Telnet commands and options (RFC 854, 857, 858)
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetEcho = 1
+	telnetSGA  = 3
+)
+
+// ServeTelnet accepts interactive console connections on ln, running the
+// same commands as the data port. It blocks until Close is called or ln
+// fails.
+func (s *Server) ServeTelnet(ln net.Listener) error {
+	if s.opts.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.opts.TLSConfig)
+	}
+
+	s.connMu.Lock()
+	if s.closed {
+		s.connMu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.telnet = ln
+	s.connMu.Unlock()
+
+	return s.acceptLoop(ln, s.serveTelnet)
+}
+
+// serveTelnet runs a console session. The server echoes what the client
+// types, so it offers WILL ECHO and WILL SUPPRESS-GO-AHEAD and ignores
+// everything else the client negotiates. A line ends with CR, LF or CR LF;
+// backspace and delete edit it, and Ctrl-C discards it. A line fits the
+// input buffer with its LF, so it is at most Options.BufferSize-1 long;
+// what is typed beyond rings the bell.
+func (s *Server) serveTelnet(conn net.Conn) {
+	console := &crlfWriter{w: conn}
+	sess := s.openSession(conn, console)
+	defer s.closeSession(sess)
+
+	prompt := []byte(s.opts.Prompt)
+	if len(prompt) == 0 {
+		prompt = []byte(DefaultPrompt)
+	}
+
+	conn.Write([]byte{telnetIAC, telnetWILL, telnetEcho, telnetIAC, telnetWILL, telnetSGA})
+	conn.Write(prompt)
+
+	var filter telnetFilter
+	var line, echo []byte
+	cr := false
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		for _, b := range buf[:n] {
+			if !filter.data(b) {
+				continue
+			}
+			if b == '\n' && cr {
+				cr = false
+				continue
+			}
+			cr = b == '\r'
+
+			switch {
+			case b == '\r' || b == '\n':
+				conn.Write(append(echo, '\r', '\n'))
+				echo = echo[:0]
+
+				s.input(sess, console, append(line, '\n'))
+
+				line = line[:0]
+				conn.Write(prompt)
+
+			case b == '\b' || b == 0x7f:
+				if len(line) > 0 {
+					line = line[:len(line)-1]
+					echo = append(echo, '\b', ' ', '\b')
+				}
+
+			case b == 0x03:
+				line = line[:0]
+				echo = append(echo, "^C\r\n"...)
+				echo = append(echo, prompt...)
+
+			case b >= ' ' && b < 0x7f:
+				if len(line) >= s.opts.BufferSize-1 {
+					echo = append(echo, '\a')
+				} else {
+					line = append(line, b)
+					echo = append(echo, b)
+				}
+			}
+		}
+		if len(echo) > 0 {
+			conn.Write(echo)
+			echo = echo[:0]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// telnetFilter removes telnet commands and option negotiation from the
+// bytes a client sends
+type telnetFilter struct {
+	state int
+}
+
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSub
+	telnetSubIAC
+)
+
+// data advances the filter by b and reports whether b is data
+func (f *telnetFilter) data(b byte) bool {
+	switch f.state {
+	case telnetCommand:
+		switch b {
+		case telnetIAC:
+			f.state = telnetData
+			return true
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			f.state = telnetOption
+		case telnetSB:
+			f.state = telnetSub
+		default:
+			f.state = telnetData
+		}
+	case telnetOption:
+		f.state = telnetData
+	case telnetSub:
+		if b == telnetIAC {
+			f.state = telnetSubIAC
+		}
+	case telnetSubIAC:
+		f.state = telnetSub
+		if b == telnetSE {
+			f.state = telnetData
+		}
+	default:
+		if b != telnetIAC {
+			return true
+		}
+		f.state = telnetCommand
+	}
+	return false
+}
+
+// crlfWriter sends responses to a terminal, which expects CR LF line ends.
+// Only the LF terminating a response message is sent as CR LF, so blocks
+// pass unchanged: a trailing LF is held back until the next Write or Flush
+// tells whether it was the terminator.
+type crlfWriter struct {
+	w  io.Writer
+	lf bool // An LF is held back
+	cr bool // The last byte sent was a CR
+}
+
+func (c *crlfWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	out := data
+	if c.lf {
+		out = append([]byte{'\n'}, data...)
+	}
+	c.lf = data[len(data)-1] == '\n'
+	if c.lf {
+		out = out[:len(out)-1]
+	}
+	if len(out) == 0 {
+		return len(data), nil
+	}
+	c.cr = out[len(out)-1] == '\r'
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Flush ends a response message, sending a held back LF as CR LF
+func (c *crlfWriter) Flush() error {
+	if !c.lf {
+		return nil
+	}
+	end := []byte("\r\n")
+	if c.cr {
+		end = end[1:]
+	}
+	c.lf, c.cr = false, false
+	_, err := c.w.Write(end)
+	return err
+}
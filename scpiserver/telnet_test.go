@@ -0,0 +1,106 @@
+package scpiserver
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// readUntil reads from r until the data read ends with suffix
+func readUntil(t *testing.T, conn net.Conn, r *bufio.Reader, suffix string) string {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	var got []byte
+	for !bytes.HasSuffix(got, []byte(suffix)) {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("reading until %q after %q: %v", suffix, got, err)
+		}
+		got = append(got, b)
+	}
+	return string(got)
+}
+
+func TestTelnetConsole(t *testing.T) {
+	s := New(testCommands(), Options{Prompt: "> "})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTelnet(ln)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	want := "\xff\xfb\x01\xff\xfb\x03> "
+	if got := readUntil(t, conn, r, "> "); got != want {
+		t.Errorf("greeting = %q, want %q", got, want)
+	}
+
+	// Negotiation is ignored, backspace edits the line and CR LF ends it
+	conn.Write([]byte("*ID\xff\xfd\x01X\bN?\r\n"))
+	want = "*IDX\b \bN?\r\n\"ACME\"\r\n> "
+	if got := readUntil(t, conn, r, "> "); got != want {
+		t.Errorf("console output = %q, want %q", got, want)
+	}
+
+	// Ctrl-C discards the line
+	conn.Write([]byte("BOGUS\x03SYST:ERR?\r"))
+	want = "BOGUS^C\r\n> SYST:ERR?\r\n0\r\n> "
+	if got := readUntil(t, conn, r, "0\r\n> "); got != want {
+		t.Errorf("console output = %q, want %q", got, want)
+	}
+}
+
+func TestTelnetBlocksAndLongLines(t *testing.T) {
+	commands := append(testCommands(), &scpi.Command{Pattern: "DATA?", Callback: func(ctx *scpi.Context) scpi.Result {
+		ctx.ResultArbitraryBlock([]byte("a\nb\n"))
+		return scpi.ResOK
+	}})
+	s := New(commands, Options{BufferSize: 16, Prompt: "> "})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTelnet(ln)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readUntil(t, conn, r, "> ")
+
+	// Only the response terminator becomes CR LF
+	conn.Write([]byte("DATA?\r"))
+	want := "DATA?\r\n#14a\nb\n\r\n> "
+	if got := readUntil(t, conn, r, "> "); got != want {
+		t.Errorf("block output = %q, want %q", got, want)
+	}
+
+	// What does not fit the buffer with the LF rings the bell, and the line
+	// that fits is parsed without overrunning the buffer
+	conn.Write([]byte(strings.Repeat("X", 18) + "\r"))
+	want = strings.Repeat("X", 15) + "\a\a\a\r\n> "
+	if got := readUntil(t, conn, r, "> "); got != want {
+		t.Errorf("long line output = %q, want %q", got, want)
+	}
+	conn.Write([]byte("SYST:ERR?\r"))
+	want = "SYST:ERR?\r\n-113\r\n> "
+	if got := readUntil(t, conn, r, "> "); got != want {
+		t.Errorf("error after long line = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+package scpi
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetSelfTest sets the self-test *TST? runs. fn returns 0 for a passed test
+// or a device-defined failure code; an error also fails the test. If
+// timeout is positive, a test that has not finished by then fails. fn runs
+// in its own goroutine and must not use the Context's parameter or result
+// functions; one that times out is left to finish in the background.
+func (c *Context) SetSelfTest(fn func(ctx *Context) (int32, error), timeout time.Duration) {
+	c.selfTest = fn
+	c.tstTimeout = timeout
+}
+
+// CoreTstQ implements *TST?. It runs the self-test set with SetSelfTest and
+// answers once it has finished (IEEE 488.2 10.38): 0 if it passed, else its
+// failure code, or 1 if it failed without one. A failure is also reported
+// as -330 in the error queue. Without a self-test it answers 0.
+func CoreTstQ(ctx *Context) Result {
+	if ctx.selfTest == nil {
+		ctx.ResultInt32(0)
+		return ResOK
+	}
+
+	type outcome struct {
+		code int32
+		err  error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		code, err := ctx.selfTest(ctx)
+		done <- outcome{code, err}
+	}()
+	var timeout <-chan time.Time
+	if ctx.tstTimeout > 0 {
+		timer := time.NewTimer(ctx.tstTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var result outcome
+	select {
+	case result = <-done:
+	case <-timeout:
+		result = outcome{err: fmt.Errorf("timed out after %v", ctx.tstTimeout)}
+	case <-ctx.Aborted():
+		return ResErr
+	}
+
+	switch {
+	case result.err != nil:
+		ctx.ErrorPushf(CodeSelfTestFailed, "%v", result.err)
+		if result.code == 0 {
+			result.code = 1
+		}
+	case result.code != 0:
+		ctx.ErrorPushf(CodeSelfTestFailed, "code %d", result.code)
+	}
+	ctx.ResultInt32(result.code)
+	return ResOK
+}
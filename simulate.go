@@ -0,0 +1,29 @@
+package scpi
+
+// SetSimulation switches simulation mode on or off. While it is on, commands
+// with a Simulate callback run it instead of Callback.
+func (c *Context) SetSimulation(on bool) {
+	c.simulate = on
+}
+
+// Simulating reports whether simulation mode is on, for callbacks that
+// handle both modes themselves
+func (c *Context) Simulating() bool {
+	return c.simulate
+}
+
+// SystemSimulate implements SYSTem:SIMulate ON|OFF
+func SystemSimulate(ctx *Context) Result {
+	on, err := ctx.ParamBool(true)
+	if err != nil {
+		return ResErr
+	}
+	ctx.SetSimulation(on)
+	return ResOK
+}
+
+// SystemSimulateQ implements SYSTem:SIMulate?
+func SystemSimulateQ(ctx *Context) Result {
+	ctx.ResultBool(ctx.simulate)
+	return ResOK
+}
@@ -0,0 +1,211 @@
+package scpi
+
+// Register names a register of the IEEE 488.2 status model kept by the
+// Context
+type Register int
+
+const (
+	RegSTB Register = iota // Status byte
+	RegSRE                 // Service request enable
+	RegESR                 // Standard event status, latched until read
+	RegESE                 // Standard event status enable
+	regCount
+)
+
+// Status byte bits (IEEE 488.2 section 11.2 and SCPI-99)
+const (
+	StbErrorQueue   uint16 = 1 << 2 // Error/event queue not empty
+	StbQuestionable uint16 = 1 << 3 // QUEStionable status summary
+	StbMAV          uint16 = 1 << 4 // Message available
+	StbESB          uint16 = 1 << 5 // Standard event summary, ESR & ESE
+	StbMSS          uint16 = 1 << 6 // Master summary status, STB & SRE
+	StbOperation    uint16 = 1 << 7 // OPERation status summary
+)
+
+// Standard event status register bits (IEEE 488.2 section 11.5.1)
+const (
+	EsrOPC uint16 = 1 << 0 // Operation complete
+	EsrRQC uint16 = 1 << 1 // Request control
+	EsrQYE uint16 = 1 << 2 // Query error
+	EsrDDE uint16 = 1 << 3 // Device-dependent error
+	EsrEXE uint16 = 1 << 4 // Execution error
+	EsrCME uint16 = 1 << 5 // Command error
+	EsrURQ uint16 = 1 << 6 // User request
+	EsrPON uint16 = 1 << 7 // Power on
+)
+
+// RegGet returns a status register. ESB and MSS of the status byte are
+// computed from the other registers when it is read. It may be called from
+// any goroutine.
+func (c *Context) RegGet(reg Register) uint16 {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	return c.regGet(reg)
+}
+
+// RegSet sets bits in a status register. Bits set in an event register such
+// as ESR stay set until the register is read or cleared. It may be called
+// from any goroutine.
+func (c *Context) RegSet(reg Register, bits uint16) {
+	c.statusMu.Lock()
+	defer c.statusUnlock()
+	c.regWrite(reg, c.regs[reg]|bits)
+}
+
+// RegClear clears bits in a status register. It may be called from any
+// goroutine.
+func (c *Context) RegClear(reg Register, bits uint16) {
+	c.statusMu.Lock()
+	defer c.statusUnlock()
+	c.regWrite(reg, c.regs[reg]&^bits)
+}
+
+// statusUnlock releases statusMu after a change of the status registers
+// and then calls Interface.OnSRQ if MSS went from 0 to 1. The rising edge
+// also sets RQS, which stays set until a serial poll or until MSS clears.
+func (c *Context) statusUnlock() {
+	mss := c.regGet(RegSTB)&StbMSS != 0
+	rising := mss && !c.mss
+	c.mss = mss
+	c.rqs = mss && (c.rqs || rising)
+	c.statusMu.Unlock()
+
+	if rising && c.iface != nil && c.iface.OnSRQ != nil {
+		c.iface.OnSRQ()
+	}
+}
+
+// regGet returns reg with the summary bits of the status byte computed;
+// statusMu must be held
+func (c *Context) regGet(reg Register) uint16 {
+	if reg != RegSTB {
+		return c.regs[reg]
+	}
+	stb := c.regs[RegSTB] &^ (StbESB | StbMSS)
+	if c.regs[RegESR]&c.regs[RegESE] != 0 {
+		stb |= StbESB
+	}
+	if stb&c.regs[RegSRE]&^StbMSS != 0 {
+		stb |= StbMSS
+	}
+	return stb & 0xFF
+}
+
+// regWrite stores a whole register; statusMu must be held. The status byte
+// and its enable register are eight bits wide, and the computed bits of
+// the status byte are not stored.
+func (c *Context) regWrite(reg Register, value uint16) {
+	switch reg {
+	case RegSTB:
+		value &= 0xFF &^ (StbESB | StbMSS)
+	case RegSRE, RegESR, RegESE:
+		value &= 0xFF
+	}
+	c.regs[reg] = value
+}
+
+// errorEvent returns the ESR bit for the class of an error or event code
+// (SCPI-99 21.8): -1xx command, -2xx execution, -3xx and positive
+// device-dependent, -4xx query errors, and the -500 to -800 events
+func errorEvent(code int16) uint16 {
+	e := &Error{Code: code}
+	switch {
+	case e.IsCommandError():
+		return EsrCME
+	case e.IsExecutionError():
+		return EsrEXE
+	case e.IsDeviceError():
+		return EsrDDE
+	case e.IsQueryError():
+		return EsrQYE
+	case code <= -500 && code > -600:
+		return EsrPON
+	case code <= -600 && code > -700:
+		return EsrURQ
+	case code <= -700 && code > -800:
+		return EsrRQC
+	case code <= -800 && code > -900:
+		return EsrOPC
+	}
+	return 0
+}
+
+// SerialPoll returns the status byte as a serial poll reads it, with RQS
+// instead of MSS in bit 6, and clears RQS (IEEE 488.2 section 11.2.2).
+// Transports call it when the controller polls, e.g. over a control
+// connection; *STB? keeps reporting MSS. It may be called from any
+// goroutine.
+func (c *Context) SerialPoll() byte {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	stb := c.regGet(RegSTB) &^ StbMSS
+	if c.rqs {
+		stb |= StbMSS
+	}
+	c.rqs = false
+	return byte(stb)
+}
+
+// CoreStbQ implements *STB?, which leaves the status byte unchanged
+func CoreStbQ(ctx *Context) Result {
+	ctx.ResultInt32(int32(ctx.RegGet(RegSTB)))
+	return ResOK
+}
+
+// CoreSre implements *SRE <NRf>. MSS cannot be enabled and is ignored.
+func CoreSre(ctx *Context) Result {
+	return coreRegWrite(ctx, RegSRE, StbMSS)
+}
+
+// CoreSreQ implements *SRE?
+func CoreSreQ(ctx *Context) Result {
+	ctx.ResultInt32(int32(ctx.RegGet(RegSRE)))
+	return ResOK
+}
+
+// CoreEse implements *ESE <NRf>
+func CoreEse(ctx *Context) Result {
+	return coreRegWrite(ctx, RegESE, 0)
+}
+
+// CoreEseQ implements *ESE?
+func CoreEseQ(ctx *Context) Result {
+	ctx.ResultInt32(int32(ctx.RegGet(RegESE)))
+	return ResOK
+}
+
+// CoreEsrQ implements *ESR?, which reads and clears the standard event
+// status register
+func CoreEsrQ(ctx *Context) Result {
+	ctx.statusMu.Lock()
+	esr := ctx.regs[RegESR]
+	ctx.regs[RegESR] = 0
+	ctx.statusUnlock()
+
+	ctx.ResultInt32(int32(esr))
+	return ResOK
+}
+
+// coreRegWrite implements an enable register command taking a value from 0
+// to 255, pushing -222 for others. The ignored bits are cleared, and the
+// value is persisted for power-on while the *PSC flag is cleared.
+func coreRegWrite(ctx *Context, reg Register, ignored uint16) Result {
+	value, err := ctx.ParamInt32(true)
+	if err != nil {
+		return ResErr
+	}
+	if value < 0 || value > 255 {
+		ctx.ErrorPush(NewError(CodeDataOutOfRange))
+		return ResErr
+	}
+	ctx.statusMu.Lock()
+	ctx.regWrite(reg, uint16(value)&^ignored)
+	ctx.statusUnlock()
+
+	if err := ctx.saveStatusEnable(); err != nil {
+		ctx.ErrorPushf(CodeExecutionError, "%v", err)
+		return ResErr
+	}
+	return ResOK
+}
@@ -0,0 +1,386 @@
+package scpi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// statusMask keeps the 15 bits of a SCPI status register; bit 15 is always
+// 0 so values read back as positive integers
+const statusMask = 0x7FFF
+
+// StatusRegister is a SCPI status structure (SCPI-99 chapter 9): condition,
+// event and enable registers with positive and negative transition filters.
+// Condition changes passing a filter latch bits in the event register, and
+// enabled events are summarized into a bit of the parent structure's
+// condition register, or of the status byte for OPERation and QUEStionable.
+// Its methods may be called from any goroutine.
+type StatusRegister struct {
+	ctx      *Context
+	name     string // Pattern path, e.g. "QUEStionable:VOLTage"
+	parent   *StatusRegister
+	bit      uint16 // Summary bit in the parent or the status byte
+	children []*StatusRegister
+
+	cond, event, enable, ptr, ntr uint16
+}
+
+// newStatusRegister returns a register with the SCPI preset transition
+// filters: positive transitions latched, negative ones not
+func newStatusRegister(ctx *Context, name string, parent *StatusRegister, bit uint16) *StatusRegister {
+	return &StatusRegister{ctx: ctx, name: name, parent: parent, bit: bit, ptr: statusMask}
+}
+
+// OperationStatus returns the STATus:OPERation register. The bits of pending
+// operations (OperationStart) are set in its condition register.
+func (c *Context) OperationStatus() *StatusRegister {
+	return c.operStatus
+}
+
+// QuestionableStatus returns the STATus:QUEStionable register
+func (c *Context) QuestionableStatus() *StatusRegister {
+	return c.quesStatus
+}
+
+// StatusRegister returns the status register at path, written in long,
+// short or pattern form, e.g. "QUEStionable:VOLTage" or "QUES:VOLT", or nil
+// if there is none
+func (c *Context) StatusRegister(path string) *StatusRegister {
+	return c.statusRegister(strings.Split(strings.TrimPrefix(path, ":"), ":"))
+}
+
+// statusRegister returns the status register at the header nodes parts
+func (c *Context) statusRegister(parts []string) *StatusRegister {
+	c.statusMu.Lock()
+	registers := c.statusRoots
+	c.statusMu.Unlock()
+	var found *StatusRegister
+	for _, part := range parts {
+		found = nil
+		for _, r := range registers {
+			node := r.name[strings.LastIndexByte(r.name, ':')+1:]
+			if matchPattern(node, part) || strings.EqualFold(node, part) {
+				found = r
+				break
+			}
+		}
+		if found == nil {
+			return nil
+		}
+		c.statusMu.Lock()
+		registers = found.children
+		c.statusMu.Unlock()
+	}
+	return found
+}
+
+// AddRegister adds a sub-register named by the pattern node name, e.g.
+// "VOLTage", whose enabled events are summarized into bit of r. If r
+// already has a sub-register of that name it is returned instead.
+func (r *StatusRegister) AddRegister(name string, bit uint16) *StatusRegister {
+	r.ctx.statusMu.Lock()
+	defer r.ctx.statusMu.Unlock()
+
+	for _, child := range r.children {
+		if strings.EqualFold(child.name, r.name+":"+name) {
+			return child
+		}
+	}
+	child := newStatusRegister(r.ctx, r.name+":"+name, r, bit)
+	r.children = append(r.children, child)
+	return child
+}
+
+// AddStatusRegister adds a device-dependent status register at path, e.g.
+// "QUEStionable:FAULt", and registers its STATus commands unless they are
+// registered already. A path of one node, e.g. "FAULt", makes a register
+// summarized into bit of the status byte, such as bit 0 or 1 which IEEE
+// 488.2 leaves to the device; a longer one a sub-register summarized into
+// bit of its parent, which must exist. An existing register at path is
+// returned as it is.
+func (c *Context) AddStatusRegister(path string, bit uint16) (*StatusRegister, error) {
+	path = strings.TrimPrefix(path, ":")
+	cmds := StatusRegisterCommands(path)
+	for _, cmd := range cmds {
+		if reason := checkPattern(cmd.Pattern); reason != "" {
+			return nil, &PatternError{Pattern: cmd.Pattern, Reason: reason}
+		}
+	}
+
+	var r *StatusRegister
+	if i := strings.LastIndexByte(path, ':'); i >= 0 {
+		parent := c.StatusRegister(path[:i])
+		if parent == nil {
+			return nil, fmt.Errorf("status register %s: no register %s", path, path[:i])
+		}
+		r = parent.AddRegister(path[i+1:], bit)
+	} else if r = c.StatusRegister(path); r == nil {
+		r = newStatusRegister(c, path, nil, bit)
+		c.statusMu.Lock()
+		c.statusRoots = append(c.statusRoots, r)
+		c.statusMu.Unlock()
+	}
+
+	if c.findCommand("STATus:"+path+":CONDition?") == nil {
+		for _, cmd := range cmds {
+			if err := c.AddCommand(cmd); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// Name returns the pattern path of r, e.g. "QUEStionable:VOLTage"
+func (r *StatusRegister) Name() string {
+	return r.name
+}
+
+// Condition returns the condition register
+func (r *StatusRegister) Condition() uint16 {
+	return r.get(&r.cond)
+}
+
+// SetCondition sets bits in the condition register
+func (r *StatusRegister) SetCondition(bits uint16) {
+	r.ctx.statusMu.Lock()
+	defer r.ctx.statusUnlock()
+	r.setCondition(r.cond | bits)
+}
+
+// ClearCondition clears bits in the condition register
+func (r *StatusRegister) ClearCondition(bits uint16) {
+	r.ctx.statusMu.Lock()
+	defer r.ctx.statusUnlock()
+	r.setCondition(r.cond &^ bits)
+}
+
+// Event returns the event register without clearing it
+func (r *StatusRegister) Event() uint16 {
+	return r.get(&r.event)
+}
+
+// ReadEvent returns and clears the event register, as its query does
+func (r *StatusRegister) ReadEvent() uint16 {
+	r.ctx.statusMu.Lock()
+	defer r.ctx.statusUnlock()
+	event := r.event
+	r.event = 0
+	r.summarize()
+	return event
+}
+
+// Enable returns the enable register
+func (r *StatusRegister) Enable() uint16 {
+	return r.get(&r.enable)
+}
+
+// SetEnable writes the enable register
+func (r *StatusRegister) SetEnable(value uint16) {
+	r.set(&r.enable, value)
+}
+
+// PositiveTransition returns the PTRansition filter
+func (r *StatusRegister) PositiveTransition() uint16 {
+	return r.get(&r.ptr)
+}
+
+// SetPositiveTransition writes the PTRansition filter
+func (r *StatusRegister) SetPositiveTransition(value uint16) {
+	r.set(&r.ptr, value)
+}
+
+// NegativeTransition returns the NTRansition filter
+func (r *StatusRegister) NegativeTransition() uint16 {
+	return r.get(&r.ntr)
+}
+
+// SetNegativeTransition writes the NTRansition filter
+func (r *StatusRegister) SetNegativeTransition(value uint16) {
+	r.set(&r.ntr, value)
+}
+
+// get reads one of the registers of r
+func (r *StatusRegister) get(reg *uint16) uint16 {
+	r.ctx.statusMu.Lock()
+	defer r.ctx.statusMu.Unlock()
+	return *reg
+}
+
+// set writes one of the registers of r and updates the summary
+func (r *StatusRegister) set(reg *uint16, value uint16) {
+	r.ctx.statusMu.Lock()
+	defer r.ctx.statusUnlock()
+	*reg = value & statusMask
+	r.summarize()
+}
+
+// setCondition writes the condition register, latching the transitions
+// the filters pass; statusMu must be held
+func (r *StatusRegister) setCondition(cond uint16) {
+	cond &= statusMask
+	rising, falling := cond&^r.cond, r.cond&^cond
+	r.cond = cond
+	r.event |= rising&r.ptr | falling&r.ntr
+	r.summarize()
+}
+
+// summarize propagates the summary of the enabled events of r to its
+// parent; statusMu must be held
+func (r *StatusRegister) summarize() {
+	on := r.event&r.enable != 0
+	if r.parent == nil {
+		if on {
+			r.ctx.regs[RegSTB] |= r.bit
+		} else {
+			r.ctx.regs[RegSTB] &^= r.bit
+		}
+		return
+	}
+	if on {
+		r.parent.setCondition(r.parent.cond | r.bit)
+	} else {
+		r.parent.setCondition(r.parent.cond &^ r.bit)
+	}
+}
+
+// PresetStatus applies STATus:PRESet (SCPI-99 20.7): the OPERation and
+// QUEStionable enable registers are cleared, those of their sub-registers
+// set so their events reach the summaries, and every transition filter
+// reset to latch positive transitions only. Event registers, *ESE and *SRE
+// are left unchanged.
+func (c *Context) PresetStatus() {
+	c.statusMu.Lock()
+	defer c.statusUnlock()
+	for _, r := range c.statusRoots {
+		r.preset(0)
+	}
+}
+
+// preset applies STATus:PRESet to r and its sub-registers; statusMu must
+// be held
+func (r *StatusRegister) preset(enable uint16) {
+	for _, child := range r.children {
+		child.preset(statusMask)
+	}
+	r.enable, r.ptr, r.ntr = enable, statusMask, 0
+	r.summarize()
+}
+
+// StatusPreset implements STATus:PRESet
+func StatusPreset(ctx *Context) Result {
+	ctx.PresetStatus()
+	return ResOK
+}
+
+// StatusRegisterCommands returns the STATus commands of the register at
+// path, e.g. "QUEStionable:VOLTage": [:EVENt]?, :CONDition?, :ENABle,
+// :PTRansition and :NTRansition with their queries. The handlers find the
+// register from the header, so the commands can be registered before
+// AddRegister creates it.
+func StatusRegisterCommands(path string) []*Command {
+	prefix := "STATus:" + strings.TrimPrefix(path, ":")
+	return []*Command{
+		{Pattern: prefix + "[:EVENt]?", Callback: StatusEventQ},
+		{Pattern: prefix + ":CONDition?", Callback: StatusConditionQ},
+		{Pattern: prefix + ":ENABle", Callback: StatusEnable},
+		{Pattern: prefix + ":ENABle?", Callback: StatusEnableQ},
+		{Pattern: prefix + ":PTRansition", Callback: StatusPositiveTransition},
+		{Pattern: prefix + ":PTRansition?", Callback: StatusPositiveTransitionQ},
+		{Pattern: prefix + ":NTRansition", Callback: StatusNegativeTransition},
+		{Pattern: prefix + ":NTRansition?", Callback: StatusNegativeTransitionQ},
+	}
+}
+
+// headerStatusRegister returns the register a STATus command header names,
+// the header without its STATus node and, unless it is an event query with
+// [:EVENt] omitted, without its last node. It pushes -113 if there is none.
+func (c *Context) headerStatusRegister(last string) *StatusRegister {
+	header := strings.TrimSuffix(strings.TrimPrefix(c.CommandHeader(), ":"), "?")
+	parts := strings.Split(header, ":")
+	if len(parts) > 0 {
+		parts = parts[1:]
+	}
+	if len(parts) > 1 && matchPattern(last, parts[len(parts)-1]) {
+		if r := c.statusRegister(parts[:len(parts)-1]); r != nil {
+			return r
+		}
+	}
+	if last == "EVENt" {
+		if r := c.statusRegister(parts); r != nil {
+			return r
+		}
+	}
+	c.ErrorPushf(CodeUndefinedHeader, "no status register")
+	return nil
+}
+
+// statusQuery answers one register of the status register in the header
+func statusQuery(ctx *Context, last string, read func(*StatusRegister) uint16) Result {
+	r := ctx.headerStatusRegister(last)
+	if r == nil {
+		return ResErr
+	}
+	ctx.ResultInt32(int32(read(r)))
+	return ResOK
+}
+
+// statusWrite writes one register of the status register in the header
+// from a parameter from 0 to 32767, pushing -222 for others
+func statusWrite(ctx *Context, last string, write func(*StatusRegister, uint16)) Result {
+	r := ctx.headerStatusRegister(last)
+	if r == nil {
+		return ResErr
+	}
+	value, err := ctx.ParamInt32(true)
+	if err != nil {
+		return ResErr
+	}
+	if value < 0 || value > statusMask {
+		ctx.ErrorPush(NewError(CodeDataOutOfRange))
+		return ResErr
+	}
+	write(r, uint16(value))
+	return ResOK
+}
+
+// StatusEventQ implements STATus:<register>[:EVENt]?, which reads and
+// clears the event register
+func StatusEventQ(ctx *Context) Result {
+	return statusQuery(ctx, "EVENt", (*StatusRegister).ReadEvent)
+}
+
+// StatusConditionQ implements STATus:<register>:CONDition?
+func StatusConditionQ(ctx *Context) Result {
+	return statusQuery(ctx, "CONDition", (*StatusRegister).Condition)
+}
+
+// StatusEnable implements STATus:<register>:ENABle <NRf>
+func StatusEnable(ctx *Context) Result {
+	return statusWrite(ctx, "ENABle", (*StatusRegister).SetEnable)
+}
+
+// StatusEnableQ implements STATus:<register>:ENABle?
+func StatusEnableQ(ctx *Context) Result {
+	return statusQuery(ctx, "ENABle", (*StatusRegister).Enable)
+}
+
+// StatusPositiveTransition implements STATus:<register>:PTRansition <NRf>
+func StatusPositiveTransition(ctx *Context) Result {
+	return statusWrite(ctx, "PTRansition", (*StatusRegister).SetPositiveTransition)
+}
+
+// StatusPositiveTransitionQ implements STATus:<register>:PTRansition?
+func StatusPositiveTransitionQ(ctx *Context) Result {
+	return statusQuery(ctx, "PTRansition", (*StatusRegister).PositiveTransition)
+}
+
+// StatusNegativeTransition implements STATus:<register>:NTRansition <NRf>
+func StatusNegativeTransition(ctx *Context) Result {
+	return statusWrite(ctx, "NTRansition", (*StatusRegister).SetNegativeTransition)
+}
+
+// StatusNegativeTransitionQ implements STATus:<register>:NTRansition?
+func StatusNegativeTransitionQ(ctx *Context) Result {
+	return statusQuery(ctx, "NTRansition", (*StatusRegister).NegativeTransition)
+}
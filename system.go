@@ -0,0 +1,84 @@
+package scpi
+
+// SetSystemHooks installs the hooks used by SYSTem:REBoot and
+// SYSTem:FIRMware:UPDate
+func (c *Context) SetSystemHooks(h *SystemHooks) {
+	c.sysHooks = h
+}
+
+// SystemReboot implements SYSTem:REBoot
+func SystemReboot(ctx *Context) Result {
+	if ctx.sysHooks == nil || ctx.sysHooks.Reboot == nil {
+		ctx.ErrorPushf(CodeExecutionError, "reboot not supported")
+		return ResErr
+	}
+	if err := ctx.sysHooks.Reboot(); err != nil {
+		ctx.ErrorPushf(CodeExecutionError, "%v", err)
+		return ResErr
+	}
+	return ResOK
+}
+
+// SystemFirmwareUpdateEnable implements SYSTem:FIRMware:UPDate:ENABle
+// ON|OFF. An update is only accepted while enabled, and each attempt
+// disables it again.
+func SystemFirmwareUpdateEnable(ctx *Context) Result {
+	on, err := ctx.ParamBool(true)
+	if err != nil {
+		return ResErr
+	}
+	ctx.firmwareArmed = on
+	return ResOK
+}
+
+// SystemFirmwareUpdateEnableQ implements SYSTem:FIRMware:UPDate:ENABle?
+func SystemFirmwareUpdateEnableQ(ctx *Context) Result {
+	ctx.ResultBool(ctx.firmwareArmed)
+	return ResOK
+}
+
+// SystemFirmwareUpdate implements SYSTem:FIRMware:UPDate <block>[,<checksum>].
+// The image is rejected with -203 unless updates were enabled first, with
+// -223 if it exceeds SystemHooks.MaxImageSize, and with -230 if
+// ValidateFirmware reports a checksum mismatch. The whole block must fit in
+// the input buffer. The OPERation PROGram bit is set while InstallFirmware
+// runs.
+func SystemFirmwareUpdate(ctx *Context) Result {
+	if !ctx.firmwareArmed {
+		ctx.ErrorPush(NewError(CodeCommandProtected))
+		return ResErr
+	}
+	ctx.firmwareArmed = false
+
+	image, err := ctx.ParamArbitraryBlock(true)
+	if err != nil {
+		return ResErr
+	}
+	checksum, err := ctx.ParamString(false)
+	if err != nil {
+		return ResErr
+	}
+
+	h := ctx.sysHooks
+	if h == nil || h.InstallFirmware == nil {
+		ctx.ErrorPushf(CodeExecutionError, "firmware update not supported")
+		return ResErr
+	}
+	if h.MaxImageSize > 0 && len(image) > h.MaxImageSize {
+		ctx.ErrorPushf(CodeTooMuchData, "image of %d bytes exceeds %d", len(image), h.MaxImageSize)
+		return ResErr
+	}
+	if h.ValidateFirmware != nil {
+		if err := h.ValidateFirmware(image, checksum); err != nil {
+			ctx.ErrorPushf(CodeDataCorruptOrStale, "%v", err)
+			return ResErr
+		}
+	}
+	ctx.OperationStart(OperProgram)
+	defer ctx.OperationComplete(OperProgram)
+	if err := h.InstallFirmware(image); err != nil {
+		ctx.ErrorPushf(CodeExecutionError, "%v", err)
+		return ResErr
+	}
+	return ResOK
+}
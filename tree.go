@@ -0,0 +1,93 @@
+package scpi
+
+import "strings"
+
+// CommandTreeNode is a node of the command tree returned by CommandTree.
+// It carries no callbacks, so it can be marshalled for documentation
+// generators, autocompletion or remote user interfaces.
+type CommandTreeNode struct {
+	Name     string             `json:"name"`               // As written in the pattern, without suffix, e.g. "VOLTage"
+	Short    string             `json:"short"`              // Short form, e.g. "VOLT"
+	Suffix   bool               `json:"suffix,omitempty"`   // Takes a numeric suffix, as OUTPut# or OUTPut[1]
+	Optional bool               `json:"optional,omitempty"` // May be omitted, as [:DC]
+	Set      bool               `json:"set,omitempty"`      // A command ends at this node
+	Query    bool               `json:"query,omitempty"`    // A query ends at this node
+	Children []*CommandTreeNode `json:"children,omitempty"`
+}
+
+// CommandTree returns the registered patterns and aliases merged into a
+// tree of header nodes, in registration order. Nodes spelled the same way
+// in several patterns are merged; a node is Optional if it is optional in
+// any of them. Set and Query mark the last node of a pattern with all its
+// optional nodes included; headers may skip the Optional ones on the way.
+func (c *Context) CommandTree() []*CommandTreeNode {
+	root := &CommandTreeNode{}
+	for _, cmd := range c.table.Load().commands {
+		for _, pattern := range append([]string{cmd.Pattern}, cmd.Aliases...) {
+			root.add(pattern)
+		}
+	}
+	return root.Children
+}
+
+// add merges the nodes of pattern below n
+func (n *CommandTreeNode) add(pattern string) {
+	body := strings.TrimSuffix(pattern, "?")
+	body, _ = suffixDefaults(body)
+
+	node := n
+	depth, start, optional := 0, -1, false
+	emit := func(end int) {
+		if start >= 0 {
+			node = node.child(body[start:end], optional)
+			start = -1
+		}
+	}
+	for i := 0; i < len(body); i++ {
+		switch body[i] {
+		case '[':
+			emit(i)
+			depth++
+		case ']':
+			emit(i)
+			depth--
+		case ':':
+			emit(i)
+		default:
+			if start < 0 {
+				start, optional = i, depth > 0
+			}
+		}
+	}
+	emit(len(body))
+
+	if node == n {
+		return
+	}
+	if strings.HasSuffix(pattern, "?") {
+		node.Query = true
+	} else {
+		node.Set = true
+	}
+}
+
+// child returns the child for the pattern node part, adding it if needed
+func (n *CommandTreeNode) child(part string, optional bool) *CommandTreeNode {
+	name, suffix := strings.CutSuffix(part, "#")
+	for _, child := range n.Children {
+		if child.Name == name && child.Suffix == suffix {
+			child.Optional = child.Optional || optional
+			return child
+		}
+	}
+
+	short := strings.TrimPrefix(name, "=")
+	if !strings.HasPrefix(name, "=") {
+		if i := strings.IndexFunc(short, func(r rune) bool { return r >= 'a' && r <= 'z' }); i >= 0 {
+			short = short[:i]
+		}
+	}
+	child := &CommandTreeNode{Name: name, Short: short, Suffix: suffix, Optional: optional}
+	n.Children = append(n.Children, child)
+	return child
+}
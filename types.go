@@ -1,5 +1,11 @@
 package scpi
 
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 // Result represents the result of SCPI command execution
 type Result int
 
@@ -55,40 +61,233 @@ const (
 type Command struct {
 	Pattern  string
 	Callback func(*Context) Result
-	Tag      int32 // Optional command tag
+	Tag      int32       // Optional command tag
+	Params   []ParamSpec // Parameter schema checked by Validate and read into Arg before Callback runs, unchecked when nil
+	Aliases  []string    // Further patterns running this command, e.g. legacy spellings
+	UserData interface{} // Per-command configuration, e.g. a channel or hardware handle
+
+	// Description is the help text SYSTem:HELP? answers after the pattern
+	// and the parameter signature built from Params
+	Description string
+
+	// Simulate, if set, runs instead of Callback while simulation mode is on,
+	// so the same command table can drive a simulator instead of hardware
+	Simulate func(*Context) Result
+}
+
+// ParamSpec describes one parameter of a command for Validate and Arg
+type ParamSpec struct {
+	Name     string      // Used in diagnostics
+	Kinds    []ParamKind // Accepted kinds, any kind when empty
+	Optional bool        // May be omitted; only trailing parameters can be
+	Units    []Unit      // Units a numeric value is converted to, as by ParamNumberWithUnits
+	Min, Max float64     // Accepted numeric range, also used for MINimum and MAXimum; unchecked when both are zero
+	Choices  []ChoiceDef // Accepted mnemonics, any mnemonic when nil
+}
+
+// Diagnostic is a problem Validate found in a message, with the SCPI error
+// executing the message would be expected to queue
+type Diagnostic struct {
+	Pos     int    // Byte offset in the message
+	Header  string // Composed header of the command, "" if it could not be parsed
+	Code    int16
+	Message string
 }
 
 // Error represents a SCPI error
 type Error struct {
-	Code int16
-	Info string // Device-dependent info
+	Code   int16
+	Info   string // Error message, e.g. "Undefined header"
+	Detail string // Device-dependent info, e.g. the offending header
+
+	// Header and Position locate an error found while parsing: the header
+	// of the command, as received, and the byte offset in the program
+	// message at which the error was found. ErrorPush sets them unless
+	// Header is already set; they stay empty for errors raised elsewhere.
+	Header   string
+	Position int
+	Phase    Phase
 }
 
+// Phase tells where an error was found
+type Phase int
+
+const (
+	PhaseNone    Phase = iota // Outside parsing, e.g. queued by the application
+	PhaseParse                // Parsing a program message: headers and parameters
+	PhaseExecute              // Executing a command callback
+)
+
 // Interface defines the callbacks for SCPI I/O operations
 type Interface struct {
 	Write   func(data []byte) (int, error)
 	Flush   func() error
 	Reset   func() error
 	OnError func(err *Error)
+
+	// OnParseError and OnCommandError, if set, are called after OnError
+	// for errors with Phase PhaseParse and PhaseExecute, so structured
+	// logs can tell malformed input from failing commands. Err.Header
+	// names the command.
+	OnParseError   func(err *Error)
+	OnCommandError func(err *Error)
+
+	// OnSRQ, if set, is called when the master summary status (MSS) of the
+	// status byte changes from 0 to 1, so transports that can assert a
+	// service request (GPIB, VXI-11, HiSLIP) do so. It is called on the
+	// goroutine that changed the status, without locks held.
+	OnSRQ func()
+
+	// End, if set, marks the last byte written as carrying END (EOI) on
+	// transports such as GPIB or USBTMC that can signal it. It is called
+	// after the NL terminating an indefinite-length block response.
+	End func() error
 }
 
 // Context represents the SCPI parser context
 type Context struct {
-	commands      []*Command
+	table         atomic.Pointer[commandTable]
+	tableMu       sync.Mutex
 	iface         *Interface
 	inputBuffer   []byte
 	bufferPos     int
+	overflow      bool // Discarding the rest of a line that overflowed
 	outputCount   int
 	inputCount    int
 	firstOutput   bool
 	cmdError      bool
+	writeErr      error
+	outMu         sync.Mutex
+	outQueue      []byte
+	outQueueOn    bool
+	checkTrailing bool
+	checkMnemonic bool
+	strictForm    bool
 	errorQueue    []*Error
+	errorLimit    int
+	dropOldest    bool
 	currentCmd    *Command
 	currentHeader string
+	errHeader     string
+	errPos        int
+	paramAt       int
+	phase         Phase
+	msgStart      int
 	currentParams []byte
+	args          []Arg
 	paramsPos     int
 	userContext   interface{}
 	idn           [4]string
+	options       []string
+	logRefs       map[Unit]LogReference
+	tempUnit      Unit
+	unitPrefs     map[quantity]Unit
+	personas      []*Personality
+	persona       *Personality
+	scpiVersion   string
+	cmdSetVersion string
+	floatFormat   string
+	maxDepth      int
+	aliasDepth    int
+	terminator    []byte
+	format        DataFormat
+	sysHooks      *SystemHooks
+	firmwareArmed bool
+	powerOn       *PowerOn
+	powerOnType   atomic.Int32
+	psc           atomic.Bool
+	messageID     atomic.Uint64
+	simulate      bool
+	abortMu       sync.Mutex
+	abort         chan struct{}
+	opMu          sync.Mutex
+	opPending     int
+	opBits        [16]int
+	opIdle        chan struct{}
+	opcArmed      bool
+	statusMu      sync.Mutex
+	regs          [regCount]uint16
+	mss           bool
+	rqs           bool
+	operStatus    *StatusRegister
+	quesStatus    *StatusRegister
+	statusRoots   []*StatusRegister
+	macros        map[string]macro
+	macrosOn      bool
+	selfTest      func(ctx *Context) (int32, error)
+	tstTimeout    time.Duration
+}
+
+// Personality bundles the identity and behavior of one instrument model, so
+// a single firmware can emulate several predecessors and switch between them
+// at runtime with SYSTem:PERSona.
+type Personality struct {
+	Name        string     // Mnemonic used with SYSTem:PERSona
+	IDN         [4]string  // Manufacturer, model, serial and version for *IDN?
+	SCPIVersion string     // Reported by SYSTem:VERSion?, "1999.0" when empty
+	FloatFormat string     // fmt verb for ResultFloat/ResultDouble, "%g" when empty
+	Options     []string   // Installed options, e.g. for *OPT?
+	Aliases     []AliasDef // Legacy commands, the first matching one is used
+}
+
+// AliasDef maps a legacy command pattern of a Personality to the pattern of
+// the command it runs
+type AliasDef struct {
+	Pattern string // e.g. "MEASure:DCVolts?"
+	Target  string // e.g. "MEASure:VOLTage:DC?"
+}
+
+// SystemHooks connects the SYSTem:REBoot and SYSTem:FIRMware:UPDate
+// handlers to the instrument. Nil hooks make the corresponding command fail.
+type SystemHooks struct {
+	Reboot func() error // Restarts the instrument, e.g. after its response is flushed
+
+	// ValidateFirmware checks an image against the checksum sent with it,
+	// "" when the host sent none. A nil ValidateFirmware accepts any image.
+	ValidateFirmware func(image []byte, checksum string) error
+
+	// InstallFirmware writes a validated image. The image is a view of the
+	// input buffer, valid only until it returns.
+	InstallFirmware func(image []byte) error
+
+	// MaxImageSize rejects larger images with -223, e.g. to fit the flash
+	// partition. Images always arrive whole in one program message, so the
+	// Context's input buffer size limits them anyway; 0 sets no other limit.
+	MaxImageSize int
+}
+
+// StateStore persists named blobs across power cycles, e.g. in flash or in
+// files. Load returns nil data and no error for a name never saved.
+type StateStore interface {
+	Load(name string) ([]byte, error)
+	Save(name string, data []byte) error
+}
+
+// PowerOnType is the SYSTem:POWeron:TYPE state the instrument starts in
+type PowerOnType int32
+
+const (
+	PowerOnReset   PowerOnType = iota // *RST defaults
+	PowerOnRecall0                    // State saved in slot 0
+	PowerOnLast                       // State when the instrument was last running
+)
+
+// StateMarshaler serializes the instrument state, in place of the Snapshot
+// and Restore functions of PowerOn
+type StateMarshaler interface {
+	MarshalState() ([]byte, error)
+	UnmarshalState(state []byte) error
+}
+
+// PowerOn connects SYSTem:POWeron:TYPE and the *SAV and *RCL slots to the
+// instrument state
+type PowerOn struct {
+	Store    StateStore
+	Reset    func() error             // Applies the *RST defaults
+	Snapshot func() ([]byte, error)   // Serializes the current state
+	Restore  func(state []byte) error // Applies a serialized state
+	State    StateMarshaler           // Used if Snapshot and Restore are nil
+	Slots    int                      // *SAV/*RCL slots from 0, 10 if 0
 }
 
 // ArrayFormat represents the format for array data
@@ -100,6 +299,23 @@ const (
 	FormatLittleEndian ArrayFormat = 2
 )
 
+// DataType is the FORMat[:DATA] type used for array data
+type DataType int
+
+const (
+	DataASCII DataType = iota
+	DataReal
+	DataInteger
+)
+
+// DataFormat holds the FORMat subsystem state consulted by ResultArray and
+// ParamDataArray
+type DataFormat struct {
+	Type    DataType
+	Length  int  // Bits per value for REAL (32, 64) and INTeger (16, 32)
+	Swapped bool // FORMat:BORDer SWAPped, i.e. little-endian
+}
+
 // Unit represents SCPI units
 type Unit int
 
@@ -115,6 +331,16 @@ const (
 	UnitFarad
 	UnitWatt
 	UnitDecibel
+	UnitDBm  // Decibels relative to a reference power, 1 mW by convention
+	UnitDBuV // Decibels relative to a reference voltage, 1 uV by convention
+	UnitKelvin
+	UnitFahrenheit
+	UnitPascal
+	UnitBar
+	UnitPercent
+	UnitPPM
+	UnitDBW // Decibels relative to 1 W
+	UnitDBV // Decibels relative to 1 V
 	// Add more units as needed
 )
 
@@ -125,6 +351,14 @@ type UnitDef struct {
 	Mult float64
 }
 
+// LogReference describes how a logarithmic level converts to a linear unit.
+// Power levels use 10*log10 and field (voltage, current) levels 20*log10.
+type LogReference struct {
+	Unit  Unit    // Linear unit the level converts to
+	Ref   float64 // Linear value corresponding to 0 dB
+	Power bool    // Power quantity (10 dB/decade) rather than field (20 dB/decade)
+}
+
 // ChoiceDef defines a choice option
 type ChoiceDef struct {
 	Name string
@@ -147,6 +381,14 @@ const (
 	NumAuto
 )
 
+// UnitTerm is one factor of a parsed unit suffix. Compound suffixes such as
+// "V/S" yield several terms ({UnitVolt, 1}, {UnitSecond, -1}) and exponents
+// such as "M2" are carried in Exp.
+type UnitTerm struct {
+	Unit Unit
+	Exp  int
+}
+
 // Number represents a numeric parameter with optional unit
 type Number struct {
 	Special bool
@@ -154,6 +396,13 @@ type Number struct {
 	Tag     int32
 	Unit    Unit
 	Base    int8
+	Mult    float64    // Suffix multiplier already applied to Value
+	Terms   []UnitTerm // Parsed suffix terms, nil when no suffix was given
+	Suffix  string     // Suffix as sent, e.g. "MV"; "" when none was given
+
+	// Value and unit as received, before ParamNumberWithUnits converted them
+	RawValue float64
+	RawUnit  Unit
 }
 
 // ChannelListEntry represents a single entry in a SCPI channel list expression.
@@ -170,3 +419,17 @@ type ChannelListEntry struct {
 
 // Parameter is an alias for Token
 type Parameter Token
+
+// ParamKind classifies a Parameter independently of the lexer's TokenType
+type ParamKind int
+
+const (
+	KindNone              ParamKind = iota // Optional parameter not present
+	KindNumeric                            // Decimal numeric, with or without suffix
+	KindNondecimalNumeric                  // #H, #Q or #B numeric
+	KindString                             // Single or double quoted string
+	KindMnemonic                           // Character data, e.g. MINimum or ON
+	KindBlock                              // Arbitrary block
+	KindExpression                         // Expression in parentheses, e.g. a channel list
+	KindInvalid                            // Token that is not program data
+)
@@ -0,0 +1,472 @@
+package scpi
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// suffixMultipliers lists the IEEE 488.2 suffix multiplier mnemonics.
+// Two-letter multipliers come first so that "MA" (mega) is tried before "M".
+var suffixMultipliers = []UnitDef{
+	{Name: "EX", Mult: 1e18},
+	{Name: "PE", Mult: 1e15},
+	{Name: "MA", Mult: 1e6},
+	{Name: "T", Mult: 1e12},
+	{Name: "G", Mult: 1e9},
+	{Name: "K", Mult: 1e3},
+	{Name: "M", Mult: 1e-3},
+	{Name: "U", Mult: 1e-6},
+	{Name: "N", Mult: 1e-9},
+	{Name: "P", Mult: 1e-12},
+	{Name: "F", Mult: 1e-15},
+	{Name: "A", Mult: 1e-18},
+}
+
+// baseUnits lists the unit mnemonics recognized without a multiplier
+var baseUnits = []UnitDef{
+	{Name: "V", Unit: UnitVolt, Mult: 1},
+	{Name: "A", Unit: UnitAmper, Mult: 1},
+	{Name: "OHM", Unit: UnitOhm, Mult: 1},
+	{Name: "HZ", Unit: UnitHertz, Mult: 1},
+	{Name: "CEL", Unit: UnitCelsius, Mult: 1},
+	{Name: "FAR", Unit: UnitFahrenheit, Mult: 1},
+	{Name: "K", Unit: UnitKelvin, Mult: 1},
+	{Name: "S", Unit: UnitSecond, Mult: 1},
+	{Name: "M", Unit: UnitMeter, Mult: 1},
+	{Name: "F", Unit: UnitFarad, Mult: 1},
+	{Name: "W", Unit: UnitWatt, Mult: 1},
+	{Name: "DB", Unit: UnitDecibel, Mult: 1},
+	{Name: "DBM", Unit: UnitDBm, Mult: 1},
+	{Name: "DBUV", Unit: UnitDBuV, Mult: 1},
+	{Name: "DBW", Unit: UnitDBW, Mult: 1},
+	{Name: "DBV", Unit: UnitDBV, Mult: 1},
+	{Name: "PAL", Unit: UnitPascal, Mult: 1},
+	{Name: "BAR", Unit: UnitBar, Mult: 1},
+	{Name: "PCT", Unit: UnitPercent, Mult: 1},
+	{Name: "PPM", Unit: UnitPPM, Mult: 1},
+}
+
+// conventionalUnits lists suffixes whose meaning differs from the strict
+// multiplier grammar by convention: "MHZ" and "MOHM" denote mega, not milli.
+var conventionalUnits = []UnitDef{
+	{Name: "MHZ", Unit: UnitHertz, Mult: 1e6},
+	{Name: "MOHM", Unit: UnitOhm, Mult: 1e6},
+}
+
+// Conventional references for the logarithmic units, for use with
+// SetLogReference
+var (
+	DBmReference  = LogReference{Unit: UnitWatt, Ref: 1e-3, Power: true}
+	DBuVReference = LogReference{Unit: UnitVolt, Ref: 1e-6, Power: false}
+	DBWReference  = LogReference{Unit: UnitWatt, Ref: 1, Power: true}
+	DBVReference  = LogReference{Unit: UnitVolt, Ref: 1, Power: false}
+)
+
+// logUnits maps each logarithmic unit with a fixed reference to it
+var logUnits = map[Unit]LogReference{
+	UnitDBm:  DBmReference,
+	UnitDBuV: DBuVReference,
+	UnitDBW:  DBWReference,
+	UnitDBV:  DBVReference,
+}
+
+// linearUnit places a unit on the scale of its quantity's coherent unit
+type linearUnit struct {
+	Quantity quantity
+	Factor   float64 // Value of one unit in the coherent unit
+}
+
+// linearUnits is the conversion table for units related by a factor
+var linearUnits = map[Unit]linearUnit{
+	UnitVolt:    {quantityVoltage, 1},
+	UnitAmper:   {quantityCurrent, 1},
+	UnitOhm:     {quantityResistance, 1},
+	UnitHertz:   {quantityFrequency, 1},
+	UnitSecond:  {quantityTime, 1},
+	UnitMeter:   {quantityLength, 1},
+	UnitFarad:   {quantityCapacitance, 1},
+	UnitWatt:    {quantityPower, 1},
+	UnitPascal:  {quantityPressure, 1},
+	UnitBar:     {quantityPressure, 1e5},
+	UnitPercent: {quantityRatio, 1e-2},
+	UnitPPM:     {quantityRatio, 1e-6},
+}
+
+// specialNumbers maps the character data accepted by ParamNumber to the
+// corresponding SpecialNumber tags
+var specialNumbers = []ChoiceDef{
+	{Name: "MINimum", Tag: int32(NumMin)},
+	{Name: "MAXimum", Tag: int32(NumMax)},
+	{Name: "DEFault", Tag: int32(NumDef)},
+	{Name: "UP", Tag: int32(NumUp)},
+	{Name: "DOWN", Tag: int32(NumDown)},
+	{Name: "NAN", Tag: int32(NumNaN)},
+	{Name: "INFinity", Tag: int32(NumInf)},
+	{Name: "NINF", Tag: int32(NumNInf)},
+	{Name: "AUTO", Tag: int32(NumAuto)},
+}
+
+// lookupUnitDef finds a unit definition by its upper-case name
+func lookupUnitDef(defs []UnitDef, name string) (UnitDef, bool) {
+	for _, def := range defs {
+		if def.Name == name {
+			return def, true
+		}
+	}
+	return UnitDef{}, false
+}
+
+// lookupUnitElement resolves a single suffix unit element without its
+// exponent, e.g. "KOHM" or "MV", to a unit and multiplier.
+func lookupUnitElement(name string) (Unit, float64, bool) {
+	if def, ok := lookupUnitDef(conventionalUnits, name); ok {
+		return def.Unit, def.Mult, true
+	}
+	if def, ok := lookupUnitDef(baseUnits, name); ok {
+		return def.Unit, def.Mult, true
+	}
+	for _, m := range suffixMultipliers {
+		if !strings.HasPrefix(name, m.Name) {
+			continue
+		}
+		if def, ok := lookupUnitDef(baseUnits, name[len(m.Name):]); ok {
+			return def.Unit, m.Mult, true
+		}
+	}
+	return UnitNone, 0, false
+}
+
+// String returns the suffix mnemonic of the unit, e.g. "V" or "OHM", or ""
+// for UnitNone
+func (u Unit) String() string {
+	for _, def := range baseUnits {
+		if def.Unit == u {
+			return def.Name
+		}
+	}
+	if u == UnitNone {
+		return ""
+	}
+	return fmt.Sprintf("Unit(%d)", int(u))
+}
+
+// unitList formats units as a comma-separated suffix list for error
+// messages
+func unitList(units []Unit) string {
+	names := make([]string, len(units))
+	for i, u := range units {
+		names[i] = u.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// parseSuffix parses suffix program data such as "MV", "V/S", "M2" or "/S"
+// into its combined multiplier and unit terms.
+func parseSuffix(suffix string) (float64, []UnitTerm, error) {
+	s := strings.ToUpper(strings.TrimSpace(suffix))
+	if s == "" {
+		return 0, nil, fmt.Errorf("empty suffix")
+	}
+
+	mult := 1.0
+	sign := 1
+	if s[0] == '/' {
+		sign = -1
+		s = s[1:]
+	}
+
+	var terms []UnitTerm
+	for {
+		end := strings.IndexAny(s, "/.")
+		elem := s
+		if end >= 0 {
+			elem = s[:end]
+		}
+
+		// Split element into unit name and optional exponent
+		nameEnd := 0
+		for nameEnd < len(elem) && isAlpha(elem[nameEnd]) {
+			nameEnd++
+		}
+		name := elem[:nameEnd]
+
+		exp := 1
+		if nameEnd < len(elem) {
+			e, err := strconv.Atoi(elem[nameEnd:])
+			if err != nil {
+				return 0, nil, fmt.Errorf("invalid suffix exponent: %s", elem)
+			}
+			exp = e
+		}
+		exp *= sign
+
+		unit, m, ok := lookupUnitElement(name)
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown suffix unit: %s", name)
+		}
+
+		mult *= math.Pow(m, float64(exp))
+		terms = append(terms, UnitTerm{Unit: unit, Exp: exp})
+
+		if end < 0 {
+			break
+		}
+
+		sign = 1
+		if s[end] == '/' {
+			sign = -1
+		}
+		s = s[end+1:]
+	}
+
+	return mult, terms, nil
+}
+
+// SetLogReference registers the reference used by ParamNumberWithUnits to
+// convert levels given in the logarithmic unit (e.g. UnitDBm) to linear
+// units. Without a reference such levels are returned unconverted.
+func (c *Context) SetLogReference(unit Unit, ref LogReference) {
+	if c.logRefs == nil {
+		c.logRefs = make(map[Unit]LogReference)
+	}
+	c.logRefs[unit] = ref
+}
+
+// toLinear converts a logarithmic level to the reference's linear unit
+func (r LogReference) toLinear(level float64) float64 {
+	if r.Power {
+		return r.Ref * math.Pow(10, level/10)
+	}
+	return r.Ref * math.Pow(10, level/20)
+}
+
+// toLevel converts a value in the reference's linear unit to a level
+func (r LogReference) toLevel(value float64) float64 {
+	if r.Power {
+		return 10 * math.Log10(value/r.Ref)
+	}
+	return 20 * math.Log10(value/r.Ref)
+}
+
+// SetTemperatureUnit selects the unit ParamNumberWithUnits normalizes
+// temperatures to: UnitCelsius (the default), UnitKelvin or UnitFahrenheit
+func (c *Context) SetTemperatureUnit(unit Unit) {
+	c.tempUnit = unit
+}
+
+// TemperatureUnit returns the unit temperatures are normalized to
+func (c *Context) TemperatureUnit() Unit {
+	if c.tempUnit == UnitNone {
+		return UnitCelsius
+	}
+	return c.tempUnit
+}
+
+// quantity groups the units that measure the same thing and can be
+// converted into each other
+type quantity int
+
+const (
+	quantityNone quantity = iota
+	quantityTemperature
+	quantityPower
+	quantityVoltage
+	quantityCurrent
+	quantityResistance
+	quantityFrequency
+	quantityTime
+	quantityLength
+	quantityCapacitance
+	quantityPressure
+	quantityRatio
+)
+
+// quantityOf returns the quantity unit measures
+func quantityOf(unit Unit) quantity {
+	if isTemperature(unit) {
+		return quantityTemperature
+	}
+	if ref, ok := logUnits[unit]; ok {
+		unit = ref.Unit
+	}
+	return linearUnits[unit].Quantity
+}
+
+// ConvertUnit converts value between two units of the same quantity, e.g.
+// UnitBar to UnitPascal, UnitFahrenheit to UnitKelvin or UnitDBm to UnitWatt.
+// Logarithmic units use their conventional references; UnitDecibel has none
+// and only converts to itself.
+func ConvertUnit(value float64, from, to Unit) (float64, error) {
+	if from == to {
+		return value, nil
+	}
+	if isTemperature(from) && isTemperature(to) {
+		return convertTemperature(value, from, to), nil
+	}
+
+	if ref, ok := logUnits[from]; ok {
+		value, from = ref.toLinear(value), ref.Unit
+	}
+	toRef, toLog := logUnits[to]
+	linearTo := to
+	if toLog {
+		linearTo = toRef.Unit
+	}
+
+	f, okFrom := linearUnits[from]
+	t, okTo := linearUnits[linearTo]
+	if !okFrom || !okTo || f.Quantity != t.Quantity {
+		return 0, fmt.Errorf("cannot convert unit %d to %d", from, to)
+	}
+
+	value = value * f.Factor / t.Factor
+	if toLog {
+		value = toRef.toLevel(value)
+	}
+	return value, nil
+}
+
+// SetUnitPreference selects unit as the preferred unit of its quantity, as
+// UNIT:TEMPerature and UNIT:POWer do. Values received without a suffix by
+// ParamNumberWithUnits are taken to be in the preferred unit, and
+// ResultNumberWithUnit converts responses to it.
+func (c *Context) SetUnitPreference(unit Unit) {
+	q := quantityOf(unit)
+	if q == quantityNone {
+		return
+	}
+	if c.unitPrefs == nil {
+		c.unitPrefs = make(map[quantity]Unit)
+	}
+	c.unitPrefs[q] = unit
+}
+
+// UnitPreference returns the preferred unit for the quantity unit measures,
+// or unit itself when no preference was set
+func (c *Context) UnitPreference(unit Unit) Unit {
+	if pref, ok := c.unitPrefs[quantityOf(unit)]; ok {
+		return pref
+	}
+	return unit
+}
+
+// convertUnit converts value between two units of the same quantity.
+// Conversions to and from logarithmic units need the reference registered
+// with SetLogReference; all others follow ConvertUnit.
+func (c *Context) convertUnit(value float64, from, to Unit) (float64, bool) {
+	if ref, ok := c.logRefs[from]; ok && ref.Unit == to {
+		return ref.toLinear(value), true
+	}
+	if ref, ok := c.logRefs[to]; ok && ref.Unit == from {
+		return ref.toLevel(value), true
+	}
+	if _, ok := logUnits[from]; ok && from != to {
+		return value, false
+	}
+	if _, ok := logUnits[to]; ok && from != to {
+		return value, false
+	}
+	v, err := ConvertUnit(value, from, to)
+	if err != nil {
+		return value, false
+	}
+	return v, true
+}
+
+// ResultNumberWithUnit writes value, given in unit, converted to the
+// preferred unit of its quantity. The value is written unconverted when no
+// conversion is known.
+func (c *Context) ResultNumberWithUnit(value float64, unit Unit) error {
+	value, _ = c.convertUnit(value, unit, c.UnitPreference(unit))
+	return c.ResultDouble(value)
+}
+
+// temperatureUnits and powerUnits map the UNIT subsystem mnemonics to units
+var (
+	temperatureUnits = []ChoiceDef{
+		{Name: "C", Tag: int32(UnitCelsius)},
+		{Name: "CEL", Tag: int32(UnitCelsius)},
+		{Name: "F", Tag: int32(UnitFahrenheit)},
+		{Name: "FAR", Tag: int32(UnitFahrenheit)},
+		{Name: "K", Tag: int32(UnitKelvin)},
+	}
+	powerUnits = []ChoiceDef{
+		{Name: "W", Tag: int32(UnitWatt)},
+		{Name: "DBM", Tag: int32(UnitDBm)},
+	}
+)
+
+// UnitTemperature implements UNIT:TEMPerature C|CEL|F|FAR|K
+func UnitTemperature(ctx *Context) Result {
+	return unitPreferenceCommand(ctx, temperatureUnits)
+}
+
+// UnitTemperatureQ implements UNIT:TEMPerature?
+func UnitTemperatureQ(ctx *Context) Result {
+	return unitPreferenceQuery(ctx, temperatureUnits, UnitCelsius)
+}
+
+// UnitPower implements UNIT:POWer W|DBM. Conversions to and from DBM need
+// a reference registered with SetLogReference(UnitDBm, DBmReference).
+func UnitPower(ctx *Context) Result {
+	return unitPreferenceCommand(ctx, powerUnits)
+}
+
+// UnitPowerQ implements UNIT:POWer?
+func UnitPowerQ(ctx *Context) Result {
+	return unitPreferenceQuery(ctx, powerUnits, UnitWatt)
+}
+
+// unitPreferenceCommand sets the preference from a choice parameter
+func unitPreferenceCommand(ctx *Context, choices []ChoiceDef) Result {
+	tag, err := ctx.ParamChoice(choices, true)
+	if err != nil {
+		return ResErr
+	}
+	ctx.SetUnitPreference(Unit(tag))
+	return ResOK
+}
+
+// unitPreferenceQuery reports the preference using the last (long) mnemonic
+// listed for it
+func unitPreferenceQuery(ctx *Context, choices []ChoiceDef, def Unit) Result {
+	pref := ctx.UnitPreference(def)
+	name := ""
+	for _, choice := range choices {
+		if Unit(choice.Tag) == pref {
+			name = choice.Name
+		}
+	}
+	ctx.ResultMnemonic(name)
+	return ResOK
+}
+
+// isTemperature reports whether unit is a temperature scale
+func isTemperature(unit Unit) bool {
+	return unit == UnitCelsius || unit == UnitKelvin || unit == UnitFahrenheit
+}
+
+// convertTemperature converts value between temperature scales
+func convertTemperature(value float64, from, to Unit) float64 {
+	if from == to {
+		return value
+	}
+
+	kelvin := value
+	switch from {
+	case UnitCelsius:
+		kelvin = value + 273.15
+	case UnitFahrenheit:
+		kelvin = (value-32)*5/9 + 273.15
+	}
+
+	switch to {
+	case UnitCelsius:
+		return kelvin - 273.15
+	case UnitFahrenheit:
+		return (kelvin-273.15)*9/5 + 32
+	}
+	return kelvin
+}
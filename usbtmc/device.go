@@ -0,0 +1,347 @@
+// Package usbtmc implements the device side of USBTMC with the USB488
+// subclass, bridging a USB instrument interface to a Context. Device
+// handles the Bulk-OUT and Bulk-IN messages and the class-specific control
+// requests; ServeFunctionFS runs it on a Linux FunctionFS gadget function.
+//
+// DEV_DEP_MSG_OUT messages feed the Context, REQUEST_DEV_DEP_MSG_IN drains
+// its output queue, TRIGGER runs *TRG, READ_STATUS_BYTE serial polls it and
+// INITIATE_CLEAR device-clears it. Service requests are notified on the
+// interrupt endpoint when there is one.
+package usbtmc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// Bulk message IDs (USBTMC 3.2, USB488 3.2)
+const (
+	msgDevDepOut      = 1
+	msgRequestDevDep  = 2
+	msgDevDepIn       = 2
+	msgTrigger        = 128
+	bulkHeaderSize    = 12
+	attrEOM           = 1
+	maxTransferLength = 1 << 20
+)
+
+// Class-specific requests (USBTMC 4.2, USB488 4.3)
+const (
+	reqInitiateAbortBulkOut    = 1
+	reqCheckAbortBulkOutStatus = 2
+	reqInitiateAbortBulkIn     = 3
+	reqCheckAbortBulkInStatus  = 4
+	reqInitiateClear           = 5
+	reqCheckClearStatus        = 6
+	reqGetCapabilities         = 7
+	reqIndicatorPulse          = 64
+	reqReadStatusByte          = 128
+	reqRenControl              = 160
+	reqGoToLocal               = 161
+	reqLocalLockout            = 162
+)
+
+// USBTMC_status values
+const (
+	statusSuccess               = 0x01
+	statusFailed                = 0x80
+	statusTransferNotInProgress = 0x81
+)
+
+// ErrStall is returned by Control for a request the device does not
+// support; the transport answers it with a STALL handshake
+var ErrStall = errors.New("usbtmc: request not supported")
+
+// Setup is the setup packet of a control request
+type Setup struct {
+	RequestType uint8
+	Request     uint8
+	Value       uint16
+	Index       uint16
+	Length      uint16
+}
+
+// Options configures a Device
+type Options struct {
+	BufferSize int                     // Input buffer size, 1024 when zero
+	Indicator  func()                  // Blinks an activity indicator for INDICATOR_PULSE, unsupported when nil
+	Setup      func(ctx *scpi.Context) // Called once on the Context, e.g. to SetIDN
+}
+
+// Device bridges USBTMC transfers to a Context
+type Device struct {
+	opts Options
+	ctx  *scpi.Context
+
+	mu      sync.Mutex // Serializes access to ctx and the transfer state
+	outTag  byte       // bTag of the current or last DEV_DEP_MSG_OUT
+	outLeft uint32     // Bytes of the current DEV_DEP_MSG_OUT still to come
+	outEOM  bool
+	outMsg  []byte // Data of the current DEV_DEP_MSG_OUT
+	inReq   *inRequest
+	inSent  uint32 // Data bytes in the last DEV_DEP_MSG_IN
+	remote  bool
+	lockout bool
+	intrMu  sync.Mutex
+	intr    io.Writer // Interrupt-IN endpoint, nil when there is none
+}
+
+// inRequest is a REQUEST_DEV_DEP_MSG_IN waiting for response data
+type inRequest struct {
+	tag  byte
+	size uint32
+}
+
+// New creates a device for commands. Its Context keeps responses in the
+// output queue for REQUEST_DEV_DEP_MSG_IN.
+func New(commands []*scpi.Command, opts Options) *Device {
+	if opts.BufferSize == 0 {
+		opts.BufferSize = 1024
+	}
+
+	d := &Device{opts: opts}
+	d.ctx = scpi.NewContext(commands, &scpi.Interface{
+		OnSRQ: func() { go d.serviceRequest() },
+	}, opts.BufferSize)
+	d.ctx.SetOutputQueue(true)
+	if opts.Setup != nil {
+		opts.Setup(d.ctx)
+	}
+	return d
+}
+
+// Context returns the Context commands are executed on
+func (d *Device) Context() *scpi.Context {
+	return d.ctx
+}
+
+// SetInterrupt sets the interrupt-IN endpoint on which service requests and
+// READ_STATUS_BYTE answers are sent, or nil for none
+func (d *Device) SetInterrupt(w io.Writer) {
+	d.intrMu.Lock()
+	d.intr = w
+	d.intrMu.Unlock()
+}
+
+// Remote returns the remote and local lockout states set by REN_CONTROL,
+// GO_TO_LOCAL and LOCAL_LOCKOUT
+func (d *Device) Remote() (remote, lockout bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.remote, d.lockout
+}
+
+// ServeBulk handles the Bulk-OUT transfers read from out, one per Read,
+// and sends Bulk-IN transfers to in, until out fails. A message's data may
+// continue in the following transfers. A REQUEST_DEV_DEP_MSG_IN is answered
+// once the output queue holds data.
+func (d *Device) ServeBulk(out io.Reader, in io.Writer) error {
+	d.mu.Lock()
+	d.outLeft, d.outMsg, d.inReq = 0, nil, nil
+	d.mu.Unlock()
+
+	buf := make([]byte, bulkHeaderSize+maxTransferLength)
+	for {
+		n, err := out.Read(buf)
+		if n > 0 {
+			if err := d.transfer(buf[:n], in); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// transfer handles one Bulk-OUT transfer. Transfers with a malformed
+// header are ignored.
+func (d *Device) transfer(data []byte, in io.Writer) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.outLeft == 0 {
+		if len(data) < bulkHeaderSize || data[1] != ^data[2] || data[1] == 0 {
+			return nil
+		}
+		id, tag := data[0], data[1]
+		size := binary.LittleEndian.Uint32(data[4:])
+		switch id {
+		case msgDevDepOut:
+			if size == 0 || size > maxTransferLength {
+				return nil
+			}
+			d.outTag, d.outLeft, d.outEOM = tag, size, data[8]&attrEOM != 0
+		case msgRequestDevDep:
+			d.inReq = &inRequest{tag: tag, size: size}
+		case msgTrigger:
+			d.ctx.Input([]byte("*TRG\n"))
+		}
+		data = data[bulkHeaderSize:]
+	}
+
+	if d.outLeft > 0 {
+		if uint32(len(data)) > d.outLeft {
+			data = data[:d.outLeft] // Alignment bytes
+		}
+		d.outMsg = append(d.outMsg, data...)
+		d.outLeft -= uint32(len(data))
+		if d.outLeft == 0 {
+			d.ctx.Input(d.outMsg)
+			if d.outEOM {
+				d.ctx.Input(nil)
+			}
+			d.outMsg = nil
+		}
+	}
+	return d.sendResponse(in)
+}
+
+// sendResponse answers a waiting REQUEST_DEV_DEP_MSG_IN when there is
+// response data, setting EOM once the output queue is drained; mu must be
+// held
+func (d *Device) sendResponse(in io.Writer) error {
+	if d.inReq == nil || d.ctx.OutputPending() == 0 {
+		return nil
+	}
+	req := d.inReq
+	d.inReq = nil
+
+	data := d.ctx.ReadOutput(int(req.size))
+	msg := make([]byte, bulkHeaderSize, bulkHeaderSize+len(data)+3)
+	msg[0], msg[1], msg[2] = msgDevDepIn, req.tag, ^req.tag
+	binary.LittleEndian.PutUint32(msg[4:], uint32(len(data)))
+	if d.ctx.OutputPending() == 0 {
+		msg[8] = attrEOM
+	}
+	msg = append(msg, data...)
+	for len(msg)%4 != 0 {
+		msg = append(msg, 0)
+	}
+	d.inSent = uint32(len(data))
+	_, err := in.Write(msg)
+	return err
+}
+
+// Control answers a class-specific control request addressed to the
+// USBTMC interface or its bulk endpoints, returning the data stage, or
+// ErrStall for other requests
+func (d *Device) Control(req Setup) ([]byte, error) {
+	if req.RequestType&0xE0 != 0xA0 { // Device-to-host class request
+		return nil, ErrStall
+	}
+
+	switch req.Request {
+	case reqGetCapabilities:
+		caps := make([]byte, 24)
+		caps[0] = statusSuccess
+		binary.LittleEndian.PutUint16(caps[2:], 0x0100) // bcdUSBTMC
+		if d.opts.Indicator != nil {
+			caps[4] = 1 << 2
+		}
+		binary.LittleEndian.PutUint16(caps[12:], 0x0100) // bcdUSB488
+		caps[14] = 1<<2 | 1<<1 | 1<<0                    // USB488.2, REN/GTL/LLO, TRIGGER
+		caps[15] = 1<<3 | 1<<2 | 1<<1 | 1<<0             // SCPI, SR1, RL1, DT1
+		return caps, nil
+
+	case reqIndicatorPulse:
+		if d.opts.Indicator == nil {
+			return []byte{statusFailed}, nil
+		}
+		d.opts.Indicator()
+		return []byte{statusSuccess}, nil
+
+	case reqReadStatusByte:
+		return d.readStatusByte(byte(req.Value)), nil
+
+	case reqInitiateClear:
+		// Abort first: a running command holds mu until it returns
+		d.ctx.Abort()
+		d.mu.Lock()
+		d.ctx.DeviceClear()
+		d.outLeft, d.outMsg, d.inReq = 0, nil, nil
+		d.mu.Unlock()
+		return []byte{statusSuccess}, nil
+
+	case reqCheckClearStatus:
+		return []byte{statusSuccess, 0}, nil
+
+	case reqInitiateAbortBulkOut:
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.outLeft == 0 || d.outTag != byte(req.Value) {
+			return []byte{statusTransferNotInProgress, d.outTag}, nil
+		}
+		d.outLeft, d.outMsg = 0, nil
+		return []byte{statusSuccess, d.outTag}, nil
+
+	case reqCheckAbortBulkOutStatus:
+		return []byte{statusSuccess, 0, 0, 0, 0, 0, 0, 0}, nil
+
+	case reqInitiateAbortBulkIn:
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.inReq == nil || d.inReq.tag != byte(req.Value) {
+			return []byte{statusTransferNotInProgress, byte(req.Value)}, nil
+		}
+		d.inReq = nil
+		return []byte{statusSuccess, byte(req.Value)}, nil
+
+	case reqCheckAbortBulkInStatus:
+		d.mu.Lock()
+		sent := d.inSent
+		d.mu.Unlock()
+		resp := []byte{statusSuccess, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(resp[4:], sent)
+		return resp, nil
+
+	case reqRenControl, reqGoToLocal, reqLocalLockout:
+		d.mu.Lock()
+		switch req.Request {
+		case reqRenControl:
+			d.remote = req.Value&1 != 0
+			if !d.remote {
+				d.lockout = false
+			}
+		case reqGoToLocal:
+			d.remote = false
+		case reqLocalLockout:
+			d.lockout = true
+		}
+		d.mu.Unlock()
+		return []byte{statusSuccess}, nil
+	}
+	return nil, ErrStall
+}
+
+// readStatusByte answers READ_STATUS_BYTE with a serial poll. With an
+// interrupt endpoint the status byte is sent there, tagged, and the
+// control response carries 0 in its place (USB488 4.3.1).
+func (d *Device) readStatusByte(tag byte) []byte {
+	stb := d.ctx.SerialPoll()
+
+	d.intrMu.Lock()
+	defer d.intrMu.Unlock()
+	if d.intr == nil {
+		return []byte{statusSuccess, tag, stb}
+	}
+	d.intr.Write([]byte{0x80 | tag&0x7F, stb})
+	return []byte{statusSuccess, tag, 0}
+}
+
+// serviceRequest sends an SRQ notification on the interrupt endpoint. It
+// is called whenever the master summary status of the Context's status
+// byte is set.
+func (d *Device) serviceRequest() {
+	stb := byte(d.ctx.RegGet(scpi.RegSTB))
+
+	d.intrMu.Lock()
+	defer d.intrMu.Unlock()
+	if d.intr != nil {
+		d.intr.Write([]byte{0x81, stb})
+	}
+}
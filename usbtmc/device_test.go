@@ -0,0 +1,227 @@
+package usbtmc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+func testDevice(opts Options) *Device {
+	return New([]*scpi.Command{
+		{Pattern: "*IDN?", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.ResultText("ACME")
+			return scpi.ResOK
+		}},
+		{Pattern: "*TRG", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.RegSet(scpi.RegESR, scpi.EsrURQ)
+			return scpi.ResOK
+		}},
+		{Pattern: "*ESR?", Callback: scpi.CoreEsrQ},
+	}, opts)
+}
+
+// bulkHeader encodes a Bulk-OUT header
+func bulkHeader(id, tag byte, size uint32, attr byte) []byte {
+	h := make([]byte, bulkHeaderSize)
+	h[0], h[1], h[2] = id, tag, ^tag
+	binary.LittleEndian.PutUint32(h[4:], size)
+	h[8] = attr
+	return h
+}
+
+// devDepOut encodes a DEV_DEP_MSG_OUT transfer with EOM set
+func devDepOut(tag byte, data string) []byte {
+	msg := append(bulkHeader(msgDevDepOut, tag, uint32(len(data)), attrEOM), data...)
+	for len(msg)%4 != 0 {
+		msg = append(msg, 0)
+	}
+	return msg
+}
+
+// bulk runs ServeBulk on pipes and returns the Bulk-OUT writer and the
+// Bulk-IN reader
+func bulk(t *testing.T, d *Device) (*io.PipeWriter, *io.PipeReader) {
+	t.Helper()
+
+	outR, outW := io.Pipe()
+	inR, inW := io.Pipe()
+	go d.ServeBulk(outR, inW)
+	t.Cleanup(func() {
+		outW.Close()
+		inR.Close()
+	})
+	return outW, inR
+}
+
+// readIn reads a DEV_DEP_MSG_IN and returns its tag, EOM and data
+func readIn(t *testing.T, r io.Reader) (byte, bool, string) {
+	t.Helper()
+
+	done := make(chan struct{})
+	var buf [bulkHeaderSize + 256]byte
+	var n int
+	var err error
+	go func() {
+		n, err = r.Read(buf[:])
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no DEV_DEP_MSG_IN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < bulkHeaderSize || n%4 != 0 || buf[0] != msgDevDepIn || buf[1] != ^buf[2] {
+		t.Fatalf("malformed DEV_DEP_MSG_IN % x", buf[:n])
+	}
+	size := binary.LittleEndian.Uint32(buf[4:])
+	return buf[1], buf[8]&attrEOM != 0, string(buf[bulkHeaderSize : bulkHeaderSize+int(size)])
+}
+
+func TestBulk(t *testing.T) {
+	d := testDevice(Options{})
+	out, in := bulk(t, d)
+
+	out.Write(devDepOut(1, "*IDN?\n"))
+	out.Write(bulkHeader(msgRequestDevDep, 2, 4, 0))
+	if tag, eom, data := readIn(t, in); tag != 2 || eom || data != `"ACM` {
+		t.Errorf("DEV_DEP_MSG_IN = %d,%v,%q, want 2,false,%q", tag, eom, data, `"ACM`)
+	}
+	out.Write(bulkHeader(msgRequestDevDep, 3, 256, 0))
+	if tag, eom, data := readIn(t, in); tag != 3 || !eom || data != "E\"\n" {
+		t.Errorf("DEV_DEP_MSG_IN = %d,%v,%q, want 3,true,%q", tag, eom, data, "E\"\n")
+	}
+
+	// A request made before the query is answered once there is output
+	out.Write(bulkHeader(msgRequestDevDep, 4, 256, 0))
+	out.Write(devDepOut(5, "*IDN?\n"))
+	if tag, eom, data := readIn(t, in); tag != 4 || !eom || data != "\"ACME\"\n" {
+		t.Errorf("DEV_DEP_MSG_IN = %d,%v,%q, want 4,true,%q", tag, eom, data, "\"ACME\"\n")
+	}
+
+	// TRIGGER runs *TRG
+	out.Write(bulkHeader(msgTrigger, 6, 0, 0))
+	out.Write(devDepOut(7, "*ESR?\n"))
+	out.Write(bulkHeader(msgRequestDevDep, 8, 256, 0))
+	if _, _, data := readIn(t, in); data != fmt.Sprintln(int(scpi.EsrURQ)) {
+		t.Errorf("*ESR? after TRIGGER = %q, want %q", data, fmt.Sprintln(int(scpi.EsrURQ)))
+	}
+}
+
+func TestControl(t *testing.T) {
+	d := testDevice(Options{})
+	in := func(request byte, value uint16) Setup {
+		return Setup{RequestType: 0xA1, Request: request, Value: value, Length: 0x40}
+	}
+
+	caps, err := d.Control(in(reqGetCapabilities, 0))
+	if err != nil || len(caps) != 24 || caps[0] != statusSuccess || caps[4] != 0 || caps[15]&(1<<3) == 0 {
+		t.Errorf("GET_CAPABILITIES = % x, %v", caps, err)
+	}
+	if resp, _ := d.Control(in(reqIndicatorPulse, 0)); fmt.Sprint(resp) != fmt.Sprint([]byte{statusFailed}) {
+		t.Errorf("INDICATOR_PULSE without an indicator = % x", resp)
+	}
+	if _, err := d.Control(Setup{RequestType: 0x80, Request: 6}); err != ErrStall {
+		t.Errorf("standard request = %v, want ErrStall", err)
+	}
+	if _, err := d.Control(in(99, 0)); err != ErrStall {
+		t.Errorf("unknown request = %v, want ErrStall", err)
+	}
+
+	// READ_STATUS_BYTE answers in the control response without an
+	// interrupt endpoint and clears RQS
+	ctx := d.Context()
+	ctx.RegSet(scpi.RegSRE, scpi.StbMAV)
+	ctx.RegSet(scpi.RegSTB, scpi.StbMAV)
+	want := []byte{statusSuccess, 2, byte(scpi.StbMAV | scpi.StbMSS)}
+	if resp, _ := d.Control(in(reqReadStatusByte, 2)); fmt.Sprint(resp) != fmt.Sprint(want) {
+		t.Errorf("READ_STATUS_BYTE = %v, want %v", resp, want)
+	}
+
+	// With one the status byte is sent as an interrupt
+	r, w := io.Pipe()
+	defer r.Close()
+	d.SetInterrupt(w)
+	got := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 2)
+		io.ReadFull(r, buf)
+		got <- buf
+	}()
+	want = []byte{statusSuccess, 3, 0}
+	if resp, _ := d.Control(in(reqReadStatusByte, 3)); fmt.Sprint(resp) != fmt.Sprint(want) {
+		t.Errorf("READ_STATUS_BYTE = %v, want %v", resp, want)
+	}
+	if intr, want := <-got, []byte{0x83, byte(scpi.StbMAV)}; fmt.Sprint(intr) != fmt.Sprint(want) {
+		t.Errorf("interrupt = %v, want %v", intr, want)
+	}
+
+	// REN_CONTROL, LOCAL_LOCKOUT and GO_TO_LOCAL
+	d.Control(in(reqRenControl, 1))
+	d.Control(in(reqLocalLockout, 0))
+	if remote, lockout := d.Remote(); !remote || !lockout {
+		t.Errorf("Remote() = %v,%v, want true,true", remote, lockout)
+	}
+	d.Control(in(reqGoToLocal, 0))
+	if remote, lockout := d.Remote(); remote || !lockout {
+		t.Errorf("Remote() after GO_TO_LOCAL = %v,%v, want false,true", remote, lockout)
+	}
+}
+
+func TestClear(t *testing.T) {
+	pulses := 0
+	d := testDevice(Options{Indicator: func() { pulses++ }})
+	out, in := bulk(t, d)
+	ctl := func(request byte, value uint16) []byte {
+		resp, err := d.Control(Setup{RequestType: 0xA1, Request: request, Value: value, Length: 0x40})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := ctl(reqIndicatorPulse, 0); resp[0] != statusSuccess || pulses != 1 {
+		t.Errorf("INDICATOR_PULSE = % x with %d pulses", resp, pulses)
+	}
+
+	// A pending Bulk-IN request can be aborted by its tag
+	out.Write(bulkHeader(msgRequestDevDep, 9, 256, 0))
+	out.Write(bulkHeader(0, 0, 0, 0)) // Ignored, synchronizes with ServeBulk
+	if resp := ctl(reqInitiateAbortBulkIn, 8); resp[0] != statusTransferNotInProgress {
+		t.Errorf("INITIATE_ABORT_BULK_IN of another tag = % x", resp)
+	}
+	if resp := ctl(reqInitiateAbortBulkIn, 9); resp[0] != statusSuccess {
+		t.Errorf("INITIATE_ABORT_BULK_IN = % x", resp)
+	}
+
+	// INITIATE_CLEAR empties the output queue and rearms an aborted Context
+	out.Write(devDepOut(10, "*IDN?\n"))
+	out.Write(bulkHeader(0, 0, 0, 0)) // Ignored, synchronizes with ServeBulk
+	d.Context().Abort()
+	if resp := ctl(reqInitiateClear, 0); resp[0] != statusSuccess {
+		t.Errorf("INITIATE_CLEAR = % x", resp)
+	}
+	if resp := ctl(reqCheckClearStatus, 0); resp[0] != statusSuccess {
+		t.Errorf("CHECK_CLEAR_STATUS = % x", resp)
+	}
+	if n := d.Context().OutputPending(); n != 0 {
+		t.Errorf("%d bytes queued after INITIATE_CLEAR", n)
+	}
+	select {
+	case <-d.Context().Aborted():
+		t.Error("Context still aborted after INITIATE_CLEAR")
+	default:
+	}
+
+	out.Write(devDepOut(11, "*IDN?\n"))
+	out.Write(bulkHeader(msgRequestDevDep, 12, 256, 0))
+	if tag, _, data := readIn(t, in); tag != 12 || data != "\"ACME\"\n" {
+		t.Errorf("DEV_DEP_MSG_IN after clear = %d,%q", tag, data)
+	}
+}
@@ -0,0 +1,189 @@
+//go:build linux
+
+package usbtmc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// FunctionFS magic numbers, flags and event types (linux/usb/functionfs.h)
+const (
+	ffsDescriptorsMagicV2 = 3
+	ffsStringsMagic       = 2
+	ffsHasFSDesc          = 1
+	ffsHasHSDesc          = 2
+
+	ffsEventEnable = 2
+	ffsEventSetup  = 4
+	ffsEventSize   = 12
+)
+
+// FunctionFS is a running FunctionFS function
+type FunctionFS struct {
+	dev     *Device
+	ep0     *os.File
+	eps     []*os.File
+	enabled chan struct{} // Signalled on ENABLE events
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// ServeFunctionFS runs d on the FunctionFS instance mounted at dir, e.g.
+// /dev/usb-ffs/usbtmc after "mount -t functionfs usbtmc /dev/usb-ffs/usbtmc".
+// It writes the interface descriptors, with Bulk-OUT, Bulk-IN and
+// interrupt-IN endpoints and the USBTMC USB488 class codes, and iface as
+// the interface string ("USBTMC" when empty), then serves control requests
+// and transfers in the background until the FunctionFS is closed. The
+// gadget can be bound to its UDC once ServeFunctionFS returns.
+func (d *Device) ServeFunctionFS(dir string, iface string) (*FunctionFS, error) {
+	ep0, err := os.OpenFile(filepath.Join(dir, "ep0"), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ep0.Write(ffsDescriptors()); err != nil {
+		ep0.Close()
+		return nil, err
+	}
+	if _, err := ep0.Write(ffsStrings(iface)); err != nil {
+		ep0.Close()
+		return nil, err
+	}
+
+	f := &FunctionFS{dev: d, ep0: ep0, enabled: make(chan struct{}, 1)}
+	for i, flag := range []int{os.O_RDONLY, os.O_WRONLY, os.O_WRONLY} {
+		ep, err := os.OpenFile(filepath.Join(dir, "ep"+strconv.Itoa(i+1)), flag, 0)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.eps = append(f.eps, ep)
+	}
+	d.SetInterrupt(f.eps[2])
+
+	go f.serveControl()
+	go f.serveBulk()
+	return f, nil
+}
+
+// Close stops the function and closes its files
+func (f *FunctionFS) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	f.dev.SetInterrupt(nil)
+	for _, ep := range f.eps {
+		ep.Close()
+	}
+	close(f.enabled)
+	return f.ep0.Close()
+}
+
+// serveBulk runs ServeBulk while the host has the function enabled,
+// restarting it after each ENABLE event
+func (f *FunctionFS) serveBulk() {
+	for range f.enabled {
+		f.dev.ServeBulk(f.eps[0], f.eps[1])
+	}
+}
+
+// serveControl reads ep0 events, answering setup requests. A request the
+// device does not support is stalled by reading from ep0, the wrong
+// direction for a device-to-host request.
+func (f *FunctionFS) serveControl() {
+	buf := make([]byte, 4*ffsEventSize)
+	for {
+		n, err := f.ep0.Read(buf)
+		if err != nil {
+			return
+		}
+		for ev := buf[:n]; len(ev) >= ffsEventSize; ev = ev[ffsEventSize:] {
+			switch ev[8] {
+			case ffsEventEnable:
+				f.mu.Lock()
+				if !f.closed {
+					select {
+					case f.enabled <- struct{}{}:
+					default:
+					}
+				}
+				f.mu.Unlock()
+			case ffsEventSetup:
+				req := Setup{
+					RequestType: ev[0],
+					Request:     ev[1],
+					Value:       binary.LittleEndian.Uint16(ev[2:]),
+					Index:       binary.LittleEndian.Uint16(ev[4:]),
+					Length:      binary.LittleEndian.Uint16(ev[6:]),
+				}
+				resp, err := f.dev.Control(req)
+				if err != nil {
+					syscall.Read(int(f.ep0.Fd()), nil)
+					continue
+				}
+				if len(resp) > int(req.Length) {
+					resp = resp[:req.Length]
+				}
+				f.ep0.Write(resp)
+			}
+		}
+	}
+}
+
+// ffsDescriptors returns the full- and high-speed descriptors of the
+// interface in the FunctionFS v2 format
+func ffsDescriptors() []byte {
+	var descs bytes.Buffer
+	for _, speed := range []struct {
+		bulk     uint16
+		interval byte
+	}{{64, 10}, {512, 7}} {
+		// Interface: class 0xFE (application specific), subclass 3 (USBTMC), protocol 1 (USB488)
+		descs.Write([]byte{9, 4, 0, 0, 3, 0xFE, 3, 1, 1})
+		descs.Write(endpointDescriptor(0x01, 2, speed.bulk, 0))
+		descs.Write(endpointDescriptor(0x82, 2, speed.bulk, 0))
+		descs.Write(endpointDescriptor(0x83, 3, 2, speed.interval))
+	}
+
+	header := make([]byte, 20)
+	binary.LittleEndian.PutUint32(header[0:], ffsDescriptorsMagicV2)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(header)+descs.Len()))
+	binary.LittleEndian.PutUint32(header[8:], ffsHasFSDesc|ffsHasHSDesc)
+	binary.LittleEndian.PutUint32(header[12:], 4) // Full-speed descriptor count
+	binary.LittleEndian.PutUint32(header[16:], 4) // High-speed descriptor count
+	return append(header, descs.Bytes()...)
+}
+
+// endpointDescriptor encodes an endpoint descriptor
+func endpointDescriptor(addr, attributes byte, maxPacket uint16, interval byte) []byte {
+	desc := []byte{7, 5, addr, attributes, 0, 0, interval}
+	binary.LittleEndian.PutUint16(desc[4:], maxPacket)
+	return desc
+}
+
+// ffsStrings returns the interface string in US English in the FunctionFS
+// strings format
+func ffsStrings(iface string) []byte {
+	if iface == "" {
+		iface = "USBTMC"
+	}
+	strs := make([]byte, 16, 16+2+len(iface)+1)
+	binary.LittleEndian.PutUint32(strs[0:], ffsStringsMagic)
+	binary.LittleEndian.PutUint32(strs[8:], 1)  // String count
+	binary.LittleEndian.PutUint32(strs[12:], 1) // Language count
+	strs = binary.LittleEndian.AppendUint16(strs, 0x0409)
+	strs = append(strs, iface...)
+	strs = append(strs, 0)
+	binary.LittleEndian.PutUint32(strs[4:], uint32(len(strs)))
+	return strs
+}
@@ -0,0 +1,110 @@
+package scpi
+
+// Validate parses message and checks it against the command patterns and
+// their Params schemas without invoking any callback or touching the error
+// queue. Commands without Params are only checked for well-formed program
+// data. Unlike Parse it carries on after an undefined header, so every
+// problem in the message is reported.
+func (c *Context) Validate(message []byte) []Diagnostic {
+	var diags []Diagnostic
+	w := newWalker(message, c.checkMnemonic)
+	for {
+		u, ok := w.next()
+		if !ok {
+			break
+		}
+		if u.code != 0 {
+			return append(diags, newDiagnostic(u.pos, "", u.code, ""))
+		}
+
+		if c.headerTooDeep(u.path) {
+			diags = append(diags, newDiagnostic(u.pos, "", CodeUndefinedHeader, ""))
+		} else if cmd := c.findCommand(u.path); cmd == nil {
+			diags = append(diags, newDiagnostic(u.pos, u.path, CodeUndefinedHeader, u.path))
+		} else {
+			diags = append(diags, validateParams(cmd, u.path, u.params, u.paramPos)...)
+		}
+	}
+
+	return diags
+}
+
+// validateParams checks the parameters of one command; offset is the
+// position of params within the message
+func validateParams(cmd *Command, header string, params []byte, offset int) []Diagnostic {
+	diag := func(pos int, code int16, detail string) []Diagnostic {
+		return []Diagnostic{newDiagnostic(offset+pos, header, code, detail)}
+	}
+
+	state := &lexState{
+		buffer: params,
+		pos:    0,
+		len:    len(params),
+	}
+
+	var found []*Parameter
+	var positions []int
+	for {
+		state.lexWhitespace()
+		if state.isEOS() {
+			break
+		}
+		if len(found) > 0 {
+			if tok, _ := state.lexComma(); tok.Type != TokenComma {
+				return diag(state.pos, CodeInvalidSeparator, "")
+			}
+			state.lexWhitespace()
+		}
+
+		pos := state.pos
+		param := parseProgramData(state)
+		if param.Type == TokenUnknown {
+			return diag(pos, CodeDataTypeError, "")
+		}
+		if !numberEnds(param, state) {
+			return diag(state.pos, CodeInvalidCharacterInNumber, "")
+		}
+		found = append(found, param)
+		positions = append(positions, pos)
+	}
+
+	if cmd.Params == nil {
+		return nil
+	}
+
+	if len(found) > len(cmd.Params) {
+		return diag(positions[len(cmd.Params)], CodeParameterNotAllowed, "")
+	}
+	for i, spec := range cmd.Params {
+		if i >= len(found) {
+			if spec.Optional {
+				return nil
+			}
+			return diag(len(params), CodeMissingParameter, spec.Name)
+		}
+		if len(spec.Kinds) > 0 && !containsKind(spec.Kinds, found[i].Kind()) {
+			return diag(positions[i], CodeDataTypeError, spec.Name)
+		}
+	}
+	return nil
+}
+
+// newDiagnostic returns a diagnostic with the standard message of code,
+// followed by detail when it is not empty
+func newDiagnostic(pos int, header string, code int16, detail string) Diagnostic {
+	msg := ErrorMessage(code)
+	if detail != "" {
+		msg += ": " + detail
+	}
+	return Diagnostic{Pos: pos, Header: header, Code: code, Message: msg}
+}
+
+// containsKind reports whether kinds includes kind
+func containsKind(kinds []ParamKind, kind ParamKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
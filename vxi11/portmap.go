@@ -0,0 +1,73 @@
+package vxi11
+
+import "net"
+
+// Portmapper program (RFC 1833)
+const (
+	progPortmap    = 100000
+	procGetPort    = 3
+	protocolTCP    = 6
+	maxDatagramLen = 65536
+)
+
+// ServePortmapper answers portmapper version 2 GETPORT queries for the
+// core channel on ln and packets, either of which may be nil, so clients
+// can find the server without a system portmapper. It blocks until Close
+// is called or ln fails.
+func (s *Server) ServePortmapper(ln net.Listener, packets net.PacketConn) error {
+	s.connMu.Lock()
+	if s.closed {
+		s.connMu.Unlock()
+		return ErrServerClosed
+	}
+	if ln != nil {
+		s.listeners = append(s.listeners, ln)
+	}
+	s.packets = packets
+	s.connMu.Unlock()
+
+	programs := map[uint32]rpcProgram{progPortmap: {2, s.portmapCall}}
+	if packets != nil {
+		go func() {
+			buf := make([]byte, maxDatagramLen)
+			for {
+				n, addr, err := packets.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				if reply := handleMessage(buf[:n], programs); reply != nil {
+					packets.WriteTo(reply, addr)
+				}
+			}
+		}()
+	}
+	if ln == nil {
+		return nil
+	}
+	return s.acceptLoop(ln, func(conn net.Conn) { serveRPC(conn, programs) })
+}
+
+// portmapCall implements the NULL and GETPORT procedures. GETPORT answers
+// the core channel port for the VXI-11 core program over TCP and 0, meaning
+// not registered, for anything else.
+func (s *Server) portmapCall(call *rpcCall, reply *xdrWriter) uint32 {
+	switch call.proc {
+	case 0:
+		return acceptSuccess
+	case procGetPort:
+		prog, vers, prot := call.args.uint32(), call.args.uint32(), call.args.uint32()
+		call.args.uint32() // port
+		if call.args.err != nil {
+			return acceptGarbageArgs
+		}
+		port := uint32(0)
+		if prog == progCore && vers == 1 && prot == protocolTCP {
+			s.connMu.Lock()
+			port = listenerPort(s.core)
+			s.connMu.Unlock()
+		}
+		reply.uint32(port)
+		return acceptSuccess
+	}
+	return acceptProcUnavail
+}
@@ -0,0 +1,168 @@
+package vxi11
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// ONC RPC message fields (RFC 5531)
+const (
+	rpcVersion = 2
+
+	msgCall  = 0
+	msgReply = 1
+
+	replyAccepted = 0
+	replyDenied   = 1
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+
+	denyRPCMismatch = 0
+
+	authNone = 0
+)
+
+// maxRecord limits the size of an RPC record read from a connection
+const maxRecord = 1 << 20
+
+var errRecordTooLarge = errors.New("vxi11: RPC record too large")
+
+// rpcCall is a decoded RPC call message
+type rpcCall struct {
+	xid, prog, vers, proc uint32
+	args                  *xdrReader
+}
+
+// rpcHandler answers a call, writing its results to reply and returning
+// the accept status
+type rpcHandler func(call *rpcCall, reply *xdrWriter) uint32
+
+// rpcProgram is a program version served on a connection
+type rpcProgram struct {
+	vers    uint32
+	handler rpcHandler
+}
+
+// readRecord reads one record-marked RPC message, joining its fragments
+func readRecord(r io.Reader) ([]byte, error) {
+	var msg []byte
+	for {
+		var mark [4]byte
+		if _, err := io.ReadFull(r, mark[:]); err != nil {
+			return nil, err
+		}
+		header := binary.BigEndian.Uint32(mark[:])
+		size := int(header & 0x7FFFFFFF)
+		if len(msg)+size > maxRecord {
+			return nil, errRecordTooLarge
+		}
+		start := len(msg)
+		msg = append(msg, make([]byte, size)...)
+		if _, err := io.ReadFull(r, msg[start:]); err != nil {
+			return nil, err
+		}
+		if header&0x80000000 != 0 {
+			return msg, nil
+		}
+	}
+}
+
+// writeRecord writes msg as a single-fragment record
+func writeRecord(w io.Writer, msg []byte) error {
+	rec := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(msg)), 0x80000000|uint32(len(msg)))
+	_, err := w.Write(append(rec, msg...))
+	return err
+}
+
+// handleMessage decodes a call message and returns the reply message, or
+// nil for a message that is not a call
+func handleMessage(msg []byte, programs map[uint32]rpcProgram) []byte {
+	r := &xdrReader{buf: msg}
+	call := &rpcCall{xid: r.uint32()}
+	if r.uint32() != msgCall || r.err != nil {
+		return nil
+	}
+	version := r.uint32()
+	call.prog, call.vers, call.proc = r.uint32(), r.uint32(), r.uint32()
+	r.uint32() // Credentials, accepted whatever they are
+	r.opaque()
+	r.uint32() // Verifier
+	r.opaque()
+	if r.err != nil {
+		return nil
+	}
+	call.args = r
+
+	reply := &xdrWriter{}
+	reply.uint32(call.xid)
+	reply.uint32(msgReply)
+	if version != rpcVersion {
+		reply.uint32(replyDenied)
+		reply.uint32(denyRPCMismatch)
+		reply.uint32(rpcVersion)
+		reply.uint32(rpcVersion)
+		return reply.buf
+	}
+
+	results := &xdrWriter{}
+	program, ok := programs[call.prog]
+	stat := uint32(acceptProgUnavail)
+	if ok && program.vers != call.vers {
+		stat = acceptProgMismatch
+	} else if ok {
+		stat = program.handler(call, results)
+		if stat == acceptSuccess && call.args.err != nil {
+			stat = acceptGarbageArgs
+		}
+	}
+
+	reply.uint32(replyAccepted)
+	reply.uint32(authNone)
+	reply.opaque(nil)
+	reply.uint32(stat)
+	switch stat {
+	case acceptSuccess:
+		reply.buf = append(reply.buf, results.buf...)
+	case acceptProgMismatch:
+		reply.uint32(program.vers)
+		reply.uint32(program.vers)
+	}
+	return reply.buf
+}
+
+// serveRPC answers the calls received on a stream connection until it fails
+func serveRPC(conn net.Conn, programs map[uint32]rpcProgram) {
+	for {
+		msg, err := readRecord(conn)
+		if err != nil {
+			return
+		}
+		if reply := handleMessage(msg, programs); reply != nil {
+			if err := writeRecord(conn, reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// callMessage encodes a call message with AUTH_NONE credentials
+func callMessage(xid, prog, vers, proc uint32, args []byte) []byte {
+	w := &xdrWriter{}
+	w.uint32(xid)
+	w.uint32(msgCall)
+	w.uint32(rpcVersion)
+	w.uint32(prog)
+	w.uint32(vers)
+	w.uint32(proc)
+	w.uint32(authNone)
+	w.opaque(nil)
+	w.uint32(authNone)
+	w.opaque(nil)
+	return append(w.buf, args...)
+}
@@ -0,0 +1,716 @@
+// Package vxi11 serves a SCPI command set over VXI-11, the ONC RPC based
+// protocol of TCPIP::host::inst0::INSTR VISA resources. It runs the core
+// and abort channels, calls the client back on its interrupt channel for
+// service requests, and can answer the portmapper queries clients use to
+// find the core channel.
+//
+// device_write feeds the Context, device_read drains its output queue,
+// device_readstb serial polls it, device_clear device-clears it and
+// device_abort on the abort channel aborts the running command. All links
+// share the one Context, as they share an instrument.
+package vxi11
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// Program numbers (VXI-11 B.6)
+const (
+	progCore  = 0x0607AF
+	progAbort = 0x0607B0
+	progIntr  = 0x0607B1
+)
+
+// Core channel procedures
+const (
+	procCreateLink      = 10
+	procDeviceWrite     = 11
+	procDeviceRead      = 12
+	procDeviceReadStb   = 13
+	procDeviceTrigger   = 14
+	procDeviceClear     = 15
+	procDeviceRemote    = 16
+	procDeviceLocal     = 17
+	procDeviceLock      = 18
+	procDeviceUnlock    = 19
+	procDeviceEnableSrq = 20
+	procDeviceDocmd     = 22
+	procDestroyLink     = 23
+	procCreateIntrChan  = 25
+	procDestroyIntrChan = 26
+
+	procDeviceAbort   = 1
+	procDeviceIntrSrq = 30
+)
+
+// Device_ErrorCode values
+const (
+	errNone          = 0
+	errInvalidLink   = 4
+	errParameter     = 5
+	errNoChannel     = 6
+	errNotSupported  = 8
+	errLocked        = 11
+	errNoLock        = 12
+	errIOTimeout     = 15
+	errChannelExists = 29
+)
+
+// Device_Flags bits and device_read reasons
+const (
+	flagWaitLock = 1
+	flagEnd      = 8
+
+	reasonReqCnt = 1
+	reasonEnd    = 4
+)
+
+const (
+	DefaultPortmapperAddr = ":111"
+	DefaultMaxRecvSize    = 64 * 1024
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close
+var ErrServerClosed = errors.New("vxi11: server closed")
+
+// Options configures a Server
+type Options struct {
+	BufferSize     int                     // Input buffer size, 1024 when zero
+	MaxRecvSize    uint32                  // Largest device_write accepted, DefaultMaxRecvSize when zero
+	PortmapperAddr string                  // Portmapper address for ListenAndServe, empty to disable it
+	Setup          func(ctx *scpi.Context) // Called once on the Context, e.g. to SetIDN
+}
+
+// Server runs a Context on the VXI-11 core and abort channels
+type Server struct {
+	opts Options
+	ctx  *scpi.Context
+
+	ctxMu sync.Mutex // Serializes access to ctx
+
+	mu       sync.Mutex // Guards the link state, never held while a command runs
+	links    map[int32]*link
+	nextLink int32
+	owner    *link         // Link holding the lock, nil when unlocked
+	unlocked chan struct{} // Closed when the lock is released
+
+	connMu    sync.Mutex
+	conns     map[net.Conn]struct{}
+	listeners []net.Listener
+	packets   net.PacketConn
+	core      net.Listener
+	abort     net.Listener
+	closed    bool
+}
+
+// link is a device link created by create_link
+type link struct {
+	id     int32
+	client *client
+	srq    bool
+	handle []byte
+}
+
+// client is a core channel connection with the links created on it
+type client struct {
+	links map[int32]*link
+	intr  net.Conn // Interrupt channel, nil until created
+	xid   uint32
+}
+
+// New creates a server for commands. Its Context keeps responses in the
+// output queue for device_read.
+func New(commands []*scpi.Command, opts Options) *Server {
+	if opts.BufferSize == 0 {
+		opts.BufferSize = 1024
+	}
+	if opts.MaxRecvSize == 0 {
+		opts.MaxRecvSize = DefaultMaxRecvSize
+	}
+
+	s := &Server{
+		opts:  opts,
+		links: make(map[int32]*link),
+		conns: make(map[net.Conn]struct{}),
+	}
+	s.ctx = scpi.NewContext(commands, &scpi.Interface{
+		OnSRQ: func() { go s.serviceRequest() },
+	}, opts.BufferSize)
+	s.ctx.SetOutputQueue(true)
+	if opts.Setup != nil {
+		opts.Setup(s.ctx)
+	}
+	return s
+}
+
+// Context returns the Context commands are executed on
+func (s *Server) Context() *scpi.Context {
+	return s.ctx
+}
+
+// ListenAndServe serves the core channel on addr, e.g. ":1024", the abort
+// channel on another port of the same host, and the portmapper on
+// Options.PortmapperAddr over TCP and UDP when set. It blocks until Close
+// is called.
+func (s *Server) ListenAndServe(addr string) error {
+	core, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	abort, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		core.Close()
+		return err
+	}
+
+	if s.opts.PortmapperAddr != "" {
+		pmap, err := net.Listen("tcp", s.opts.PortmapperAddr)
+		if err != nil {
+			core.Close()
+			abort.Close()
+			return err
+		}
+		packets, err := net.ListenPacket("udp", s.opts.PortmapperAddr)
+		if err != nil {
+			core.Close()
+			abort.Close()
+			pmap.Close()
+			return err
+		}
+		go s.ServePortmapper(pmap, packets)
+	}
+	return s.Serve(core, abort)
+}
+
+// Serve accepts core channel connections on core and abort channel
+// connections on abort. It blocks until Close is called or core fails.
+func (s *Server) Serve(core, abort net.Listener) error {
+	s.connMu.Lock()
+	if s.closed {
+		s.connMu.Unlock()
+		return ErrServerClosed
+	}
+	s.core, s.abort = core, abort
+	s.listeners = append(s.listeners, core, abort)
+	s.connMu.Unlock()
+
+	abortPrograms := map[uint32]rpcProgram{progAbort: {1, s.abortCall}}
+	go s.acceptLoop(abort, func(conn net.Conn) { serveRPC(conn, abortPrograms) })
+	return s.acceptLoop(core, s.serveCore)
+}
+
+// Close stops the listeners and closes all open connections
+func (s *Server) Close() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	s.closed = true
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	if s.packets != nil {
+		s.packets.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// acceptLoop accepts connections on ln and handles each with serve
+func (s *Server) acceptLoop(ln net.Listener, serve func(net.Conn)) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.connMu.Lock()
+			closed := s.closed
+			s.connMu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.connMu.Lock()
+		s.conns[conn] = struct{}{}
+		s.connMu.Unlock()
+
+		go func() {
+			serve(conn)
+			conn.Close()
+			s.connMu.Lock()
+			delete(s.conns, conn)
+			s.connMu.Unlock()
+		}()
+	}
+}
+
+// listenerPort returns the port ln is bound to, or 0
+func listenerPort(ln net.Listener) uint32 {
+	if ln == nil {
+		return 0
+	}
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		return uint32(addr.Port)
+	}
+	return 0
+}
+
+// serveCore answers core channel calls on conn, destroying the links
+// created on it when it closes
+func (s *Server) serveCore(conn net.Conn) {
+	c := &client{links: make(map[int32]*link)}
+	serveRPC(conn, map[uint32]rpcProgram{progCore: {1, func(call *rpcCall, reply *xdrWriter) uint32 {
+		return s.coreCall(c, call, reply)
+	}}})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range c.links {
+		s.destroyLink(l)
+	}
+	if c.intr != nil {
+		c.intr.Close()
+		c.intr = nil
+	}
+}
+
+// coreCall dispatches a core channel call. Arguments are decoded before
+// anything is done, so a truncated call has no effect.
+func (s *Server) coreCall(c *client, call *rpcCall, reply *xdrWriter) uint32 {
+	args := call.args
+	switch call.proc {
+	case 0:
+		return acceptSuccess
+
+	case procCreateLink:
+		args.int32() // clientId
+		lockDevice := args.bool()
+		lockTimeout := args.uint32()
+		args.opaque() // Device name, e.g. "inst0"
+		if args.err != nil {
+			return acceptGarbageArgs
+		}
+		s.createLink(c, lockDevice, lockTimeout, reply)
+
+	case procDeviceWrite:
+		id := args.int32()
+		args.uint32() // io_timeout
+		lockTimeout := args.uint32()
+		flags := args.uint32()
+		data := args.opaque()
+		if args.err != nil {
+			return acceptGarbageArgs
+		}
+		code, size := s.deviceWrite(c, id, lockTimeout, flags, data)
+		reply.uint32(code)
+		reply.uint32(size)
+
+	case procDeviceRead:
+		id := args.int32()
+		size := args.uint32()
+		args.uint32() // io_timeout
+		lockTimeout := args.uint32()
+		flags := args.uint32()
+		args.uint32() // termChar
+		if args.err != nil {
+			return acceptGarbageArgs
+		}
+		code, reason, data := s.deviceRead(c, id, size, lockTimeout, flags)
+		reply.uint32(code)
+		reply.uint32(reason)
+		reply.opaque(data)
+
+	case procDeviceReadStb, procDeviceTrigger, procDeviceClear, procDeviceRemote, procDeviceLocal:
+		id := args.int32()
+		flags := args.uint32()
+		lockTimeout := args.uint32()
+		args.uint32() // io_timeout
+		if args.err != nil {
+			return acceptGarbageArgs
+		}
+		code, stb := s.generic(c, call.proc, id, flags, lockTimeout)
+		reply.uint32(code)
+		if call.proc == procDeviceReadStb {
+			reply.uint32(uint32(stb))
+		}
+
+	case procDeviceLock:
+		id := args.int32()
+		flags := args.uint32()
+		lockTimeout := args.uint32()
+		if args.err != nil {
+			return acceptGarbageArgs
+		}
+		reply.uint32(s.deviceLock(c, id, flags, lockTimeout))
+
+	case procDeviceUnlock:
+		id := args.int32()
+		if args.err != nil {
+			return acceptGarbageArgs
+		}
+		reply.uint32(s.deviceUnlock(c, id))
+
+	case procDeviceEnableSrq:
+		id := args.int32()
+		enable := args.bool()
+		handle := args.opaque()
+		if args.err != nil {
+			return acceptGarbageArgs
+		}
+		reply.uint32(s.enableSrq(c, id, enable, handle))
+
+	case procDeviceDocmd:
+		reply.uint32(errNotSupported)
+		reply.opaque(nil)
+
+	case procDestroyLink:
+		id := args.int32()
+		if args.err != nil {
+			return acceptGarbageArgs
+		}
+		s.mu.Lock()
+		l := c.links[id]
+		if l != nil {
+			s.destroyLink(l)
+		}
+		s.mu.Unlock()
+		if l == nil {
+			reply.uint32(errInvalidLink)
+		} else {
+			reply.uint32(errNone)
+		}
+
+	case procCreateIntrChan:
+		hostAddr := args.uint32()
+		hostPort := args.uint32()
+		prog := args.uint32()
+		vers := args.uint32()
+		family := args.uint32()
+		if args.err != nil {
+			return acceptGarbageArgs
+		}
+		reply.uint32(s.createIntrChan(c, hostAddr, hostPort, prog, vers, family))
+
+	case procDestroyIntrChan:
+		s.mu.Lock()
+		intr := c.intr
+		c.intr = nil
+		s.mu.Unlock()
+		if intr == nil {
+			reply.uint32(errNoChannel)
+		} else {
+			intr.Close()
+			reply.uint32(errNone)
+		}
+
+	default:
+		return acceptProcUnavail
+	}
+	return acceptSuccess
+}
+
+// createLink implements create_link
+func (s *Server) createLink(c *client, lockDevice bool, lockTimeout uint32, reply *xdrWriter) {
+	s.mu.Lock()
+	s.nextLink++
+	l := &link{id: s.nextLink, client: c}
+	s.mu.Unlock()
+
+	code := uint32(errNone)
+	if lockDevice {
+		code = s.lock(l, flagWaitLock, lockTimeout)
+	}
+	if code == errNone {
+		s.mu.Lock()
+		c.links[l.id] = l
+		s.links[l.id] = l
+		s.mu.Unlock()
+	}
+
+	s.connMu.Lock()
+	abortPort := listenerPort(s.abort)
+	s.connMu.Unlock()
+
+	reply.uint32(code)
+	reply.int32(l.id)
+	reply.uint32(abortPort)
+	reply.uint32(s.opts.MaxRecvSize)
+}
+
+// destroyLink forgets l and releases its lock; mu must be held
+func (s *Server) destroyLink(l *link) {
+	delete(l.client.links, l.id)
+	delete(s.links, l.id)
+	if s.owner == l {
+		s.release()
+	}
+}
+
+// access locks ctxMu for an operation on link id of c, first waiting up to
+// lockTimeout milliseconds for another link's lock when flags ask for it.
+// It returns the link with ctxMu held, or an error code with ctxMu
+// released. The link state is checked under mu, which is released again so
+// the abort channel can reach the operation.
+func (s *Server) access(c *client, id int32, flags, lockTimeout uint32) (*link, uint32) {
+	for {
+		s.ctxMu.Lock()
+		s.mu.Lock()
+		l := c.links[id]
+		if l == nil {
+			s.mu.Unlock()
+			s.ctxMu.Unlock()
+			return nil, errInvalidLink
+		}
+		if s.owner == nil || s.owner == l {
+			s.mu.Unlock()
+			return l, errNone
+		}
+		unlocked := s.unlocked
+		s.mu.Unlock()
+		s.ctxMu.Unlock()
+		if flags&flagWaitLock == 0 || !waitFor(unlocked, lockTimeout) {
+			return nil, errLocked
+		}
+	}
+}
+
+// waitFor waits up to timeout milliseconds for ch to be closed
+func waitFor(ch <-chan struct{}, timeout uint32) bool {
+	timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// deviceWrite implements device_write. The data is input to the Context;
+// with the END flag an unterminated message is parsed as well.
+func (s *Server) deviceWrite(c *client, id int32, lockTimeout, flags uint32, data []byte) (uint32, uint32) {
+	if uint32(len(data)) > s.opts.MaxRecvSize {
+		return errParameter, 0
+	}
+	_, code := s.access(c, id, flags, lockTimeout)
+	if code != errNone {
+		return code, 0
+	}
+	defer s.ctxMu.Unlock()
+
+	s.ctx.Input(data)
+	if flags&flagEnd != 0 {
+		s.ctx.Input(nil)
+	}
+	return errNone, uint32(len(data))
+}
+
+// deviceRead implements device_read, returning up to size bytes of the
+// output queue. END is reported once the queue is drained. With nothing
+// queued the read fails at once with an I/O timeout, as commands complete
+// before device_write returns.
+func (s *Server) deviceRead(c *client, id int32, size, lockTimeout, flags uint32) (uint32, uint32, []byte) {
+	_, code := s.access(c, id, flags, lockTimeout)
+	if code != errNone {
+		return code, 0, nil
+	}
+	defer s.ctxMu.Unlock()
+
+	if s.ctx.OutputPending() == 0 {
+		return errIOTimeout, 0, nil
+	}
+	data := s.ctx.ReadOutput(int(size))
+	reason := uint32(reasonReqCnt)
+	if s.ctx.OutputPending() == 0 {
+		reason = reasonEnd
+	}
+	return errNone, reason, data
+}
+
+// generic implements the procedures taking Device_GenericParms.
+// device_trigger runs *TRG, and device_remote and device_local have no
+// effect.
+func (s *Server) generic(c *client, proc uint32, id int32, flags, lockTimeout uint32) (uint32, byte) {
+	_, code := s.access(c, id, flags, lockTimeout)
+	if code != errNone {
+		return code, 0
+	}
+	defer s.ctxMu.Unlock()
+
+	switch proc {
+	case procDeviceReadStb:
+		return errNone, s.ctx.SerialPoll()
+	case procDeviceTrigger:
+		s.ctx.Input([]byte("*TRG\n"))
+	case procDeviceClear:
+		s.ctx.DeviceClear()
+	}
+	return errNone, 0
+}
+
+// deviceLock implements device_lock
+func (s *Server) deviceLock(c *client, id int32, flags, lockTimeout uint32) uint32 {
+	s.mu.Lock()
+	l := c.links[id]
+	s.mu.Unlock()
+	if l == nil {
+		return errInvalidLink
+	}
+	return s.lock(l, flags, lockTimeout)
+}
+
+// lock takes the lock for l, waiting up to lockTimeout milliseconds for
+// another link to release it when flags ask for it
+func (s *Server) lock(l *link, flags, lockTimeout uint32) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.owner != nil && s.owner != l {
+		unlocked := s.unlocked
+		s.mu.Unlock()
+		ok := flags&flagWaitLock != 0 && waitFor(unlocked, lockTimeout)
+		s.mu.Lock()
+		if !ok {
+			return errLocked
+		}
+	}
+	if s.owner == nil {
+		s.owner = l
+		s.unlocked = make(chan struct{})
+	}
+	return errNone
+}
+
+// deviceUnlock implements device_unlock
+func (s *Server) deviceUnlock(c *client, id int32) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := c.links[id]
+	if l == nil {
+		return errInvalidLink
+	}
+	if s.owner != l {
+		return errNoLock
+	}
+	s.release()
+	return errNone
+}
+
+// release releases the lock; mu must be held
+func (s *Server) release() {
+	s.owner = nil
+	close(s.unlocked)
+}
+
+// enableSrq implements device_enable_srq
+func (s *Server) enableSrq(c *client, id int32, enable bool, handle []byte) uint32 {
+	if len(handle) > 40 {
+		return errParameter
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := c.links[id]
+	if l == nil {
+		return errInvalidLink
+	}
+	l.srq = enable
+	l.handle = append([]byte(nil), handle...)
+	return errNone
+}
+
+// createIntrChan implements create_intr_chan, connecting to the client's
+// interrupt service. Only TCP is supported.
+func (s *Server) createIntrChan(c *client, hostAddr, hostPort, prog, vers, family uint32) uint32 {
+	if prog != progIntr || vers != 1 || family != 0 {
+		return errNotSupported
+	}
+	s.mu.Lock()
+	exists := c.intr != nil
+	s.mu.Unlock()
+	if exists {
+		return errChannelExists
+	}
+
+	ip := net.IPv4(byte(hostAddr>>24), byte(hostAddr>>16), byte(hostAddr>>8), byte(hostAddr))
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.FormatUint(uint64(hostPort), 10)), 5*time.Second)
+	if err != nil {
+		return errNoChannel
+	}
+	// Replies to device_intr_srq are not needed
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	s.mu.Lock()
+	c.intr = conn
+	s.mu.Unlock()
+	return errNone
+}
+
+// serviceRequest calls device_intr_srq with the handle of every link that
+// enabled service requests on a connection with an interrupt channel
+func (s *Server) serviceRequest() {
+	type call struct {
+		conn net.Conn
+		msg  []byte
+	}
+	var calls []call
+
+	s.mu.Lock()
+	for _, l := range s.links {
+		c := l.client
+		if !l.srq || c.intr == nil {
+			continue
+		}
+		c.xid++
+		args := &xdrWriter{}
+		args.opaque(l.handle)
+		calls = append(calls, call{c.intr, callMessage(c.xid, progIntr, 1, procDeviceIntrSrq, args.buf)})
+	}
+	s.mu.Unlock()
+
+	for _, call := range calls {
+		call.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		writeRecord(call.conn, call.msg)
+	}
+}
+
+// abortCall answers the abort channel. device_abort aborts the command in
+// progress; the next device_clear rearms the Context.
+func (s *Server) abortCall(call *rpcCall, reply *xdrWriter) uint32 {
+	switch call.proc {
+	case 0:
+		return acceptSuccess
+	case procDeviceAbort:
+		id := call.args.int32()
+		if call.args.err != nil {
+			return acceptGarbageArgs
+		}
+		s.mu.Lock()
+		l := s.links[id]
+		s.mu.Unlock()
+		if l == nil {
+			reply.uint32(errInvalidLink)
+			return acceptSuccess
+		}
+		s.ctx.Abort()
+		reply.uint32(errNone)
+		return acceptSuccess
+	}
+	return acceptProcUnavail
+}
@@ -0,0 +1,301 @@
+package vxi11
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	scpi "github.com/Nine-Fives/go-scpi-parser"
+)
+
+// rpcClient calls procedures on one RPC connection
+type rpcClient struct {
+	t    *testing.T
+	conn net.Conn
+	xid  uint32
+}
+
+func dialRPC(t *testing.T, addr string) *rpcClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rpcClient{t: t, conn: conn}
+}
+
+// call sends a call and returns the decoder of its results
+func (c *rpcClient) call(prog, vers, proc uint32, args *xdrWriter) *xdrReader {
+	c.t.Helper()
+
+	c.xid++
+	c.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := writeRecord(c.conn, callMessage(c.xid, prog, vers, proc, args.buf)); err != nil {
+		c.t.Fatal(err)
+	}
+	msg, err := readRecord(c.conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r := &xdrReader{buf: msg}
+	xid, typ, stat := r.uint32(), r.uint32(), r.uint32()
+	r.uint32() // Verifier
+	r.opaque()
+	if accept := r.uint32(); xid != c.xid || typ != msgReply || stat != replyAccepted || accept != acceptSuccess || r.err != nil {
+		c.t.Fatalf("call %d: reply %d,%d,%d,%d: %v", proc, xid, typ, stat, accept, r.err)
+	}
+	return r
+}
+
+// args encodes 32-bit arguments
+func args(values ...uint32) *xdrWriter {
+	w := &xdrWriter{}
+	for _, v := range values {
+		w.uint32(v)
+	}
+	return w
+}
+
+// startServer runs s on loopback listeners and returns the addresses of
+// the core channel and the portmapper
+func startServer(t *testing.T, s *Server) (string, string) {
+	t.Helper()
+
+	listen := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ln
+	}
+	core, abort, pmap := listen(), listen(), listen()
+	go s.Serve(core, abort)
+	go s.ServePortmapper(pmap, nil)
+	t.Cleanup(func() { s.Close() })
+
+	// The portmapper answers GETPORT once Serve has the core listener
+	for ready := false; !ready; time.Sleep(time.Millisecond) {
+		s.connMu.Lock()
+		ready = s.core != nil
+		s.connMu.Unlock()
+	}
+	return core.Addr().String(), pmap.Addr().String()
+}
+
+func testServer() *Server {
+	return New([]*scpi.Command{
+		{Pattern: "*IDN?", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.ResultText("ACME")
+			return scpi.ResOK
+		}},
+		{Pattern: "*TRG", Callback: func(ctx *scpi.Context) scpi.Result {
+			ctx.RegSet(scpi.RegESR, scpi.EsrURQ)
+			return scpi.ResOK
+		}},
+	}, Options{})
+}
+
+// createLink creates a link on c and returns its id and abort port
+func createLink(c *rpcClient, lock bool) (int32, uint32, uint32) {
+	c.t.Helper()
+
+	w := args(1)
+	w.bool(lock)
+	w.uint32(0)
+	w.opaque([]byte("inst0"))
+	r := c.call(progCore, 1, procCreateLink, w)
+	code, id, abortPort := r.uint32(), r.int32(), r.uint32()
+	r.uint32() // maxRecvSize
+	return id, abortPort, code
+}
+
+func TestWriteRead(t *testing.T) {
+	s := testServer()
+	_, pmapAddr := startServer(t, s)
+
+	port := dialRPC(t, pmapAddr).call(progPortmap, 2, procGetPort, args(progCore, 1, protocolTCP, 0)).uint32()
+	if port == 0 {
+		t.Fatal("core channel not registered")
+	}
+	c := dialRPC(t, net.JoinHostPort("127.0.0.1", strconv.FormatUint(uint64(port), 10)))
+	id, _, code := createLink(c, false)
+	if code != errNone {
+		t.Fatalf("create_link error %d", code)
+	}
+
+	w := args(uint32(id), 1000, 0, flagEnd)
+	w.opaque([]byte("*IDN?"))
+	r := c.call(progCore, 1, procDeviceWrite, w)
+	if code, size := r.uint32(), r.uint32(); code != errNone || size != 5 {
+		t.Errorf("device_write = %d,%d, want 0,5", code, size)
+	}
+
+	// Read in two parts to check the reasons
+	r = c.call(progCore, 1, procDeviceRead, args(uint32(id), 4, 1000, 0, 0, 0))
+	if code, reason, data := r.uint32(), r.uint32(), r.opaque(); code != errNone || reason != reasonReqCnt || string(data) != `"ACM` {
+		t.Errorf("device_read = %d,%d,%q, want 0,1,%q", code, reason, data, `"ACM`)
+	}
+	r = c.call(progCore, 1, procDeviceRead, args(uint32(id), 1024, 1000, 0, 0, 0))
+	if code, reason, data := r.uint32(), r.uint32(), r.opaque(); code != errNone || reason != reasonEnd || string(data) != "E\"\n" {
+		t.Errorf("device_read = %d,%d,%q, want 0,4,%q", code, reason, data, "E\"\n")
+	}
+	r = c.call(progCore, 1, procDeviceRead, args(uint32(id), 1024, 1000, 0, 0, 0))
+	if code := r.uint32(); code != errIOTimeout {
+		t.Errorf("device_read with nothing queued = %d, want %d", code, errIOTimeout)
+	}
+
+	// device_trigger runs *TRG; device_readstb reports its event
+	s.Context().RegSet(scpi.RegESE, scpi.EsrURQ)
+	if code := c.call(progCore, 1, procDeviceTrigger, args(uint32(id), 0, 0, 0)).uint32(); code != errNone {
+		t.Errorf("device_trigger = %d", code)
+	}
+	r = c.call(progCore, 1, procDeviceReadStb, args(uint32(id), 0, 0, 0))
+	if code, stb := r.uint32(), r.uint32(); code != errNone || stb != uint32(scpi.StbESB) {
+		t.Errorf("device_readstb = %d,%d, want 0,%d", code, stb, scpi.StbESB)
+	}
+
+	if code := c.call(progCore, 1, procDestroyLink, args(uint32(id))).uint32(); code != errNone {
+		t.Errorf("destroy_link = %d", code)
+	}
+	if code := c.call(progCore, 1, procDeviceWrite, w).uint32(); code != errInvalidLink {
+		t.Errorf("device_write after destroy_link = %d, want %d", code, errInvalidLink)
+	}
+}
+
+func TestLockAndAbort(t *testing.T) {
+	s := testServer()
+	coreAddr, _ := startServer(t, s)
+	a, b := dialRPC(t, coreAddr), dialRPC(t, coreAddr)
+	idA, abortPort, _ := createLink(a, true)
+	idB, _, _ := createLink(b, false)
+
+	w := args(uint32(idB), 1000, 10, flagWaitLock|flagEnd)
+	w.opaque([]byte("*IDN?\n"))
+	if code := b.call(progCore, 1, procDeviceWrite, w).uint32(); code != errLocked {
+		t.Errorf("device_write on another link's lock = %d, want %d", code, errLocked)
+	}
+	if code := b.call(progCore, 1, procDeviceUnlock, args(uint32(idB))).uint32(); code != errNoLock {
+		t.Errorf("device_unlock without the lock = %d, want %d", code, errNoLock)
+	}
+
+	// Closing the owner's connection releases its lock
+	a.conn.Close()
+	w = args(uint32(idB), 1000, 1000, flagWaitLock|flagEnd)
+	w.opaque([]byte("*IDN?\n"))
+	if code := b.call(progCore, 1, procDeviceWrite, w).uint32(); code != errNone {
+		t.Errorf("device_write after the owner left = %d, want 0", code)
+	}
+
+	abort := dialRPC(t, net.JoinHostPort("127.0.0.1", strconv.FormatUint(uint64(abortPort), 10)))
+	if code := abort.call(progAbort, 1, procDeviceAbort, args(uint32(idA))).uint32(); code != errInvalidLink {
+		t.Errorf("device_abort of a destroyed link = %d, want %d", code, errInvalidLink)
+	}
+	if code := abort.call(progAbort, 1, procDeviceAbort, args(uint32(idB))).uint32(); code != errNone {
+		t.Errorf("device_abort = %d", code)
+	}
+	select {
+	case <-s.Context().Aborted():
+	default:
+		t.Error("device_abort did not abort the Context")
+	}
+
+	// device_clear rearms the Context and empties the output queue
+	if code := b.call(progCore, 1, procDeviceClear, args(uint32(idB), 0, 0, 0)).uint32(); code != errNone {
+		t.Errorf("device_clear = %d", code)
+	}
+	if n := s.Context().OutputPending(); n != 0 {
+		t.Errorf("%d bytes queued after device_clear", n)
+	}
+}
+
+func TestAbortRunningWrite(t *testing.T) {
+	started := make(chan struct{})
+	s := New([]*scpi.Command{{Pattern: "SLOW", Callback: func(ctx *scpi.Context) scpi.Result {
+		close(started)
+		select {
+		case <-ctx.Aborted():
+			return scpi.ResOK
+		case <-time.After(5 * time.Second):
+			return scpi.ResErr
+		}
+	}}}, Options{})
+	coreAddr, _ := startServer(t, s)
+	c := dialRPC(t, coreAddr)
+	id, abortPort, _ := createLink(c, false)
+
+	// Send device_write without waiting for its reply
+	w := args(uint32(id), 1000, 0, flagEnd)
+	w.opaque([]byte("SLOW\n"))
+	c.xid++
+	if err := writeRecord(c.conn, callMessage(c.xid, progCore, 1, procDeviceWrite, w.buf)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	start := time.Now()
+	abort := dialRPC(t, net.JoinHostPort("127.0.0.1", strconv.FormatUint(uint64(abortPort), 10)))
+	if code := abort.call(progAbort, 1, procDeviceAbort, args(uint32(id))).uint32(); code != errNone {
+		t.Errorf("device_abort = %d", code)
+	}
+	c.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := readRecord(c.conn); err != nil {
+		t.Fatalf("device_write reply: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("device_abort took %v, the write was not aborted", elapsed)
+	}
+	if errs := s.Context().ErrorPopAll(); len(errs) != 0 {
+		t.Errorf("aborted write queued %v", errs)
+	}
+}
+
+func TestServiceRequest(t *testing.T) {
+	s := testServer()
+	coreAddr, _ := startServer(t, s)
+
+	intr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intr.Close()
+
+	c := dialRPC(t, coreAddr)
+	id, _, _ := createLink(c, false)
+
+	intrPort := uint32(intr.Addr().(*net.TCPAddr).Port)
+	if code := c.call(progCore, 1, procCreateIntrChan, args(0x7F000001, intrPort, progIntr, 1, 0)).uint32(); code != errNone {
+		t.Fatalf("create_intr_chan = %d", code)
+	}
+	w := args(uint32(id), 1)
+	w.opaque([]byte("handle"))
+	if code := c.call(progCore, 1, procDeviceEnableSrq, w).uint32(); code != errNone {
+		t.Fatalf("device_enable_srq = %d", code)
+	}
+
+	conn, err := intr.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s.Context().RegSet(scpi.RegSRE, scpi.StbMAV)
+	s.Context().RegSet(scpi.RegSTB, scpi.StbMAV)
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	msg, err := readRecord(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &xdrReader{buf: msg}
+	r.uint32() // xid
+	typ, _, prog, vers, proc := r.uint32(), r.uint32(), r.uint32(), r.uint32(), r.uint32()
+	r.uint32()
+	r.opaque()
+	r.uint32()
+	r.opaque()
+	if handle := r.opaque(); typ != msgCall || prog != progIntr || vers != 1 || proc != procDeviceIntrSrq || string(handle) != "handle" {
+		t.Errorf("interrupt call = %d,%#x,%d,%d,%q", typ, prog, vers, proc, handle)
+	}
+}
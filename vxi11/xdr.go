@@ -0,0 +1,76 @@
+package vxi11
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errShortArgs = errors.New("vxi11: truncated XDR data")
+
+// xdrReader decodes XDR (RFC 4506) items. The first decoding error is kept
+// and later reads return zero values.
+type xdrReader struct {
+	buf []byte
+	err error
+}
+
+func (r *xdrReader) uint32() uint32 {
+	if r.err != nil || len(r.buf) < 4 {
+		r.err = errShortArgs
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *xdrReader) int32() int32 {
+	return int32(r.uint32())
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+// opaque reads variable-length opaque data or a string
+func (r *xdrReader) opaque() []byte {
+	n := r.uint32()
+	padded := (uint64(n) + 3) &^ 3
+	if r.err != nil || uint64(len(r.buf)) < padded {
+		r.err = errShortArgs
+		return nil
+	}
+	data := r.buf[:n]
+	r.buf = r.buf[padded:]
+	return data
+}
+
+// xdrWriter encodes XDR items
+type xdrWriter struct {
+	buf []byte
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *xdrWriter) int32(v int32) {
+	w.uint32(uint32(v))
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+// opaque writes variable-length opaque data or a string
+func (w *xdrWriter) opaque(data []byte) {
+	w.uint32(uint32(len(data)))
+	w.buf = append(w.buf, data...)
+	for len(w.buf)%4 != 0 {
+		w.buf = append(w.buf, 0)
+	}
+}